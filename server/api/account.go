@@ -1,52 +1,110 @@
 package api
 
 import (
+	"crypto/subtle"
 	"encoding/json"
-	"log"
+	"errors"
 	"net/http"
 	"time"
 
 	"github.com/lassilaiho/expenditure-accounting/server/db"
+	"github.com/lassilaiho/expenditure-accounting/server/metrics"
 )
 
+var errInvalidInviteCode = errors.New("invalid invite code")
+
 func (api *API) Login(w http.ResponseWriter, r *http.Request) {
 	var creds struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		Cookie   bool   `json:"cookie"`
 	}
 	err := json.NewDecoder(r.Body).Decode(&creds)
 	if err != nil {
-		log.Print(err)
-		w.WriteHeader(http.StatusBadRequest)
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if creds.Cookie && api.Cookies == nil {
+		writeError(w, r, http.StatusBadRequest, errCookiesDisabled)
 		return
 	}
-	session, err := api.DB.CreateSession(r.Context(), creds.Email, creds.Password)
+	if !api.checkLoginLimit(w, r) {
+		return
+	}
+	result, err := api.DB.Login(
+		r.Context(), creds.Email, creds.Password, api.clientInfo(r))
 	if err != nil {
-		log.Print(err)
-		if err == db.ErrInvalidEmailOrPassword {
-			http.Error(w, err.Error(), http.StatusUnauthorized)
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
+		switch err {
+		case db.ErrInvalidEmailOrPassword:
+			api.loginFailed(r)
+			logger(r).Warn(err)
+			writeError(w, r, http.StatusUnauthorized, err)
+		case db.ErrAccountDisabled, db.ErrPasswordLoginDisabled:
+			logger(r).Warn(err)
+			writeError(w, r, http.StatusForbidden, err)
+		default:
+			logger(r).Error(err)
+			writeError(w, r, http.StatusInternalServerError, err)
 		}
 		return
 	}
+	api.writeLoginResult(w, r, result, creds.Cookie)
+}
+
+// writeLoginResult sends the session or the two-factor challenge created by a
+// login to the client.
+func (api *API) writeLoginResult(
+	w http.ResponseWriter, r *http.Request, result *db.LoginResult, useCookie bool,
+) {
+	if result.Challenge == nil {
+		api.writeNewSession(w, r, result.Session, useCookie)
+		return
+	}
+	resp := struct {
+		TwoFactorRequired bool `json:"twoFactorRequired"`
+		*db.LoginChallenge
+	}{true, result.Challenge}
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+// writeNewSession sends a newly created session to the client. If useCookie is
+// true, the session token is set in a cookie and only the CSRF token is
+// included in the response body.
+func (api *API) writeNewSession(
+	w http.ResponseWriter, r *http.Request, session *db.Session, useCookie bool,
+) {
+	metrics.LoginSucceeded()
 	resp := struct {
-		Token      string    `json:"token"`
+		Token      string    `json:"token,omitempty"`
+		CSRFToken  string    `json:"csrfToken,omitempty"`
 		ExpiryTime time.Time `json:"expiryTime"`
 	}{
-		Token:      session.Token,
 		ExpiryTime: session.ExpiryTime,
 	}
-	if err = json.NewEncoder(w).Encode(&resp); err != nil {
-		log.Print(err)
-		w.WriteHeader(http.StatusInternalServerError)
+	if useCookie {
+		api.setSessionCookies(w, session.Token)
+		resp.CSRFToken = csrfToken(session.Token)
+	} else {
+		resp.Token = session.Token
+	}
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
 	}
 }
 
 func (api *API) Logout(w http.ResponseWriter, r *http.Request) {
 	if err := api.DB.DeleteSession(r.Context(), getSession(r).ID); err != nil {
-		log.Print(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if api.Cookies != nil {
+		api.clearSessionCookies(w)
 	}
 }
 
@@ -56,22 +114,108 @@ func (api *API) ChangePassword(w http.ResponseWriter, r *http.Request) {
 		NewPassword string `json:"newPassword"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
-		log.Print(err)
-		w.WriteHeader(http.StatusBadRequest)
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusBadRequest, err)
 		return
 	}
+	session := getSession(r)
 	err := api.DB.ChangePasswordForAccount(
 		r.Context(),
-		getSession(r).AccountID,
+		session.AccountID,
+		session.ID,
 		reqData.OldPassword,
 		reqData.NewPassword)
 	if err != nil {
-		log.Print(err)
-		if err == db.ErrInvalidEmailOrPassword {
-			w.WriteHeader(http.StatusUnauthorized)
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
+		switch err {
+		case db.ErrInvalidEmailOrPassword:
+			logger(r).Warn(err)
+			writeError(w, r, http.StatusUnauthorized, err)
+		case db.ErrPasswordTooShort:
+			logger(r).Warn(err)
+			writeError(w, r, http.StatusBadRequest, err)
+		default:
+			logger(r).Error(err)
+			writeError(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+}
+
+func (api *API) isValidInviteCode(code string) bool {
+	valid := false
+	for _, c := range api.InviteCodes {
+		if subtle.ConstantTimeCompare([]byte(c), []byte(code)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+func (api *API) Register(w http.ResponseWriter, r *http.Request) {
+	if !api.AllowRegistration {
+		writeError(w, r, http.StatusForbidden, nil)
+		return
+	}
+	var reqData struct {
+		Email      string `json:"email"`
+		Password   string `json:"password"`
+		InviteCode string `json:"inviteCode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if len(api.InviteCodes) > 0 && !api.isValidInviteCode(reqData.InviteCode) {
+		writeError(w, r, http.StatusForbidden, errInvalidInviteCode)
+		return
+	}
+	var err error
+	var respData struct {
+		ID int64 `json:"id"`
+	}
+	respData.ID, err = api.DB.InsertAccount(
+		r.Context(), reqData.Email, reqData.Password, db.RoleUser)
+	if err != nil {
+		switch err {
+		case db.ErrInvalidEmail, db.ErrPasswordTooShort:
+			writeError(w, r, http.StatusBadRequest, err)
+		case db.ErrEmailTaken:
+			writeError(w, r, http.StatusConflict, err)
+		default:
+			logger(r).Error(err)
+			writeError(w, r, http.StatusInternalServerError, err)
 		}
 		return
 	}
+	if err = json.NewEncoder(w).Encode(&respData); err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+func (api *API) GetLoginEvents(w http.ResponseWriter, r *http.Request) {
+	events, err := api.DB.GetLoginEventsForAccount(r.Context(), getSession(r).AccountID)
+	if err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	respData := struct {
+		Events []*db.LoginEvent `json:"events"`
+	}{events}
+	if err = json.NewEncoder(w).Encode(&respData); err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+func (api *API) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	if !api.reauthenticate(w, r) {
+		return
+	}
+	if err := api.DB.DeleteAccount(r.Context(), getSession(r).AccountID); err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+	}
 }
@@ -0,0 +1,186 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/lassilaiho/expenditure-accounting/server/db"
+)
+
+var errOwnAccount = errors.New("cannot modify own account")
+
+func (api *API) adminMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !getSession(r).IsAdmin() {
+			writeError(w, r, http.StatusForbidden, nil)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// getAccountID parses the account ID from the URL. Administrators aren't
+// allowed to modify their own account through the admin API to avoid locking
+// themselves out.
+func getAccountID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	accountID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusNotFound, err)
+		return -1, false
+	}
+	if accountID == getSession(r).AccountID {
+		writeError(w, r, http.StatusConflict, errOwnAccount)
+		return -1, false
+	}
+	return accountID, true
+}
+
+func (api *API) GetAccounts(w http.ResponseWriter, r *http.Request) {
+	var err error
+	var respData struct {
+		Accounts []*db.Account `json:"accounts"`
+	}
+	respData.Accounts, err = api.DB.GetAccounts(r.Context())
+	if err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if err = json.NewEncoder(w).Encode(&respData); err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+func (api *API) CreateAccount(w http.ResponseWriter, r *http.Request) {
+	var reqData struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+		Role     string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if reqData.Role == "" {
+		reqData.Role = db.RoleUser
+	}
+	var err error
+	var respData struct {
+		ID int64 `json:"id"`
+	}
+	respData.ID, err = api.DB.InsertAccount(
+		r.Context(), reqData.Email, reqData.Password, reqData.Role)
+	if err != nil {
+		switch err {
+		case db.ErrInvalidEmail, db.ErrPasswordTooShort, db.ErrInvalidRole:
+			writeError(w, r, http.StatusBadRequest, err)
+		case db.ErrEmailTaken:
+			writeError(w, r, http.StatusConflict, err)
+		default:
+			logger(r).Error(err)
+			writeError(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	if err = json.NewEncoder(w).Encode(&respData); err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+func (api *API) UpdateAccount(w http.ResponseWriter, r *http.Request) {
+	accountID, ok := getAccountID(w, r)
+	if !ok {
+		return
+	}
+	var values db.AccountUpdate
+	if err := json.NewDecoder(r.Body).Decode(&values); err != nil {
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	err := api.DB.UpdateAccount(r.Context(), accountID, &values)
+	if err != nil {
+		switch err {
+		case db.ErrNoRowsAffected:
+			writeError(w, r, http.StatusNotFound, err)
+		case db.ErrInvalidRole:
+			writeError(w, r, http.StatusBadRequest, err)
+		default:
+			logger(r).Error(err)
+			writeError(w, r, http.StatusInternalServerError, err)
+		}
+	}
+}
+
+func (api *API) AdminDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	accountID, ok := getAccountID(w, r)
+	if !ok {
+		return
+	}
+	if err := api.DB.DeleteAccount(r.Context(), accountID); err != nil {
+		if err == db.ErrNoRowsAffected {
+			writeError(w, r, http.StatusNotFound, err)
+		} else {
+			logger(r).Error(err)
+			writeError(w, r, http.StatusInternalServerError, err)
+		}
+	}
+}
+
+func (api *API) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	accountID, ok := getAccountID(w, r)
+	if !ok {
+		return
+	}
+	var reqData struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	err := api.DB.ResetPasswordForAccount(r.Context(), accountID, reqData.Password)
+	if err != nil {
+		switch err {
+		case db.ErrNoRowsAffected:
+			writeError(w, r, http.StatusNotFound, err)
+		case db.ErrPasswordTooShort:
+			writeError(w, r, http.StatusBadRequest, err)
+		default:
+			logger(r).Error(err)
+			writeError(w, r, http.StatusInternalServerError, err)
+		}
+	}
+}
+
+func (api *API) ForceLogout(w http.ResponseWriter, r *http.Request) {
+	accountID, ok := getAccountID(w, r)
+	if !ok {
+		return
+	}
+	if err := api.DB.DeleteSessionsForAccount(r.Context(), accountID); err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+func (api *API) GetUsageStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := api.DB.GetUsageStats(r.Context())
+	if err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if err = json.NewEncoder(w).Encode(stats); err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+	}
+}
@@ -4,52 +4,236 @@ import (
 	"context"
 	"encoding/base64"
 	"errors"
-	"log"
+	"net"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/graph-gophers/graphql-go/relay"
 	"github.com/lassilaiho/expenditure-accounting/server/db"
+	"github.com/lassilaiho/expenditure-accounting/server/gql"
+	"github.com/lassilaiho/expenditure-accounting/server/logging"
+	"github.com/lassilaiho/expenditure-accounting/server/metrics"
+	"github.com/lassilaiho/expenditure-accounting/server/webhooks"
+	"github.com/sirupsen/logrus"
 )
 
 type API struct {
 	DB *db.API
+	// AllowRegistration enables creating new accounts through the API.
+	AllowRegistration bool
+	// InviteCodes, if not empty, restricts registration to users presenting
+	// one of the codes.
+	InviteCodes []string
+	// TrustProxyHeaders makes the client IP address to be read from the
+	// X-Forwarded-For header set by a reverse proxy.
+	TrustProxyHeaders bool
+	// Cookies enables cookie based sessions if not nil.
+	Cookies *CookieConfig
+	// TOTPIssuer is the issuer name shown in authenticator apps.
+	TOTPIssuer string
+	// LoginLimiter throttles login attempts per client IP address if not nil.
+	LoginLimiter *LoginLimiter
+	// OIDC enables logging in through an OpenID Connect provider if not nil.
+	OIDC *OIDCProvider
+	// IdempotencyWindow is how long responses to requests with an
+	// idempotency key are kept for replaying.
+	IdempotencyWindow time.Duration
+	// Changes enables streaming changes with GET /events if not nil.
+	Changes *db.ChangeFeed
+	// Webhooks enables testing webhooks with POST /webhooks/{id}/ping if
+	// not nil.
+	Webhooks *webhooks.Deliverer
+	// Log is the logger of requests. Nil is the standard logger of logrus.
+	Log *logrus.Logger
+	// Build is reported by GET /version.
+	Build BuildInfo
+
+	graphQL *relay.Handler
+}
+
+// routeScopes lists the API token scopes granting access to each route. Routes
+// that aren't listed can only be used with a login session.
+type routeScopes map[*mux.Route][]string
+
+func (rs routeScopes) add(route *mux.Route, scopes ...string) {
+	rs[route] = scopes
 }
 
 func NewHandler(api *API) http.Handler {
+	return metrics.Instrument(requestIDs(api.logRequests(api.newRouter())))
+}
+
+// newRouter returns the router of the handler returned by NewHandler.
+func (api *API) newRouter() *mux.Router {
+	api.graphQL = &relay.Handler{Schema: gql.NewSchema(api.DB)}
+
 	root := mux.NewRouter()
+	root.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowed)
+	root.Use(metrics.RecordRoute, validateRequests)
+	root.Path("/openapi.json").Methods("GET").HandlerFunc(api.GetOpenAPI)
+	root.Path("/healthz").Methods("GET").HandlerFunc(api.GetHealth)
+	root.Path("/readyz").Methods("GET").HandlerFunc(api.GetReadiness)
+	root.Path("/version").Methods("GET").HandlerFunc(api.GetVersion)
 	root.Path("/login").Methods("POST").HandlerFunc(api.Login)
+	root.Path("/login/2fa").Methods("POST").HandlerFunc(api.CompleteLogin)
+	root.Path("/login/oidc").Methods("POST").HandlerFunc(api.BeginOIDCLogin)
+	root.Path("/login/oidc/callback").Methods("POST").HandlerFunc(api.CompleteOIDCLogin)
+	// Registration doesn't take an idempotency key, because keys are scoped
+	// to the account making the request and there is none yet.
+	root.Path("/accounts").Methods("POST").HandlerFunc(api.Register)
 
+	scopes := routeScopes{}
 	authed := mux.NewRouter()
+	authed.NotFoundHandler = http.HandlerFunc(notFound)
+	authed.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowed)
 	root.PathPrefix("/").Handler(authed)
-	authed.Use(api.authMiddleware)
+	authed.Use(metrics.RecordRoute, api.authMiddleware(scopes), validateRequests)
 	authed.Path("/logout").Methods("POST").HandlerFunc(api.Logout)
+	authed.Path("/account").Methods("DELETE").HandlerFunc(api.DeleteAccount)
 	authed.Path("/account/password").Methods("POST").HandlerFunc(api.ChangePassword)
-	authed.Path("/products").Methods("POST").HandlerFunc(api.AddProduct)
-	authed.Path("/purchases").Methods("GET").HandlerFunc(api.GetPurchases)
-	authed.Path("/purchases").Methods("POST").HandlerFunc(api.AddPurchase)
-	authed.Path("/purchases/{id}").Methods("PATCH").HandlerFunc(api.UpdatePurchase)
-	authed.Path("/purchases/{id}").Methods("DELETE").HandlerFunc(api.DeletePurchase)
-	authed.Path("/purchases/{id}/restore").Methods("POST").HandlerFunc(api.RestorePurchase)
-	authed.Path("/tags").Methods("POST").HandlerFunc(api.AddTags)
+	authed.Path("/account/password-login").Methods("PUT").HandlerFunc(api.SetPasswordLogin)
+	authed.Path("/account/oidc").Methods("POST").HandlerFunc(api.LinkOIDCIdentity)
+	authed.Path("/account/2fa").Methods("GET").HandlerFunc(api.GetTwoFactorStatus)
+	authed.Path("/account/2fa").Methods("DELETE").HandlerFunc(api.DisableTwoFactor)
+	authed.Path("/account/2fa/totp").Methods("POST").HandlerFunc(api.BeginTOTPEnrollment)
+	authed.Path("/account/2fa/totp/confirm").Methods("POST").HandlerFunc(api.ConfirmTOTPEnrollment)
+	authed.Path("/account/2fa/recovery-codes").Methods("POST").HandlerFunc(api.RegenerateRecoveryCodes)
+	authed.Path("/account/login-events").Methods("GET").HandlerFunc(api.GetLoginEvents)
+	authed.Path("/account/sessions").Methods("GET").HandlerFunc(api.GetSessions)
+	authed.Path("/account/sessions").Methods("DELETE").HandlerFunc(api.DeleteOtherSessions)
+	authed.Path("/account/sessions/{id}").Methods("PATCH").HandlerFunc(api.RenameSession)
+	authed.Path("/account/sessions/{id}").Methods("DELETE").HandlerFunc(api.DeleteSession)
+	authed.Path("/account/tokens").Methods("GET").HandlerFunc(api.GetAPITokens)
+	authed.Path("/account/tokens").Methods("POST").HandlerFunc(api.CreateAPIToken)
+	authed.Path("/account/tokens/{id}").Methods("DELETE").HandlerFunc(api.DeleteAPIToken)
+	scopes.add(
+		authed.Path("/products").Methods("POST").HandlerFunc(api.idempotent(api.AddProduct)),
+		db.ScopePurchasesWrite)
+	scopes.add(
+		authed.Path("/purchases").Methods("GET").HandlerFunc(api.GetPurchases),
+		db.ScopeRead, db.ScopeReportsRead)
+	scopes.add(
+		authed.Path("/purchases").Methods("POST").HandlerFunc(api.idempotent(api.AddPurchase)),
+		db.ScopePurchasesWrite)
+	scopes.add(
+		authed.Path("/purchases/batch").Methods("POST").HandlerFunc(api.idempotent(api.ExecutePurchaseBatch)),
+		db.ScopePurchasesWrite)
+	scopes.add(
+		authed.Path("/purchases/{id}").Methods("GET").HandlerFunc(api.GetPurchase),
+		db.ScopeRead, db.ScopeReportsRead)
+	scopes.add(
+		authed.Path("/purchases/{id}").Methods("PATCH").HandlerFunc(api.UpdatePurchase),
+		db.ScopePurchasesWrite)
+	scopes.add(
+		authed.Path("/purchases/{id}").Methods("DELETE").HandlerFunc(api.DeletePurchase),
+		db.ScopePurchasesWrite)
+	scopes.add(
+		authed.Path("/purchases/{id}/restore").Methods("POST").HandlerFunc(api.RestorePurchase),
+		db.ScopePurchasesWrite)
+	scopes.add(
+		authed.Path("/purchases/{id}/history").Methods("GET").HandlerFunc(api.GetPurchaseHistory),
+		db.ScopeRead)
+	scopes.add(
+		authed.Path("/tags").Methods("POST").HandlerFunc(api.idempotent(api.AddTags)),
+		db.ScopePurchasesWrite)
+	scopes.add(
+		authed.Path("/sync").Methods("GET").HandlerFunc(api.GetChanges),
+		db.ScopeRead)
+	scopes.add(
+		authed.Path("/sync").Methods("POST").HandlerFunc(api.idempotent(api.PushChanges)),
+		db.ScopePurchasesWrite)
+	scopes.add(
+		authed.Path("/graphql").Methods("POST").HandlerFunc(api.GraphQL),
+		db.ScopeRead, db.ScopePurchasesWrite)
+	scopes.add(
+		authed.Path("/events").Methods("GET").HandlerFunc(api.StreamEvents),
+		db.ScopeRead)
+	scopes.add(
+		authed.Path("/trash").Methods("GET").HandlerFunc(api.GetTrash),
+		db.ScopeRead)
+	scopes.add(
+		authed.Path("/trash/restore").Methods("POST").HandlerFunc(api.RestoreFromTrash),
+		db.ScopePurchasesWrite)
+	scopes.add(
+		authed.Path("/trash/purge").Methods("POST").HandlerFunc(api.PurgeFromTrash),
+		db.ScopePurchasesWrite)
+	authed.Path("/webhooks").Methods("GET").HandlerFunc(api.GetWebhooks)
+	authed.Path("/webhooks").Methods("POST").HandlerFunc(api.idempotent(api.CreateWebhook))
+	authed.Path("/webhooks/{id}").Methods("PATCH").HandlerFunc(api.UpdateWebhook)
+	authed.Path("/webhooks/{id}").Methods("DELETE").HandlerFunc(api.DeleteWebhook)
+	authed.Path("/webhooks/{id}/deliveries").Methods("GET").HandlerFunc(api.GetWebhookDeliveries)
+	authed.Path("/webhooks/{id}/ping").Methods("POST").HandlerFunc(api.PingWebhook)
+	authed.Path("/undo").Methods("POST").HandlerFunc(api.Undo)
+	authed.Path("/redo").Methods("POST").HandlerFunc(api.Redo)
+	scopes.add(
+		authed.Path("/audit-log").Methods("GET").HandlerFunc(api.GetAuditLog),
+		db.ScopeRead)
+
+	admin := authed.PathPrefix("/admin").Subrouter()
+	admin.Use(api.adminMiddleware)
+	admin.Path("/accounts").Methods("GET").HandlerFunc(api.GetAccounts)
+	admin.Path("/accounts").Methods("POST").HandlerFunc(api.idempotent(api.CreateAccount))
+	admin.Path("/accounts/{id}").Methods("PATCH").HandlerFunc(api.UpdateAccount)
+	admin.Path("/accounts/{id}").Methods("DELETE").HandlerFunc(api.AdminDeleteAccount)
+	admin.Path("/accounts/{id}/password").Methods("POST").HandlerFunc(api.ResetPassword)
+	admin.Path("/accounts/{id}/logout").Methods("POST").HandlerFunc(api.ForceLogout)
+	admin.Path("/stats").Methods("GET").HandlerFunc(api.GetUsageStats)
+	admin.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		scopes.add(route, db.ScopeAdmin)
+		return nil
+	})
 
 	return root
 }
 
+// getSessionToken reads the session token from the Authorization header. The
+// token is accepted either in the standard "Bearer <token>" form or in the
+// legacy "Basic <base64 encoded token>" form.
 func getSessionToken(r *http.Request) (string, error) {
 	authStr := r.Header.Get("Authorization")
 	if authStr == "" {
-		return "", errors.New("missing or invalid session token")
+		return "", errInvalidSessionToken
 	}
 	authParts := strings.Split(authStr, " ")
-	if len(authParts) != 2 || strings.ToLower(authParts[0]) != "basic" {
-		return "", errors.New("missing or invalid session token")
+	if len(authParts) != 2 || authParts[1] == "" {
+		return "", errInvalidSessionToken
+	}
+	switch strings.ToLower(authParts[0]) {
+	case "bearer":
+		return authParts[1], nil
+	case "basic":
+		tokenBytes, err := base64.StdEncoding.DecodeString(authParts[1])
+		if err != nil {
+			return "", errInvalidSessionToken
+		}
+		return string(tokenBytes), nil
+	default:
+		return "", errInvalidSessionToken
 	}
-	tokenBytes, err := base64.StdEncoding.DecodeString(authParts[1])
+}
+
+// clientIP returns the IP address of the client making the request.
+func (api *API) clientIP(r *http.Request) string {
+	if api.TrustProxyHeaders {
+		forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		if ip := strings.TrimSpace(forwarded[len(forwarded)-1]); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		return "", errors.New("missing or invalid session token")
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (api *API) clientInfo(r *http.Request) *db.ClientInfo {
+	return &db.ClientInfo{
+		UserAgent: r.UserAgent(),
+		IPAddress: api.clientIP(r),
 	}
-	return string(tokenBytes), nil
 }
 
 type sessionContextKey struct{}
@@ -62,26 +246,72 @@ func getSession(r *http.Request) *db.Session {
 	return val.(*db.Session)
 }
 
-func (api *API) authMiddleware(h http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token, err := getSessionToken(r)
-		if err != nil {
-			log.Print(err)
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
-		session, err := api.DB.ValidateSession(r.Context(), token)
-		if err == nil {
+// getCookieSessionToken reads the session token from the session cookie. If
+// the request isn't a safe request, it must also carry a valid CSRF token.
+func (api *API) getCookieSessionToken(r *http.Request) (string, error) {
+	cookie, err := r.Cookie(api.Cookies.Name)
+	if err != nil || cookie.Value == "" {
+		return "", errInvalidSessionToken
+	}
+	if !isSafeMethod(r.Method) && !validCSRFToken(r, cookie.Value) {
+		return "", errInvalidCSRFToken
+	}
+	return cookie.Value, nil
+}
+
+var (
+	errInvalidSessionToken = errors.New("missing or invalid session token")
+	errInvalidCSRFToken    = errors.New("missing or invalid CSRF token")
+	errMissingScope        = errors.New("API token lacks the required scope")
+)
+
+// authMiddleware authenticates requests and checks that API tokens have one of
+// the scopes required by the requested route.
+func (api *API) authMiddleware(scopes routeScopes) mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var token string
+			var err error
+			if api.Cookies != nil && r.Header.Get("Authorization") == "" {
+				token, err = api.getCookieSessionToken(r)
+			} else {
+				token, err = getSessionToken(r)
+			}
+			if err != nil {
+				if err == errInvalidCSRFToken {
+					logger(r).Warn(err)
+					writeError(w, r, http.StatusForbidden, err)
+				} else {
+					logger(r).Warn(err)
+					writeError(w, r, http.StatusUnauthorized, err)
+				}
+				return
+			}
+			session, err := api.DB.ValidateSession(r.Context(), token)
+			if err != nil {
+				logger(r).Warn(err)
+				writeError(w, r, http.StatusUnauthorized, errInvalidSessionToken)
+				return
+			}
+			if !session.HasScope(scopes[mux.CurrentRoute(r)]...) {
+				writeError(w, r, http.StatusForbidden, errMissingScope)
+				return
+			}
+			logFields := logrus.Fields{"accountId": session.AccountID}
+			if session.APITokenID != 0 {
+				logFields["apiTokenId"] = session.APITokenID
+			} else {
+				logFields["sessionId"] = session.ID
+			}
+			logging.AddFields(r.Context(), logFields)
+			ctx := db.WithActor(r.Context(), &db.Actor{
+				AccountID:  session.AccountID,
+				SessionID:  session.ID,
+				APITokenID: session.APITokenID,
+			})
 			h.ServeHTTP(w, r.WithContext(
-				context.WithValue(
-					r.Context(),
-					sessionContextKey{},
-					session,
-				),
+				context.WithValue(ctx, sessionContextKey{}, session),
 			))
-		} else {
-			log.Print(err)
-			w.WriteHeader(http.StatusUnauthorized)
-		}
-	})
+		})
+	}
 }
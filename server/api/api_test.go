@@ -1,28 +1,43 @@
 package api
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/lassilaiho/expenditure-accounting/server/db"
+	"github.com/lassilaiho/expenditure-accounting/server/gql"
+	"github.com/lassilaiho/expenditure-accounting/server/logging"
+	"github.com/lassilaiho/expenditure-accounting/server/openapi"
 	"github.com/lassilaiho/expenditure-accounting/server/testutil"
+	"github.com/lassilaiho/expenditure-accounting/server/totp"
+	"github.com/lassilaiho/expenditure-accounting/server/webhooks"
 	"github.com/stretchr/testify/require"
 )
 
-var httpAPI = API{DB: &db.API{
-	BcryptCost:     14,
-	SessionTimeout: time.Hour,
-	RefreshTime:    15 * time.Minute,
-}}
+var httpAPI = API{
+	DB: &db.API{
+		BcryptCost:     14,
+		SessionTimeout: time.Hour,
+		RefreshTime:    15 * time.Minute,
+		// Webhooks are delivered to a local test server.
+		AllowPrivateWebhooks: true,
+	},
+	IdempotencyWindow: time.Hour,
+}
 var bgctx = context.Background()
 var handler = NewHandler(&httpAPI)
 
@@ -70,6 +85,11 @@ func assertSuccess(t *testing.T, r *http.Response) {
 }
 
 func testReq(t *testing.T, method, url string, body interface{}) *http.Response {
+	t.Helper()
+	return testReqAs(t, testSession, method, url, body)
+}
+
+func testReqAs(t *testing.T, session *db.Session, method, url string, body interface{}) *http.Response {
 	t.Helper()
 	var buf bytes.Buffer
 	if body != nil {
@@ -78,7 +98,7 @@ func testReq(t *testing.T, method, url string, body interface{}) *http.Response
 	req := httptest.NewRequest(method, url, &buf)
 	req.Header.Add(
 		"Authorization",
-		"Basic "+base64.StdEncoding.EncodeToString([]byte(testSession.Token)))
+		"Basic "+base64.StdEncoding.EncodeToString([]byte(session.Token)))
 	resp := httptest.NewRecorder()
 	handler.ServeHTTP(resp, req)
 	return resp.Result()
@@ -107,23 +127,31 @@ type obj map[string]interface{}
 type arr []interface{}
 
 func TestMain(m *testing.M) {
-	var cleanup func()
-	httpAPI.DB.DB, cleanup = testutil.ConnectDB()
+	var (
+		cleanup func()
+		connStr string
+	)
+	httpAPI.DB.DB, connStr, cleanup = testutil.ConnectDBWithConnStr()
 	if err := httpAPI.DB.InitDB(bgctx); err != nil {
 		cleanup()
 		log.Fatal(err)
 	}
-	err := httpAPI.DB.InsertAccount(bgctx, "test@example.com", "password", "user")
+	httpAPI.Changes = db.NewChangeFeed(connStr)
+	httpAPI.Webhooks = &webhooks.Deliverer{DB: httpAPI.DB, AllowPrivateAddresses: true}
+	feedCtx, stopFeed := context.WithCancel(bgctx)
+	go httpAPI.Changes.Run(feedCtx)
+	_, err := httpAPI.DB.InsertAccount(bgctx, "test@example.com", "password", "user")
 	if err != nil {
 		cleanup()
 		log.Fatal(err)
 	}
-	testSession, err = httpAPI.DB.CreateSession(bgctx, "test@example.com", "password")
+	testSession, err = httpAPI.DB.CreateSession(bgctx, "test@example.com", "password", nil)
 	if err != nil {
 		cleanup()
 		log.Fatal(err)
 	}
 	code := m.Run()
+	stopFeed()
 	cleanup()
 	os.Exit(code)
 }
@@ -189,3 +217,1967 @@ func TestOperation(t *testing.T) {
 		require.Contains(t, result[2], "false")
 	})
 }
+
+func TestRegistration(t *testing.T) {
+	register := func(body obj) *http.Response {
+		return testReq(t, "POST", "/accounts", body)
+	}
+	newAccount := obj{"email": " New@Example.com", "password": "password"}
+
+	httpAPI.AllowRegistration = false
+	require.Equal(t, http.StatusForbidden, register(newAccount).StatusCode)
+
+	httpAPI.AllowRegistration = true
+	httpAPI.InviteCodes = []string{"invite"}
+	defer func() {
+		httpAPI.AllowRegistration = false
+		httpAPI.InviteCodes = nil
+	}()
+	require.Equal(t, http.StatusForbidden, register(newAccount).StatusCode)
+	newAccount["inviteCode"] = "invite"
+	require.Equal(t, http.StatusBadRequest, register(obj{
+		"email": "short@example.com", "password": "short", "inviteCode": "invite",
+	}).StatusCode)
+	assertSuccess(t, register(newAccount))
+	assertInResult(t, queryDB(t, "SELECT email FROM accounts"), "new@example.com")
+	require.Equal(t, http.StatusConflict, register(obj{
+		"email": "NEW@example.com", "password": "password", "inviteCode": "invite",
+	}).StatusCode)
+
+	session, err := httpAPI.DB.CreateSession(bgctx, "NEW@EXAMPLE.COM", "password", nil)
+	require.Nil(t, err)
+	require.Equal(
+		t,
+		http.StatusUnauthorized,
+		testReqAs(t, session, "DELETE", "/account", obj{"password": "wrong"}).StatusCode)
+	assertSuccess(t, testReqAs(t, session, "DELETE", "/account", obj{"password": "password"}))
+	result := queryDB(t, "SELECT email FROM accounts WHERE email = $1", "new@example.com")
+	require.Len(t, result, 0)
+	result = queryDB(t, "SELECT id FROM sessions WHERE account_id = $1", session.AccountID)
+	require.Len(t, result, 0)
+}
+
+func TestAdmin(t *testing.T) {
+	require.Equal(t, http.StatusForbidden, testReq(t, "GET", "/admin/accounts", nil).StatusCode)
+
+	_, err := httpAPI.DB.InsertAccount(bgctx, "admin@example.com", "password", db.RoleAdmin)
+	require.Nil(t, err)
+	admin, err := httpAPI.DB.CreateSession(bgctx, "admin@example.com", "password", nil)
+	require.Nil(t, err)
+
+	var created struct {
+		ID int64 `json:"id"`
+	}
+	toJSON(t, &created, testReqAs(t, admin, "POST", "/admin/accounts", obj{
+		"email": "managed@example.com", "password": "password",
+	}))
+	accountURL := "/admin/accounts/" + strconv.FormatInt(created.ID, 10)
+
+	createRetried := func() *http.Response {
+		var buf bytes.Buffer
+		require.Nil(t, json.NewEncoder(&buf).Encode(obj{
+			"email": "retried@example.com", "password": "password",
+		}))
+		req := httptest.NewRequest("POST", "/admin/accounts", &buf)
+		req.Header.Set("Authorization", "Bearer "+admin.Token)
+		req.Header.Set(IdempotencyKeyHeader, "create-retried")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Result()
+	}
+	var retried, replayed struct {
+		ID int64 `json:"id"`
+	}
+	toJSON(t, &retried, createRetried())
+	resp := createRetried()
+	require.Equal(t, "true", resp.Header.Get("Idempotent-Replayed"))
+	toJSON(t, &replayed, resp)
+	require.Equal(t, retried.ID, replayed.ID)
+
+	var accounts struct {
+		Accounts []*db.Account `json:"accounts"`
+	}
+	toJSON(t, &accounts, testReqAs(t, admin, "GET", "/admin/accounts", nil))
+	found := false
+	for _, a := range accounts.Accounts {
+		if a.ID == created.ID {
+			found = true
+			require.Equal(t, "managed@example.com", a.Email)
+			require.Equal(t, db.RoleUser, a.Role)
+		}
+	}
+	require.True(t, found)
+
+	session, err := httpAPI.DB.CreateSession(bgctx, "managed@example.com", "password", nil)
+	require.Nil(t, err)
+	newToken := func() *db.Session {
+		token, err := httpAPI.DB.InsertAPIToken(
+			bgctx, created.ID, "script", []string{db.ScopeRead}, nil)
+		require.Nil(t, err)
+		session := &db.Session{Token: token.Token}
+		assertSuccess(t, testReqAs(t, session, "GET", "/purchases", nil))
+		return session
+	}
+	token := newToken()
+	assertSuccess(t, testReqAs(t, session, "GET", "/purchases", nil))
+	assertSuccess(t, testReqAs(t, admin, "PATCH", accountURL, obj{"disabled": true}))
+	require.Equal(t, http.StatusUnauthorized, testReqAs(t, session, "GET", "/purchases", nil).StatusCode)
+	_, err = httpAPI.DB.CreateSession(bgctx, "managed@example.com", "password", nil)
+	require.Equal(t, db.ErrAccountDisabled, err)
+	assertSuccess(t, testReqAs(t, admin, "PATCH", accountURL, obj{"disabled": false}))
+	require.Equal(
+		t,
+		http.StatusUnauthorized,
+		testReqAs(t, token, "GET", "/purchases", nil).StatusCode,
+		"disabling an account must revoke its API tokens")
+
+	token = newToken()
+	assertSuccess(t, testReqAs(t, admin, "POST", accountURL+"/password", obj{"password": "new password"}))
+	_, err = httpAPI.DB.CreateSession(bgctx, "managed@example.com", "password", nil)
+	require.Equal(t, db.ErrInvalidEmailOrPassword, err)
+	session, err = httpAPI.DB.CreateSession(bgctx, "managed@example.com", "new password", nil)
+	require.Nil(t, err)
+	require.Equal(
+		t,
+		http.StatusUnauthorized,
+		testReqAs(t, token, "GET", "/purchases", nil).StatusCode,
+		"resetting the password must revoke API tokens")
+
+	token = newToken()
+	assertSuccess(t, testReqAs(t, admin, "POST", accountURL+"/logout", nil))
+	require.Equal(t, http.StatusUnauthorized, testReqAs(t, session, "GET", "/purchases", nil).StatusCode)
+	require.Equal(
+		t,
+		http.StatusUnauthorized,
+		testReqAs(t, token, "GET", "/purchases", nil).StatusCode,
+		"logging out an account must revoke its API tokens")
+
+	require.Equal(
+		t,
+		http.StatusConflict,
+		testReqAs(t, admin, "DELETE", "/admin/accounts/"+strconv.FormatInt(admin.AccountID, 10), nil).StatusCode)
+	assertSuccess(t, testReqAs(t, admin, "DELETE", accountURL, nil))
+	require.Equal(t, http.StatusNotFound, testReqAs(t, admin, "DELETE", accountURL, nil).StatusCode)
+
+	var stats db.UsageStats
+	toJSON(t, &stats, testReqAs(t, admin, "GET", "/admin/stats", nil))
+	require.GreaterOrEqual(t, stats.AccountCount, int64(2))
+}
+
+func TestSessions(t *testing.T) {
+	_, err := httpAPI.DB.InsertAccount(bgctx, "sessions@example.com", "password", db.RoleUser)
+	require.Nil(t, err)
+	newSession := func(userAgent string) *db.Session {
+		s, err := httpAPI.DB.CreateSession(
+			bgctx,
+			"sessions@example.com",
+			"password",
+			&db.ClientInfo{UserAgent: userAgent, IPAddress: "192.0.2.1"})
+		require.Nil(t, err)
+		return s
+	}
+	s1, s2, s3 := newSession("agent 1"), newSession("agent 2"), newSession("agent 3")
+	sessionURL := func(s *db.Session) string {
+		return "/account/sessions/" + strconv.FormatInt(s.ID, 10)
+	}
+
+	assertSuccess(t, testReqAs(t, s1, "PATCH", sessionURL(s2), obj{"name": "Phone"}))
+	var resp struct {
+		Sessions []struct {
+			ID        int64  `json:"id"`
+			Token     string `json:"token"`
+			UserAgent string `json:"userAgent"`
+			IPAddress string `json:"ipAddress"`
+			Name      string `json:"name"`
+			Current   bool   `json:"current"`
+		} `json:"sessions"`
+	}
+	toJSON(t, &resp, testReqAs(t, s1, "GET", "/account/sessions", nil))
+	require.Len(t, resp.Sessions, 3)
+	for _, s := range resp.Sessions {
+		require.Empty(t, s.Token)
+		require.Equal(t, "192.0.2.1", s.IPAddress)
+		require.Equal(t, s.ID == s1.ID, s.Current)
+		if s.ID == s2.ID {
+			require.Equal(t, "Phone", s.Name)
+			require.Equal(t, "agent 2", s.UserAgent)
+		}
+	}
+
+	assertSuccess(t, testReqAs(t, s1, "DELETE", sessionURL(s3), nil))
+	require.Equal(t, http.StatusUnauthorized, testReqAs(t, s3, "GET", "/purchases", nil).StatusCode)
+	require.Equal(t, http.StatusNotFound, testReqAs(t, s1, "DELETE", sessionURL(testSession), nil).StatusCode)
+
+	assertSuccess(t, testReqAs(t, s1, "POST", "/account/password", obj{
+		"oldPassword": "password",
+		"newPassword": "new password",
+	}))
+	require.Equal(t, http.StatusUnauthorized, testReqAs(t, s2, "GET", "/purchases", nil).StatusCode)
+	assertSuccess(t, testReqAs(t, s1, "GET", "/purchases", nil))
+
+	s4, err := httpAPI.DB.CreateSession(bgctx, "sessions@example.com", "new password", nil)
+	require.Nil(t, err)
+	assertSuccess(t, testReqAs(t, s1, "DELETE", "/account/sessions", nil))
+	require.Equal(t, http.StatusUnauthorized, testReqAs(t, s4, "GET", "/purchases", nil).StatusCode)
+	assertSuccess(t, testReqAs(t, s1, "GET", "/purchases", nil))
+}
+
+func TestSessionTokens(t *testing.T) {
+	result := queryDB(t, "SELECT token_hash FROM sessions WHERE id = $1", testSession.ID)
+	require.Len(t, result, 1)
+	require.NotContains(t, result[0], testSession.Token)
+
+	req := httptest.NewRequest("GET", "/purchases", nil)
+	req.Header.Add("Authorization", "Bearer "+testSession.Token)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	assertSuccess(t, resp.Result())
+
+	req = httptest.NewRequest("GET", "/purchases", nil)
+	req.Header.Add("Authorization", "Bearer "+testSession.Token+"x")
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusUnauthorized, resp.Code)
+}
+
+func TestCookieSessions(t *testing.T) {
+	httpAPI.Cookies = &CookieConfig{
+		Name:     "session",
+		Path:     "/",
+		SameSite: http.SameSiteStrictMode,
+		Secure:   true,
+	}
+	defer func() { httpAPI.Cookies = nil }()
+
+	var body bytes.Buffer
+	require.Nil(t, json.NewEncoder(&body).Encode(obj{
+		"email": "test@example.com", "password": "password", "cookie": true,
+	}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/login", &body))
+	resp := rec.Result()
+	assertSuccess(t, resp)
+	cookies := resp.Cookies()
+	var loginResp struct {
+		Token     string `json:"token"`
+		CSRFToken string `json:"csrfToken"`
+	}
+	toJSON(t, &loginResp, resp)
+	require.Empty(t, loginResp.Token)
+	require.NotEmpty(t, loginResp.CSRFToken)
+	var sessionCookie *http.Cookie
+	for _, c := range cookies {
+		if c.Name == "session" {
+			sessionCookie = c
+		}
+	}
+	require.NotNil(t, sessionCookie)
+	require.True(t, sessionCookie.HttpOnly)
+	require.True(t, sessionCookie.Secure)
+
+	cookieReq := func(method, url, csrf string) *http.Response {
+		req := httptest.NewRequest(method, url, strings.NewReader(`{"name":"Browser"}`))
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		if csrf != "" {
+			req.Header.Set(CSRFHeader, csrf)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Result()
+	}
+	assertSuccess(t, cookieReq("GET", "/account/sessions", ""))
+	var sessions struct {
+		Sessions []struct {
+			ID      int64 `json:"id"`
+			Current bool  `json:"current"`
+		} `json:"sessions"`
+	}
+	toJSON(t, &sessions, cookieReq("GET", "/account/sessions", ""))
+	var sessionURL string
+	for _, s := range sessions.Sessions {
+		if s.Current {
+			sessionURL = "/account/sessions/" + strconv.FormatInt(s.ID, 10)
+		}
+	}
+	require.NotEmpty(t, sessionURL)
+	require.Equal(t, http.StatusForbidden, cookieReq("PATCH", sessionURL, "").StatusCode)
+	require.Equal(t, http.StatusForbidden, cookieReq("PATCH", sessionURL, "invalid").StatusCode)
+	assertSuccess(t, cookieReq("PATCH", sessionURL, loginResp.CSRFToken))
+
+	assertSuccess(t, cookieReq("POST", "/logout", loginResp.CSRFToken))
+	require.Equal(t, http.StatusUnauthorized, cookieReq("GET", "/account/sessions", "").StatusCode)
+}
+
+func TestTwoFactor(t *testing.T) {
+	_, err := httpAPI.DB.InsertAccount(bgctx, "2fa@example.com", "password", db.RoleUser)
+	require.Nil(t, err)
+	session, err := httpAPI.DB.CreateSession(bgctx, "2fa@example.com", "password", nil)
+	require.Nil(t, err)
+
+	require.Equal(
+		t,
+		http.StatusUnauthorized,
+		testReqAs(t, session, "POST", "/account/2fa/totp", obj{"password": "wrong"}).StatusCode)
+	var enrollment struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}
+	toJSON(t, &enrollment, testReqAs(t, session, "POST", "/account/2fa/totp", obj{"password": "password"}))
+	require.Contains(t, enrollment.URI, "secret="+enrollment.Secret)
+	require.Equal(
+		t,
+		http.StatusUnauthorized,
+		testReqAs(t, session, "POST", "/account/2fa/totp/confirm", obj{"code": "000000"}).StatusCode)
+	code, err := totp.Code(enrollment.Secret, time.Now())
+	require.Nil(t, err)
+	var recovery struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+	toJSON(t, &recovery, testReqAs(t, session, "POST", "/account/2fa/totp/confirm", obj{"code": code}))
+	require.Len(t, recovery.RecoveryCodes, 10)
+
+	_, err = httpAPI.DB.CreateSession(bgctx, "2fa@example.com", "password", nil)
+	require.Equal(t, db.ErrTwoFactorRequired, err)
+
+	login := func() string {
+		var resp struct {
+			TwoFactorRequired bool   `json:"twoFactorRequired"`
+			Challenge         string `json:"challenge"`
+		}
+		toJSON(t, &resp, testReq(t, "POST", "/login", obj{
+			"email": "2fa@example.com", "password": "password",
+		}))
+		require.True(t, resp.TwoFactorRequired)
+		require.NotEmpty(t, resp.Challenge)
+		return resp.Challenge
+	}
+	challenge := login()
+	require.Equal(
+		t,
+		http.StatusUnauthorized,
+		testReq(t, "POST", "/login/2fa", obj{"challenge": challenge, "code": code}).StatusCode,
+		"code used for enrollment must not be accepted again")
+	nextCode, err := totp.Code(enrollment.Secret, time.Now().Add(totp.Period))
+	require.Nil(t, err)
+	var sessionResp struct {
+		Token string `json:"token"`
+	}
+	toJSON(t, &sessionResp, testReq(t, "POST", "/login/2fa", obj{
+		"challenge": challenge, "code": nextCode,
+	}))
+	require.NotEmpty(t, sessionResp.Token)
+	require.Equal(
+		t,
+		http.StatusUnauthorized,
+		testReq(t, "POST", "/login/2fa", obj{"challenge": challenge, "code": nextCode}).StatusCode)
+
+	challenge = login()
+	assertSuccess(t, testReq(t, "POST", "/login/2fa", obj{
+		"challenge": challenge, "recoveryCode": strings.ToUpper(recovery.RecoveryCodes[0]),
+	}))
+	challenge = login()
+	require.Equal(
+		t,
+		http.StatusUnauthorized,
+		testReq(t, "POST", "/login/2fa", obj{
+			"challenge": challenge, "recoveryCode": recovery.RecoveryCodes[0],
+		}).StatusCode)
+
+	var status db.TwoFactorStatus
+	toJSON(t, &status, testReqAs(t, session, "GET", "/account/2fa", nil))
+	require.True(t, status.Enabled)
+	require.Equal(t, 9, status.RecoveryCodesLeft)
+
+	assertSuccess(t, testReqAs(t, session, "DELETE", "/account/2fa", obj{"password": "password"}))
+	_, err = httpAPI.DB.CreateSession(bgctx, "2fa@example.com", "password", nil)
+	require.Nil(t, err)
+}
+
+func TestLoginProtection(t *testing.T) {
+	httpAPI.DB.MaxLoginFailures = 3
+	httpAPI.DB.LockoutDuration = time.Minute
+	defer func() {
+		httpAPI.DB.MaxLoginFailures = 0
+		httpAPI.DB.LockoutDuration = 0
+	}()
+	accountID, err := httpAPI.DB.InsertAccount(bgctx, "locked@example.com", "password", db.RoleUser)
+	require.Nil(t, err)
+	login := func(password string) *http.Response {
+		return testReq(t, "POST", "/login", obj{
+			"email": "locked@example.com", "password": password,
+		})
+	}
+
+	assertSuccess(t, login("password"))
+	for i := 0; i < 3; i++ {
+		require.Equal(t, http.StatusUnauthorized, login("wrong").StatusCode)
+	}
+	resp := login("password")
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	var errResp struct {
+		Error errorBody `json:"error"`
+	}
+	toJSON(t, &errResp, resp)
+	require.Equal(t, "invalid_credentials", errResp.Error.Code,
+		"a locked account must look like invalid credentials")
+	require.Nil(t, httpAPI.DB.ResetPasswordForAccount(bgctx, accountID, "password2"))
+	assertSuccess(t, login("password2"))
+
+	session, err := httpAPI.DB.CreateSession(bgctx, "locked@example.com", "password2", nil)
+	require.Nil(t, err)
+	var events struct {
+		Events []db.LoginEvent `json:"events"`
+	}
+	toJSON(t, &events, testReqAs(t, session, "GET", "/account/login-events", nil))
+	results := make([]string, len(events.Events))
+	for i, e := range events.Events {
+		results[i] = e.Result
+	}
+	require.Equal(t, []string{
+		db.LoginSucceeded,
+		db.LoginSucceeded,
+		db.LoginLocked,
+		db.LoginInvalidPassword,
+		db.LoginInvalidPassword,
+		db.LoginInvalidPassword,
+		db.LoginSucceeded,
+	}, results)
+
+	_, err = httpAPI.DB.CreateSession(bgctx, "nobody@example.com", "password", nil)
+	require.Equal(t, db.ErrInvalidEmailOrPassword, err)
+	assertInResult(
+		t,
+		queryDB(t, "SELECT result FROM login_events WHERE email = 'nobody@example.com'"),
+		db.LoginUnknownEmail)
+
+	httpAPI.LoginLimiter = &LoginLimiter{
+		MaxFailures: 2,
+		BaseDelay:   time.Minute,
+		MaxDelay:    time.Hour,
+	}
+	defer func() { httpAPI.LoginLimiter = nil }()
+	require.Equal(t, http.StatusUnauthorized, login("wrong").StatusCode)
+	require.Equal(t, http.StatusUnauthorized, login("wrong").StatusCode)
+	resp = login("password2")
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Equal(t, "60", resp.Header.Get("Retry-After"))
+}
+
+func TestAPITokens(t *testing.T) {
+	_, err := httpAPI.DB.InsertAccount(bgctx, "tokens@example.com", "password", db.RoleUser)
+	require.Nil(t, err)
+	session, err := httpAPI.DB.CreateSession(bgctx, "tokens@example.com", "password", nil)
+	require.Nil(t, err)
+	createToken := func(scopes ...string) *db.Session {
+		var token db.APIToken
+		toJSON(t, &token, testReqAs(t, session, "POST", "/account/tokens", obj{
+			"name": "script", "scopes": scopes,
+		}))
+		require.True(t, strings.HasPrefix(token.Token, db.APITokenPrefix))
+		return &db.Session{ID: token.ID, Token: token.Token}
+	}
+
+	require.Equal(
+		t,
+		http.StatusBadRequest,
+		testReqAs(t, session, "POST", "/account/tokens", obj{
+			"name": "script", "scopes": []string{"everything"},
+		}).StatusCode)
+	require.Equal(
+		t,
+		http.StatusForbidden,
+		testReqAs(t, session, "POST", "/account/tokens", obj{
+			"name": "script", "scopes": []string{db.ScopeAdmin},
+		}).StatusCode)
+
+	readToken := createToken(db.ScopeRead)
+	assertSuccess(t, testReqAs(t, readToken, "GET", "/purchases", nil))
+	require.Equal(
+		t,
+		http.StatusForbidden,
+		testReqAs(t, readToken, "POST", "/tags", arr{"tag"}).StatusCode)
+	require.Equal(
+		t,
+		http.StatusForbidden,
+		testReqAs(t, readToken, "GET", "/account/tokens", nil).StatusCode)
+	require.Equal(
+		t,
+		http.StatusForbidden,
+		testReqAs(t, readToken, "POST", "/logout", nil).StatusCode)
+
+	writeToken := createToken(db.ScopePurchasesWrite)
+	require.Equal(
+		t,
+		http.StatusForbidden,
+		testReqAs(t, writeToken, "GET", "/purchases", nil).StatusCode)
+	require.NotEqual(
+		t,
+		http.StatusForbidden,
+		testReqAs(t, writeToken, "DELETE", "/purchases/0", nil).StatusCode)
+
+	var tokens struct {
+		Tokens []db.APIToken `json:"tokens"`
+	}
+	toJSON(t, &tokens, testReqAs(t, session, "GET", "/account/tokens", nil))
+	require.Len(t, tokens.Tokens, 2)
+	require.Empty(t, tokens.Tokens[0].Token)
+
+	assertSuccess(t, testReqAs(
+		t, session, "DELETE", "/account/tokens/"+strconv.FormatInt(readToken.ID, 10), nil))
+	require.Equal(
+		t,
+		http.StatusUnauthorized,
+		testReqAs(t, readToken, "GET", "/purchases", nil).StatusCode)
+
+	expired, err := httpAPI.DB.InsertAPIToken(
+		bgctx, session.AccountID, "old", []string{db.ScopeRead}, nil)
+	require.Nil(t, err)
+	_, err = httpAPI.DB.DB.Exec(
+		"UPDATE api_tokens SET expiry_time = $1 WHERE id = $2",
+		time.Now().UTC().Add(-time.Minute), expired.ID)
+	require.Nil(t, err)
+	require.Equal(
+		t,
+		http.StatusUnauthorized,
+		testReqAs(t, &db.Session{Token: expired.Token}, "GET", "/purchases", nil).StatusCode)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	mock, err := testutil.NewMockOIDCProvider("client")
+	require.Nil(t, err)
+	defer mock.Close()
+	httpAPI.OIDC, err = NewOIDCProvider(bgctx, &OIDCConfig{
+		Issuer:       mock.Issuer,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RedirectURL:  "http://localhost/oidc-callback",
+	})
+	require.Nil(t, err)
+	defer func() { httpAPI.OIDC = nil }()
+
+	authorize := func(user *testutil.MockUser) obj {
+		var begin struct {
+			URL string `json:"url"`
+		}
+		toJSON(t, &begin, testReq(t, "POST", "/login/oidc", nil))
+		code, state, err := mock.Authorize(begin.URL, user)
+		require.Nil(t, err)
+		return obj{"state": state, "code": code}
+	}
+	login := func(user *testutil.MockUser) *http.Response {
+		return testReq(t, "POST", "/login/oidc/callback", authorize(user))
+	}
+	errorCode := func(resp *http.Response) string {
+		var errResp struct {
+			Error errorBody `json:"error"`
+		}
+		toJSON(t, &errResp, resp)
+		return errResp.Error.Code
+	}
+
+	accountID, err := httpAPI.DB.InsertAccount(bgctx, "oidc@example.com", "password", db.RoleUser)
+	require.Nil(t, err)
+	session, err := httpAPI.DB.CreateSession(bgctx, "oidc@example.com", "password", nil)
+	require.Nil(t, err)
+	require.Equal(
+		t,
+		http.StatusConflict,
+		testReqAs(t, session, "PUT", "/account/password-login", obj{"enabled": false}).StatusCode)
+
+	user := &testutil.MockUser{Subject: "1", Email: "OIDC@example.com", EmailVerified: true}
+	require.Equal(
+		t,
+		http.StatusForbidden,
+		login(&testutil.MockUser{Subject: "1", Email: "oidc@example.com"}).StatusCode,
+		"unverified email must not be linked")
+	resp := login(user)
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+	require.Equal(t, "oidc_link_required", errorCode(resp),
+		"an account with a password must not be linked by email")
+	link := authorize(user)
+	link["password"] = "wrong"
+	require.Equal(
+		t,
+		http.StatusUnauthorized,
+		testReqAs(t, session, "POST", "/account/oidc", link).StatusCode)
+	link = authorize(user)
+	link["password"] = "password"
+	assertSuccess(t, testReqAs(t, session, "POST", "/account/oidc", link))
+	link = authorize(&testutil.MockUser{Subject: "2", Email: "other@example.com", EmailVerified: true})
+	link["password"] = "password"
+	require.Equal(
+		t,
+		http.StatusConflict,
+		testReqAs(t, session, "POST", "/account/oidc", link).StatusCode,
+		"account already linked to another identity")
+
+	var sessionResp struct {
+		Token string `json:"token"`
+	}
+	toJSON(t, &sessionResp, login(user))
+	oidcSession, err := httpAPI.DB.ValidateSession(bgctx, sessionResp.Token)
+	require.Nil(t, err)
+	require.Equal(t, accountID, oidcSession.AccountID)
+	require.Equal(
+		t,
+		http.StatusForbidden,
+		login(&testutil.MockUser{
+			Subject: "2", Email: "oidc@example.com", EmailVerified: true,
+		}).StatusCode,
+		"account linked to another identity")
+
+	_, err = httpAPI.DB.DB.Exec("UPDATE accounts SET totp_enabled = TRUE WHERE id = $1", accountID)
+	require.Nil(t, err)
+	var challenge struct {
+		TwoFactorRequired bool   `json:"twoFactorRequired"`
+		Challenge         string `json:"challenge"`
+		Token             string `json:"token"`
+	}
+	toJSON(t, &challenge, login(user))
+	require.True(t, challenge.TwoFactorRequired)
+	require.NotEmpty(t, challenge.Challenge)
+	require.Empty(t, challenge.Token, "two-factor authentication must not be skipped")
+	_, err = httpAPI.DB.DB.Exec("UPDATE accounts SET totp_enabled = FALSE WHERE id = $1", accountID)
+	require.Nil(t, err)
+
+	_, err = httpAPI.DB.DB.Exec(
+		"UPDATE accounts SET locked_until = $1 WHERE id = $2",
+		time.Now().UTC().Add(time.Hour), accountID)
+	require.Nil(t, err)
+	require.Equal(t, http.StatusForbidden, login(user).StatusCode, "locked account")
+	_, err = httpAPI.DB.DB.Exec("UPDATE accounts SET locked_until = NULL WHERE id = $1", accountID)
+	require.Nil(t, err)
+
+	assertSuccess(t, testReqAs(t, session, "PUT", "/account/password-login", obj{"enabled": false}))
+	_, err = httpAPI.DB.CreateSession(bgctx, "oidc@example.com", "password", nil)
+	require.Equal(t, db.ErrPasswordLoginDisabled, err)
+	assertSuccess(t, login(&testutil.MockUser{
+		Subject: "1", Email: "renamed@example.com", EmailVerified: true,
+	}))
+
+	newUser := &testutil.MockUser{Subject: "3", Email: "new@example.com", EmailVerified: true}
+	require.Equal(t, http.StatusForbidden, login(newUser).StatusCode)
+	httpAPI.OIDC.autoProvision = true
+	toJSON(t, &sessionResp, login(newUser))
+	_, err = httpAPI.DB.GetAccountIDByEmail(bgctx, "new@example.com")
+	require.Nil(t, err)
+	newSession := &db.Session{Token: sessionResp.Token}
+	require.Equal(
+		t,
+		http.StatusUnauthorized,
+		testReqAs(t, newSession, "DELETE", "/account", obj{"password": ""}).StatusCode,
+		"accounts without a password must not be confirmed with an empty password")
+	require.Equal(
+		t,
+		http.StatusUnauthorized,
+		testReqAs(t, newSession, "DELETE", "/account", obj{"oidc": authorize(user)}).StatusCode,
+		"identity of another account")
+	assertSuccess(t, testReqAs(t, newSession, "DELETE", "/account", obj{"oidc": authorize(newUser)}))
+	_, err = httpAPI.DB.GetAccountIDByEmail(bgctx, "new@example.com")
+	require.Equal(t, db.ErrNoRowsAffected, err)
+
+	require.Equal(
+		t,
+		http.StatusUnauthorized,
+		testReq(t, "POST", "/login/oidc/callback", obj{"state": "invalid", "code": "invalid"}).StatusCode)
+}
+
+func TestAuditLog(t *testing.T) {
+	_, err := httpAPI.DB.InsertAccount(bgctx, "audit@example.com", "password", db.RoleUser)
+	require.Nil(t, err)
+	session, err := httpAPI.DB.CreateSession(bgctx, "audit@example.com", "password", nil)
+	require.Nil(t, err)
+
+	var product db.Product
+	toJSON(t, &product, testReqAs(t, session, "POST", "/products", obj{"name": "Audited"}))
+	var tags struct {
+		Tags []db.Tag `json:"tags"`
+	}
+	toJSON(t, &tags, testReqAs(t, session, "POST", "/tags", obj{"tags": arr{"Audited"}}))
+	var purchase struct {
+		ID int64 `json:"id"`
+	}
+	toJSON(t, &purchase, testReqAs(t, session, "POST", "/purchases", obj{
+		"product":  product.ID,
+		"date":     parseTime("2021-02-01"),
+		"quantity": "1",
+		"price":    "3",
+		"tags":     arr{tags.Tags[0].ID},
+	}))
+	purchaseURL := "/purchases/" + strconv.FormatInt(purchase.ID, 10)
+	assertSuccess(t, testReqAs(t, session, "PATCH", purchaseURL, obj{"price": "4"}))
+	assertSuccess(t, testReqAs(t, session, "PATCH", purchaseURL, obj{}))
+	assertSuccess(t, testReqAs(t, session, "DELETE", purchaseURL, nil))
+	assertSuccess(t, testReqAs(t, session, "POST", purchaseURL+"/restore", nil))
+	require.Equal(
+		t,
+		http.StatusNotFound,
+		testReq(t, "GET", purchaseURL+"/history", nil).StatusCode,
+		"history of other accounts must not be visible")
+
+	var history struct {
+		Entries []struct {
+			Action    string `json:"action"`
+			SessionID *int64 `json:"sessionId"`
+			Before    *struct {
+				Price   json.Number `json:"price"`
+				Deleted bool        `json:"deleted"`
+				Tags    []int64     `json:"tags"`
+			} `json:"before"`
+			After struct {
+				Price   json.Number `json:"price"`
+				Deleted bool        `json:"deleted"`
+				Tags    []int64     `json:"tags"`
+			} `json:"after"`
+		} `json:"entries"`
+	}
+	toJSON(t, &history, testReqAs(t, session, "GET", purchaseURL+"/history", nil))
+	require.Len(t, history.Entries, 4)
+	for i, action := range []string{db.ActionRestore, db.ActionDelete, db.ActionUpdate, db.ActionCreate} {
+		require.Equal(t, action, history.Entries[i].Action)
+		require.Equal(t, session.ID, *history.Entries[i].SessionID)
+	}
+	require.Nil(t, history.Entries[3].Before)
+	require.Equal(t, []int64{tags.Tags[0].ID}, history.Entries[3].After.Tags)
+	require.Equal(t, json.Number("3"), history.Entries[2].Before.Price)
+	require.Equal(t, json.Number("4"), history.Entries[2].After.Price)
+	require.True(t, history.Entries[1].After.Deleted)
+	require.False(t, history.Entries[0].After.Deleted)
+
+	var feed struct {
+		Entries []db.AuditEntry `json:"entries"`
+	}
+	toJSON(t, &feed, testReqAs(t, session, "GET", "/audit-log?entity=product", nil))
+	require.Len(t, feed.Entries, 3)
+	toJSON(t, &feed, testReqAs(t, session, "GET", "/audit-log?entity=tag&limit=1", nil))
+	require.Len(t, feed.Entries, 1)
+	require.Equal(t, db.ActionRestore, feed.Entries[0].Action)
+	toJSON(t, &feed, testReqAs(t, session, "GET", "/audit-log?from=2000-01-01&to=2000-01-02", nil))
+	require.Empty(t, feed.Entries)
+	require.Equal(
+		t,
+		http.StatusBadRequest,
+		testReqAs(t, session, "GET", "/audit-log?entity=account", nil).StatusCode)
+
+	_, err = httpAPI.DB.DB.Exec("UPDATE audit_log SET action = 'create'")
+	require.NotNil(t, err, "audit log must be append-only")
+}
+
+func TestTrashAndUndo(t *testing.T) {
+	_, err := httpAPI.DB.InsertAccount(bgctx, "trash@example.com", "password", db.RoleUser)
+	require.Nil(t, err)
+	session, err := httpAPI.DB.CreateSession(bgctx, "trash@example.com", "password", nil)
+	require.Nil(t, err)
+	otherSession, err := httpAPI.DB.CreateSession(bgctx, "trash@example.com", "password", nil)
+	require.Nil(t, err)
+
+	var product db.Product
+	toJSON(t, &product, testReqAs(t, session, "POST", "/products", obj{"name": "Trashed"}))
+	var tags struct {
+		Tags []db.Tag `json:"tags"`
+	}
+	toJSON(t, &tags, testReqAs(t, session, "POST", "/tags", obj{"tags": arr{"Trashed"}}))
+	addPurchase := func(price string) string {
+		var purchase struct {
+			ID int64 `json:"id"`
+		}
+		toJSON(t, &purchase, testReqAs(t, session, "POST", "/purchases", obj{
+			"product":  product.ID,
+			"date":     parseTime("2021-03-01"),
+			"quantity": "1",
+			"price":    price,
+			"tags":     arr{tags.Tags[0].ID},
+		}))
+		return strconv.FormatInt(purchase.ID, 10)
+	}
+	getPrices := func() []string {
+		var purchases struct {
+			Purchases []db.Purchase `json:"purchases"`
+		}
+		toJSON(t, &purchases, testReqAs(t, session, "GET", "/purchases", nil))
+		prices := []string{}
+		for _, p := range purchases.Purchases {
+			prices = append(prices, p.Price.String())
+		}
+		return prices
+	}
+
+	purchaseID := addPurchase("3")
+	assertSuccess(t, testReqAs(t, session, "DELETE", "/purchases/"+purchaseID, nil))
+	var trash db.Trash
+	toJSON(t, &trash, testReqAs(t, session, "GET", "/trash", nil))
+	require.Len(t, trash.Purchases, 1)
+	require.Equal(t, purchaseID, strconv.FormatInt(trash.Purchases[0].ID, 10))
+	require.Len(t, trash.Purchases[0].Tags, 1)
+	require.False(t, trash.Purchases[0].DeletedTime.IsZero())
+	require.Len(t, trash.Products, 1)
+	require.Len(t, trash.Tags, 1)
+	var purged struct {
+		Count int64 `json:"count"`
+	}
+	toJSON(t, &purged, testReqAs(t, session, "POST", "/trash/purge", obj{"tags": arr{tags.Tags[0].ID}}))
+	require.Zero(t, purged.Count, "tags of purchases in the trash must not be purged")
+
+	id, _ := strconv.ParseInt(purchaseID, 10, 64)
+	assertSuccess(t, testReqAs(t, session, "POST", "/trash/restore", obj{"purchases": arr{id}}))
+	toJSON(t, &trash, testReqAs(t, session, "GET", "/trash", nil))
+	require.Empty(t, trash.Purchases)
+	require.Empty(t, trash.Products)
+	require.Empty(t, trash.Tags)
+	var restored struct {
+		Purchase db.Purchase `json:"purchase"`
+	}
+	toJSON(t, &restored, testReqAs(t, session, "GET", "/purchases/"+purchaseID, nil))
+	require.Len(t, restored.Purchase.Tags, 1, "a restored purchase must keep its tags")
+	require.Equal(
+		t,
+		http.StatusNotFound,
+		testReqAs(t, session, "POST", "/trash/restore", obj{"purchases": arr{-1}}).StatusCode)
+
+	assertSuccess(t, testReqAs(t, session, "DELETE", "/purchases/"+purchaseID, nil))
+	toJSON(t, &purged, testReqAs(t, session, "POST", "/trash/purge", obj{"products": arr{product.ID}}))
+	require.Equal(t, int64(2), purged.Count, "purging a product must purge its purchases")
+	toJSON(t, &trash, testReqAs(t, session, "GET", "/trash", nil))
+	require.Empty(t, trash.Purchases)
+	require.Empty(t, trash.Products)
+	require.Len(t, trash.Tags, 1)
+	count, err := httpAPI.DB.PurgeExpiredTrash(bgctx, time.Now().Add(-time.Hour))
+	require.Nil(t, err)
+	require.Zero(t, count)
+	_, err = httpAPI.DB.PurgeExpiredTrash(bgctx, time.Now().Add(time.Hour))
+	require.Nil(t, err)
+	toJSON(t, &trash, testReqAs(t, session, "GET", "/trash", nil))
+	require.Empty(t, trash.Tags)
+
+	toJSON(t, &product, testReqAs(t, session, "POST", "/products", obj{"name": "Undone"}))
+	toJSON(t, &tags, testReqAs(t, session, "POST", "/tags", obj{"tags": arr{"Undone"}}))
+	purchaseID = addPurchase("3")
+	assertSuccess(t, testReqAs(t, session, "PATCH", "/purchases/"+purchaseID, obj{"price": "5"}))
+	require.Equal(t, []string{"5"}, getPrices())
+	assertSuccess(t, testReqAs(t, session, "PATCH", "/purchases/"+purchaseID, obj{}))
+
+	var undone struct {
+		Count int `json:"count"`
+	}
+	toJSON(t, &undone, testReqAs(t, session, "POST", "/undo", nil))
+	require.Equal(t, 1, undone.Count)
+	require.Equal(t, []string{"3"}, getPrices(), "changes doing nothing must not be undone")
+	toJSON(t, &undone, testReqAs(t, session, "POST", "/redo", nil))
+	require.Equal(t, 1, undone.Count)
+	require.Equal(t, []string{"5"}, getPrices())
+	toJSON(t, &undone, testReqAs(t, session, "POST", "/undo", obj{"count": 2}))
+	require.Equal(t, 2, undone.Count)
+	require.Empty(t, getPrices(), "undoing a creation must move the purchase to the trash")
+	toJSON(t, &trash, testReqAs(t, session, "GET", "/trash", nil))
+	require.Len(t, trash.Purchases, 1)
+
+	toJSON(t, &undone, testReqAs(t, session, "POST", "/redo", obj{"count": 1}))
+	require.Equal(t, 1, undone.Count)
+	require.Equal(t, []string{"3"}, getPrices())
+	assertSuccess(t, testReqAs(t, otherSession, "PATCH", "/purchases/"+purchaseID, obj{"price": "7"}))
+	require.Equal(
+		t,
+		http.StatusConflict,
+		testReqAs(t, session, "POST", "/undo", nil).StatusCode,
+		"changes made after the operation must not be overwritten")
+	require.Equal(t, []string{"7"}, getPrices())
+	require.Equal(
+		t,
+		http.StatusBadRequest,
+		testReqAs(t, session, "POST", "/undo", obj{"count": 0}).StatusCode)
+}
+
+func TestPurchaseBatch(t *testing.T) {
+	_, err := httpAPI.DB.InsertAccount(bgctx, "batch@example.com", "password", db.RoleUser)
+	require.Nil(t, err)
+	session, err := httpAPI.DB.CreateSession(bgctx, "batch@example.com", "password", nil)
+	require.Nil(t, err)
+
+	var product, otherProduct db.Product
+	toJSON(t, &product, testReqAs(t, session, "POST", "/products", obj{"name": "Batch"}))
+	toJSON(t, &otherProduct, testReqAs(t, session, "POST", "/products", obj{"name": "Other"}))
+	var tags struct {
+		Tags []db.Tag `json:"tags"`
+	}
+	toJSON(t, &tags, testReqAs(t, session, "POST", "/tags", obj{"tags": arr{"Batch"}}))
+	newPurchase := func(price string) obj {
+		return obj{"op": db.BatchCreate, "values": obj{
+			"product":  product.ID,
+			"date":     parseTime("2021-04-01"),
+			"quantity": "1",
+			"price":    price,
+		}}
+	}
+	getPurchases := func() []*db.Purchase {
+		var purchases struct {
+			Purchases []*db.Purchase `json:"purchases"`
+		}
+		toJSON(t, &purchases, testReqAs(t, session, "GET", "/purchases", nil))
+		return purchases.Purchases
+	}
+
+	var batch struct {
+		Results []db.BatchResult `json:"results"`
+	}
+	toJSON(t, &batch, testReqAs(t, session, "POST", "/purchases/batch", obj{
+		"operations": arr{newPurchase("1"), newPurchase("2"), newPurchase("3")},
+	}))
+	require.Len(t, batch.Results, 3)
+	ids := []int64{batch.Results[0].ID, batch.Results[1].ID, batch.Results[2].ID}
+
+	resp := testReqAs(t, session, "POST", "/purchases/batch", obj{
+		"operations": arr{
+			obj{"op": db.BatchUpdate, "id": ids[0], "values": obj{"price": "10"}},
+			obj{"op": db.BatchDelete, "id": -1},
+		},
+	})
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	var failure struct {
+		Error errorBody `json:"error"`
+	}
+	toJSON(t, &failure, resp)
+	require.Equal(t, "/operations/1", failure.Error.Details[0].Path)
+	for _, p := range getPurchases() {
+		require.NotEqual(t, "10", p.Price.String(), "failed batch must not change anything")
+	}
+	require.Equal(
+		t,
+		http.StatusBadRequest,
+		testReqAs(t, session, "POST", "/purchases/batch", obj{
+			"operations": arr{obj{"op": "explode", "id": ids[0]}},
+		}).StatusCode)
+
+	resp = testReqAs(t, session, "POST", "/purchases/batch", obj{
+		"operations": arr{obj{"op": db.BatchAddTag, "tag": tags.Tags[0].ID, "filter": obj{}}},
+	})
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	toJSON(t, &failure, resp)
+	require.Equal(t, "invalid_batch_operation", failure.Error.Code,
+		"an empty filter must not select every purchase")
+
+	toJSON(t, &batch, testReqAs(t, session, "POST", "/purchases/batch", obj{
+		"operations": arr{
+			obj{"op": db.BatchUpdate, "id": ids[0], "values": obj{"price": "10"}},
+			obj{"op": db.BatchDelete, "id": ids[2]},
+			obj{"op": db.BatchAddTag, "tag": tags.Tags[0].ID, "filter": obj{"ids": ids}},
+			obj{"op": db.BatchSetProduct, "product": otherProduct.ID, "filter": obj{
+				"tag": tags.Tags[0].ID,
+				"ids": arr{ids[1]},
+			}},
+		},
+	}))
+	require.Len(t, batch.Results, 4)
+	require.Equal(t, int64(2), batch.Results[2].Count, "deleted purchases must not be selected")
+	require.Equal(t, int64(1), batch.Results[3].Count)
+	purchases := getPurchases()
+	require.Len(t, purchases, 2)
+	tagsByPurchase, err := httpAPI.DB.GetTagsByPurchaseForAccount(bgctx, session.AccountID)
+	require.Nil(t, err)
+	for _, p := range purchases {
+		require.Len(t, tagsByPurchase[p.ID], 1)
+		if p.ID == ids[1] {
+			require.Equal(t, otherProduct.ID, p.Product.ID)
+		} else {
+			require.Equal(t, "10", p.Price.String())
+			require.Equal(t, product.ID, p.Product.ID)
+		}
+	}
+
+	toJSON(t, &batch, testReqAs(t, session, "POST", "/purchases/batch", obj{
+		"operations": arr{
+			obj{"op": db.BatchRemoveTag, "tag": tags.Tags[0].ID, "filter": obj{"from": parseTime("2021-01-01")}},
+			obj{"op": db.BatchRestore, "id": ids[2]},
+		},
+	}))
+	require.Equal(t, int64(2), batch.Results[0].Count)
+	require.Len(t, getPurchases(), 3)
+}
+
+func TestSync(t *testing.T) {
+	_, err := httpAPI.DB.InsertAccount(bgctx, "sync@example.com", "password", db.RoleUser)
+	require.Nil(t, err)
+	session, err := httpAPI.DB.CreateSession(bgctx, "sync@example.com", "password", nil)
+	require.Nil(t, err)
+
+	var changes db.SyncChanges
+	toJSON(t, &changes, testReqAs(t, session, "GET", "/sync", nil))
+	require.Empty(t, changes.Purchases)
+	cursor := changes.Cursor
+
+	push := obj{
+		"products": arr{obj{"clientId": "product-1", "name": "Offline"}},
+		"tags":     arr{obj{"clientId": "tag-1", "name": "Offline"}},
+		"purchases": arr{obj{
+			"clientId":        "purchase-1",
+			"productClientId": "product-1",
+			"date":            parseTime("2021-05-01"),
+			"quantity":        "2",
+			"price":           "1.5",
+			"tagClientIds":    arr{"tag-1"},
+		}},
+	}
+	var result db.PushResult
+	toJSON(t, &result, testReqAs(t, session, "POST", "/sync", push))
+	require.Len(t, result.Applied, 3)
+	require.Empty(t, result.Conflicts)
+	product := result.Applied[0]
+	purchase := result.Applied[2]
+	require.Equal(t, db.EntityPurchase, purchase.Entity)
+	require.Equal(t, "purchase-1", purchase.ClientID)
+
+	toJSON(t, &result, testReqAs(t, session, "POST", "/sync", push))
+	require.Len(t, result.Applied, 3)
+	require.Equal(t, purchase.ID, result.Applied[2].ID, "pushing again must not create duplicates")
+	var purchases struct {
+		Purchases []db.Purchase `json:"purchases"`
+	}
+	toJSON(t, &purchases, testReqAs(t, session, "GET", "/purchases", nil))
+	require.Len(t, purchases.Purchases, 1)
+
+	toJSON(t, &changes, testReqAs(t, session, "GET", "/sync?since="+strconv.FormatInt(cursor, 10), nil))
+	require.Len(t, changes.Products, 1)
+	require.Len(t, changes.Tags, 1)
+	require.Len(t, changes.Purchases, 1)
+	synced := changes.Purchases[0]
+	require.Equal(t, "purchase-1", *synced.ClientID)
+	require.Equal(t, []int64{changes.Tags[0].ID}, synced.Tags)
+	cursor = changes.Cursor
+
+	purchaseURL := "/purchases/" + strconv.FormatInt(purchase.ID, 10)
+	assertSuccess(t, testReqAs(t, session, "PATCH", purchaseURL, obj{"price": "3"}))
+	toJSON(t, &result, testReqAs(t, session, "POST", "/sync", obj{
+		"purchases": arr{obj{
+			"id":          purchase.ID,
+			"baseVersion": synced.Version,
+			"product":     synced.Product,
+			"date":        synced.Date,
+			"quantity":    "5",
+			"price":       "1.5",
+		}},
+	}))
+	require.Empty(t, result.Applied)
+	require.Len(t, result.Conflicts, 1, "changes based on an old version must conflict")
+	var current struct {
+		Price json.Number `json:"price"`
+	}
+	require.Nil(t, json.Unmarshal(result.Conflicts[0].Current, &current))
+	require.Equal(t, json.Number("3"), current.Price)
+
+	toJSON(t, &changes, testReqAs(t, session, "GET", "/sync?since="+strconv.FormatInt(cursor, 10), nil))
+	require.Len(t, changes.Purchases, 1)
+	require.Equal(t, "3", changes.Purchases[0].Price.String())
+	toJSON(t, &result, testReqAs(t, session, "POST", "/sync", obj{
+		"purchases": arr{obj{
+			"id":          purchase.ID,
+			"baseVersion": changes.Purchases[0].Version,
+			"product":     synced.Product,
+			"date":        synced.Date,
+			"quantity":    "5",
+			"price":       "3",
+			"deleted":     true,
+		}},
+	}))
+	require.Len(t, result.Applied, 1)
+	cursor = changes.Cursor
+
+	toJSON(t, &changes, testReqAs(t, session, "GET", "/sync?since="+strconv.FormatInt(cursor, 10), nil))
+	require.Len(t, changes.Purchases, 1)
+	require.True(t, changes.Purchases[0].Deleted)
+	require.Equal(t, "5", changes.Purchases[0].Quantity.String())
+	cursor = changes.Cursor
+	assertSuccess(t, testReqAs(t, session, "POST", "/trash/purge", obj{"purchases": arr{purchase.ID}}))
+	toJSON(t, &changes, testReqAs(t, session, "GET", "/sync?since="+strconv.FormatInt(cursor, 10), nil))
+	require.Equal(t, []int64{purchase.ID}, changes.Purged[db.EntityPurchase])
+
+	toJSON(t, &result, testReqAs(t, session, "POST", "/sync", obj{
+		"products": arr{obj{"clientId": "product-2", "name": "Other"}},
+	}))
+	require.Len(t, result.Applied, 1)
+	toJSON(t, &result, testReqAs(t, session, "POST", "/sync", obj{
+		"products": arr{obj{"id": product.ID, "clientId": "product-2", "name": "Mixed up"}},
+	}))
+	require.Empty(t, result.Applied)
+	require.Len(t, result.Conflicts, 1, "IDs of different entities must conflict")
+	require.Equal(t, product.ID, result.Conflicts[0].ID)
+	var names []string
+	toJSON(t, &changes, testReqAs(t, session, "GET", "/sync", nil))
+	for _, p := range changes.Products {
+		names = append(names, p.Name)
+	}
+	require.ElementsMatch(t, []string{"Offline", "Other"}, names)
+
+	require.Equal(
+		t,
+		http.StatusBadRequest,
+		testReqAs(t, session, "POST", "/sync", obj{
+			"purchases": arr{obj{"clientId": "purchase-2", "productClientId": "missing"}},
+		}).StatusCode)
+}
+
+func TestConcurrentEdits(t *testing.T) {
+	_, err := httpAPI.DB.InsertAccount(bgctx, "etag@example.com", "password", db.RoleUser)
+	require.Nil(t, err)
+	session, err := httpAPI.DB.CreateSession(bgctx, "etag@example.com", "password", nil)
+	require.Nil(t, err)
+
+	var product db.Product
+	toJSON(t, &product, testReqAs(t, session, "POST", "/products", obj{"name": "Versioned"}))
+	var purchase struct {
+		ID int64 `json:"id"`
+	}
+	toJSON(t, &purchase, testReqAs(t, session, "POST", "/purchases", obj{
+		"product":  product.ID,
+		"date":     parseTime("2021-06-01"),
+		"quantity": "1",
+		"price":    "2",
+	}))
+	purchaseURL := "/purchases/" + strconv.FormatInt(purchase.ID, 10)
+	resp := testReqAs(t, session, "GET", purchaseURL, nil)
+	assertSuccess(t, resp)
+	etag := resp.Header.Get("ETag")
+	require.NotEmpty(t, etag)
+
+	patch := func(etag string, price string) *http.Response {
+		var buf bytes.Buffer
+		require.Nil(t, json.NewEncoder(&buf).Encode(obj{"price": price}))
+		req := httptest.NewRequest("PATCH", purchaseURL, &buf)
+		req.Header.Set("Authorization", "Bearer "+session.Token)
+		req.Header.Set("If-Match", etag)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Result()
+	}
+	resp = patch(etag, "3")
+	assertSuccess(t, resp)
+	newETag := resp.Header.Get("ETag")
+	require.NotEqual(t, etag, newETag)
+	require.Equal(
+		t,
+		http.StatusPreconditionFailed,
+		patch(etag, "4").StatusCode,
+		"updates based on an old version must be rejected")
+	require.Equal(t, http.StatusPreconditionFailed, patch(`W/`+newETag, "4").StatusCode)
+	assertSuccess(t, patch(newETag, "4"))
+	assertSuccess(t, patch("*", "5"))
+
+	var fetched struct {
+		Purchase db.Purchase `json:"purchase"`
+	}
+	toJSON(t, &fetched, testReqAs(t, session, "GET", purchaseURL, nil))
+	require.Equal(t, "5", fetched.Purchase.Price.String())
+
+	resp = testReqAs(t, session, "POST", "/purchases/batch", obj{
+		"operations": arr{obj{"op": db.BatchDelete, "id": purchase.ID, "ifVersion": 1}},
+	})
+	require.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	var batch struct {
+		Results []db.BatchResult `json:"results"`
+	}
+	toJSON(t, &batch, testReqAs(t, session, "POST", "/purchases/batch", obj{
+		"operations": arr{obj{
+			"op":        db.BatchDelete,
+			"id":        purchase.ID,
+			"ifVersion": fetched.Purchase.Version,
+		}},
+	}))
+	require.NotEqual(t, fetched.Purchase.Version, batch.Results[0].Version)
+	require.Equal(t, http.StatusNotFound, testReqAs(t, session, "GET", purchaseURL, nil).StatusCode)
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	_, err := httpAPI.DB.InsertAccount(bgctx, "idempotency@example.com", "password", db.RoleUser)
+	require.Nil(t, err)
+	session, err := httpAPI.DB.CreateSession(bgctx, "idempotency@example.com", "password", nil)
+	require.Nil(t, err)
+
+	post := func(key string, body interface{}) *http.Response {
+		var buf bytes.Buffer
+		require.Nil(t, json.NewEncoder(&buf).Encode(body))
+		req := httptest.NewRequest("POST", "/products", &buf)
+		req.Header.Set("Authorization", "Bearer "+session.Token)
+		req.Header.Set(IdempotencyKeyHeader, key)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Result()
+	}
+	resp := post("key-1", obj{"name": "Once"})
+	assertSuccess(t, resp)
+	require.Empty(t, resp.Header.Get("Idempotent-Replayed"))
+	var first, second db.Product
+	toJSON(t, &first, resp)
+
+	resp = post("key-1", obj{"name": "Once"})
+	assertSuccess(t, resp)
+	require.Equal(t, "true", resp.Header.Get("Idempotent-Replayed"))
+	toJSON(t, &second, resp)
+	require.Equal(t, first.ID, second.ID)
+
+	require.Equal(
+		t,
+		[]string{"1"},
+		queryDB(t, "SELECT count(*) FROM products WHERE account_id = $1", session.AccountID),
+		"a retried request must not create duplicates")
+
+	require.Equal(t, http.StatusUnprocessableEntity, post("key-1", obj{"name": "Other"}).StatusCode)
+	require.Equal(t, http.StatusBadRequest, post(strings.Repeat("k", 256), obj{"name": "Long"}).StatusCode)
+
+	resp = post("key-2", obj{"name": "Other"})
+	assertSuccess(t, resp)
+	toJSON(t, &second, resp)
+	require.NotEqual(t, first.ID, second.ID)
+
+	_, err = httpAPI.DB.PurgeIdempotencyKeys(bgctx, time.Now().Add(time.Minute))
+	require.Nil(t, err)
+	resp = post("key-1", obj{"name": "Other"})
+	assertSuccess(t, resp)
+	require.Empty(t, resp.Header.Get("Idempotent-Replayed"), "purged keys must be forgotten")
+}
+
+func TestChangeEvents(t *testing.T) {
+	_, err := httpAPI.DB.InsertAccount(bgctx, "events@example.com", "password", db.RoleUser)
+	require.Nil(t, err)
+	session, err := httpAPI.DB.CreateSession(bgctx, "events@example.com", "password", nil)
+	require.Nil(t, err)
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	req, err := http.NewRequest("GET", server.URL+"/events", nil)
+	require.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer "+session.Token)
+	resp, err := server.Client().Do(req)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	events := make(chan string)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), "data: ") {
+				events <- strings.TrimPrefix(scanner.Text(), "data: ")
+			}
+		}
+	}()
+	nextEvent := func() *db.ChangeEvent {
+		t.Helper()
+		select {
+		case data, ok := <-events:
+			require.True(t, ok, "event stream ended")
+			event := &db.ChangeEvent{}
+			require.Nil(t, json.Unmarshal([]byte(data), event))
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for an event")
+			return nil
+		}
+	}
+
+	// Changes of other accounts must not be streamed.
+	assertSuccess(t, testReq(t, "POST", "/tags", obj{"tags": arr{"Not streamed"}}))
+
+	var product db.Product
+	toJSON(t, &product, testReqAs(t, session, "POST", "/products", obj{"name": "Streamed"}))
+	require.Equal(t, &db.ChangeEvent{
+		AccountID: session.AccountID,
+		Entity:    db.EntityProduct,
+		EntityID:  product.ID,
+		Action:    db.ActionCreate,
+	}, nextEvent())
+
+	var purchase struct {
+		ID int64 `json:"id"`
+	}
+	toJSON(t, &purchase, testReqAs(t, session, "POST", "/purchases", obj{
+		"product":  product.ID,
+		"date":     parseTime("2021-07-01"),
+		"quantity": "1",
+		"price":    "1",
+	}))
+	event := nextEvent()
+	require.Equal(t, db.EntityPurchase, event.Entity)
+	require.Equal(t, purchase.ID, event.EntityID)
+	require.Equal(t, db.ActionCreate, event.Action)
+
+	assertSuccess(t, testReqAs(t, session, "DELETE", "/purchases/"+strconv.FormatInt(purchase.ID, 10), nil))
+	event = nextEvent()
+	require.Equal(t, purchase.ID, event.EntityID)
+	require.Equal(t, db.ActionDelete, event.Action)
+}
+
+func TestWebhooks(t *testing.T) {
+	_, err := httpAPI.DB.InsertAccount(bgctx, "webhooks@example.com", "password", db.RoleUser)
+	require.Nil(t, err)
+	session, err := httpAPI.DB.CreateSession(bgctx, "webhooks@example.com", "password", nil)
+	require.Nil(t, err)
+
+	type received struct {
+		header http.Header
+		body   []byte
+	}
+	requests := make(chan received, 10)
+	responseStatus := int32(http.StatusOK)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		requests <- received{r.Header, body}
+		w.WriteHeader(int(atomic.LoadInt32(&responseStatus)))
+	}))
+	defer receiver.Close()
+
+	require.Equal(
+		t,
+		http.StatusBadRequest,
+		testReqAs(t, session, "POST", "/webhooks", obj{
+			"url":    "ftp://example.com",
+			"events": arr{"purchase.create"},
+		}).StatusCode)
+	require.Equal(
+		t,
+		http.StatusBadRequest,
+		testReqAs(t, session, "POST", "/webhooks", obj{
+			"url":    receiver.URL,
+			"events": arr{"purchase.explode"},
+		}).StatusCode)
+	httpAPI.DB.AllowPrivateWebhooks = false
+	resp := testReqAs(t, session, "POST", "/webhooks", obj{
+		"url":    "http://169.254.169.254/latest/meta-data",
+		"events": arr{"purchase.create"},
+	})
+	httpAPI.DB.AllowPrivateWebhooks = true
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode, "private addresses must be rejected")
+	var webhook db.Webhook
+	toJSON(t, &webhook, testReqAs(t, session, "POST", "/webhooks", obj{
+		"url":    receiver.URL,
+		"events": arr{"purchase.create"},
+		"secret": "s3cret",
+	}))
+	require.Equal(t, "s3cret", webhook.Secret)
+	webhookURL := "/webhooks/" + strconv.FormatInt(webhook.ID, 10)
+	require.Equal(t, http.StatusNotFound, testReq(t, "GET", webhookURL+"/deliveries", nil).StatusCode)
+
+	var product db.Product
+	toJSON(t, &product, testReqAs(t, session, "POST", "/products", obj{"name": "Hooked"}))
+	addPurchase := func() int64 {
+		var purchase struct {
+			ID int64 `json:"id"`
+		}
+		toJSON(t, &purchase, testReqAs(t, session, "POST", "/purchases", obj{
+			"product":  product.ID,
+			"date":     parseTime("2021-08-01"),
+			"quantity": "1",
+			"price":    "9.5",
+		}))
+		return purchase.ID
+	}
+	purchaseID := addPurchase()
+	require.Nil(t, httpAPI.Webhooks.DeliverPending(bgctx))
+	require.Len(t, requests, 1, "only subscribed events must be delivered")
+	req := <-requests
+	require.Equal(t, "purchase.create", req.header.Get(webhooks.EventHeader))
+	timestamp, err := strconv.ParseInt(req.header.Get(webhooks.TimestampHeader), 10, 64)
+	require.Nil(t, err)
+	require.Equal(
+		t,
+		webhooks.Sign("s3cret", timestamp, req.body),
+		req.header.Get(webhooks.SignatureHeader))
+	var payload struct {
+		Event    string `json:"event"`
+		EntityID int64  `json:"entityId"`
+		After    struct {
+			Price json.Number `json:"price"`
+		} `json:"after"`
+	}
+	require.Nil(t, json.Unmarshal(req.body, &payload))
+	require.Equal(t, "purchase.create", payload.Event)
+	require.Equal(t, purchaseID, payload.EntityID)
+	require.Equal(t, json.Number("9.5"), payload.After.Price)
+
+	atomic.StoreInt32(&responseStatus, http.StatusInternalServerError)
+	addPurchase()
+	require.Nil(t, httpAPI.Webhooks.DeliverPending(bgctx))
+	require.Len(t, requests, 1)
+	<-requests
+	require.Nil(t, httpAPI.Webhooks.DeliverPending(bgctx))
+	require.Len(t, requests, 0, "a failed delivery must not be retried before the backoff")
+
+	var deliveries struct {
+		Deliveries []db.WebhookDelivery `json:"deliveries"`
+	}
+	toJSON(t, &deliveries, testReqAs(t, session, "GET", webhookURL+"/deliveries", nil))
+	require.Len(t, deliveries.Deliveries, 2)
+	failed := deliveries.Deliveries[0]
+	require.Equal(t, db.DeliveryPending, failed.Status)
+	require.Equal(t, 1, failed.Attempts)
+	require.Equal(t, http.StatusInternalServerError, *failed.ResponseStatus)
+	require.NotNil(t, failed.NextAttemptTime)
+	require.True(t, failed.NextAttemptTime.After(time.Now()))
+	require.Equal(t, db.DeliverySucceeded, deliveries.Deliveries[1].Status)
+
+	atomic.StoreInt32(&responseStatus, http.StatusNoContent)
+	var ping db.WebhookDelivery
+	toJSON(t, &ping, testReqAs(t, session, "POST", webhookURL+"/ping", nil))
+	require.Equal(t, db.EventPing, ping.Event)
+	require.Equal(t, db.DeliverySucceeded, ping.Status)
+	require.Equal(t, db.EventPing, (<-requests).header.Get(webhooks.EventHeader))
+
+	atomic.StoreInt32(&responseStatus, http.StatusInternalServerError)
+	addPurchase()
+	require.Nil(t, httpAPI.Webhooks.DeliverPending(bgctx))
+	<-requests
+	atomic.StoreInt32(&responseStatus, http.StatusOK)
+
+	var updated db.Webhook
+	toJSON(t, &updated, testReqAs(t, session, "PATCH", webhookURL, obj{"active": false}))
+	require.False(t, updated.Active)
+	require.Empty(t, updated.Secret)
+	addPurchase()
+	_, err = httpAPI.DB.DB.Exec(
+		"UPDATE webhook_deliveries SET next_attempt_time = $1 WHERE webhook_id = $2",
+		time.Now().UTC().Add(-time.Minute), webhook.ID)
+	require.Nil(t, err)
+	require.Nil(t, httpAPI.Webhooks.DeliverPending(bgctx))
+	require.Len(t, requests, 0, "inactive webhooks must not receive events or retries")
+
+	assertSuccess(t, testReqAs(t, session, "DELETE", webhookURL, nil))
+	require.Equal(t, http.StatusNotFound, testReqAs(t, session, "GET", webhookURL+"/deliveries", nil).StatusCode)
+}
+
+func TestGraphQL(t *testing.T) {
+	_, err := httpAPI.DB.InsertAccount(bgctx, "graphql@example.com", "password", db.RoleUser)
+	require.Nil(t, err)
+	session, err := httpAPI.DB.CreateSession(bgctx, "graphql@example.com", "password", nil)
+	require.Nil(t, err)
+
+	query := func(session *db.Session, query string, variables obj, data interface{}) []string {
+		t.Helper()
+		var resp struct {
+			Data   json.RawMessage `json:"data"`
+			Errors []struct {
+				Message string `json:"message"`
+			} `json:"errors"`
+		}
+		toJSON(t, &resp, testReqAs(t, session, "POST", "/graphql", obj{
+			"query":     query,
+			"variables": variables,
+		}))
+		messages := []string{}
+		for _, e := range resp.Errors {
+			messages = append(messages, e.Message)
+		}
+		if len(messages) == 0 && data != nil {
+			require.Nil(t, json.Unmarshal(resp.Data, data))
+		}
+		return messages
+	}
+
+	var created struct {
+		AddProduct struct{ ID string }
+		AddTags    []struct{ ID string }
+	}
+	require.Empty(t, query(session, `mutation {
+		addProduct(name: "Coffee") { id }
+		addTags(names: ["Drinks", "Work"]) { id }
+	}`, nil, &created))
+	addPurchase := `mutation($input: PurchaseInput!) {
+		addPurchase(input: $input) { id version tags { name } }
+	}`
+	for i, date := range []string{"2021-01-15", "2021-02-10", "2021-02-20"} {
+		tags := arr{created.AddTags[0].ID}
+		if i == 2 {
+			tags = append(tags, created.AddTags[1].ID)
+		}
+		var added struct {
+			AddPurchase struct {
+				ID   string
+				Tags []struct{ Name string }
+			}
+		}
+		require.Empty(t, query(session, addPurchase, obj{"input": obj{
+			"product":  created.AddProduct.ID,
+			"date":     date + "T00:00:00Z",
+			"quantity": "2",
+			"price":    "1.5",
+			"tags":     tags,
+		}}, &added))
+		require.Len(t, added.AddPurchase.Tags, len(tags))
+	}
+
+	type page struct {
+		Purchases struct {
+			TotalCount int
+			PageInfo   struct {
+				HasNextPage bool
+				EndCursor   string
+			}
+			Edges []struct {
+				Node struct {
+					ID      string
+					Date    time.Time
+					Product struct{ Name string }
+					Tags    []struct{ Name string }
+				}
+			}
+		}
+	}
+	listPurchases := `query($after: String, $tag: ID) {
+		purchases(first: 2, after: $after, filter: {tag: $tag}) {
+			totalCount
+			pageInfo { hasNextPage endCursor }
+			edges { node { id date product { name } tags { name } } }
+		}
+	}`
+	var first, second page
+	require.Empty(t, query(session, listPurchases, nil, &first))
+	require.Equal(t, 3, first.Purchases.TotalCount)
+	require.True(t, first.Purchases.PageInfo.HasNextPage)
+	require.Len(t, first.Purchases.Edges, 2)
+	newest := first.Purchases.Edges[0].Node
+	require.Equal(t, "2021-02-20", newest.Date.Format("2006-01-02"))
+	require.Equal(t, "Coffee", newest.Product.Name)
+	require.Len(t, newest.Tags, 2)
+	require.Empty(t, query(session, listPurchases, obj{"after": first.Purchases.PageInfo.EndCursor}, &second))
+	require.False(t, second.Purchases.PageInfo.HasNextPage)
+	require.Len(t, second.Purchases.Edges, 1)
+	require.Equal(t, "2021-01-15", second.Purchases.Edges[0].Node.Date.Format("2006-01-02"))
+
+	var tagged page
+	require.Empty(t, query(session, listPurchases, obj{"tag": created.AddTags[1].ID}, &tagged))
+	require.Equal(t, 1, tagged.Purchases.TotalCount)
+
+	var stats struct {
+		Stats struct {
+			Count     int
+			Total     string
+			ByProduct []struct {
+				Product struct{ Name string }
+				Total   string
+			}
+			ByTag []struct {
+				Tag   struct{ Name string }
+				Count int
+			}
+			ByMonth []struct {
+				Month time.Time
+				Count int
+			}
+		}
+	}
+	require.Empty(t, query(session, `{
+		stats(filter: {from: "2021-02-01T00:00:00Z"}) {
+			count
+			total
+			byProduct { product { name } total }
+			byTag { tag { name } count }
+			byMonth { month count }
+		}
+	}`, nil, &stats))
+	require.Equal(t, 2, stats.Stats.Count)
+	require.Equal(t, "6.0", stats.Stats.Total)
+	require.Len(t, stats.Stats.ByProduct, 1)
+	require.Equal(t, "Coffee", stats.Stats.ByProduct[0].Product.Name)
+	require.Len(t, stats.Stats.ByTag, 2)
+	require.Len(t, stats.Stats.ByMonth, 1)
+	require.Equal(t, 2, stats.Stats.ByMonth[0].Count)
+
+	var updated struct {
+		UpdatePurchase struct{ Price string }
+	}
+	require.Equal(
+		t,
+		[]string{db.ErrVersionMismatch.Error()},
+		query(session, `mutation($id: ID!) {
+			updatePurchase(id: $id, input: {price: "3"}, ifVersion: "1") { price }
+		}`, obj{"id": newest.ID}, nil))
+	require.Empty(t, query(session, `mutation($id: ID!) {
+		updatePurchase(id: $id, input: {price: "3"}) { price }
+	}`, obj{"id": newest.ID}, &updated))
+	require.Equal(t, "3", updated.UpdatePurchase.Price)
+
+	readToken, err := httpAPI.DB.InsertAPIToken(
+		bgctx, session.AccountID, "graphql", []string{db.ScopeRead}, nil)
+	require.Nil(t, err)
+	readSession := &db.Session{Token: readToken.Token}
+	require.Empty(t, query(readSession, `{ products { name } }`, nil, nil))
+	require.Equal(
+		t,
+		[]string{gql.ErrForbidden.Error()},
+		query(readSession, `mutation($id: ID!) { deletePurchase(id: $id) }`, obj{"id": newest.ID}, nil))
+
+	var other struct {
+		Purchase *struct{ ID string }
+	}
+	require.Empty(t, query(testSession, `query($id: ID!) { purchase(id: $id) { id } }`, obj{"id": newest.ID}, &other))
+	require.Nil(t, other.Purchase, "purchases of other accounts must not be visible")
+}
+
+func TestOpenAPI(t *testing.T) {
+	resp := testReq(t, "GET", "/openapi.json", nil)
+	assertSuccess(t, resp)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	_, err = openapi.Parse(body)
+	require.Nil(t, err)
+
+	routes := map[string]bool{}
+	var walk func(router *mux.Router)
+	walk = func(router *mux.Router) {
+		err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+			if authed, ok := route.GetHandler().(*mux.Router); ok {
+				walk(authed)
+				return nil
+			}
+			methods, err := route.GetMethods()
+			if err != nil {
+				// Subrouters don't restrict methods.
+				return nil
+			}
+			path, err := route.GetPathTemplate()
+			require.Nil(t, err)
+			for _, method := range methods {
+				routes[method+" "+path] = true
+				require.NotNil(t, spec.Operation(method, path), "%s %s is not documented", method, path)
+			}
+			return nil
+		})
+		require.Nil(t, err)
+	}
+	walk(httpAPI.newRouter())
+	for path, item := range spec.Paths {
+		for method := range item {
+			method = strings.ToUpper(method)
+			require.True(t, routes[method+" "+path], "%s %s is documented but not routed", method, path)
+		}
+	}
+}
+
+func TestRequestValidation(t *testing.T) {
+	var errResp struct {
+		Error errorBody `json:"error"`
+	}
+	resp := testReq(t, "POST", "/purchases", obj{
+		"product":  "1",
+		"date":     "yesterday",
+		"quantity": true,
+		"tags":     arr{1, "2"},
+	})
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	toJSON(t, &errResp, resp)
+	require.Equal(t, CodeValidationFailed, errResp.Error.Code)
+	require.Equal(t, []*openapi.ValidationError{
+		{Path: "/date", Message: "must be an RFC 3339 date-time"},
+		{Path: "/product", Message: "must be an integer"},
+		{Path: "/quantity", Message: "must be a string"},
+		{Path: "/tags/1", Message: "must be an integer"},
+	}, errResp.Error.Details)
+
+	resp = testReq(t, "POST", "/purchases/batch", obj{
+		"operations": arr{obj{"id": 1}, obj{"op": "explode"}},
+	})
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	toJSON(t, &errResp, resp)
+	require.Len(t, errResp.Error.Details, 2)
+	require.Equal(t, "/operations/0/op", errResp.Error.Details[0].Path)
+	require.Equal(t, "/operations/1/op", errResp.Error.Details[1].Path)
+
+	resp = testReq(t, "POST", "/tags", nil)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	toJSON(t, &errResp, resp)
+	require.Equal(t, "request body is required", errResp.Error.Details[0].Message)
+
+	resp = testReq(t, "POST", "/login", obj{"email": "test@example.com"})
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	toJSON(t, &errResp, resp)
+	require.Equal(t, "/password", errResp.Error.Details[0].Path)
+
+	require.Equal(
+		t,
+		http.StatusUnauthorized,
+		testReq(t, "POST", "/login", obj{"email": "test@example.com", "password": "wrong"}).StatusCode)
+}
+
+func TestErrorResponses(t *testing.T) {
+	var errResp struct {
+		Error errorBody `json:"error"`
+	}
+	resp := testReq(t, "GET", "/nonexistent", nil)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	toJSON(t, &errResp, resp)
+	require.Equal(t, CodeNotFound, errResp.Error.Code)
+	require.NotEmpty(t, errResp.Error.RequestID)
+	require.Equal(t, resp.Header.Get(RequestIDHeader), errResp.Error.RequestID)
+
+	req := httptest.NewRequest("GET", "/purchases", nil)
+	req.Header.Set(RequestIDHeader, "client-request-1")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	resp = rec.Result()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	require.Equal(t, "client-request-1", resp.Header.Get(RequestIDHeader))
+	toJSON(t, &errResp, resp)
+	require.Equal(t, CodeUnauthorized, errResp.Error.Code)
+	require.Equal(t, "client-request-1", errResp.Error.RequestID)
+
+	resp = testReq(t, "POST", "/purchases", obj{
+		"product":  -1,
+		"date":     parseTime("2021-04-01"),
+		"quantity": "1",
+		"price":    "1",
+	})
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	toJSON(t, &errResp, resp)
+	require.Equal(t, CodeValidationFailed, errResp.Error.Code)
+	require.Equal(t, []*openapi.ValidationError{
+		{Path: "/product", Message: "product does not exist"},
+	}, errResp.Error.Details)
+
+	var product db.Product
+	toJSON(t, &product, testReq(t, "POST", "/products", obj{"name": "Errors"}))
+	resp = testReq(t, "POST", "/purchases", obj{
+		"product":  product.ID,
+		"date":     parseTime("2021-04-01"),
+		"quantity": "1",
+		"price":    "-1",
+	})
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	toJSON(t, &errResp, resp)
+	require.Equal(t, CodeValidationFailed, errResp.Error.Code)
+	require.Equal(t, []*openapi.ValidationError{
+		{Path: "/price", Message: "must be positive"},
+	}, errResp.Error.Details)
+
+	resp = testReq(t, "POST", "/login", obj{"email": "test@example.com", "password": "wrong"})
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	toJSON(t, &errResp, resp)
+	require.Equal(t, "invalid_credentials", errResp.Error.Code)
+	require.Equal(t, db.ErrInvalidEmailOrPassword.Error(), errResp.Error.Message)
+}
+
+func TestPurchaseValidation(t *testing.T) {
+	_, err := httpAPI.DB.InsertAccount(bgctx, "validation@example.com", "password", db.RoleUser)
+	require.Nil(t, err)
+	session, err := httpAPI.DB.CreateSession(bgctx, "validation@example.com", "password", nil)
+	require.Nil(t, err)
+	_, err = httpAPI.DB.InsertAccount(bgctx, "validation2@example.com", "password", db.RoleUser)
+	require.Nil(t, err)
+	otherSession, err := httpAPI.DB.CreateSession(bgctx, "validation2@example.com", "password", nil)
+	require.Nil(t, err)
+
+	var product, otherProduct db.Product
+	toJSON(t, &product, testReqAs(t, session, "POST", "/products", obj{"name": "Validated"}))
+	toJSON(t, &otherProduct, testReqAs(t, otherSession, "POST", "/products", obj{"name": "Foreign"}))
+	var tags, otherTags struct {
+		Tags []db.Tag `json:"tags"`
+	}
+	toJSON(t, &tags, testReqAs(t, session, "POST", "/tags", obj{"tags": arr{"Validated"}}))
+	toJSON(t, &otherTags, testReqAs(t, otherSession, "POST", "/tags", obj{"tags": arr{"Foreign"}}))
+
+	var errResp struct {
+		Error errorBody `json:"error"`
+	}
+	resp := testReqAs(t, session, "POST", "/purchases", obj{
+		"product":  otherProduct.ID,
+		"date":     parseTime("2200-01-01"),
+		"quantity": "0",
+		"price":    "2.12345",
+		"tags":     arr{tags.Tags[0].ID, otherTags.Tags[0].ID, tags.Tags[0].ID},
+	})
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	toJSON(t, &errResp, resp)
+	require.Equal(t, CodeValidationFailed, errResp.Error.Code)
+	require.Equal(t, []*openapi.ValidationError{
+		{Path: "/product", Message: "product does not exist"},
+		{Path: "/date", Message: "is out of range"},
+		{Path: "/quantity", Message: "must be positive"},
+		{Path: "/price", Message: "must have at most 4 decimal places"},
+		{Path: "/tags/1", Message: "tag does not exist"},
+		{Path: "/tags/2", Message: "tag is listed more than once"},
+	}, errResp.Error.Details)
+	require.Empty(t, queryDB(t, "SELECT id FROM purchase_tag WHERE tag_id = $1", otherTags.Tags[0].ID))
+
+	var created struct {
+		ID int64 `json:"id"`
+	}
+	toJSON(t, &created, testReqAs(t, session, "POST", "/purchases", obj{
+		"product":  product.ID,
+		"date":     parseTime("2021-09-01"),
+		"quantity": "1.5",
+		"price":    "2.1234",
+		"tags":     arr{tags.Tags[0].ID},
+	}))
+	purchaseURL := "/purchases/" + strconv.FormatInt(created.ID, 10)
+	resp = testReqAs(t, session, "PATCH", purchaseURL, obj{"tags": arr{otherTags.Tags[0].ID}})
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	toJSON(t, &errResp, resp)
+	require.Equal(t, []*openapi.ValidationError{
+		{Path: "/tags/0", Message: "tag does not exist"},
+	}, errResp.Error.Details)
+
+	resp = testReqAs(t, session, "POST", "/purchases/batch", obj{
+		"operations": arr{
+			obj{"op": db.BatchUpdate, "id": created.ID, "values": obj{"price": "0"}},
+		},
+	})
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	toJSON(t, &errResp, resp)
+	require.Equal(t, []*openapi.ValidationError{
+		{Path: "/operations/0/values/price", Message: "must be positive"},
+	}, errResp.Error.Details)
+
+	resp = testReqAs(t, session, "POST", "/tags", obj{"tags": arr{"Fine", "  "}})
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	toJSON(t, &errResp, resp)
+	require.Equal(t, []*openapi.ValidationError{
+		{Path: "/tags/1", Message: "must not be empty"},
+	}, errResp.Error.Details)
+	resp = testReqAs(t, session, "POST", "/products", obj{"name": ""})
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	toJSON(t, &errResp, resp)
+	require.Equal(t, []*openapi.ValidationError{
+		{Path: "/name", Message: "must not be empty"},
+	}, errResp.Error.Details)
+}
+
+func TestDecimalPrices(t *testing.T) {
+	_, err := httpAPI.DB.InsertAccount(bgctx, "decimal@example.com", "password", db.RoleUser)
+	require.Nil(t, err)
+	session, err := httpAPI.DB.CreateSession(bgctx, "decimal@example.com", "password", nil)
+	require.Nil(t, err)
+	var product db.Product
+	toJSON(t, &product, testReqAs(t, session, "POST", "/products", obj{"name": "Decimal"}))
+
+	var created struct {
+		ID int64 `json:"id"`
+	}
+	toJSON(t, &created, testReqAs(t, session, "POST", "/purchases", obj{
+		"product":  product.ID,
+		"date":     parseTime("2021-10-01"),
+		"quantity": 3,
+		"price":    "0.335",
+	}))
+	var fetched struct {
+		Purchase struct {
+			Quantity   string `json:"quantity"`
+			Price      string `json:"price"`
+			TotalPrice string `json:"totalPrice"`
+		} `json:"purchase"`
+	}
+	purchaseURL := "/purchases/" + strconv.FormatInt(created.ID, 10)
+	toJSON(t, &fetched, testReqAs(t, session, "GET", purchaseURL, nil))
+	require.Equal(t, "3", fetched.Purchase.Quantity)
+	require.Equal(t, "0.335", fetched.Purchase.Price)
+	require.Equal(t, "1.01", fetched.Purchase.TotalPrice, "1.005 must be rounded half up")
+
+	assertSuccess(t, testReqAs(t, session, "PATCH", purchaseURL, obj{"quantity": 0.5, "price": "4"}))
+	toJSON(t, &fetched, testReqAs(t, session, "GET", purchaseURL, nil))
+	require.Equal(t, "0.5", fetched.Purchase.Quantity)
+	require.Equal(t, "2.00", fetched.Purchase.TotalPrice)
+
+	resp := testReqAs(t, session, "PATCH", purchaseURL, obj{"price": "4,5"})
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	var errResp struct {
+		Error errorBody `json:"error"`
+	}
+	toJSON(t, &errResp, resp)
+	require.Equal(t, []*openapi.ValidationError{
+		{Path: "/price", Message: "must be a decimal number"},
+	}, errResp.Error.Details)
+}
+
+func TestRequestLogging(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := logging.New(&buf, logging.FormatJSON, "info")
+	require.Nil(t, err)
+	httpAPI.Log = logger
+	defer func() { httpAPI.Log = nil }()
+
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(
+		`{"email": "test@example.com", "password": "wrong password"}`))
+	req.Header.Set(RequestIDHeader, "logged-login")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusUnauthorized, resp.Code)
+	require.Equal(t, "logged-login", resp.Header().Get(RequestIDHeader))
+
+	req = httptest.NewRequest("GET", "/purchases?limit=1&token=secret-value", nil)
+	req.Header.Set("Authorization", "Bearer "+testSession.Token)
+	req.Header.Set(RequestIDHeader, "logged-purchases")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	require.NotContains(t, buf.String(), "wrong password")
+	require.NotContains(t, buf.String(), "secret-value")
+	entries := map[string]map[string]interface{}{}
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var entry map[string]interface{}
+		require.Nil(t, json.Unmarshal(scanner.Bytes(), &entry))
+		if entry["msg"] == "request handled" {
+			entries[entry["requestId"].(string)] = entry
+		}
+	}
+	login := entries["logged-login"]
+	require.NotNil(t, login)
+	require.Equal(t, "POST", login["method"])
+	require.Equal(t, "/login", login["path"])
+	require.Equal(t, float64(http.StatusUnauthorized), login["status"])
+	require.NotContains(t, login, "accountId")
+	purchases := entries["logged-purchases"]
+	require.NotNil(t, purchases)
+	require.Equal(t, float64(testSession.AccountID), purchases["accountId"])
+	require.Equal(t, float64(testSession.ID), purchases["sessionId"])
+	require.Equal(t, "limit=1&token=%5BREDACTED%5D", purchases["query"])
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	get := func(path string) *http.Response {
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest("GET", path, nil))
+		return resp.Result()
+	}
+	var status struct {
+		Status string `json:"status"`
+	}
+	resp := get("/healthz")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	toJSON(t, &status, resp)
+	require.Equal(t, "ok", status.Status)
+
+	resp = get("/readyz")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	toJSON(t, &status, resp)
+	require.Equal(t, "ready", status.Status)
+
+	httpAPI.Build = BuildInfo{Version: "1.2.3", Commit: "abc123"}
+	defer func() { httpAPI.Build = BuildInfo{} }()
+	var version struct {
+		Version       string `json:"version"`
+		Commit        string `json:"commit"`
+		SchemaVersion int    `json:"schemaVersion"`
+	}
+	resp = get("/version")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	toJSON(t, &version, resp)
+	require.Equal(t, "1.2.3", version.Version)
+	require.Equal(t, "abc123", version.Commit)
+	require.Equal(t, db.SchemaVersion, version.SchemaVersion)
+
+	_, err := httpAPI.DB.DB.Exec("UPDATE metadata SET version = version + 1 WHERE is_current")
+	require.Nil(t, err)
+	defer func() {
+		_, err := httpAPI.DB.DB.Exec("UPDATE metadata SET version = version - 1 WHERE is_current")
+		require.Nil(t, err)
+	}()
+	resp = get("/readyz")
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	var errResp struct {
+		Error errorBody `json:"error"`
+	}
+	toJSON(t, &errResp, resp)
+	require.Equal(t, "schema_version_mismatch", errResp.Error.Code)
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lassilaiho/expenditure-accounting/server/db"
+)
+
+// parseTimeParam parses a time given either as a date or as an RFC 3339
+// timestamp. An empty string results in the zero time.
+func parseTimeParam(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func writeAuditLog(w http.ResponseWriter, r *http.Request, entries []*db.AuditEntry) {
+	respData := struct {
+		Entries []*db.AuditEntry `json:"entries"`
+	}{entries}
+	if err := json.NewEncoder(w).Encode(&respData); err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+func (api *API) GetPurchaseHistory(w http.ResponseWriter, r *http.Request) {
+	purchaseID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusNotFound, err)
+		return
+	}
+	entries, err := api.DB.GetAuditLog(r.Context(), getSession(r).AccountID, &db.AuditFilter{
+		Entity:   db.EntityPurchase,
+		EntityID: purchaseID,
+		Limit:    db.MaxAuditLogLimit,
+	})
+	if err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if len(entries) == 0 {
+		writeError(w, r, http.StatusNotFound, err)
+		return
+	}
+	writeAuditLog(w, r, entries)
+}
+
+// GetAuditLog returns the changes made to the data of the account. The
+// changes can be filtered with the query parameters entity, from, to and
+// limit.
+func (api *API) GetAuditLog(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := &db.AuditFilter{Entity: query.Get("entity")}
+	var err error
+	if filter.From, err = parseTimeParam(query.Get("from")); err != nil {
+		writeError(w, r, http.StatusBadRequest, invalidParameter("from"))
+		return
+	}
+	if filter.To, err = parseTimeParam(query.Get("to")); err != nil {
+		writeError(w, r, http.StatusBadRequest, invalidParameter("to"))
+		return
+	}
+	if limit := query.Get("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil {
+			writeError(w, r, http.StatusBadRequest, invalidParameter("limit"))
+			return
+		}
+	}
+	entries, err := api.DB.GetAuditLog(r.Context(), getSession(r).AccountID, filter)
+	if err != nil {
+		if err == db.ErrInvalidEntity {
+			writeError(w, r, http.StatusBadRequest, err)
+		} else {
+			logger(r).Error(err)
+			writeError(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	writeAuditLog(w, r, entries)
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+)
+
+var errCookiesDisabled = errors.New("cookie sessions are not enabled")
+
+// CSRFHeader is the request header carrying the CSRF token when the session
+// token is sent in a cookie.
+const CSRFHeader = "X-CSRF-Token"
+
+// CookieConfig configures cookie based sessions. When enabled, the session
+// token is stored in an HttpOnly cookie instead of being handed to the client
+// application, and state-changing requests authenticated with the cookie must
+// carry a CSRF token in the X-CSRF-Token header.
+type CookieConfig struct {
+	// Name is the name of the session cookie. The CSRF token is stored in a
+	// cookie named Name + "_csrf" readable by the client application.
+	Name     string
+	Domain   string
+	Path     string
+	SameSite http.SameSite
+	// Secure should be true unless the server is accessed over plain HTTP
+	// during development.
+	Secure bool
+}
+
+func (c *CookieConfig) csrfCookieName() string {
+	return c.Name + "_csrf"
+}
+
+// csrfToken derives the CSRF token of a session from the session token. The
+// derived token can be validated without storing it, and it doesn't reveal the
+// session token.
+func csrfToken(sessionToken string) string {
+	mac := hmac.New(sha256.New, []byte(sessionToken))
+	mac.Write([]byte("csrf"))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func validCSRFToken(r *http.Request, sessionToken string) bool {
+	token := r.Header.Get(CSRFHeader)
+	return token != "" && hmac.Equal([]byte(token), []byte(csrfToken(sessionToken)))
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	default:
+		return false
+	}
+}
+
+func (api *API) setSessionCookies(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     api.Cookies.Name,
+		Value:    token,
+		Domain:   api.Cookies.Domain,
+		Path:     api.Cookies.Path,
+		SameSite: api.Cookies.SameSite,
+		Secure:   api.Cookies.Secure,
+		HttpOnly: true,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     api.Cookies.csrfCookieName(),
+		Value:    csrfToken(token),
+		Domain:   api.Cookies.Domain,
+		Path:     api.Cookies.Path,
+		SameSite: api.Cookies.SameSite,
+		Secure:   api.Cookies.Secure,
+	})
+}
+
+func (api *API) clearSessionCookies(w http.ResponseWriter) {
+	for _, name := range []string{api.Cookies.Name, api.Cookies.csrfCookieName()} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Domain:   api.Cookies.Domain,
+			Path:     api.Cookies.Path,
+			SameSite: api.Cookies.SameSite,
+			Secure:   api.Cookies.Secure,
+			MaxAge:   -1,
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/lassilaiho/expenditure-accounting/server/db"
+	"github.com/lassilaiho/expenditure-accounting/server/openapi"
+)
+
+// Codes of error responses. Errors without a more specific code have the code
+// of their status.
+const (
+	CodeInvalidRequest     = "invalid_request"
+	CodeInvalidParameter   = "invalid_parameter"
+	CodeValidationFailed   = "validation_failed"
+	CodeUnauthorized       = "unauthorized"
+	CodeForbidden          = "forbidden"
+	CodeNotFound           = "not_found"
+	CodeMethodNotAllowed   = "method_not_allowed"
+	CodeConflict           = "conflict"
+	CodePreconditionFailed = "precondition_failed"
+	CodeTooLarge           = "request_too_large"
+	CodeUnprocessable      = "unprocessable"
+	CodeRateLimited        = "rate_limited"
+	CodeInternal           = "internal_error"
+	CodeUnavailable        = "unavailable"
+)
+
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            CodeInvalidRequest,
+	http.StatusUnauthorized:          CodeUnauthorized,
+	http.StatusForbidden:             CodeForbidden,
+	http.StatusNotFound:              CodeNotFound,
+	http.StatusMethodNotAllowed:      CodeMethodNotAllowed,
+	http.StatusConflict:              CodeConflict,
+	http.StatusPreconditionFailed:    CodePreconditionFailed,
+	http.StatusRequestEntityTooLarge: CodeTooLarge,
+	http.StatusUnprocessableEntity:   CodeUnprocessable,
+	http.StatusTooManyRequests:       CodeRateLimited,
+	http.StatusInternalServerError:   CodeInternal,
+	http.StatusServiceUnavailable:    CodeUnavailable,
+}
+
+// errorCodes lists the errors whose messages are shown to clients.
+var errorCodes = map[error]string{
+	db.ErrAccountDisabled:          "account_disabled",
+	db.ErrAccountLocked:            "account_locked",
+	db.ErrAdminScopeForbidden:      "admin_scope_forbidden",
+	db.ErrEmailTaken:               "email_taken",
+	db.ErrIdempotencyKeyInProgress: "request_in_progress",
+	db.ErrIdempotencyKeyReused:     "idempotency_key_reused",
+	db.ErrInvalidBatchOperation:    "invalid_batch_operation",
+	db.ErrInvalidChallenge:         "invalid_challenge",
+	db.ErrInvalidEmail:             "invalid_email",
+	db.ErrInvalidEmailOrPassword:   "invalid_credentials",
+	db.ErrInvalidEntity:            "invalid_entity",
+	db.ErrInvalidIdempotencyKey:    "invalid_idempotency_key",
+	db.ErrInvalidOIDCState:         "invalid_oidc_state",
+	db.ErrInvalidRole:              "invalid_role",
+	db.ErrInvalidScope:             "invalid_scope",
+	db.ErrInvalidTokenName:         "invalid_token_name",
+	db.ErrInvalidTwoFactorCode:     "invalid_two_factor_code",
+	db.ErrInvalidWebhookEvent:      "invalid_webhook_event",
+	db.ErrInvalidWebhookURL:        "invalid_webhook_url",
+	db.ErrNoOIDCIdentity:           "no_oidc_identity",
+	db.ErrOIDCAccountNotFound:      "oidc_account_not_found",
+	db.ErrOIDCIdentityMismatch:     "oidc_identity_mismatch",
+	db.ErrOIDCIdentityTaken:        "oidc_identity_taken",
+	db.ErrOIDCLinkRequired:         "oidc_link_required",
+	db.ErrPasswordLoginDisabled:    "password_login_disabled",
+	db.ErrPasswordTooShort:         "password_too_short",
+	db.ErrTooManyOperations:        "too_many_operations",
+	db.ErrTwoFactorEnabled:         "two_factor_enabled",
+	db.ErrTwoFactorNotEnabled:      "two_factor_not_enabled",
+	db.ErrTwoFactorRequired:        "two_factor_required",
+	db.ErrUndoConflict:             "undo_conflict",
+	db.ErrUnknownReference:         "unknown_reference",
+	db.ErrVersionMismatch:          "version_mismatch",
+	errCookiesDisabled:             "cookies_disabled",
+	errDatabaseUnavailable:         "database_unavailable",
+	errEmailNotVerified:            "email_not_verified",
+	errExpiryInPast:                "invalid_expiry_time",
+	errInvalidCSRFToken:            "invalid_csrf_token",
+	errInvalidInviteCode:           "invalid_invite_code",
+	errInvalidSessionToken:         CodeUnauthorized,
+	errInvalidUndoCount:            "invalid_count",
+	errMissingScope:                "missing_scope",
+	errOIDCDisabled:                "oidc_disabled",
+	errOIDCFailed:                  "oidc_failed",
+	errOwnAccount:                  "own_account",
+	errSchemaVersionMismatch:       "schema_version_mismatch",
+	errTooManyLoginAttempts:        "too_many_login_attempts",
+}
+
+// apiError is an error shown to clients as is.
+type apiError struct {
+	Code    string
+	Message string
+	Details []*openapi.ValidationError
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+func invalidParameter(name string) error {
+	return &apiError{Code: CodeInvalidParameter, Message: "invalid " + name + " parameter"}
+}
+
+// errorBody is the body of error responses. Details lists the invalid fields
+// of the request, if any, identified by JSON pointers.
+type errorBody struct {
+	Code      string                     `json:"code"`
+	Message   string                     `json:"message"`
+	Details   []*openapi.ValidationError `json:"details,omitempty"`
+	RequestID string                     `json:"requestId,omitempty"`
+}
+
+// newErrorBody describes err in an error response with status, which may be
+// changed to better describe the error. Errors listed in errorCodes are
+// reported with their own code and message and values rejected by the database
+// as validation errors. Other errors are described by the status only so that
+// internal details aren't revealed.
+func newErrorBody(status int, err error) (int, *errorBody) {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return status, &errorBody{
+			Code:    apiErr.Code,
+			Message: apiErr.Message,
+			Details: apiErr.Details,
+		}
+	}
+	for e, code := range errorCodes {
+		if errors.Is(err, e) {
+			return status, &errorBody{Code: code, Message: e.Error()}
+		}
+	}
+	var validationErrs db.ValidationErrors
+	if errors.As(err, &validationErrs) {
+		return http.StatusBadRequest, &errorBody{
+			Code:    CodeValidationFailed,
+			Message: "request contains invalid values",
+			Details: dataErrorDetails(validationErrs...),
+		}
+	}
+	if dataErr := db.AsDataError(err); dataErr != nil {
+		body := &errorBody{
+			Code:    CodeValidationFailed,
+			Message: "request contains invalid values",
+			Details: dataErrorDetails(dataErr),
+		}
+		if dataErr.Kind == db.DataDuplicate {
+			return http.StatusConflict, body
+		}
+		return http.StatusBadRequest, body
+	}
+	code, ok := statusCodes[status]
+	if !ok {
+		code = CodeInternal
+	}
+	return status, &errorBody{
+		Code:    code,
+		Message: strings.ToLower(http.StatusText(status)),
+	}
+}
+
+// dataErrorDetails describes invalid values of a request as error details.
+func dataErrorDetails(errs ...*db.DataError) []*openapi.ValidationError {
+	details := make([]*openapi.ValidationError, len(errs))
+	for i, err := range errs {
+		details[i] = &openapi.ValidationError{Message: err.Message}
+		if err.Field != "" {
+			details[i].Path = "/" + err.Field
+		}
+	}
+	return details
+}
+
+// writeError sends an error response describing err with status. The error
+// may be nil if the status alone describes the problem.
+func writeError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	status, body := newErrorBody(status, err)
+	body.RequestID = getRequestID(r)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	respData := struct {
+		Error *errorBody `json:"error"`
+	}{body}
+	if err := json.NewEncoder(w).Encode(&respData); err != nil {
+		logger(r).Error(err)
+	}
+}
+
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, nil)
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusMethodNotAllowed, nil)
+}
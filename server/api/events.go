@@ -0,0 +1,67 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// eventHeartbeatInterval is how often a comment is sent to keep an idle event
+// stream open. The session is also checked to still be valid at the same
+// interval.
+var eventHeartbeatInterval = 30 * time.Second
+
+// StreamEvents streams the changes to the purchases, products and tags of the
+// account as Server-Sent Events until the client disconnects or the session
+// ends.
+func (api *API) StreamEvents(w http.ResponseWriter, r *http.Request) {
+	if api.Changes == nil {
+		writeError(w, r, http.StatusNotFound, nil)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		logger(r).Error("response writer doesn't support flushing")
+		writeError(w, r, http.StatusInternalServerError, nil)
+		return
+	}
+	session := getSession(r)
+	events, cancel := api.Changes.Subscribe(session.AccountID)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := api.DB.ValidateSession(r.Context(), session.Token); err != nil {
+				logger(r).Error(err)
+				return
+			}
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case event, ok := <-events:
+			if !ok {
+				// The subscriber was dropped. The client reconnects and
+				// reloads its data.
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				logger(r).Error(err)
+				return
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Action, data)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,21 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/lassilaiho/expenditure-accounting/server/db"
+	"github.com/lassilaiho/expenditure-accounting/server/gql"
+)
+
+// GraphQL executes a GraphQL query posted as JSON with the fields query,
+// operationName and variables. Queries require the read scope and mutations
+// the purchases:write scope.
+func (api *API) GraphQL(w http.ResponseWriter, r *http.Request) {
+	session := getSession(r)
+	ctx := gql.WithViewer(r.Context(), &gql.Viewer{
+		AccountID: session.AccountID,
+		CanRead:   session.HasScope(db.ScopeRead),
+		CanWrite:  session.HasScope(db.ScopePurchasesWrite),
+	})
+	api.graphQL.ServeHTTP(w, r.WithContext(ctx))
+}
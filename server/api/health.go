@@ -0,0 +1,77 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/lassilaiho/expenditure-accounting/server/db"
+)
+
+// readinessTimeout limits the time spent checking the database in
+// GetReadiness.
+const readinessTimeout = 5 * time.Second
+
+var (
+	errDatabaseUnavailable   = errors.New("database is unavailable")
+	errSchemaVersionMismatch = errors.New("database schema version doesn't match the server")
+)
+
+// BuildInfo identifies the build of the server.
+type BuildInfo struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit"`
+}
+
+func writeStatus(w http.ResponseWriter, r *http.Request, status string) {
+	respData := struct {
+		Status string `json:"status"`
+	}{status}
+	if err := json.NewEncoder(w).Encode(&respData); err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+// GetHealth tells that the server is alive. It doesn't check the database.
+func (api *API) GetHealth(w http.ResponseWriter, r *http.Request) {
+	writeStatus(w, r, "ok")
+}
+
+// GetReadiness tells whether the database is reachable and has the schema
+// version of the server.
+func (api *API) GetReadiness(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+	if err := api.DB.DB.PingContext(ctx); err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusServiceUnavailable, errDatabaseUnavailable)
+		return
+	}
+	version, err := api.DB.GetSchemaVersion(ctx)
+	if err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusServiceUnavailable, errDatabaseUnavailable)
+		return
+	}
+	if version != db.SchemaVersion {
+		logger(r).WithField("schemaVersion", version).Error(errSchemaVersionMismatch)
+		writeError(w, r, http.StatusServiceUnavailable, errSchemaVersionMismatch)
+		return
+	}
+	writeStatus(w, r, "ready")
+}
+
+// GetVersion tells the build of the server and the schema version it expects.
+func (api *API) GetVersion(w http.ResponseWriter, r *http.Request) {
+	respData := struct {
+		BuildInfo
+		SchemaVersion int `json:"schemaVersion"`
+	}{api.Build, db.SchemaVersion}
+	if err := json.NewEncoder(w).Encode(&respData); err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+	}
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/lassilaiho/expenditure-accounting/server/db"
+	"github.com/lassilaiho/expenditure-accounting/server/recorder"
+)
+
+// IdempotencyKeyHeader carries a client generated key that makes retrying a
+// creating request safe.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// idempotent makes a handler honour the Idempotency-Key header. The response
+// to the first request with a key is stored, and retries with the same key
+// and request get the stored response without running the handler again.
+// Reusing a key for a different request is rejected.
+func (api *API) idempotent(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			h(w, r)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			logger(r).Warn(err)
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		hash := sha256.New()
+		hash.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+		hash.Write(body)
+		requestHash := hex.EncodeToString(hash.Sum(nil))
+
+		accountID := getSession(r).AccountID
+		stored, err := api.DB.BeginIdempotentRequest(
+			r.Context(), accountID, key, requestHash, api.IdempotencyWindow)
+		if err != nil {
+			switch err {
+			case db.ErrInvalidIdempotencyKey:
+				logger(r).Warn(err)
+				writeError(w, r, http.StatusBadRequest, err)
+			case db.ErrIdempotencyKeyReused:
+				logger(r).Warn(err)
+				writeError(w, r, http.StatusUnprocessableEntity, err)
+			case db.ErrIdempotencyKeyInProgress:
+				logger(r).Warn(err)
+				writeError(w, r, http.StatusConflict, err)
+			default:
+				logger(r).Error(err)
+				writeError(w, r, http.StatusInternalServerError, err)
+			}
+			return
+		}
+		if stored != nil {
+			if stored.ContentType != "" {
+				w.Header().Set("Content-Type", stored.ContentType)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.Status)
+			w.Write(stored.Body)
+			return
+		}
+
+		// The recorder may be shared with outer middlewares, so the body is
+		// captured only while h runs and then handed on to any outer capture.
+		rec := recorder.Wrap(w)
+		captured := &bytes.Buffer{}
+		outerBody := rec.Body
+		rec.Body = captured
+		h(rec, r)
+		rec.Body = outerBody
+		if outerBody != nil {
+			outerBody.Write(captured.Bytes())
+		}
+		// The outcome of the request may not be known for sure if the client
+		// went away, so the key is released or stored regardless.
+		ctx := context.Background()
+		if rec.Status() >= 500 {
+			err = api.DB.AbortIdempotentRequest(ctx, accountID, key)
+		} else {
+			err = api.DB.CompleteIdempotentRequest(ctx, accountID, key, &db.StoredResponse{
+				Status:      rec.Status(),
+				ContentType: w.Header().Get("Content-Type"),
+				Body:        captured.Bytes(),
+			})
+		}
+		if err != nil {
+			logger(r).Error(err)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/lassilaiho/expenditure-accounting/server/logging"
+	"github.com/lassilaiho/expenditure-accounting/server/recorder"
+	"github.com/sirupsen/logrus"
+)
+
+// logger returns the logger of a request. Entries logged with it carry the ID
+// of the request and, once authenticated, the account making it.
+func logger(r *http.Request) *logrus.Entry {
+	return logging.Logger(r.Context(), nil)
+}
+
+// baseLogger returns the logger requests are logged with.
+func (api *API) baseLogger() *logrus.Logger {
+	if api.Log == nil {
+		return logrus.StandardLogger()
+	}
+	return api.Log
+}
+
+// logRequests is a middleware giving each request a logger with the ID of the
+// request and writing an access log entry after the request has been handled.
+// Values of sensitive query parameters are redacted.
+func (api *API) logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entry := api.baseLogger().WithField("requestId", getRequestID(r))
+		ctx := logging.NewContext(r.Context(), entry)
+		rec := recorder.Wrap(w)
+		start := time.Now()
+		h.ServeHTTP(rec, r.WithContext(ctx))
+		fields := logrus.Fields{
+			"method":     r.Method,
+			"path":       r.URL.Path,
+			"status":     rec.Status(),
+			"size":       rec.Size(),
+			"duration":   time.Since(start).Seconds(),
+			"remoteAddr": api.clientIP(r),
+			"userAgent":  r.UserAgent(),
+		}
+		if r.URL.RawQuery != "" {
+			fields["query"] = logging.RedactQuery(r.URL.Query())
+		}
+		logging.Logger(ctx, nil).WithFields(fields).Info("request handled")
+	})
+}
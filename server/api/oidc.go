@@ -0,0 +1,276 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/coreos/go-oidc"
+	"github.com/lassilaiho/expenditure-accounting/server/db"
+	"golang.org/x/oauth2"
+)
+
+// OIDCConfig configures logging in through an OpenID Connect provider.
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the page of the client application the provider
+	// redirects the user to after authentication.
+	RedirectURL string
+	// Scopes are requested in addition to the openid scope.
+	Scopes []string
+	// AutoProvision creates accounts for users without an existing account.
+	AutoProvision bool
+}
+
+// OIDCProvider implements the authorization code flow with PKCE against an
+// OpenID Connect provider.
+type OIDCProvider struct {
+	issuer        string
+	oauth2        oauth2.Config
+	verifier      *oidc.IDTokenVerifier
+	autoProvision bool
+}
+
+// NewOIDCProvider fetches the discovery document of the provider configured
+// in config.
+func NewOIDCProvider(ctx context.Context, config *OIDCConfig) (*OIDCProvider, error) {
+	provider, err := oidc.NewProvider(ctx, config.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	return &OIDCProvider{
+		issuer: config.Issuer,
+		oauth2: oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			RedirectURL:  config.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       append([]string{oidc.ScopeOpenID}, config.Scopes...),
+		},
+		verifier:      provider.Verifier(&oidc.Config{ClientID: config.ClientID}),
+		autoProvision: config.AutoProvision,
+	}, nil
+}
+
+var (
+	errEmailNotVerified = errors.New("email address has not been verified by the identity provider")
+	errOIDCFailed       = errors.New("OpenID Connect authentication failed")
+	errOIDCDisabled     = errors.New("OpenID Connect login is not enabled")
+)
+
+// identity exchanges an authorization code for an ID token and returns the
+// identity of the user.
+func (p *OIDCProvider) identity(
+	ctx context.Context, code string, state *db.OIDCLoginState,
+) (*db.OIDCIdentity, error) {
+	token, err := p.oauth2.Exchange(
+		ctx, code, oauth2.SetAuthURLParam("code_verifier", state.CodeVerifier))
+	if err != nil {
+		return nil, err
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("token response has no ID token")
+	}
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+	if idToken.Nonce != state.Nonce {
+		return nil, errors.New("invalid ID token nonce")
+	}
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	if err = idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+	if !claims.EmailVerified {
+		return nil, errEmailNotVerified
+	}
+	return &db.OIDCIdentity{
+		Issuer:  idToken.Issuer,
+		Subject: idToken.Subject,
+		Email:   claims.Email,
+	}, nil
+}
+
+// BeginOIDCLogin returns the URL of the identity provider the client must
+// redirect the user to.
+func (api *API) BeginOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if api.OIDC == nil {
+		writeError(w, r, http.StatusNotFound, nil)
+		return
+	}
+	state, err := api.DB.BeginOIDCLogin(r.Context())
+	if err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	respData := struct {
+		URL string `json:"url"`
+	}{
+		api.OIDC.oauth2.AuthCodeURL(
+			state.State,
+			oidc.Nonce(state.Nonce),
+			oauth2.SetAuthURLParam("code_challenge", state.CodeChallenge()),
+			oauth2.SetAuthURLParam("code_challenge_method", "S256")),
+	}
+	if err = json.NewEncoder(w).Encode(&respData); err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+// CompleteOIDCLogin exchanges the code and state the identity provider
+// redirected the user back with for a session.
+func (api *API) CompleteOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if api.OIDC == nil {
+		writeError(w, r, http.StatusNotFound, nil)
+		return
+	}
+	var reqData struct {
+		State  string `json:"state"`
+		Code   string `json:"code"`
+		Cookie bool   `json:"cookie"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if reqData.Cookie && api.Cookies == nil {
+		writeError(w, r, http.StatusBadRequest, errCookiesDisabled)
+		return
+	}
+	if !api.checkLoginLimit(w, r) {
+		return
+	}
+	identity, ok := api.oidcIdentity(w, r, reqData.State, reqData.Code)
+	if !ok {
+		return
+	}
+	result, err := api.DB.OIDCLogin(
+		r.Context(), identity, api.OIDC.autoProvision, api.clientInfo(r))
+	if err != nil {
+		switch err {
+		case db.ErrOIDCAccountNotFound, db.ErrOIDCIdentityMismatch,
+			db.ErrAccountDisabled, db.ErrAccountLocked:
+			logger(r).Warn(err)
+			writeError(w, r, http.StatusForbidden, err)
+		case db.ErrInvalidEmail, db.ErrEmailTaken, db.ErrOIDCLinkRequired:
+			logger(r).Warn(err)
+			writeError(w, r, http.StatusConflict, err)
+		default:
+			logger(r).Error(err)
+			writeError(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	api.writeLoginResult(w, r, result, reqData.Cookie)
+}
+
+// oidcIdentity takes the login state of an OpenID Connect redirect and
+// exchanges the code of the redirect for the identity of the user. If the
+// identity can't be verified, an error response is written, the attempt is
+// counted as a failed login and false is returned.
+func (api *API) oidcIdentity(
+	w http.ResponseWriter, r *http.Request, stateToken, code string,
+) (*db.OIDCIdentity, bool) {
+	state, err := api.DB.TakeOIDCLoginState(r.Context(), stateToken)
+	if err != nil {
+		if err == db.ErrInvalidOIDCState {
+			api.loginFailed(r)
+			logger(r).Warn(err)
+			writeError(w, r, http.StatusUnauthorized, err)
+		} else {
+			logger(r).Error(err)
+			writeError(w, r, http.StatusInternalServerError, err)
+		}
+		return nil, false
+	}
+	identity, err := api.OIDC.identity(r.Context(), code, state)
+	if err != nil {
+		logger(r).Error(err)
+		api.loginFailed(r)
+		if err == errEmailNotVerified {
+			writeError(w, r, http.StatusForbidden, err)
+		} else {
+			writeError(w, r, http.StatusUnauthorized, errOIDCFailed)
+		}
+		return nil, false
+	}
+	return identity, true
+}
+
+// LinkOIDCIdentity links the identity the identity provider redirected the
+// user back with to the account of the session. The password of the account
+// must be given to confirm the link.
+func (api *API) LinkOIDCIdentity(w http.ResponseWriter, r *http.Request) {
+	if api.OIDC == nil {
+		writeError(w, r, http.StatusNotFound, nil)
+		return
+	}
+	var reqData struct {
+		State    string `json:"state"`
+		Code     string `json:"code"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	accountID := getSession(r).AccountID
+	err := api.DB.VerifyPassword(r.Context(), accountID, reqData.Password)
+	if err != nil {
+		if err == db.ErrInvalidEmailOrPassword {
+			logger(r).Warn(err)
+			writeError(w, r, http.StatusUnauthorized, err)
+		} else {
+			logger(r).Error(err)
+			writeError(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	identity, ok := api.oidcIdentity(w, r, reqData.State, reqData.Code)
+	if !ok {
+		return
+	}
+	err = api.DB.LinkOIDCIdentity(r.Context(), accountID, identity)
+	if err != nil {
+		if err == db.ErrOIDCIdentityMismatch || err == db.ErrOIDCIdentityTaken {
+			logger(r).Warn(err)
+			writeError(w, r, http.StatusConflict, err)
+		} else {
+			logger(r).Error(err)
+			writeError(w, r, http.StatusInternalServerError, err)
+		}
+	}
+}
+
+func (api *API) SetPasswordLogin(w http.ResponseWriter, r *http.Request) {
+	var reqData struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	err := api.DB.SetPasswordLogin(r.Context(), getSession(r).AccountID, reqData.Enabled)
+	if err != nil {
+		if err == db.ErrNoOIDCIdentity {
+			logger(r).Warn(err)
+			writeError(w, r, http.StatusConflict, err)
+		} else {
+			logger(r).Error(err)
+			writeError(w, r, http.StatusInternalServerError, err)
+		}
+	}
+}
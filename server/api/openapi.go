@@ -0,0 +1,83 @@
+package api
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/lassilaiho/expenditure-accounting/server/openapi"
+)
+
+var spec = openapi.MustParse(openAPISpec)
+
+// GetOpenAPI returns the OpenAPI document describing the API.
+func (api *API) GetOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := io.WriteString(w, openAPISpec); err != nil {
+		logger(r).Error(err)
+	}
+}
+
+// validateRequests is a middleware rejecting requests whose body doesn't match
+// the schema of the route in the OpenAPI document.
+func validateRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op := currentOperation(r)
+		if op == nil || op.JSONSchema() == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			logger(r).Warn(err)
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if errs := validateBody(op, body); len(errs) > 0 {
+			writeValidationErrors(w, r, errs)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// currentOperation returns the operation of the route matched by r or nil if
+// the route isn't documented.
+func currentOperation(r *http.Request) *openapi.Operation {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return nil
+	}
+	path, err := route.GetPathTemplate()
+	if err != nil {
+		return nil
+	}
+	return spec.Operation(r.Method, path)
+}
+
+func validateBody(op *openapi.Operation, body []byte) []*openapi.ValidationError {
+	if len(bytes.TrimSpace(body)) == 0 {
+		if op.RequestBody.Required {
+			return []*openapi.ValidationError{{Message: "request body is required"}}
+		}
+		return nil
+	}
+	value, err := openapi.DecodeJSON(body)
+	if err != nil {
+		return []*openapi.ValidationError{{Message: "invalid JSON: " + err.Error()}}
+	}
+	return spec.Validate(op.JSONSchema(), value)
+}
+
+func writeValidationErrors(
+	w http.ResponseWriter, r *http.Request, errs []*openapi.ValidationError,
+) {
+	writeError(w, r, http.StatusBadRequest, &apiError{
+		Code:    CodeValidationFailed,
+		Message: "request body does not match the schema",
+		Details: errs,
+	})
+}
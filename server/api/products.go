@@ -2,7 +2,6 @@ package api
 
 import (
 	"encoding/json"
-	"log"
 	"net/http"
 )
 
@@ -11,19 +10,19 @@ func (api *API) AddProduct(w http.ResponseWriter, r *http.Request) {
 		Name string `json:"name"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
-		log.Print(err)
-		w.WriteHeader(http.StatusBadRequest)
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusBadRequest, err)
 		return
 	}
 	product, err := api.DB.InsertProduct(r.Context(), getSession(r).AccountID, requestData.Name)
 	if err != nil {
-		log.Print(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 	if err = json.NewEncoder(w).Encode(product); err != nil {
-		log.Print(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 }
@@ -3,12 +3,13 @@ package api
 import (
 	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
 	"net/http"
 	"strconv"
 
 	"github.com/gorilla/mux"
 	"github.com/lassilaiho/expenditure-accounting/server/db"
+	"github.com/lassilaiho/expenditure-accounting/server/openapi"
 )
 
 func (api *API) GetPurchases(w http.ResponseWriter, r *http.Request) {
@@ -20,15 +21,15 @@ func (api *API) GetPurchases(w http.ResponseWriter, r *http.Request) {
 	respData.Purchases, err =
 		api.DB.GetPurchasesByAccount(r.Context(), session.AccountID)
 	if err != nil {
-		log.Print(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 	tagsByPurchase, err :=
 		api.DB.GetTagsByPurchaseForAccount(r.Context(), session.AccountID)
 	if err != nil {
-		log.Print(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 	for _, p := range respData.Purchases {
@@ -40,8 +41,8 @@ func (api *API) GetPurchases(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	if err = json.NewEncoder(w).Encode(&respData); err != nil {
-		log.Print(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 }
@@ -51,33 +52,70 @@ func (api *API) UpdatePurchase(w http.ResponseWriter, r *http.Request) {
 	idStr := vars["id"]
 	id, err := strconv.ParseInt(idStr, 10, 64)
 	if err != nil {
-		log.Print(err)
-		w.WriteHeader(http.StatusNotFound)
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusNotFound, err)
+		return
+	}
+	ifVersion, ok := ifMatchVersion(r)
+	if !ok {
+		writePreconditionFailed(w, r)
 		return
 	}
 	var values db.PurchaseUpdate
 	if err = json.NewDecoder(r.Body).Decode(&values); err != nil {
-		log.Print(err)
-		w.WriteHeader(http.StatusBadRequest)
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusBadRequest, err)
 		return
 	}
-	err = api.DB.UpdatePurchaseById(r.Context(), id, getSession(r).AccountID, &values)
+	version, err := api.DB.UpdatePurchaseById(
+		r.Context(), id, getSession(r).AccountID, ifVersion, &values)
+	if err != nil {
+		switch err {
+		case db.ErrNoRowsAffected:
+			writeError(w, r, http.StatusNotFound, err)
+		case db.ErrVersionMismatch:
+			writePreconditionFailed(w, r)
+		default:
+			logger(r).Error(err)
+			writeError(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	w.Header().Set("ETag", formatETag(version))
+}
+
+func (api *API) GetPurchase(w http.ResponseWriter, r *http.Request) {
+	purchaseID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusNotFound, err)
+		return
+	}
+	purchase, err := api.DB.GetPurchaseById(r.Context(), purchaseID, getSession(r).AccountID)
 	if err != nil {
 		if err == db.ErrNoRowsAffected {
-			w.WriteHeader(http.StatusNotFound)
+			writeError(w, r, http.StatusNotFound, err)
 		} else {
-			log.Print(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			logger(r).Error(err)
+			writeError(w, r, http.StatusInternalServerError, err)
 		}
 		return
 	}
+	w.Header().Set("ETag", formatETag(purchase.Version))
+	err = json.NewEncoder(w).Encode(struct {
+		Purchase *db.Purchase `json:"purchase"`
+	}{Purchase: purchase})
+	if err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+	}
 }
 
 func (api *API) AddPurchase(w http.ResponseWriter, r *http.Request) {
 	var values db.PurchaseUpdate
 	if err := json.NewDecoder(r.Body).Decode(&values); err != nil {
-		log.Print(err)
-		w.WriteHeader(http.StatusBadRequest)
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusBadRequest, err)
 		return
 	}
 	var err error
@@ -86,31 +124,40 @@ func (api *API) AddPurchase(w http.ResponseWriter, r *http.Request) {
 	}
 	respData.ID, err = api.DB.InsertPurchase(r.Context(), getSession(r).AccountID, &values)
 	if err != nil {
-		log.Print(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 	if err = json.NewEncoder(w).Encode(&respData); err != nil {
-		log.Print(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
 	}
 }
 
 func (api *API) DeletePurchase(w http.ResponseWriter, r *http.Request) {
 	purchaseID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
 	if err != nil {
-		log.Print(err)
-		w.WriteHeader(http.StatusNotFound)
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusNotFound, err)
+		return
+	}
+	ifVersion, ok := ifMatchVersion(r)
+	if !ok {
+		writePreconditionFailed(w, r)
 		return
 	}
-	err = api.DB.DeletePurchaseById(r.Context(), purchaseID, getSession(r).AccountID)
+	err = api.DB.DeletePurchaseById(r.Context(), purchaseID, getSession(r).AccountID, ifVersion)
 	if err != nil {
-		if err == db.ErrNoRowsAffected {
-			w.WriteHeader(http.StatusNotFound)
-		} else {
-			log.Print(err)
-			w.WriteHeader(http.StatusInternalServerError)
+		switch err {
+		case db.ErrNoRowsAffected:
+			writeError(w, r, http.StatusNotFound, err)
+		case db.ErrVersionMismatch:
+			writePreconditionFailed(w, r)
+		default:
+			logger(r).Error(err)
+			writeError(w, r, http.StatusInternalServerError, err)
 		}
+		return
 	}
 	w.WriteHeader(http.StatusOK)
 }
@@ -118,26 +165,103 @@ func (api *API) DeletePurchase(w http.ResponseWriter, r *http.Request) {
 func (api *API) RestorePurchase(w http.ResponseWriter, r *http.Request) {
 	purchaseID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
 	if err != nil {
-		log.Print(err)
-		w.WriteHeader(http.StatusNotFound)
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusNotFound, err)
+		return
+	}
+	ifVersion, ok := ifMatchVersion(r)
+	if !ok {
+		writePreconditionFailed(w, r)
 		return
 	}
 	purchase, err := api.DB.RestorePurchaseById(
-		r.Context(), purchaseID, getSession(r).AccountID)
+		r.Context(), purchaseID, getSession(r).AccountID, ifVersion)
 	if err != nil {
 		if errors.Is(err, db.ErrNoRowsAffected) {
-			w.WriteHeader(http.StatusNotFound)
+			writeError(w, r, http.StatusNotFound, err)
+		} else if err == db.ErrVersionMismatch {
+			writePreconditionFailed(w, r)
 		} else {
-			log.Print(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			logger(r).Error(err)
+			writeError(w, r, http.StatusInternalServerError, err)
 		}
 		return
 	}
+	w.Header().Set("ETag", formatETag(purchase.Version))
 	err = json.NewEncoder(w).Encode(struct {
 		Purchase *db.Purchase `json:"purchase"`
 	}{Purchase: purchase})
 	if err != nil {
-		log.Print(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+// ExecutePurchaseBatch executes a list of operations on purchases atomically.
+// If an operation fails, nothing is changed and the response identifies the
+// failed operation.
+func (api *API) ExecutePurchaseBatch(w http.ResponseWriter, r *http.Request) {
+	var reqData struct {
+		Operations []*db.BatchOperation `json:"operations"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	results, err := api.DB.ExecutePurchaseBatch(
+		r.Context(), getSession(r).AccountID, reqData.Operations)
+	var batchErr *db.BatchError
+	if errors.As(err, &batchErr) {
+		logger(r).Error(err)
+		status := http.StatusInternalServerError
+		switch batchErr.Err {
+		case db.ErrNoRowsAffected:
+			status = http.StatusNotFound
+		case db.ErrVersionMismatch:
+			status = http.StatusPreconditionFailed
+		case db.ErrInvalidBatchOperation:
+			status = http.StatusBadRequest
+		}
+		status, body := newErrorBody(status, batchErr.Err)
+		opPath := fmt.Sprintf("/operations/%d", batchErr.Index)
+		if len(body.Details) > 0 {
+			// Invalid values are identified relative to the operation.
+			if reqData.Operations[batchErr.Index].Values != nil {
+				opPath += "/values"
+			}
+			for _, detail := range body.Details {
+				detail.Path = opPath + detail.Path
+			}
+		} else {
+			detail := &openapi.ValidationError{Path: opPath, Message: body.Message}
+			if status != http.StatusInternalServerError {
+				detail.Message = batchErr.Err.Error()
+			}
+			body.Details = []*openapi.ValidationError{detail}
+		}
+		writeError(w, r, status, &apiError{
+			Code:    body.Code,
+			Message: body.Message,
+			Details: body.Details,
+		})
+		return
+	}
+	if err != nil {
+		if err == db.ErrTooManyOperations {
+			logger(r).Warn(err)
+			writeError(w, r, http.StatusRequestEntityTooLarge, err)
+		} else {
+			logger(r).Error(err)
+			writeError(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	respData := struct {
+		Results []*db.BatchResult `json:"results"`
+	}{results}
+	if err = json.NewEncoder(w).Encode(&respData); err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
 	}
 }
@@ -0,0 +1,128 @@
+package api
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lassilaiho/expenditure-accounting/server/metrics"
+)
+
+// loginFailureWindow is how long failed logins from a client are remembered
+// after the latest failure.
+const loginFailureWindow = 15 * time.Minute
+
+// LoginLimiter throttles login attempts per client IP address. After
+// MaxFailures failed attempts, the client must wait before trying again. The
+// wait starts at BaseDelay and doubles with every further failure up to
+// MaxDelay.
+type LoginLimiter struct {
+	MaxFailures int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]*loginLimiterEntry
+	lastSweep time.Time
+}
+
+type loginLimiterEntry struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+// Allow reports whether a login attempt from the client identified by key is
+// allowed. If not, the time to wait before the next attempt is returned.
+func (l *LoginLimiter) Allow(key string) (time.Duration, bool) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	entry, ok := l.entries[key]
+	if !ok || !now.Before(entry.blockedUntil) {
+		return 0, true
+	}
+	return entry.blockedUntil.Sub(now), false
+}
+
+// Fail records a failed login attempt from the client identified by key.
+func (l *LoginLimiter) Fail(key string) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.entries == nil {
+		l.entries = map[string]*loginLimiterEntry{}
+	}
+	entry, ok := l.entries[key]
+	if !ok {
+		entry = &loginLimiterEntry{}
+		l.entries[key] = entry
+	}
+	entry.failures++
+	entry.lastFailure = now
+	if entry.failures >= l.MaxFailures {
+		entry.blockedUntil = now.Add(l.delay(entry.failures))
+	}
+}
+
+func (l *LoginLimiter) delay(failures int) time.Duration {
+	exp := failures - l.MaxFailures
+	if exp > 30 {
+		exp = 30
+	}
+	d := time.Duration(float64(l.BaseDelay) * math.Pow(2, float64(exp)))
+	if d > l.MaxDelay || d <= 0 {
+		d = l.MaxDelay
+	}
+	return d
+}
+
+// sweep removes entries of clients that haven't failed recently so that the
+// memory used by the limiter stays bounded.
+func (l *LoginLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < loginFailureWindow {
+		return
+	}
+	l.lastSweep = now
+	for key, entry := range l.entries {
+		if now.Sub(entry.lastFailure) > loginFailureWindow && now.After(entry.blockedUntil) {
+			delete(l.entries, key)
+		}
+	}
+}
+
+// checkLoginLimit writes a 429 response and returns false if the client
+// making the request has to wait before attempting to log in again.
+func (api *API) checkLoginLimit(w http.ResponseWriter, r *http.Request) bool {
+	if api.LoginLimiter == nil {
+		return true
+	}
+	wait, ok := api.LoginLimiter.Allow(api.clientIP(r))
+	if ok {
+		return true
+	}
+	writeTooManyRequests(w, r, wait)
+	return false
+}
+
+func (api *API) loginFailed(r *http.Request) {
+	metrics.LoginFailed()
+	if api.LoginLimiter != nil {
+		api.LoginLimiter.Fail(api.clientIP(r))
+	}
+}
+
+var errTooManyLoginAttempts = errors.New("too many login attempts")
+
+func writeTooManyRequests(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	seconds := int64(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	writeError(w, r, http.StatusTooManyRequests, errTooManyLoginAttempts)
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/lassilaiho/expenditure-accounting/server/db"
+)
+
+type sessionInfo struct {
+	*db.Session
+	Current bool `json:"current"`
+}
+
+func (api *API) GetSessions(w http.ResponseWriter, r *http.Request) {
+	current := getSession(r)
+	sessions, err := api.DB.GetSessionsForAccount(r.Context(), current.AccountID)
+	if err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	var respData struct {
+		Sessions []sessionInfo `json:"sessions"`
+	}
+	respData.Sessions = make([]sessionInfo, len(sessions))
+	for i, s := range sessions {
+		respData.Sessions[i] = sessionInfo{Session: s, Current: s.ID == current.ID}
+	}
+	if err = json.NewEncoder(w).Encode(&respData); err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+func (api *API) DeleteOtherSessions(w http.ResponseWriter, r *http.Request) {
+	session := getSession(r)
+	err := api.DB.DeleteOtherSessions(r.Context(), session.AccountID, session.ID)
+	if err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+func (api *API) RenameSession(w http.ResponseWriter, r *http.Request) {
+	sessionID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusNotFound, err)
+		return
+	}
+	var reqData struct {
+		Name string `json:"name"`
+	}
+	if err = json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	err = api.DB.RenameSession(
+		r.Context(), sessionID, getSession(r).AccountID, reqData.Name)
+	if err != nil {
+		if err == db.ErrNoRowsAffected {
+			writeError(w, r, http.StatusNotFound, err)
+		} else {
+			logger(r).Error(err)
+			writeError(w, r, http.StatusInternalServerError, err)
+		}
+	}
+}
+
+func (api *API) DeleteSession(w http.ResponseWriter, r *http.Request) {
+	sessionID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusNotFound, err)
+		return
+	}
+	err = api.DB.DeleteSessionForAccount(r.Context(), sessionID, getSession(r).AccountID)
+	if err != nil {
+		if err == db.ErrNoRowsAffected {
+			writeError(w, r, http.StatusNotFound, err)
+		} else {
+			logger(r).Error(err)
+			writeError(w, r, http.StatusInternalServerError, err)
+		}
+	}
+}
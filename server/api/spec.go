@@ -0,0 +1,1411 @@
+package api
+
+// openAPISpec is the OpenAPI 3 document describing the REST API. Request
+// bodies are validated against the schemas in it, so every route added to
+// NewHandler must be documented here.
+const openAPISpec = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "Expenditure accounting API",
+    "version": "1"
+  },
+  "security": [
+    {"bearerAuth": []},
+    {"basicAuth": []},
+    {"cookieAuth": []}
+  ],
+  "paths": {
+    "/openapi.json": {
+      "get": {
+        "operationId": "getOpenAPI",
+        "summary": "Returns this document.",
+        "security": [],
+        "responses": {
+          "200": {"description": "The OpenAPI document.", "content": {"application/json": {}}}
+        }
+      }
+    },
+    "/healthz": {
+      "get": {
+        "operationId": "getHealth",
+        "summary": "Tells that the server is running.",
+        "security": [],
+        "responses": {
+          "200": {"description": "The server is running.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Health"}}}}
+        }
+      }
+    },
+    "/readyz": {
+      "get": {
+        "operationId": "getReadiness",
+        "summary": "Tells whether the server can handle requests.",
+        "description": "The server is ready if the database is reachable and migrated to the schema version of the server.",
+        "security": [],
+        "responses": {
+          "200": {"description": "The server is ready.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Health"}}}},
+          "503": {"description": "The database is unreachable or has a different schema version.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+        }
+      }
+    },
+    "/version": {
+      "get": {
+        "operationId": "getVersion",
+        "summary": "Returns the version of the server.",
+        "security": [],
+        "responses": {
+          "200": {"description": "The version.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Version"}}}}
+        }
+      }
+    },
+    "/login": {
+      "post": {
+        "operationId": "login",
+        "summary": "Logs in with an email address and a password.",
+        "security": [],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/LoginRequest"}}}},
+        "responses": {
+          "200": {
+            "description": "A new session or a two-factor challenge.",
+            "content": {"application/json": {"schema": {"oneOf": [
+              {"$ref": "#/components/schemas/NewSession"},
+              {"$ref": "#/components/schemas/LoginChallenge"}
+            ]}}}
+          },
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"description": "Invalid email or password.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+          "403": {"description": "The account is disabled or password login is disabled.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+          "429": {"description": "Too many failed login attempts.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+        }
+      }
+    },
+    "/login/2fa": {
+      "post": {
+        "operationId": "completeLogin",
+        "summary": "Completes a login with a TOTP code or a recovery code.",
+        "security": [],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CompleteLoginRequest"}}}},
+        "responses": {
+          "200": {"description": "A new session.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/NewSession"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"description": "Invalid challenge or code.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+        }
+      }
+    },
+    "/login/oidc": {
+      "post": {
+        "operationId": "beginOIDCLogin",
+        "summary": "Returns the URL of the OpenID Connect provider to redirect the user to.",
+        "security": [],
+        "responses": {
+          "200": {"description": "The authorization URL.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/OIDCLogin"}}}},
+          "404": {"description": "OpenID Connect login is not enabled.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+        }
+      }
+    },
+    "/login/oidc/callback": {
+      "post": {
+        "operationId": "completeOIDCLogin",
+        "summary": "Completes an OpenID Connect login with the parameters of the redirect.",
+        "security": [],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/OIDCCallbackRequest"}}}},
+        "responses": {
+          "200": {
+            "description": "A new session or a two-factor challenge.",
+            "content": {"application/json": {"schema": {"oneOf": [
+              {"$ref": "#/components/schemas/NewSession"},
+              {"$ref": "#/components/schemas/LoginChallenge"}
+            ]}}}
+          },
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"description": "The login could not be verified.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+          "403": {"description": "No account is linked to the identity or the account is disabled or locked.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+          "404": {"description": "OpenID Connect login is not enabled.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+          "409": {"description": "The account with the email address of the identity must be linked while logged in or a new account could not be created for the identity.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+        }
+      }
+    },
+    "/accounts": {
+      "post": {
+        "operationId": "register",
+        "summary": "Registers a new account.",
+        "description": "Idempotency keys aren't supported, because they are scoped to the account making the request. A retried registration fails with email_taken.",
+        "security": [],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/RegisterRequest"}}}},
+        "responses": {
+          "200": {"description": "The new account.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CreatedID"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "403": {"description": "Registration is disabled or the invite code is invalid.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+          "409": {"description": "The email address is taken.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+        }
+      }
+    },
+    "/logout": {
+      "post": {
+        "operationId": "logout",
+        "summary": "Ends the current session.",
+        "responses": {
+          "200": {"description": "Logged out."},
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      }
+    },
+    "/account": {
+      "delete": {
+        "operationId": "deleteAccount",
+        "summary": "Deletes the account and all of its data.",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ReauthenticateRequest"}}}},
+        "responses": {
+          "200": {"description": "The account was deleted."},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      }
+    },
+    "/account/password": {
+      "post": {
+        "operationId": "changePassword",
+        "summary": "Changes the password and ends the other sessions of the account.",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ChangePasswordRequest"}}}},
+        "responses": {
+          "200": {"description": "The password was changed."},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      }
+    },
+    "/account/password-login": {
+      "put": {
+        "operationId": "setPasswordLogin",
+        "summary": "Enables or disables logging in with the password.",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/PasswordLoginRequest"}}}},
+        "responses": {
+          "200": {"description": "The setting was changed."},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "409": {"description": "The account has no other way to log in.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+        }
+      }
+    },
+    "/account/oidc": {
+      "post": {
+        "operationId": "linkOIDCIdentity",
+        "summary": "Links the account to an OpenID Connect identity with the parameters of the redirect.",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/LinkOIDCIdentityRequest"}}}},
+        "responses": {
+          "200": {"description": "The identity was linked."},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"description": "The password is incorrect or the login could not be verified.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+          "403": {"description": "The identity provider has not verified the email address.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+          "404": {"description": "OpenID Connect login is not enabled.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+          "409": {"description": "The account or the identity is already linked.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+        }
+      }
+    },
+    "/account/2fa": {
+      "get": {
+        "operationId": "getTwoFactorStatus",
+        "summary": "Returns the two-factor authentication status of the account.",
+        "responses": {
+          "200": {"description": "The status.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TwoFactorStatus"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      },
+      "delete": {
+        "operationId": "disableTwoFactor",
+        "summary": "Disables two-factor authentication.",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ReauthenticateRequest"}}}},
+        "responses": {
+          "200": {"description": "Two-factor authentication was disabled."},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      }
+    },
+    "/account/2fa/totp": {
+      "post": {
+        "operationId": "beginTOTPEnrollment",
+        "summary": "Generates a TOTP secret to be confirmed with a code.",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ReauthenticateRequest"}}}},
+        "responses": {
+          "200": {"description": "The secret.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TOTPEnrollment"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "409": {"description": "Two-factor authentication is already enabled.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+        }
+      }
+    },
+    "/account/2fa/totp/confirm": {
+      "post": {
+        "operationId": "confirmTOTPEnrollment",
+        "summary": "Enables two-factor authentication after checking a code generated with the new secret.",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CodeRequest"}}}},
+        "responses": {
+          "200": {"description": "The recovery codes of the account.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/RecoveryCodes"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      }
+    },
+    "/account/2fa/recovery-codes": {
+      "post": {
+        "operationId": "regenerateRecoveryCodes",
+        "summary": "Replaces the recovery codes of the account.",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ReauthenticateRequest"}}}},
+        "responses": {
+          "200": {"description": "The new recovery codes.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/RecoveryCodes"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      }
+    },
+    "/account/login-events": {
+      "get": {
+        "operationId": "getLoginEvents",
+        "summary": "Returns the recent login attempts of the account.",
+        "responses": {
+          "200": {"description": "The login attempts.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/LoginEvents"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      }
+    },
+    "/account/sessions": {
+      "get": {
+        "operationId": "getSessions",
+        "summary": "Returns the active sessions of the account.",
+        "responses": {
+          "200": {"description": "The sessions.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Sessions"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      },
+      "delete": {
+        "operationId": "deleteOtherSessions",
+        "summary": "Ends all sessions of the account except the current one.",
+        "responses": {
+          "200": {"description": "The sessions were ended."},
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      }
+    },
+    "/account/sessions/{id}": {
+      "patch": {
+        "operationId": "renameSession",
+        "summary": "Renames a session.",
+        "parameters": [{"$ref": "#/components/parameters/ID"}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/RenameSessionRequest"}}}},
+        "responses": {
+          "200": {"description": "The session was renamed."},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      },
+      "delete": {
+        "operationId": "deleteSession",
+        "summary": "Ends a session.",
+        "parameters": [{"$ref": "#/components/parameters/ID"}],
+        "responses": {
+          "200": {"description": "The session was ended."},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/account/tokens": {
+      "get": {
+        "operationId": "getAPITokens",
+        "summary": "Returns the API tokens of the account.",
+        "responses": {
+          "200": {"description": "The tokens without their secrets.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/APITokens"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      },
+      "post": {
+        "operationId": "createAPIToken",
+        "summary": "Creates an API token. The token is only returned in this response.",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CreateAPITokenRequest"}}}},
+        "responses": {
+          "200": {"description": "The new token.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/APIToken"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      }
+    },
+    "/account/tokens/{id}": {
+      "delete": {
+        "operationId": "deleteAPIToken",
+        "summary": "Revokes an API token.",
+        "parameters": [{"$ref": "#/components/parameters/ID"}],
+        "responses": {
+          "200": {"description": "The token was revoked."},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/products": {
+      "post": {
+        "operationId": "addProduct",
+        "summary": "Creates a product.",
+        "parameters": [{"$ref": "#/components/parameters/IdempotencyKey"}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/AddProductRequest"}}}},
+        "responses": {
+          "200": {"description": "The new product.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Product"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      }
+    },
+    "/purchases": {
+      "get": {
+        "operationId": "getPurchases",
+        "summary": "Returns all purchases of the account.",
+        "responses": {
+          "200": {"description": "The purchases.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Purchases"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      },
+      "post": {
+        "operationId": "addPurchase",
+        "summary": "Creates a purchase.",
+        "parameters": [{"$ref": "#/components/parameters/IdempotencyKey"}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/PurchaseUpdate"}}}},
+        "responses": {
+          "200": {"description": "The new purchase.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CreatedID"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      }
+    },
+    "/purchases/batch": {
+      "post": {
+        "operationId": "executePurchaseBatch",
+        "summary": "Executes a list of operations on purchases atomically.",
+        "parameters": [{"$ref": "#/components/parameters/IdempotencyKey"}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/BatchRequest"}}}},
+        "responses": {
+          "200": {"description": "The results of the operations.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/BatchResults"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"description": "An operation referenced a missing purchase.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+          "412": {"description": "An operation failed a version check.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+        }
+      }
+    },
+    "/purchases/{id}": {
+      "get": {
+        "operationId": "getPurchase",
+        "summary": "Returns a purchase. The ETag header holds its version.",
+        "parameters": [{"$ref": "#/components/parameters/ID"}],
+        "responses": {
+          "200": {"description": "The purchase.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/PurchaseResponse"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      },
+      "patch": {
+        "operationId": "updatePurchase",
+        "summary": "Changes the fields of a purchase given in the request.",
+        "parameters": [{"$ref": "#/components/parameters/ID"}, {"$ref": "#/components/parameters/IfMatch"}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/PurchaseUpdate"}}}},
+        "responses": {
+          "200": {"description": "The purchase was changed. The ETag header holds its new version."},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "412": {"$ref": "#/components/responses/PreconditionFailed"}
+        }
+      },
+      "delete": {
+        "operationId": "deletePurchase",
+        "summary": "Moves a purchase to the trash.",
+        "parameters": [{"$ref": "#/components/parameters/ID"}, {"$ref": "#/components/parameters/IfMatch"}],
+        "responses": {
+          "200": {"description": "The purchase was deleted."},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "412": {"$ref": "#/components/responses/PreconditionFailed"}
+        }
+      }
+    },
+    "/purchases/{id}/restore": {
+      "post": {
+        "operationId": "restorePurchase",
+        "summary": "Restores a deleted purchase.",
+        "parameters": [{"$ref": "#/components/parameters/ID"}, {"$ref": "#/components/parameters/IfMatch"}],
+        "responses": {
+          "200": {"description": "The purchase was restored. The ETag header holds its new version."},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "412": {"$ref": "#/components/responses/PreconditionFailed"}
+        }
+      }
+    },
+    "/purchases/{id}/history": {
+      "get": {
+        "operationId": "getPurchaseHistory",
+        "summary": "Returns the audit log entries of a purchase.",
+        "parameters": [{"$ref": "#/components/parameters/ID"}],
+        "responses": {
+          "200": {"description": "The changes, newest first.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/AuditLog"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/tags": {
+      "post": {
+        "operationId": "addTags",
+        "summary": "Creates tags.",
+        "parameters": [{"$ref": "#/components/parameters/IdempotencyKey"}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/AddTagsRequest"}}}},
+        "responses": {
+          "200": {"description": "The new tags.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Tags"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      }
+    },
+    "/sync": {
+      "get": {
+        "operationId": "getChanges",
+        "summary": "Returns the entities changed since a sync cursor.",
+        "parameters": [
+          {"name": "since", "in": "query", "schema": {"type": "integer", "format": "int64", "minimum": 0}}
+        ],
+        "responses": {
+          "200": {"description": "The changes.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/SyncChanges"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      },
+      "post": {
+        "operationId": "pushChanges",
+        "summary": "Applies changes made by a client while offline.",
+        "parameters": [{"$ref": "#/components/parameters/IdempotencyKey"}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/PushRequest"}}}},
+        "responses": {
+          "200": {"description": "The applied changes and conflicts.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/PushResult"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      }
+    },
+    "/graphql": {
+      "post": {
+        "operationId": "graphQL",
+        "summary": "Executes a GraphQL query.",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/GraphQLRequest"}}}},
+        "responses": {
+          "200": {"description": "The result of the query.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/GraphQLResponse"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      }
+    },
+    "/events": {
+      "get": {
+        "operationId": "streamEvents",
+        "summary": "Streams changes to the data of the account as server-sent events.",
+        "responses": {
+          "200": {"description": "A stream of change events.", "content": {"text/event-stream": {"schema": {"$ref": "#/components/schemas/ChangeEvent"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"description": "Live updates are not enabled.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+        }
+      }
+    },
+    "/trash": {
+      "get": {
+        "operationId": "getTrash",
+        "summary": "Returns the deleted entities of the account.",
+        "responses": {
+          "200": {"description": "The trash.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Trash"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      }
+    },
+    "/trash/restore": {
+      "post": {
+        "operationId": "restoreFromTrash",
+        "summary": "Restores deleted entities.",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TrashItems"}}}},
+        "responses": {
+          "200": {"description": "The entities were restored."},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/trash/purge": {
+      "post": {
+        "operationId": "purgeFromTrash",
+        "summary": "Permanently deletes entities from the trash.",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TrashItems"}}}},
+        "responses": {
+          "200": {"description": "The number of purged entities.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Count"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      }
+    },
+    "/webhooks": {
+      "get": {
+        "operationId": "getWebhooks",
+        "summary": "Returns the webhooks of the account and the events they can subscribe to.",
+        "responses": {
+          "200": {"description": "The webhooks.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Webhooks"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      },
+      "post": {
+        "operationId": "createWebhook",
+        "summary": "Creates a webhook. The signing secret is only returned in this response.",
+        "parameters": [{"$ref": "#/components/parameters/IdempotencyKey"}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CreateWebhookRequest"}}}},
+        "responses": {
+          "200": {"description": "The new webhook.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Webhook"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      }
+    },
+    "/webhooks/{id}": {
+      "patch": {
+        "operationId": "updateWebhook",
+        "summary": "Changes the fields of a webhook given in the request.",
+        "parameters": [{"$ref": "#/components/parameters/ID"}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/WebhookUpdate"}}}},
+        "responses": {
+          "200": {"description": "The changed webhook.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Webhook"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      },
+      "delete": {
+        "operationId": "deleteWebhook",
+        "summary": "Deletes a webhook and its deliveries.",
+        "parameters": [{"$ref": "#/components/parameters/ID"}],
+        "responses": {
+          "200": {"description": "The webhook was deleted."},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/webhooks/{id}/deliveries": {
+      "get": {
+        "operationId": "getWebhookDeliveries",
+        "summary": "Returns the recent deliveries of a webhook, newest first.",
+        "parameters": [
+          {"$ref": "#/components/parameters/ID"},
+          {"name": "limit", "in": "query", "schema": {"type": "integer", "minimum": 1, "maximum": 500}}
+        ],
+        "responses": {
+          "200": {"description": "The deliveries.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/WebhookDeliveries"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/webhooks/{id}/ping": {
+      "post": {
+        "operationId": "pingWebhook",
+        "summary": "Sends a ping event to a webhook immediately.",
+        "parameters": [{"$ref": "#/components/parameters/ID"}],
+        "responses": {
+          "200": {"description": "The ping delivery.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/WebhookDelivery"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/undo": {
+      "post": {
+        "operationId": "undo",
+        "summary": "Undoes the latest operations of the current session.",
+        "requestBody": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/UndoRequest"}}}},
+        "responses": {
+          "200": {"description": "The number of undone operations.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Count"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "409": {"description": "The data has been changed since the operation.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+        }
+      }
+    },
+    "/redo": {
+      "post": {
+        "operationId": "redo",
+        "summary": "Redoes the latest undone operations of the current session.",
+        "requestBody": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/UndoRequest"}}}},
+        "responses": {
+          "200": {"description": "The number of redone operations.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Count"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "409": {"description": "The data has been changed since the operation.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+        }
+      }
+    },
+    "/audit-log": {
+      "get": {
+        "operationId": "getAuditLog",
+        "summary": "Returns the changes made to the data of the account, newest first.",
+        "parameters": [
+          {"name": "entity", "in": "query", "schema": {"type": "string", "enum": ["purchase", "product", "tag"]}},
+          {"name": "from", "in": "query", "schema": {"type": "string", "format": "date-time"}},
+          {"name": "to", "in": "query", "schema": {"type": "string", "format": "date-time"}},
+          {"name": "limit", "in": "query", "schema": {"type": "integer", "minimum": 1}}
+        ],
+        "responses": {
+          "200": {"description": "The changes.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/AuditLog"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      }
+    },
+    "/admin/accounts": {
+      "get": {
+        "operationId": "getAccounts",
+        "summary": "Returns all accounts.",
+        "responses": {
+          "200": {"description": "The accounts.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Accounts"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"}
+        }
+      },
+      "post": {
+        "operationId": "createAccount",
+        "summary": "Creates an account.",
+        "parameters": [{"$ref": "#/components/parameters/IdempotencyKey"}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CreateAccountRequest"}}}},
+        "responses": {
+          "200": {"description": "The new account.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CreatedID"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "409": {"description": "The email address is taken.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+        }
+      }
+    },
+    "/admin/accounts/{id}": {
+      "patch": {
+        "operationId": "updateAccount",
+        "summary": "Changes the role of an account or disables it. Disabling an account ends its sessions and revokes its API tokens.",
+        "parameters": [{"$ref": "#/components/parameters/ID"}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/AccountUpdate"}}}},
+        "responses": {
+          "200": {"description": "The account was changed."},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      },
+      "delete": {
+        "operationId": "adminDeleteAccount",
+        "summary": "Deletes an account and all of its data.",
+        "parameters": [{"$ref": "#/components/parameters/ID"}],
+        "responses": {
+          "200": {"description": "The account was deleted."},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/admin/accounts/{id}/password": {
+      "post": {
+        "operationId": "resetPassword",
+        "summary": "Sets a new password for an account, ends its sessions and revokes its API tokens.",
+        "parameters": [{"$ref": "#/components/parameters/ID"}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/PasswordRequest"}}}},
+        "responses": {
+          "200": {"description": "The password was reset."},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/admin/accounts/{id}/logout": {
+      "post": {
+        "operationId": "forceLogout",
+        "summary": "Ends all sessions of an account and revokes its API tokens.",
+        "parameters": [{"$ref": "#/components/parameters/ID"}],
+        "responses": {
+          "200": {"description": "The sessions were ended."},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/admin/stats": {
+      "get": {
+        "operationId": "getUsageStats",
+        "summary": "Returns statistics about the use of the service.",
+        "responses": {
+          "200": {"description": "The statistics.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/UsageStats"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "bearerAuth": {"type": "http", "scheme": "bearer"},
+      "basicAuth": {"type": "http", "scheme": "basic", "description": "Deprecated. The session token encoded in base64 as the whole credentials."},
+      "cookieAuth": {"type": "apiKey", "in": "cookie", "name": "session", "description": "The cookie name is configurable. Requires the X-CSRF-Token header on unsafe requests."}
+    },
+    "parameters": {
+      "ID": {"name": "id", "in": "path", "required": true, "schema": {"type": "integer", "format": "int64"}},
+      "IdempotencyKey": {"name": "Idempotency-Key", "in": "header", "schema": {"type": "string", "maxLength": 255}},
+      "IfMatch": {"name": "If-Match", "in": "header", "description": "An ETag of the purchase.", "schema": {"type": "string"}}
+    },
+    "responses": {
+      "BadRequest": {"description": "The request is invalid.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+      "Unauthorized": {"description": "The session is missing or invalid.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+      "Forbidden": {"description": "The session lacks the required permissions.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+      "NotFound": {"description": "The resource doesn't exist.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+      "PreconditionFailed": {"description": "The If-Match header doesn't match the current version.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+    },
+    "schemas": {
+      "Error": {
+        "type": "object",
+        "properties": {
+          "error": {
+            "type": "object",
+            "properties": {
+              "code": {"type": "string", "description": "A machine-readable code identifying the error."},
+              "message": {"type": "string"},
+              "details": {"type": "array", "items": {"$ref": "#/components/schemas/ValidationError"}},
+              "requestId": {"type": "string", "description": "The ID of the request, also returned in the X-Request-ID header."}
+            }
+          }
+        }
+      },
+      "ValidationError": {
+        "type": "object",
+        "properties": {
+          "path": {"type": "string", "description": "A JSON pointer to the invalid value."},
+          "message": {"type": "string"}
+        }
+      },
+      "Decimal": {
+        "description": "A decimal number such as \"2.50\" given as a string or a number. Responses always use strings.",
+        "oneOf": [{"type": "string", "format": "decimal"}, {"type": "number"}]
+      },
+      "CreatedID": {
+        "type": "object",
+        "properties": {"id": {"type": "integer", "format": "int64"}}
+      },
+      "Count": {
+        "type": "object",
+        "properties": {"count": {"type": "integer"}}
+      },
+      "LoginRequest": {
+        "type": "object",
+        "required": ["email", "password"],
+        "properties": {
+          "email": {"type": "string"},
+          "password": {"type": "string"},
+          "cookie": {"type": "boolean", "description": "Sets the session in a cookie instead of returning the token."}
+        }
+      },
+      "CompleteLoginRequest": {
+        "type": "object",
+        "required": ["challenge"],
+        "properties": {
+          "challenge": {"type": "string"},
+          "code": {"type": "string"},
+          "recoveryCode": {"type": "string"},
+          "cookie": {"type": "boolean"}
+        }
+      },
+      "OIDCLogin": {
+        "type": "object",
+        "properties": {"url": {"type": "string"}}
+      },
+      "OIDCCallbackRequest": {
+        "type": "object",
+        "required": ["state", "code"],
+        "properties": {
+          "state": {"type": "string"},
+          "code": {"type": "string"},
+          "cookie": {"type": "boolean"}
+        }
+      },
+      "LinkOIDCIdentityRequest": {
+        "type": "object",
+        "required": ["state", "code", "password"],
+        "properties": {
+          "state": {"type": "string"},
+          "code": {"type": "string"},
+          "password": {"type": "string"}
+        }
+      },
+      "Health": {
+        "type": "object",
+        "properties": {
+          "status": {"type": "string", "enum": ["ok", "ready"]}
+        }
+      },
+      "Version": {
+        "type": "object",
+        "properties": {
+          "version": {"type": "string"},
+          "commit": {"type": "string"},
+          "schemaVersion": {"type": "integer", "description": "The database schema version the server uses."}
+        }
+      },
+      "NewSession": {
+        "type": "object",
+        "properties": {
+          "token": {"type": "string"},
+          "csrfToken": {"type": "string"},
+          "expiryTime": {"type": "string", "format": "date-time"}
+        }
+      },
+      "LoginChallenge": {
+        "type": "object",
+        "properties": {
+          "twoFactorRequired": {"type": "boolean"},
+          "challenge": {"type": "string"},
+          "expiryTime": {"type": "string", "format": "date-time"}
+        }
+      },
+      "RegisterRequest": {
+        "type": "object",
+        "required": ["email", "password"],
+        "properties": {
+          "email": {"type": "string"},
+          "password": {"type": "string"},
+          "inviteCode": {"type": "string"}
+        }
+      },
+      "PasswordRequest": {
+        "type": "object",
+        "required": ["password"],
+        "properties": {"password": {"type": "string"}}
+      },
+      "ReauthenticateRequest": {
+        "description": "Confirms an operation with the password of the account or with a fresh OpenID Connect login.",
+        "oneOf": [
+          {"$ref": "#/components/schemas/PasswordRequest"},
+          {
+            "type": "object",
+            "required": ["oidc"],
+            "properties": {
+              "oidc": {
+                "type": "object",
+                "required": ["state", "code"],
+                "properties": {
+                  "state": {"type": "string"},
+                  "code": {"type": "string"}
+                }
+              }
+            }
+          }
+        ]
+      },
+      "ChangePasswordRequest": {
+        "type": "object",
+        "required": ["oldPassword", "newPassword"],
+        "properties": {
+          "oldPassword": {"type": "string"},
+          "newPassword": {"type": "string"}
+        }
+      },
+      "PasswordLoginRequest": {
+        "type": "object",
+        "required": ["enabled"],
+        "properties": {"enabled": {"type": "boolean"}}
+      },
+      "TwoFactorStatus": {
+        "type": "object",
+        "properties": {
+          "enabled": {"type": "boolean"},
+          "recoveryCodesLeft": {"type": "integer"},
+          "pendingTotpEnrollment": {"type": "boolean"}
+        }
+      },
+      "TOTPEnrollment": {
+        "type": "object",
+        "properties": {
+          "secret": {"type": "string"},
+          "uri": {"type": "string"}
+        }
+      },
+      "CodeRequest": {
+        "type": "object",
+        "required": ["code"],
+        "properties": {"code": {"type": "string"}}
+      },
+      "RecoveryCodes": {
+        "type": "object",
+        "properties": {"recoveryCodes": {"type": "array", "items": {"type": "string"}}}
+      },
+      "LoginEvents": {
+        "type": "object",
+        "properties": {"events": {"type": "array", "items": {"$ref": "#/components/schemas/LoginEvent"}}}
+      },
+      "LoginEvent": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "format": "int64"},
+          "time": {"type": "string", "format": "date-time"},
+          "email": {"type": "string"},
+          "ipAddress": {"type": "string"},
+          "userAgent": {"type": "string"},
+          "result": {"type": "string"}
+        }
+      },
+      "Sessions": {
+        "type": "object",
+        "properties": {"sessions": {"type": "array", "items": {"$ref": "#/components/schemas/Session"}}}
+      },
+      "Session": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "format": "int64"},
+          "expiryTime": {"type": "string", "format": "date-time"},
+          "accountId": {"type": "integer", "format": "int64"},
+          "creationTime": {"type": "string", "format": "date-time"},
+          "lastUsedTime": {"type": "string", "format": "date-time"},
+          "userAgent": {"type": "string"},
+          "ipAddress": {"type": "string"},
+          "name": {"type": "string"},
+          "current": {"type": "boolean"}
+        }
+      },
+      "RenameSessionRequest": {
+        "type": "object",
+        "required": ["name"],
+        "properties": {"name": {"type": "string"}}
+      },
+      "APITokens": {
+        "type": "object",
+        "properties": {"tokens": {"type": "array", "items": {"$ref": "#/components/schemas/APIToken"}}}
+      },
+      "APIToken": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "format": "int64"},
+          "token": {"type": "string"},
+          "name": {"type": "string"},
+          "scopes": {"type": "array", "items": {"$ref": "#/components/schemas/Scope"}},
+          "creationTime": {"type": "string", "format": "date-time"},
+          "expiryTime": {"type": "string", "format": "date-time", "nullable": true},
+          "lastUsedTime": {"type": "string", "format": "date-time", "nullable": true}
+        }
+      },
+      "CreateAPITokenRequest": {
+        "type": "object",
+        "required": ["name", "scopes"],
+        "properties": {
+          "name": {"type": "string"},
+          "scopes": {"type": "array", "items": {"$ref": "#/components/schemas/Scope"}},
+          "expiryTime": {"type": "string", "format": "date-time", "nullable": true}
+        }
+      },
+      "Scope": {
+        "type": "string",
+        "enum": ["read", "purchases:write", "reports:read", "admin"]
+      },
+      "AddProductRequest": {
+        "type": "object",
+        "required": ["name"],
+        "properties": {"name": {"type": "string"}}
+      },
+      "Product": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "format": "int64"},
+          "name": {"type": "string"}
+        }
+      },
+      "AddTagsRequest": {
+        "type": "object",
+        "required": ["tags"],
+        "properties": {"tags": {"type": "array", "items": {"type": "string"}}}
+      },
+      "Tags": {
+        "type": "object",
+        "properties": {"tags": {"type": "array", "items": {"$ref": "#/components/schemas/Tag"}}}
+      },
+      "Tag": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "format": "int64"},
+          "name": {"type": "string"}
+        }
+      },
+      "Purchases": {
+        "type": "object",
+        "properties": {"purchases": {"type": "array", "items": {"$ref": "#/components/schemas/Purchase"}}}
+      },
+      "PurchaseResponse": {
+        "type": "object",
+        "properties": {"purchase": {"$ref": "#/components/schemas/Purchase"}}
+      },
+      "Purchase": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "format": "int64"},
+          "product": {"$ref": "#/components/schemas/Product"},
+          "date": {"type": "string", "format": "date-time"},
+          "quantity": {"type": "string", "format": "decimal"},
+          "price": {"type": "string", "format": "decimal"},
+          "totalPrice": {"type": "string", "format": "decimal", "description": "The quantity times the price rounded in the currency of the server."},
+          "tags": {"type": "array", "items": {"$ref": "#/components/schemas/Tag"}},
+          "version": {"type": "integer", "format": "int64"}
+        }
+      },
+      "PurchaseUpdate": {
+        "type": "object",
+        "description": "The fields of a purchase. Missing or null fields are left unchanged.",
+        "properties": {
+          "product": {"type": "integer", "format": "int64", "nullable": true},
+          "date": {"type": "string", "format": "date-time", "nullable": true},
+          "quantity": {"$ref": "#/components/schemas/Decimal"},
+          "price": {"$ref": "#/components/schemas/Decimal"},
+          "tags": {"type": "array", "items": {"type": "integer", "format": "int64"}, "nullable": true}
+        }
+      },
+      "PurchaseFilter": {
+        "type": "object",
+        "properties": {
+          "ids": {"type": "array", "items": {"type": "integer", "format": "int64"}, "nullable": true},
+          "from": {"type": "string", "format": "date-time", "nullable": true},
+          "to": {"type": "string", "format": "date-time", "nullable": true},
+          "product": {"type": "integer", "format": "int64", "nullable": true},
+          "tag": {"type": "integer", "format": "int64", "nullable": true}
+        }
+      },
+      "BatchRequest": {
+        "type": "object",
+        "required": ["operations"],
+        "properties": {"operations": {"type": "array", "items": {"$ref": "#/components/schemas/BatchOperation"}}}
+      },
+      "BatchOperation": {
+        "type": "object",
+        "required": ["op"],
+        "properties": {
+          "op": {"type": "string", "enum": ["create", "update", "delete", "restore", "addTag", "removeTag", "setProduct"]},
+          "id": {"type": "integer", "format": "int64", "description": "The purchase of update, delete and restore operations."},
+          "ifVersion": {"type": "integer", "format": "int64"},
+          "values": {"$ref": "#/components/schemas/PurchaseUpdate"},
+          "filter": {"$ref": "#/components/schemas/PurchaseFilter"},
+          "tag": {"type": "integer", "format": "int64"},
+          "product": {"type": "integer", "format": "int64"}
+        }
+      },
+      "BatchResults": {
+        "type": "object",
+        "properties": {"results": {"type": "array", "items": {"$ref": "#/components/schemas/BatchResult"}}}
+      },
+      "BatchResult": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "format": "int64"},
+          "version": {"type": "integer", "format": "int64"},
+          "count": {"type": "integer", "format": "int64"}
+        }
+      },
+      "SyncChanges": {
+        "type": "object",
+        "properties": {
+          "cursor": {"type": "integer", "format": "int64"},
+          "products": {"type": "array", "items": {"$ref": "#/components/schemas/SyncEntity"}},
+          "tags": {"type": "array", "items": {"$ref": "#/components/schemas/SyncEntity"}},
+          "purchases": {"type": "array", "items": {"$ref": "#/components/schemas/SyncPurchase"}},
+          "purged": {
+            "type": "object",
+            "description": "The IDs of permanently deleted entities by entity type.",
+            "additionalProperties": {"type": "array", "items": {"type": "integer", "format": "int64"}}
+          }
+        }
+      },
+      "SyncEntity": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "format": "int64"},
+          "clientId": {"type": "string", "nullable": true},
+          "name": {"type": "string"},
+          "deleted": {"type": "boolean"},
+          "version": {"type": "integer", "format": "int64"}
+        }
+      },
+      "SyncPurchase": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "format": "int64"},
+          "clientId": {"type": "string", "nullable": true},
+          "product": {"type": "integer", "format": "int64"},
+          "date": {"type": "string", "format": "date-time"},
+          "quantity": {"type": "string", "format": "decimal"},
+          "price": {"type": "string", "format": "decimal"},
+          "tags": {"type": "array", "items": {"type": "integer", "format": "int64"}},
+          "deleted": {"type": "boolean"},
+          "version": {"type": "integer", "format": "int64"}
+        }
+      },
+      "PushRequest": {
+        "type": "object",
+        "properties": {
+          "products": {"type": "array", "items": {"$ref": "#/components/schemas/PushEntity"}, "nullable": true},
+          "tags": {"type": "array", "items": {"$ref": "#/components/schemas/PushEntity"}, "nullable": true},
+          "purchases": {"type": "array", "items": {"$ref": "#/components/schemas/PushPurchase"}, "nullable": true}
+        }
+      },
+      "PushEntity": {
+        "type": "object",
+        "description": "A product or a tag created or changed by a client. New entities are identified by clientId.",
+        "properties": {
+          "id": {"type": "integer", "format": "int64"},
+          "clientId": {"type": "string"},
+          "baseVersion": {"type": "integer", "format": "int64"},
+          "name": {"type": "string"},
+          "deleted": {"type": "boolean"}
+        }
+      },
+      "PushPurchase": {
+        "type": "object",
+        "description": "A purchase created or changed by a client. The product and tags are referenced either by server ID or by client ID.",
+        "properties": {
+          "id": {"type": "integer", "format": "int64"},
+          "clientId": {"type": "string"},
+          "baseVersion": {"type": "integer", "format": "int64"},
+          "product": {"type": "integer", "format": "int64"},
+          "productClientId": {"type": "string"},
+          "date": {"type": "string", "format": "date-time"},
+          "quantity": {"$ref": "#/components/schemas/Decimal"},
+          "price": {"$ref": "#/components/schemas/Decimal"},
+          "tags": {"type": "array", "items": {"type": "integer", "format": "int64"}, "nullable": true},
+          "tagClientIds": {"type": "array", "items": {"type": "string"}, "nullable": true},
+          "deleted": {"type": "boolean"}
+        }
+      },
+      "PushResult": {
+        "type": "object",
+        "properties": {
+          "applied": {"type": "array", "items": {"$ref": "#/components/schemas/PushedEntity"}},
+          "conflicts": {"type": "array", "items": {"$ref": "#/components/schemas/PushConflict"}}
+        }
+      },
+      "PushedEntity": {
+        "type": "object",
+        "properties": {
+          "entity": {"type": "string"},
+          "id": {"type": "integer", "format": "int64"},
+          "clientId": {"type": "string"},
+          "version": {"type": "integer", "format": "int64"}
+        }
+      },
+      "PushConflict": {
+        "type": "object",
+        "properties": {
+          "entity": {"type": "string"},
+          "id": {"type": "integer", "format": "int64"},
+          "clientId": {"type": "string"},
+          "current": {"type": "object", "description": "The current state of the entity on the server."}
+        }
+      },
+      "GraphQLRequest": {
+        "type": "object",
+        "required": ["query"],
+        "properties": {
+          "query": {"type": "string"},
+          "operationName": {"type": "string", "nullable": true},
+          "variables": {"type": "object", "nullable": true}
+        }
+      },
+      "GraphQLResponse": {
+        "type": "object",
+        "properties": {
+          "data": {"type": "object", "nullable": true},
+          "errors": {"type": "array", "items": {"type": "object"}}
+        }
+      },
+      "ChangeEvent": {
+        "type": "object",
+        "description": "The data of an event. The event type is the action.",
+        "properties": {
+          "accountId": {"type": "integer", "format": "int64"},
+          "entity": {"type": "string"},
+          "entityId": {"type": "integer", "format": "int64"},
+          "action": {"type": "string"}
+        }
+      },
+      "Trash": {
+        "type": "object",
+        "properties": {
+          "purchases": {"type": "array", "items": {"$ref": "#/components/schemas/TrashedPurchase"}},
+          "products": {"type": "array", "items": {"$ref": "#/components/schemas/TrashedEntity"}},
+          "tags": {"type": "array", "items": {"$ref": "#/components/schemas/TrashedEntity"}}
+        }
+      },
+      "TrashedPurchase": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "format": "int64"},
+          "product": {"$ref": "#/components/schemas/Product"},
+          "date": {"type": "string", "format": "date-time"},
+          "quantity": {"type": "string", "format": "decimal"},
+          "price": {"type": "string", "format": "decimal"},
+          "totalPrice": {"type": "string", "format": "decimal"},
+          "tags": {"type": "array", "items": {"$ref": "#/components/schemas/Tag"}},
+          "version": {"type": "integer", "format": "int64"},
+          "deletedTime": {"type": "string", "format": "date-time"}
+        }
+      },
+      "TrashedEntity": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "format": "int64"},
+          "name": {"type": "string"},
+          "deletedTime": {"type": "string", "format": "date-time"}
+        }
+      },
+      "TrashItems": {
+        "type": "object",
+        "properties": {
+          "purchases": {"type": "array", "items": {"type": "integer", "format": "int64"}, "nullable": true},
+          "products": {"type": "array", "items": {"type": "integer", "format": "int64"}, "nullable": true},
+          "tags": {"type": "array", "items": {"type": "integer", "format": "int64"}, "nullable": true}
+        }
+      },
+      "UndoRequest": {
+        "type": "object",
+        "properties": {"count": {"type": "integer", "minimum": 1, "maximum": 100}}
+      },
+      "Webhooks": {
+        "type": "object",
+        "properties": {
+          "webhooks": {"type": "array", "items": {"$ref": "#/components/schemas/Webhook"}},
+          "events": {"type": "array", "items": {"type": "string"}, "description": "The event types webhooks can subscribe to."}
+        }
+      },
+      "Webhook": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "format": "int64"},
+          "url": {"type": "string"},
+          "events": {"type": "array", "items": {"type": "string"}},
+          "secret": {"type": "string"},
+          "active": {"type": "boolean"},
+          "creationTime": {"type": "string", "format": "date-time"}
+        }
+      },
+      "CreateWebhookRequest": {
+        "type": "object",
+        "required": ["url", "events"],
+        "properties": {
+          "url": {"type": "string"},
+          "events": {"type": "array", "items": {"type": "string"}},
+          "secret": {"type": "string", "description": "Generated if not given."}
+        }
+      },
+      "WebhookUpdate": {
+        "type": "object",
+        "properties": {
+          "url": {"type": "string", "nullable": true},
+          "events": {"type": "array", "items": {"type": "string"}, "nullable": true},
+          "secret": {"type": "string", "nullable": true},
+          "active": {"type": "boolean", "nullable": true}
+        }
+      },
+      "WebhookDeliveries": {
+        "type": "object",
+        "properties": {"deliveries": {"type": "array", "items": {"$ref": "#/components/schemas/WebhookDelivery"}}}
+      },
+      "WebhookDelivery": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "format": "int64"},
+          "webhookId": {"type": "integer", "format": "int64"},
+          "event": {"type": "string"},
+          "payload": {"type": "object"},
+          "creationTime": {"type": "string", "format": "date-time"},
+          "status": {"type": "string", "enum": ["pending", "succeeded", "failed"]},
+          "attempts": {"type": "integer"},
+          "nextAttemptTime": {"type": "string", "format": "date-time", "nullable": true},
+          "lastAttemptTime": {"type": "string", "format": "date-time", "nullable": true},
+          "responseStatus": {"type": "integer", "nullable": true},
+          "error": {"type": "string"}
+        }
+      },
+      "AuditLog": {
+        "type": "object",
+        "properties": {"entries": {"type": "array", "items": {"$ref": "#/components/schemas/AuditEntry"}}}
+      },
+      "AuditEntry": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "format": "int64"},
+          "time": {"type": "string", "format": "date-time"},
+          "actorAccountId": {"type": "integer", "format": "int64", "nullable": true},
+          "sessionId": {"type": "integer", "format": "int64", "nullable": true},
+          "apiTokenId": {"type": "integer", "format": "int64", "nullable": true},
+          "entity": {"type": "string"},
+          "entityId": {"type": "integer", "format": "int64"},
+          "action": {"type": "string"},
+          "before": {"type": "object", "nullable": true},
+          "after": {"type": "object", "nullable": true}
+        }
+      },
+      "Accounts": {
+        "type": "object",
+        "properties": {"accounts": {"type": "array", "items": {"$ref": "#/components/schemas/Account"}}}
+      },
+      "Account": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "format": "int64"},
+          "email": {"type": "string"},
+          "role": {"$ref": "#/components/schemas/Role"},
+          "disabled": {"type": "boolean"},
+          "purchaseCount": {"type": "integer", "format": "int64"},
+          "productCount": {"type": "integer", "format": "int64"},
+          "tagCount": {"type": "integer", "format": "int64"},
+          "sessionCount": {"type": "integer", "format": "int64"}
+        }
+      },
+      "CreateAccountRequest": {
+        "type": "object",
+        "required": ["email", "password"],
+        "properties": {
+          "email": {"type": "string"},
+          "password": {"type": "string"},
+          "role": {"$ref": "#/components/schemas/Role"}
+        }
+      },
+      "AccountUpdate": {
+        "type": "object",
+        "properties": {
+          "role": {"type": "string", "enum": ["user", "admin"], "nullable": true},
+          "disabled": {"type": "boolean", "nullable": true}
+        }
+      },
+      "Role": {
+        "type": "string",
+        "enum": ["user", "admin"]
+      },
+      "UsageStats": {
+        "type": "object",
+        "properties": {
+          "accountCount": {"type": "integer", "format": "int64"},
+          "disabledAccountCount": {"type": "integer", "format": "int64"},
+          "activeSessionCount": {"type": "integer", "format": "int64"},
+          "purchaseCount": {"type": "integer", "format": "int64"},
+          "productCount": {"type": "integer", "format": "int64"},
+          "tagCount": {"type": "integer", "format": "int64"}
+        }
+      }
+    }
+  }
+}
+`
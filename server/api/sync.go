@@ -0,0 +1,57 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/lassilaiho/expenditure-accounting/server/db"
+)
+
+// GetChanges returns the entities changed since the cursor given in the since
+// query parameter. Without a cursor all entities are returned.
+func (api *API) GetChanges(w http.ResponseWriter, r *http.Request) {
+	var cursor int64
+	if since := r.URL.Query().Get("since"); since != "" {
+		var err error
+		cursor, err = strconv.ParseInt(since, 10, 64)
+		if err != nil || cursor < 0 {
+			writeError(w, r, http.StatusBadRequest, invalidParameter("since"))
+			return
+		}
+	}
+	changes, err := api.DB.GetChangesSince(r.Context(), getSession(r).AccountID, cursor)
+	if err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if err = json.NewEncoder(w).Encode(changes); err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+func (api *API) PushChanges(w http.ResponseWriter, r *http.Request) {
+	var reqData db.PushRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	result, err := api.DB.PushChanges(r.Context(), getSession(r).AccountID, &reqData)
+	if err != nil {
+		if err == db.ErrUnknownReference {
+			logger(r).Warn(err)
+			writeError(w, r, http.StatusBadRequest, err)
+		} else {
+			logger(r).Error(err)
+			writeError(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	if err = json.NewEncoder(w).Encode(result); err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+	}
+}
@@ -2,7 +2,6 @@ package api
 
 import (
 	"encoding/json"
-	"log"
 	"net/http"
 
 	"github.com/lassilaiho/expenditure-accounting/server/db"
@@ -13,8 +12,8 @@ func (api *API) AddTags(w http.ResponseWriter, r *http.Request) {
 		Tags []string `json:"tags"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
-		log.Print(err)
-		w.WriteHeader(http.StatusBadRequest)
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusBadRequest, err)
 		return
 	}
 	var err error
@@ -24,13 +23,13 @@ func (api *API) AddTags(w http.ResponseWriter, r *http.Request) {
 	responseData.Tags, err = api.DB.InsertTags(
 		r.Context(), getSession(r).AccountID, requestData.Tags)
 	if err != nil {
-		log.Print(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 	if err = json.NewEncoder(w).Encode(&responseData); err != nil {
-		log.Print(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 }
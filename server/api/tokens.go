@@ -0,0 +1,88 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lassilaiho/expenditure-accounting/server/db"
+)
+
+var errExpiryInPast = errors.New("expiry time must be in the future")
+
+func (api *API) GetAPITokens(w http.ResponseWriter, r *http.Request) {
+	tokens, err := api.DB.GetAPITokensForAccount(r.Context(), getSession(r).AccountID)
+	if err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	respData := struct {
+		Tokens []*db.APIToken `json:"tokens"`
+	}{tokens}
+	if err = json.NewEncoder(w).Encode(&respData); err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+func (api *API) CreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	var reqData struct {
+		Name       string     `json:"name"`
+		Scopes     []string   `json:"scopes"`
+		ExpiryTime *time.Time `json:"expiryTime"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if reqData.ExpiryTime != nil && !reqData.ExpiryTime.After(time.Now()) {
+		writeError(w, r, http.StatusBadRequest, errExpiryInPast)
+		return
+	}
+	token, err := api.DB.InsertAPIToken(
+		r.Context(),
+		getSession(r).AccountID,
+		reqData.Name,
+		reqData.Scopes,
+		reqData.ExpiryTime)
+	if err != nil {
+		switch err {
+		case db.ErrInvalidTokenName, db.ErrInvalidScope:
+			writeError(w, r, http.StatusBadRequest, err)
+		case db.ErrAdminScopeForbidden:
+			writeError(w, r, http.StatusForbidden, err)
+		default:
+			logger(r).Error(err)
+			writeError(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	if err = json.NewEncoder(w).Encode(token); err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+func (api *API) DeleteAPIToken(w http.ResponseWriter, r *http.Request) {
+	tokenID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusNotFound, err)
+		return
+	}
+	err = api.DB.DeleteAPIToken(r.Context(), tokenID, getSession(r).AccountID)
+	if err != nil {
+		if err == db.ErrNoRowsAffected {
+			logger(r).Warn(err)
+			writeError(w, r, http.StatusNotFound, err)
+		} else {
+			logger(r).Error(err)
+			writeError(w, r, http.StatusInternalServerError, err)
+		}
+	}
+}
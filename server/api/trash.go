@@ -0,0 +1,120 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/lassilaiho/expenditure-accounting/server/db"
+)
+
+func (api *API) GetTrash(w http.ResponseWriter, r *http.Request) {
+	trash, err := api.DB.GetTrash(r.Context(), getSession(r).AccountID)
+	if err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if err = json.NewEncoder(w).Encode(trash); err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+func (api *API) RestoreFromTrash(w http.ResponseWriter, r *http.Request) {
+	var items db.TrashItems
+	if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	err := api.DB.RestoreFromTrash(r.Context(), getSession(r).AccountID, &items)
+	if err != nil {
+		if err == db.ErrNoRowsAffected {
+			writeError(w, r, http.StatusNotFound, err)
+		} else {
+			logger(r).Error(err)
+			writeError(w, r, http.StatusInternalServerError, err)
+		}
+	}
+}
+
+func (api *API) PurgeFromTrash(w http.ResponseWriter, r *http.Request) {
+	var items db.TrashItems
+	if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	var err error
+	var respData struct {
+		Count int64 `json:"count"`
+	}
+	respData.Count, err = api.DB.PurgeFromTrash(r.Context(), getSession(r).AccountID, &items)
+	if err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if err = json.NewEncoder(w).Encode(&respData); err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+// maxUndoCount limits the number of operations undone or redone in one
+// request.
+const maxUndoCount = 100
+
+var errInvalidUndoCount = errors.New("invalid operation count")
+
+func (api *API) Undo(w http.ResponseWriter, r *http.Request) {
+	api.undoOrRedo(w, r, api.DB.Undo)
+}
+
+func (api *API) Redo(w http.ResponseWriter, r *http.Request) {
+	api.undoOrRedo(w, r, api.DB.Redo)
+}
+
+type undoFunc func(
+	ctx context.Context, accountID, sessionID int64, count int,
+) (int, error)
+
+// undoOrRedo undoes or redoes the number of operations given in the request,
+// one by default.
+func (api *API) undoOrRedo(w http.ResponseWriter, r *http.Request, f undoFunc) {
+	reqData := struct {
+		Count int `json:"count"`
+	}{1}
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil && err != io.EOF {
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if reqData.Count < 1 || reqData.Count > maxUndoCount {
+		writeError(w, r, http.StatusBadRequest, errInvalidUndoCount)
+		return
+	}
+	session := getSession(r)
+	var err error
+	var respData struct {
+		Count int `json:"count"`
+	}
+	respData.Count, err = f(r.Context(), session.AccountID, session.ID, reqData.Count)
+	if err != nil {
+		if err == db.ErrUndoConflict {
+			logger(r).Warn(err)
+			writeError(w, r, http.StatusConflict, err)
+		} else {
+			logger(r).Error(err)
+			writeError(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	if err = json.NewEncoder(w).Encode(&respData); err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+	}
+}
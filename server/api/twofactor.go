@@ -0,0 +1,210 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/lassilaiho/expenditure-accounting/server/db"
+	"github.com/lassilaiho/expenditure-accounting/server/totp"
+)
+
+func (api *API) CompleteLogin(w http.ResponseWriter, r *http.Request) {
+	var reqData struct {
+		Challenge    string `json:"challenge"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recoveryCode"`
+		Cookie       bool   `json:"cookie"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if reqData.Cookie && api.Cookies == nil {
+		writeError(w, r, http.StatusBadRequest, errCookiesDisabled)
+		return
+	}
+	if !api.checkLoginLimit(w, r) {
+		return
+	}
+	session, err := api.DB.CompleteLogin(
+		r.Context(),
+		reqData.Challenge,
+		reqData.Code,
+		reqData.RecoveryCode,
+		api.clientInfo(r))
+	if err != nil {
+		switch err {
+		case db.ErrInvalidChallenge, db.ErrInvalidTwoFactorCode:
+			api.loginFailed(r)
+			logger(r).Warn(err)
+			writeError(w, r, http.StatusUnauthorized, err)
+		case db.ErrAccountDisabled:
+			logger(r).Warn(err)
+			writeError(w, r, http.StatusForbidden, err)
+		default:
+			logger(r).Error(err)
+			writeError(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	api.writeNewSession(w, r, session, reqData.Cookie)
+}
+
+// reauthenticate checks the password given in a request body for operations
+// requiring the user to confirm their identity. Instead of the password, the
+// state and code of a fresh OpenID Connect login may be given in the oidc
+// property, so that accounts without a password can confirm such operations.
+// If the confirmation fails, an error response is written and false is
+// returned.
+func (api *API) reauthenticate(w http.ResponseWriter, r *http.Request) bool {
+	var reqData struct {
+		Password string `json:"password"`
+		OIDC     *struct {
+			State string `json:"state"`
+			Code  string `json:"code"`
+		} `json:"oidc"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusBadRequest, err)
+		return false
+	}
+	accountID := getSession(r).AccountID
+	if reqData.OIDC != nil {
+		if api.OIDC == nil {
+			writeError(w, r, http.StatusBadRequest, errOIDCDisabled)
+			return false
+		}
+		identity, ok := api.oidcIdentity(w, r, reqData.OIDC.State, reqData.OIDC.Code)
+		if !ok {
+			return false
+		}
+		err := api.DB.VerifyOIDCIdentity(r.Context(), accountID, identity)
+		if err != nil {
+			if err == db.ErrOIDCIdentityMismatch {
+				logger(r).Warn(err)
+				writeError(w, r, http.StatusUnauthorized, err)
+			} else {
+				logger(r).Error(err)
+				writeError(w, r, http.StatusInternalServerError, err)
+			}
+			return false
+		}
+		return true
+	}
+	err := api.DB.VerifyPassword(r.Context(), accountID, reqData.Password)
+	if err != nil {
+		if err == db.ErrInvalidEmailOrPassword {
+			writeError(w, r, http.StatusUnauthorized, err)
+		} else {
+			logger(r).Error(err)
+			writeError(w, r, http.StatusInternalServerError, err)
+		}
+		return false
+	}
+	return true
+}
+
+func (api *API) GetTwoFactorStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := api.DB.GetTwoFactorStatus(r.Context(), getSession(r).AccountID)
+	if err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if err = json.NewEncoder(w).Encode(status); err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+func (api *API) BeginTOTPEnrollment(w http.ResponseWriter, r *http.Request) {
+	if !api.reauthenticate(w, r) {
+		return
+	}
+	secret, email, err := api.DB.BeginTOTPEnrollment(r.Context(), getSession(r).AccountID)
+	if err != nil {
+		if err == db.ErrTwoFactorEnabled {
+			writeError(w, r, http.StatusConflict, err)
+		} else {
+			logger(r).Error(err)
+			writeError(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	respData := struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}{
+		Secret: secret,
+		URI:    totp.ProvisioningURI(secret, api.TOTPIssuer, email),
+	}
+	if err = json.NewEncoder(w).Encode(&respData); err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+func writeRecoveryCodes(w http.ResponseWriter, r *http.Request, codes []string) {
+	respData := struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}{codes}
+	if err := json.NewEncoder(w).Encode(&respData); err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+func (api *API) ConfirmTOTPEnrollment(w http.ResponseWriter, r *http.Request) {
+	var reqData struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	codes, err := api.DB.ConfirmTOTPEnrollment(
+		r.Context(), getSession(r).AccountID, reqData.Code)
+	if err != nil {
+		switch err {
+		case db.ErrInvalidTwoFactorCode:
+			writeError(w, r, http.StatusUnauthorized, err)
+		case db.ErrTwoFactorEnabled, db.ErrTwoFactorNotEnabled:
+			writeError(w, r, http.StatusConflict, err)
+		default:
+			logger(r).Error(err)
+			writeError(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	writeRecoveryCodes(w, r, codes)
+}
+
+func (api *API) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if !api.reauthenticate(w, r) {
+		return
+	}
+	if err := api.DB.DisableTwoFactor(r.Context(), getSession(r).AccountID); err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+func (api *API) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	if !api.reauthenticate(w, r) {
+		return
+	}
+	codes, err := api.DB.RegenerateRecoveryCodes(r.Context(), getSession(r).AccountID)
+	if err != nil {
+		if err == db.ErrTwoFactorNotEnabled {
+			writeError(w, r, http.StatusConflict, err)
+		} else {
+			logger(r).Error(err)
+			writeError(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	writeRecoveryCodes(w, r, codes)
+}
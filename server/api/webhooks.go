@@ -0,0 +1,191 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/lassilaiho/expenditure-accounting/server/db"
+)
+
+const (
+	defaultDeliveryLimit = 50
+	maxDeliveryLimit     = 500
+)
+
+func (api *API) GetWebhooks(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := api.DB.GetWebhooks(r.Context(), getSession(r).AccountID)
+	if err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	respData := struct {
+		Webhooks []*db.Webhook `json:"webhooks"`
+		Events   []string      `json:"events"`
+	}{webhooks, db.WebhookEvents}
+	if err = json.NewEncoder(w).Encode(&respData); err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+func (api *API) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var reqData struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+		Secret string   `json:"secret"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	webhook, err := api.DB.InsertWebhook(
+		r.Context(),
+		getSession(r).AccountID,
+		reqData.URL,
+		reqData.Events,
+		reqData.Secret)
+	if err != nil {
+		switch err {
+		case db.ErrInvalidWebhookURL, db.ErrInvalidWebhookEvent:
+			writeError(w, r, http.StatusBadRequest, err)
+		default:
+			logger(r).Error(err)
+			writeError(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	if err = json.NewEncoder(w).Encode(webhook); err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+func (api *API) UpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	webhookID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusNotFound, err)
+		return
+	}
+	var update db.WebhookUpdate
+	if err = json.NewDecoder(r.Body).Decode(&update); err != nil {
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	webhook, err := api.DB.UpdateWebhook(r.Context(), webhookID, getSession(r).AccountID, &update)
+	if err != nil {
+		switch err {
+		case db.ErrInvalidWebhookURL, db.ErrInvalidWebhookEvent:
+			writeError(w, r, http.StatusBadRequest, err)
+		case db.ErrNoRowsAffected:
+			writeError(w, r, http.StatusNotFound, err)
+		default:
+			logger(r).Error(err)
+			writeError(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	if err = json.NewEncoder(w).Encode(webhook); err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+func (api *API) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	webhookID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusNotFound, err)
+		return
+	}
+	err = api.DB.DeleteWebhook(r.Context(), webhookID, getSession(r).AccountID)
+	if err != nil {
+		if err == db.ErrNoRowsAffected {
+			logger(r).Warn(err)
+			writeError(w, r, http.StatusNotFound, err)
+		} else {
+			logger(r).Error(err)
+			writeError(w, r, http.StatusInternalServerError, err)
+		}
+	}
+}
+
+// GetWebhookDeliveries lists the most recent deliveries of a webhook. The
+// number of deliveries is limited by the limit query parameter.
+func (api *API) GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	webhookID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusNotFound, err)
+		return
+	}
+	limit := defaultDeliveryLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit <= 0 || limit > maxDeliveryLimit {
+			writeError(w, r, http.StatusBadRequest, invalidParameter("limit"))
+			return
+		}
+	}
+	deliveries, err := api.DB.GetWebhookDeliveries(
+		r.Context(), webhookID, getSession(r).AccountID, limit)
+	if err != nil {
+		if err == db.ErrNoRowsAffected {
+			logger(r).Warn(err)
+			writeError(w, r, http.StatusNotFound, err)
+		} else {
+			logger(r).Error(err)
+			writeError(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	respData := struct {
+		Deliveries []*db.WebhookDelivery `json:"deliveries"`
+	}{deliveries}
+	if err = json.NewEncoder(w).Encode(&respData); err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+// PingWebhook sends a ping event to a webhook right away and responds with
+// the delivery. A failed ping is not retried.
+func (api *API) PingWebhook(w http.ResponseWriter, r *http.Request) {
+	if api.Webhooks == nil {
+		writeError(w, r, http.StatusNotFound, nil)
+		return
+	}
+	webhookID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		logger(r).Warn(err)
+		writeError(w, r, http.StatusNotFound, err)
+		return
+	}
+	due, err := api.DB.InsertWebhookPing(
+		r.Context(), webhookID, getSession(r).AccountID, api.Webhooks.Lease())
+	if err != nil {
+		if err == db.ErrNoRowsAffected {
+			logger(r).Warn(err)
+			writeError(w, r, http.StatusNotFound, err)
+		} else {
+			logger(r).Error(err)
+			writeError(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	delivery, err := api.Webhooks.Deliver(r.Context(), due)
+	if err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if err = json.NewEncoder(w).Encode(delivery); err != nil {
+		logger(r).Error(err)
+		writeError(w, r, http.StatusInternalServerError, err)
+	}
+}
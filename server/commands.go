@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lassilaiho/expenditure-accounting/server/db"
+)
+
+type command struct {
+	args string
+	desc string
+	run  func(ctx context.Context, dbapi *db.API, args []string) error
+}
+
+var commands = map[string]command{
+	"create-account": {
+		args: "EMAIL ROLE",
+		desc: "create an account, reading the password from standard input",
+		run:  createAccount,
+	},
+	"set-role": {
+		args: "EMAIL ROLE",
+		desc: "change the role of an account",
+		run:  setRole,
+	},
+	"reset-password": {
+		args: "EMAIL",
+		desc: "set the password of an account, reading it from standard input",
+		run:  resetPassword,
+	},
+}
+
+var commandNames = []string{"create-account", "set-role", "reset-password"}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s -config CONFIG_FILE [COMMAND [ARGS...]]\n\n", os.Args[0])
+	fmt.Fprintln(out, "Without a command the server is started. Commands:")
+	for _, name := range commandNames {
+		cmd := commands[name]
+		fmt.Fprintf(out, "  %s %s\n    \t%s\n", name, cmd.args, cmd.desc)
+	}
+	fmt.Fprintln(out, "\nFlags:")
+	flag.PrintDefaults()
+}
+
+func runCommand(ctx context.Context, dbapi *db.API, name string, args []string) error {
+	cmd, ok := commands[name]
+	if !ok {
+		flag.Usage()
+		return fmt.Errorf("unknown command %q", name)
+	}
+	if len(args) != len(strings.Fields(cmd.args)) {
+		return fmt.Errorf("usage: %s %s", name, cmd.args)
+	}
+	return cmd.run(ctx, dbapi, args)
+}
+
+// readPassword reads a password from the first line of standard input.
+func readPassword() (string, error) {
+	fmt.Fprint(os.Stderr, "Password: ")
+	scanner := bufio.NewScanner(os.Stdin)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", errors.New("no password given")
+	}
+	return strings.TrimRight(scanner.Text(), "\r"), nil
+}
+
+func createAccount(ctx context.Context, dbapi *db.API, args []string) error {
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+	id, err := dbapi.InsertAccount(ctx, args[0], password, args[1])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Created account %d\n", id)
+	return nil
+}
+
+func setRole(ctx context.Context, dbapi *db.API, args []string) error {
+	id, err := dbapi.GetAccountIDByEmail(ctx, args[0])
+	if err != nil {
+		return fmt.Errorf("account %s: %w", args[0], err)
+	}
+	return dbapi.UpdateAccount(ctx, id, &db.AccountUpdate{Role: &args[1]})
+}
+
+func resetPassword(ctx context.Context, dbapi *db.API, args []string) error {
+	id, err := dbapi.GetAccountIDByEmail(ctx, args[0])
+	if err != nil {
+		return fmt.Errorf("account %s: %w", args[0], err)
+	}
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+	return dbapi.ResetPasswordForAccount(ctx, id, password)
+}
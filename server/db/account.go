@@ -4,18 +4,64 @@ import (
 	"context"
 	"database/sql"
 	"errors"
-	"log"
-	"time"
+	"strings"
 
-	"github.com/google/uuid"
+	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 )
 
 var (
 	ErrInvalidEmailOrPassword = errors.New("invalid email or password")
 	ErrSessionExpired         = errors.New("session has been expired")
+	ErrInvalidEmail           = errors.New("invalid email address")
+	ErrEmailTaken             = errors.New("email address is already in use")
+	ErrPasswordTooShort       = errors.New("password is too short")
+	ErrAccountDisabled        = errors.New("account has been disabled")
+	ErrInvalidRole            = errors.New("invalid role")
+	ErrTwoFactorRequired      = errors.New("two-factor authentication is required")
+	ErrAccountLocked          = errors.New("account is temporarily locked due to failed logins")
 )
 
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+func checkRole(role string) error {
+	if role != RoleUser && role != RoleAdmin {
+		return ErrInvalidRole
+	}
+	return nil
+}
+
+const MinPasswordLength = 8
+
+// normalizeEmail returns the canonical form of email. Email addresses are
+// stored and looked up in this form.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func checkEmail(email string) error {
+	at := strings.IndexByte(email, '@')
+	if at <= 0 || at == len(email)-1 || strings.ContainsAny(email, " \t\r\n") {
+		return ErrInvalidEmail
+	}
+	return nil
+}
+
+func checkPassword(password string) error {
+	if len(password) < MinPasswordLength {
+		return ErrPasswordTooShort
+	}
+	return nil
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
 func (api *API) hashPassword(password string) ([]byte, error) {
 	return bcrypt.GenerateFromPassword([]byte(password), api.BcryptCost)
 }
@@ -24,123 +70,81 @@ func comparePassword(password, hash string) error {
 	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 }
 
-func generateSessionToken() string {
-	return uuid.New().String()
-}
-
-func (api *API) InsertAccount(ctx context.Context, email, password, role string) error {
+func (api *API) InsertAccount(ctx context.Context, email, password, role string) (int64, error) {
+	defer api.observe("InsertAccount")()
+	email = normalizeEmail(email)
+	if err := checkEmail(email); err != nil {
+		return -1, err
+	}
+	if err := checkRole(role); err != nil {
+		return -1, err
+	}
+	if err := checkPassword(password); err != nil {
+		return -1, err
+	}
 	hash, err := api.hashPassword(password)
 	if err != nil {
-		return err
+		return -1, err
 	}
 	query := `
 INSERT INTO accounts (email, password_hash, role)
-VALUES ($1, $2, $3)`
-	_, err = api.DB.ExecContext(ctx, query, email, hash, role)
-	return err
-}
-
-type Session struct {
-	ID         int64     `json:"id"`
-	Token      string    `json:"token"`
-	ExpiryTime time.Time `json:"expiryTime"`
-	AccountID  int64     `json:"accountId"`
-}
-
-func (api *API) CreateSession(ctx context.Context, email, password string) (*Session, error) {
-	tx, err := api.DB.BeginTx(ctx, nil)
+VALUES ($1, $2, $3)
+RETURNING id`
+	var id int64
+	err = api.DB.QueryRowContext(ctx, query, email, hash, role).Scan(&id)
 	if err != nil {
-		return nil, err
+		if isUniqueViolation(err) {
+			return -1, ErrEmailTaken
+		}
+		return -1, err
 	}
-	var (
-		accountID    int64
-		passwordHash string
-	)
-	err = tx.QueryRowContext(
-		ctx,
-		"SELECT id, password_hash FROM accounts WHERE email = $1",
-		email).Scan(&accountID, &passwordHash)
-	if err != nil {
-		tx.Rollback()
+	return id, nil
+}
+
+// VerifyPassword returns ErrInvalidEmailOrPassword if password isn't the
+// password of the account.
+func (api *API) VerifyPassword(ctx context.Context, accountID int64, password string) error {
+	defer api.observe("VerifyPassword")()
+	query := "SELECT password_hash FROM accounts WHERE id = $1"
+	var hash string
+	if err := api.DB.QueryRowContext(ctx, query, accountID).Scan(&hash); err != nil {
 		if err == sql.ErrNoRows {
-			return nil, ErrInvalidEmailOrPassword
+			return ErrInvalidEmailOrPassword
 		}
-		return nil, err
-	}
-	if err = comparePassword(password, passwordHash); err != nil {
-		tx.Rollback()
-		return nil, ErrInvalidEmailOrPassword
+		return err
 	}
-	now := time.Now().UTC()
-	session := &Session{
-		AccountID:  accountID,
-		Token:      generateSessionToken(),
-		ExpiryTime: now.Add(api.SessionTimeout),
+	if err := comparePassword(password, hash); err != nil {
+		return ErrInvalidEmailOrPassword
 	}
-	_, err = tx.ExecContext(
+	return nil
+}
+
+// DeleteAccount permanently deletes the account and all data belonging to it.
+func (api *API) DeleteAccount(ctx context.Context, accountID int64) error {
+	defer api.observe("DeleteAccount")()
+	result, err := api.DB.ExecContext(
 		ctx,
-		"INSERT INTO sessions (token, expiry_time, account_id) VALUES ($1, $2, $3)",
-		session.Token, session.ExpiryTime, accountID)
+		"DELETE FROM accounts WHERE id = $1",
+		accountID)
 	if err != nil {
-		tx.Rollback()
-		return nil, err
+		return err
 	}
-	_, err = tx.ExecContext(
-		ctx,
-		"DELETE FROM sessions WHERE account_id = $1 AND expiry_time < $2",
-		accountID,
-		now)
+	count, err := result.RowsAffected()
 	if err != nil {
-		tx.Rollback()
-		return nil, err
+		return err
 	}
-	if err = tx.Commit(); err != nil {
-		tx.Rollback()
-		return nil, err
+	if count == 0 {
+		return ErrNoRowsAffected
 	}
-	return session, nil
-}
-
-func (api *API) DeleteSession(ctx context.Context, id int64) error {
-	_, err := api.DB.ExecContext(
-		ctx,
-		"DELETE FROM sessions WHERE id = $1",
-		id)
-	return err
-}
-
-func (api *API) ValidateSession(ctx context.Context, token string) (*Session, error) {
-	session := &Session{Token: token}
-	err := api.DB.
-		QueryRowContext(
-			ctx,
-			"SELECT id, account_id, expiry_time FROM sessions WHERE token = $1",
-			session.Token).
-		Scan(
-			&session.ID,
-			&session.AccountID,
-			&session.ExpiryTime)
-	if err != nil {
-		return nil, err
-	}
-	now := time.Now().UTC()
-	if now.After(session.ExpiryTime) {
-		return nil, ErrSessionExpired
-	}
-	if now.Add(api.RefreshTime).After(session.ExpiryTime) {
-		go func() {
-			_, err := api.DB.Exec(
-				"UPDATE sessions SET expiry_time = $1 WHERE id = $2",
-				now.Add(api.SessionTimeout), session.ID)
-			if err != nil {
-				log.Print("error refreshing session: ", err)
-			}
-		}()
-	}
-	return session, nil
+	return nil
 }
 
-func (api *API) ChangePasswordForAccount(ctx context.Context, accountID int64, old, new string) error {
+// ChangePasswordForAccount changes the password of an account and ends all
+// sessions of the account except the one with ID keepSessionID.
+func (api *API) ChangePasswordForAccount(
+	ctx context.Context, accountID, keepSessionID int64, old, new string,
+) error {
+	defer api.observe("ChangePasswordForAccount")()
 	tx, err := api.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
@@ -152,17 +156,28 @@ func (api *API) ChangePasswordForAccount(ctx context.Context, accountID int64, o
 		return err
 	}
 	if err = comparePassword(old, oldHash); err != nil {
+		tx.Rollback()
 		return ErrInvalidEmailOrPassword
 	}
+	if err = checkPassword(new); err != nil {
+		tx.Rollback()
+		return err
+	}
 	newHash, err := api.hashPassword(new)
 	if err != nil {
-		return ErrInvalidEmailOrPassword
+		tx.Rollback()
+		return err
 	}
 	query = "UPDATE accounts SET password_hash = $1 WHERE id = $2"
 	if _, err = tx.ExecContext(ctx, query, newHash, accountID); err != nil {
 		tx.Rollback()
 		return err
 	}
+	query = "DELETE FROM sessions WHERE account_id = $1 AND id <> $2"
+	if _, err = tx.ExecContext(ctx, query, accountID, keepSessionID); err != nil {
+		tx.Rollback()
+		return err
+	}
 	if err = tx.Commit(); err != nil {
 		tx.Rollback()
 		return err
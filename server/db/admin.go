@@ -0,0 +1,246 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type Account struct {
+	ID            int64  `json:"id"`
+	Email         string `json:"email"`
+	Role          string `json:"role"`
+	Disabled      bool   `json:"disabled"`
+	PurchaseCount int64  `json:"purchaseCount"`
+	ProductCount  int64  `json:"productCount"`
+	TagCount      int64  `json:"tagCount"`
+	SessionCount  int64  `json:"sessionCount"`
+}
+
+func (api *API) GetAccounts(ctx context.Context) ([]*Account, error) {
+	defer api.observe("GetAccounts")()
+	rows, err := api.DB.QueryContext(
+		ctx,
+		`
+SELECT
+	accounts.id,
+	accounts.email,
+	accounts.role,
+	accounts.disabled,
+	(SELECT count(*) FROM purchases
+		WHERE purchases.account_id = accounts.id AND NOT purchases.deleted),
+	(SELECT count(*) FROM products
+		WHERE products.account_id = accounts.id AND NOT products.deleted),
+	(SELECT count(*) FROM tags
+		WHERE tags.account_id = accounts.id AND NOT tags.deleted),
+	(SELECT count(*) FROM sessions
+		WHERE sessions.account_id = accounts.id AND sessions.expiry_time > $1)
+FROM accounts
+ORDER BY accounts.id`,
+		time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := []*Account{}
+	for rows.Next() {
+		a := &Account{}
+		err = rows.Scan(
+			&a.ID,
+			&a.Email,
+			&a.Role,
+			&a.Disabled,
+			&a.PurchaseCount,
+			&a.ProductCount,
+			&a.TagCount,
+			&a.SessionCount,
+		)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, a)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (api *API) GetAccountIDByEmail(ctx context.Context, email string) (int64, error) {
+	defer api.observe("GetAccountIDByEmail")()
+	var id int64
+	err := api.DB.
+		QueryRowContext(ctx, "SELECT id FROM accounts WHERE email = $1", normalizeEmail(email)).
+		Scan(&id)
+	if err == sql.ErrNoRows {
+		return -1, ErrNoRowsAffected
+	}
+	return id, err
+}
+
+type AccountUpdate struct {
+	Role     *string `json:"role"`
+	Disabled *bool   `json:"disabled"`
+}
+
+// UpdateAccount changes the role or disabled status of an account. Disabling
+// an account also ends all of its sessions and revokes its API tokens.
+func (api *API) UpdateAccount(ctx context.Context, accountID int64, update *AccountUpdate) error {
+	defer api.observe("UpdateAccount")()
+	builder := updateQuery("accounts")
+	if update.Role != nil {
+		if err := checkRole(*update.Role); err != nil {
+			return err
+		}
+		builder.Set("role", *update.Role)
+	}
+	if update.Disabled != nil {
+		builder.Set("disabled", *update.Disabled)
+	}
+	if !builder.HasParams() {
+		return nil
+	}
+	tx, err := api.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	query, params := builder.Where().Column("id", accountID).Build()
+	result, err := tx.ExecContext(ctx, query, params...)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if count == 0 {
+		tx.Rollback()
+		return ErrNoRowsAffected
+	}
+	if update.Disabled != nil && *update.Disabled {
+		if err = revokeCredentials(ctx, tx, accountID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return nil
+}
+
+// ResetPasswordForAccount sets the password of an account without requiring
+// the old password, unlocks the account, ends all sessions of the account and
+// revokes its API tokens.
+func (api *API) ResetPasswordForAccount(ctx context.Context, accountID int64, password string) error {
+	defer api.observe("ResetPasswordForAccount")()
+	if err := checkPassword(password); err != nil {
+		return err
+	}
+	hash, err := api.hashPassword(password)
+	if err != nil {
+		return err
+	}
+	tx, err := api.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	query := `
+UPDATE accounts
+SET password_hash = $1, failed_login_count = 0, locked_until = NULL
+WHERE id = $2`
+	result, err := tx.ExecContext(ctx, query, hash, accountID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if count == 0 {
+		tx.Rollback()
+		return ErrNoRowsAffected
+	}
+	if err = revokeCredentials(ctx, tx, accountID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return nil
+}
+
+// DeleteSessionsForAccount ends all sessions of an account and revokes its
+// API tokens.
+func (api *API) DeleteSessionsForAccount(ctx context.Context, accountID int64) error {
+	defer api.observe("DeleteSessionsForAccount")()
+	tx, err := api.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err = revokeCredentials(ctx, tx, accountID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return nil
+}
+
+// revokeCredentials deletes the sessions and API tokens of an account, so
+// that nothing issued before an administrator intervened keeps working.
+func revokeCredentials(ctx context.Context, tx *sql.Tx, accountID int64) error {
+	query := "DELETE FROM sessions WHERE account_id = $1"
+	if _, err := tx.ExecContext(ctx, query, accountID); err != nil {
+		return err
+	}
+	query = "DELETE FROM api_tokens WHERE account_id = $1"
+	_, err := tx.ExecContext(ctx, query, accountID)
+	return err
+}
+
+type UsageStats struct {
+	AccountCount         int64 `json:"accountCount"`
+	DisabledAccountCount int64 `json:"disabledAccountCount"`
+	ActiveSessionCount   int64 `json:"activeSessionCount"`
+	PurchaseCount        int64 `json:"purchaseCount"`
+	ProductCount         int64 `json:"productCount"`
+	TagCount             int64 `json:"tagCount"`
+}
+
+func (api *API) GetUsageStats(ctx context.Context) (*UsageStats, error) {
+	defer api.observe("GetUsageStats")()
+	stats := &UsageStats{}
+	err := api.DB.
+		QueryRowContext(
+			ctx,
+			`
+SELECT
+	(SELECT count(*) FROM accounts),
+	(SELECT count(*) FROM accounts WHERE disabled),
+	(SELECT count(*) FROM sessions WHERE expiry_time > $1),
+	(SELECT count(*) FROM purchases WHERE NOT deleted),
+	(SELECT count(*) FROM products WHERE NOT deleted),
+	(SELECT count(*) FROM tags WHERE NOT deleted)`,
+			time.Now().UTC()).
+		Scan(
+			&stats.AccountCount,
+			&stats.DisabledAccountCount,
+			&stats.ActiveSessionCount,
+			&stats.PurchaseCount,
+			&stats.ProductCount,
+			&stats.TagCount)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
@@ -0,0 +1,263 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// APITokenPrefix starts every personal API token so that they can be told
+// apart from session tokens.
+const APITokenPrefix = "pat_"
+
+// Scopes granted to personal API tokens.
+const (
+	// ScopeRead allows reading the data of the account.
+	ScopeRead = "read"
+	// ScopePurchasesWrite allows adding, changing and deleting purchases and
+	// the products and tags they refer to.
+	ScopePurchasesWrite = "purchases:write"
+	// ScopeReportsRead allows listing purchases for reporting without access
+	// to the rest of the account.
+	ScopeReportsRead = "reports:read"
+	// ScopeAdmin allows using the administration endpoints. It is only
+	// effective for administrator accounts.
+	ScopeAdmin = "admin"
+)
+
+const maxAPITokenNameLength = 100
+
+var (
+	ErrInvalidScope        = errors.New("invalid API token scope")
+	ErrInvalidTokenName    = errors.New("invalid API token name")
+	ErrAdminScopeForbidden = errors.New("admin scope requires an administrator account")
+)
+
+func checkScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return ErrInvalidScope
+	}
+	for _, scope := range scopes {
+		switch scope {
+		case ScopeRead, ScopePurchasesWrite, ScopeReportsRead, ScopeAdmin:
+		default:
+			return ErrInvalidScope
+		}
+	}
+	return nil
+}
+
+// APIToken is a long-lived credential used by scripts and integrations in
+// place of a session.
+type APIToken struct {
+	ID           int64      `json:"id"`
+	Token        string     `json:"token,omitempty"`
+	Name         string     `json:"name"`
+	Scopes       []string   `json:"scopes"`
+	CreationTime time.Time  `json:"creationTime"`
+	ExpiryTime   *time.Time `json:"expiryTime"`
+	LastUsedTime *time.Time `json:"lastUsedTime"`
+}
+
+// InsertAPIToken creates a new API token for an account. The token itself is
+// only returned here. A nil expiryTime creates a token that doesn't expire.
+func (api *API) InsertAPIToken(
+	ctx context.Context, accountID int64, name string, scopes []string, expiryTime *time.Time,
+) (*APIToken, error) {
+	defer api.observe("InsertAPIToken")()
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > maxAPITokenNameLength {
+		return nil, ErrInvalidTokenName
+	}
+	if err := checkScopes(scopes); err != nil {
+		return nil, err
+	}
+	tx, err := api.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	var role string
+	query := "SELECT role FROM accounts WHERE id = $1"
+	if err = tx.QueryRowContext(ctx, query, accountID).Scan(&role); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	for _, scope := range scopes {
+		if scope == ScopeAdmin && role != RoleAdmin {
+			tx.Rollback()
+			return nil, ErrAdminScopeForbidden
+		}
+	}
+	secret, err := generateToken(sessionTokenBytes)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	token := &APIToken{
+		Token:        APITokenPrefix + secret,
+		Name:         name,
+		Scopes:       scopes,
+		CreationTime: time.Now().UTC(),
+	}
+	if expiryTime != nil {
+		t := expiryTime.UTC()
+		token.ExpiryTime = &t
+	}
+	query = `
+INSERT INTO api_tokens (
+	account_id,
+	token_hash,
+	name,
+	scopes,
+	creation_time,
+	expiry_time
+)
+VALUES ($1, $2, $3, $4, $5, $6)
+RETURNING id`
+	err = tx.QueryRowContext(
+		ctx,
+		query,
+		accountID,
+		hashToken(token.Token),
+		token.Name,
+		pq.Array(token.Scopes),
+		token.CreationTime,
+		token.ExpiryTime).Scan(&token.ID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return token, nil
+}
+
+// GetAPITokensForAccount returns the API tokens of an account, newest first.
+// The tokens themselves are not returned.
+func (api *API) GetAPITokensForAccount(ctx context.Context, accountID int64) ([]*APIToken, error) {
+	defer api.observe("GetAPITokensForAccount")()
+	rows, err := api.DB.QueryContext(
+		ctx,
+		`
+SELECT id, name, scopes, creation_time, expiry_time, last_used_time
+FROM api_tokens
+WHERE account_id = $1
+ORDER BY creation_time DESC, id DESC`,
+		accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := []*APIToken{}
+	for rows.Next() {
+		t := &APIToken{}
+		var expiryTime, lastUsedTime sql.NullTime
+		err = rows.Scan(
+			&t.ID,
+			&t.Name,
+			pq.Array(&t.Scopes),
+			&t.CreationTime,
+			&expiryTime,
+			&lastUsedTime,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if expiryTime.Valid {
+			t.ExpiryTime = &expiryTime.Time
+		}
+		if lastUsedTime.Valid {
+			t.LastUsedTime = &lastUsedTime.Time
+		}
+		result = append(result, t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (api *API) DeleteAPIToken(ctx context.Context, tokenID, accountID int64) error {
+	defer api.observe("DeleteAPIToken")()
+	result, err := api.DB.ExecContext(
+		ctx,
+		"DELETE FROM api_tokens WHERE id = $1 AND account_id = $2",
+		tokenID,
+		accountID)
+	if err != nil {
+		return err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNoRowsAffected
+	}
+	return nil
+}
+
+// validateAPIToken returns a session representing a request authenticated
+// with an API token.
+func (api *API) validateAPIToken(ctx context.Context, token string) (*Session, error) {
+	session := &Session{Token: token}
+	var (
+		expiryTime   sql.NullTime
+		lastUsedTime sql.NullTime
+		disabled     bool
+	)
+	err := api.DB.
+		QueryRowContext(
+			ctx,
+			`
+SELECT
+	api_tokens.id,
+	api_tokens.account_id,
+	api_tokens.scopes,
+	api_tokens.expiry_time,
+	api_tokens.last_used_time,
+	accounts.role,
+	accounts.disabled
+FROM api_tokens, accounts
+WHERE api_tokens.token_hash = $1 AND accounts.id = api_tokens.account_id`,
+			hashToken(token)).
+		Scan(
+			&session.APITokenID,
+			&session.AccountID,
+			pq.Array(&session.Scopes),
+			&expiryTime,
+			&lastUsedTime,
+			&session.Role,
+			&disabled)
+	if err != nil {
+		return nil, err
+	}
+	if disabled {
+		return nil, ErrAccountDisabled
+	}
+	now := time.Now().UTC()
+	if expiryTime.Valid {
+		session.ExpiryTime = expiryTime.Time
+		if now.After(expiryTime.Time) {
+			return nil, ErrSessionExpired
+		}
+	}
+	if !lastUsedTime.Valid || now.Sub(lastUsedTime.Time) >= lastUsedResolution {
+		logger := api.logger(ctx)
+		go func() {
+			_, err := api.DB.Exec(
+				"UPDATE api_tokens SET last_used_time = $1 WHERE id = $2",
+				now, session.APITokenID)
+			if err != nil {
+				logger.WithError(err).Error("error updating API token")
+			}
+		}()
+	}
+	return session, nil
+}
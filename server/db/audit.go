@@ -0,0 +1,294 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Entities recorded in the audit log.
+const (
+	EntityPurchase = "purchase"
+	EntityProduct  = "product"
+	EntityTag      = "tag"
+)
+
+// Actions recorded in the audit log.
+const (
+	ActionCreate  = "create"
+	ActionUpdate  = "update"
+	ActionDelete  = "delete"
+	ActionRestore = "restore"
+	ActionPurge   = "purge"
+	ActionUndo    = "undo"
+	ActionRedo    = "redo"
+)
+
+const (
+	DefaultAuditLogLimit = 100
+	MaxAuditLogLimit     = 1000
+)
+
+var ErrInvalidEntity = errors.New("invalid entity")
+
+// Actor identifies who makes the changes recorded in the audit log.
+type Actor struct {
+	AccountID  int64
+	SessionID  int64
+	APITokenID int64
+}
+
+type actorContextKey struct{}
+
+// WithActor returns a context making changes on behalf of actor.
+func WithActor(ctx context.Context, actor *Actor) context.Context {
+	return context.WithValue(ctx, actorContextKey{}, actor)
+}
+
+func actorFromContext(ctx context.Context) *Actor {
+	actor, _ := ctx.Value(actorContextKey{}).(*Actor)
+	if actor == nil {
+		return &Actor{}
+	}
+	return actor
+}
+
+func nullID(id int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: id, Valid: id != 0}
+}
+
+// entityTables maps entities to the tables storing them.
+var entityTables = map[string]string{
+	EntityPurchase: "purchases",
+	EntityProduct:  "products",
+	EntityTag:      "tags",
+}
+
+// snapshotExprs are SQL expressions producing the JSON representation of an
+// entity stored in the audit log. The row of the entity is aliased as e.
+// Bookkeeping columns used for synchronization are left out.
+var snapshotExprs = map[string]string{
+	EntityPurchase: `
+	(to_jsonb(e) - '{account_id,client_id,change_version}'::text[]) || jsonb_build_object(
+		'tags',
+		(SELECT coalesce(jsonb_agg(tag_id ORDER BY tag_id), '[]')
+			FROM purchase_tag
+			WHERE purchase_id = e.id))`,
+	EntityProduct: "to_jsonb(e) - '{account_id,client_id,change_version}'::text[]",
+	EntityTag:     "to_jsonb(e) - '{account_id,client_id,change_version}'::text[]",
+}
+
+// snapshot returns the current state of an entity. ErrNoRowsAffected is
+// returned if the entity doesn't exist or belongs to another account.
+func snapshot(
+	ctx context.Context, tx *sql.Tx, entity string, entityID, accountID int64,
+) (json.RawMessage, error) {
+	query := "SELECT " + snapshotExprs[entity] + `
+FROM ` + entityTables[entity] + ` e
+WHERE e.id = $1 AND e.account_id = $2`
+	var data []byte
+	err := tx.QueryRowContext(ctx, query, entityID, accountID).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoRowsAffected
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// change is a modification of an entity made in a transaction.
+type change struct {
+	Entity   string
+	EntityID int64
+	Action   string
+	Before   json.RawMessage
+	After    json.RawMessage
+}
+
+// recordChange appends a change to the audit log of an account. If c.After is
+// nil, the state of the entity after the change is read from the database.
+// Changes that leave the entity as it was are not recorded.
+func recordChange(
+	ctx context.Context, tx *sql.Tx, accountID int64, c *change,
+) error {
+	if c.After == nil {
+		after, err := snapshot(ctx, tx, c.Entity, c.EntityID, accountID)
+		if err != nil {
+			return err
+		}
+		c.After = after
+	}
+	if c.Before != nil && bytes.Equal(c.Before, c.After) {
+		return nil
+	}
+	actor := actorFromContext(ctx)
+	if actor.SessionID != 0 && isUndoable(c.Action) {
+		if err := pushOperation(ctx, tx, actor.SessionID); err != nil {
+			return err
+		}
+	}
+	query := `
+INSERT INTO audit_log (
+	time,
+	account_id,
+	actor_account_id,
+	session_id,
+	api_token_id,
+	entity,
+	entity_id,
+	action,
+	before,
+	after
+)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+	var before interface{}
+	if c.Before != nil {
+		before = string(c.Before)
+	}
+	_, err := tx.ExecContext(
+		ctx,
+		query,
+		time.Now().UTC(),
+		accountID,
+		nullID(actor.AccountID),
+		nullID(actor.SessionID),
+		nullID(actor.APITokenID),
+		c.Entity,
+		c.EntityID,
+		c.Action,
+		before,
+		string(c.After))
+	return err
+}
+
+type AuditEntry struct {
+	ID             int64           `json:"id"`
+	Time           time.Time       `json:"time"`
+	ActorAccountID *int64          `json:"actorAccountId"`
+	SessionID      *int64          `json:"sessionId"`
+	APITokenID     *int64          `json:"apiTokenId"`
+	Entity         string          `json:"entity"`
+	EntityID       int64           `json:"entityId"`
+	Action         string          `json:"action"`
+	Before         json.RawMessage `json:"before"`
+	After          json.RawMessage `json:"after"`
+}
+
+// AuditFilter restricts the entries returned by GetAuditLog. Zero values
+// don't restrict the entries.
+type AuditFilter struct {
+	Entity   string
+	EntityID int64
+	From     time.Time
+	To       time.Time
+	Limit    int
+}
+
+// GetAuditLog returns the audit log entries of an account matching filter,
+// newest first.
+func (api *API) GetAuditLog(
+	ctx context.Context, accountID int64, filter *AuditFilter,
+) ([]*AuditEntry, error) {
+	defer api.observe("GetAuditLog")()
+	conditions := []string{"account_id = $1"}
+	params := []interface{}{accountID}
+	addCondition := func(condition string, param interface{}) {
+		params = append(params, param)
+		conditions = append(conditions, strings.Replace(
+			condition, "?", "$"+strconv.Itoa(len(params)), 1))
+	}
+	if filter.Entity != "" {
+		if _, ok := entityTables[filter.Entity]; !ok {
+			return nil, ErrInvalidEntity
+		}
+		addCondition("entity = ?", filter.Entity)
+	}
+	if filter.EntityID != 0 {
+		addCondition("entity_id = ?", filter.EntityID)
+	}
+	if !filter.From.IsZero() {
+		addCondition("time >= ?", filter.From.UTC())
+	}
+	if !filter.To.IsZero() {
+		addCondition("time < ?", filter.To.UTC())
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = DefaultAuditLogLimit
+	} else if limit > MaxAuditLogLimit {
+		limit = MaxAuditLogLimit
+	}
+	params = append(params, limit)
+	query := `
+SELECT
+	id,
+	time,
+	actor_account_id,
+	session_id,
+	api_token_id,
+	entity,
+	entity_id,
+	action,
+	before,
+	after
+FROM audit_log
+WHERE ` + strings.Join(conditions, " AND ") + `
+ORDER BY time DESC, id DESC
+LIMIT $` + strconv.Itoa(len(params))
+	rows, err := api.DB.QueryContext(ctx, query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := []*AuditEntry{}
+	for rows.Next() {
+		e := &AuditEntry{}
+		var (
+			actorAccountID sql.NullInt64
+			sessionID      sql.NullInt64
+			apiTokenID     sql.NullInt64
+			before         []byte
+			after          []byte
+		)
+		err = rows.Scan(
+			&e.ID,
+			&e.Time,
+			&actorAccountID,
+			&sessionID,
+			&apiTokenID,
+			&e.Entity,
+			&e.EntityID,
+			&e.Action,
+			&before,
+			&after,
+		)
+		if err != nil {
+			return nil, err
+		}
+		e.ActorAccountID = int64Ptr(actorAccountID)
+		e.SessionID = int64Ptr(sessionID)
+		e.APITokenID = int64Ptr(apiTokenID)
+		if before != nil {
+			e.Before = before
+		}
+		e.After = after
+		result = append(result, e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func int64Ptr(n sql.NullInt64) *int64 {
+	if !n.Valid {
+		return nil
+	}
+	return &n.Int64
+}
@@ -0,0 +1,279 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Operations of a purchase batch. Create, update, delete and restore act on a
+// single purchase, the others on all purchases matching a filter.
+const (
+	BatchCreate     = "create"
+	BatchUpdate     = "update"
+	BatchDelete     = "delete"
+	BatchRestore    = "restore"
+	BatchAddTag     = "addTag"
+	BatchRemoveTag  = "removeTag"
+	BatchSetProduct = "setProduct"
+)
+
+const MaxBatchOperations = 1000
+
+var (
+	ErrInvalidBatchOperation = errors.New("invalid batch operation")
+	ErrTooManyOperations     = errors.New("too many operations in batch")
+)
+
+// PurchaseFilter selects the purchases a bulk operation applies to. Zero
+// values don't restrict the purchases. Deleted purchases are never selected.
+type PurchaseFilter struct {
+	IDs     []int64    `json:"ids"`
+	From    *time.Time `json:"from"`
+	To      *time.Time `json:"to"`
+	Product *int64     `json:"product"`
+	Tag     *int64     `json:"tag"`
+}
+
+// empty reports whether f selects every purchase.
+func (f *PurchaseFilter) empty() bool {
+	return f.IDs == nil && f.From == nil && f.To == nil && f.Product == nil && f.Tag == nil
+}
+
+type BatchOperation struct {
+	Op string `json:"op"`
+	// ID is the purchase of create, update, delete and restore operations.
+	ID int64 `json:"id"`
+	// IfVersion, if not zero, makes update, delete and restore operations
+	// fail with ErrVersionMismatch unless the purchase has this version.
+	IfVersion int64           `json:"ifVersion"`
+	Values    *PurchaseUpdate `json:"values"`
+	// Filter selects the purchases of addTag, removeTag and setProduct
+	// operations. It must have at least one criterion.
+	Filter  *PurchaseFilter `json:"filter"`
+	Tag     int64           `json:"tag"`
+	Product int64           `json:"product"`
+}
+
+type BatchResult struct {
+	// ID is the purchase the operation acted on, if it acted on a single
+	// purchase.
+	ID int64 `json:"id,omitempty"`
+	// Version is the version of the purchase after the whole batch, set
+	// like ID.
+	Version int64 `json:"version,omitempty"`
+	// Count is the number of purchases changed by the operation.
+	Count int64 `json:"count"`
+}
+
+// BatchError is returned when an operation of a batch fails.
+type BatchError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("operation %d: %v", e.Index, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// ExecutePurchaseBatch executes operations on purchases in a single
+// transaction. Either all operations succeed or none of them is applied. If
+// an operation fails, a *BatchError identifying it is returned.
+func (api *API) ExecutePurchaseBatch(
+	ctx context.Context, accountID int64, operations []*BatchOperation,
+) ([]*BatchResult, error) {
+	defer api.observe("ExecutePurchaseBatch")()
+	if len(operations) > MaxBatchOperations {
+		return nil, ErrTooManyOperations
+	}
+	tx, err := api.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*BatchResult, len(operations))
+	for i, op := range operations {
+		switch op.Op {
+		case BatchUpdate, BatchDelete, BatchRestore:
+			err = checkVersion(ctx, tx, EntityPurchase, op.ID, accountID, op.IfVersion)
+			if err != nil {
+				tx.Rollback()
+				return nil, &BatchError{Index: i, Err: err}
+			}
+		}
+		results[i], err = executeBatchOperation(ctx, tx, accountID, op)
+		if err != nil {
+			tx.Rollback()
+			if dataErr := AsDataError(err); dataErr != nil {
+				err = dataErr
+			}
+			return nil, &BatchError{Index: i, Err: err}
+		}
+	}
+	for _, result := range results {
+		if result.ID == 0 {
+			continue
+		}
+		if result.Version, err = getVersion(ctx, tx, EntityPurchase, result.ID); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return results, nil
+}
+
+func executeBatchOperation(
+	ctx context.Context, tx *sql.Tx, accountID int64, op *BatchOperation,
+) (*BatchResult, error) {
+	switch op.Op {
+	case BatchCreate:
+		if op.Values == nil {
+			return nil, ErrInvalidBatchOperation
+		}
+		if err := validatePurchase(ctx, tx, accountID, op.Values, true); err != nil {
+			return nil, err
+		}
+		id, err := insertPurchase(ctx, tx, accountID, op.Values)
+		if err != nil {
+			return nil, err
+		}
+		return &BatchResult{ID: id, Count: 1}, nil
+	case BatchUpdate:
+		if op.Values == nil {
+			return nil, ErrInvalidBatchOperation
+		}
+		if err := validatePurchase(ctx, tx, accountID, op.Values, false); err != nil {
+			return nil, err
+		}
+		err := updatePurchase(ctx, tx, op.ID, accountID, op.Values)
+		if err != nil {
+			return nil, err
+		}
+		return &BatchResult{ID: op.ID, Count: 1}, nil
+	case BatchDelete:
+		if err := deletePurchase(ctx, tx, op.ID, accountID); err != nil {
+			return nil, err
+		}
+		return &BatchResult{ID: op.ID, Count: 1}, nil
+	case BatchRestore:
+		if _, err := restorePurchase(ctx, tx, op.ID, accountID); err != nil {
+			return nil, err
+		}
+		return &BatchResult{ID: op.ID, Count: 1}, nil
+	case BatchAddTag:
+		query := `
+INSERT INTO purchase_tag (purchase_id, tag_id)
+SELECT $1, $2
+WHERE NOT EXISTS (
+	SELECT 1 FROM purchase_tag WHERE purchase_id = $1 AND tag_id = $2
+)`
+		return bulkUpdatePurchases(ctx, tx, accountID, op, "tags", op.Tag, query)
+	case BatchRemoveTag:
+		query := "DELETE FROM purchase_tag WHERE purchase_id = $1 AND tag_id = $2"
+		return bulkUpdatePurchases(ctx, tx, accountID, op, "tags", op.Tag, query)
+	case BatchSetProduct:
+		query := "UPDATE purchases SET product_id = $2 WHERE id = $1 AND product_id <> $2"
+		return bulkUpdatePurchases(ctx, tx, accountID, op, "products", op.Product, query)
+	default:
+		return nil, ErrInvalidBatchOperation
+	}
+}
+
+// bulkUpdatePurchases runs query with the ID of each purchase matching the
+// filter of op and the ID of a product or tag as parameters. The product or
+// tag must belong to the account and not be deleted.
+func bulkUpdatePurchases(
+	ctx context.Context,
+	tx *sql.Tx,
+	accountID int64,
+	op *BatchOperation,
+	table string,
+	targetID int64,
+	query string,
+) (*BatchResult, error) {
+	// A filter without criteria is rejected so that a mistake in a request
+	// can't change every purchase of the account.
+	if op.Filter == nil || op.Filter.empty() {
+		return nil, ErrInvalidBatchOperation
+	}
+	exists, err := entityExists(ctx, tx, table, accountID, targetID)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrNoRowsAffected
+	}
+	purchaseIDs, err := filterPurchases(ctx, tx, accountID, op.Filter)
+	if err != nil {
+		return nil, err
+	}
+	result := &BatchResult{}
+	for _, purchaseID := range purchaseIDs {
+		before, err := snapshot(ctx, tx, EntityPurchase, purchaseID, accountID)
+		if err != nil {
+			return nil, err
+		}
+		res, err := tx.ExecContext(ctx, query, purchaseID, targetID)
+		if err != nil {
+			return nil, err
+		}
+		count, err := res.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			continue
+		}
+		err = recordChange(ctx, tx, accountID, &change{
+			Entity:   EntityPurchase,
+			EntityID: purchaseID,
+			Action:   ActionUpdate,
+			Before:   before,
+		})
+		if err != nil {
+			return nil, err
+		}
+		result.Count++
+	}
+	return result, nil
+}
+
+// filterPurchases returns the IDs of the purchases of an account matching
+// filter and locks them for the rest of the transaction.
+func filterPurchases(
+	ctx context.Context, tx *sql.Tx, accountID int64, filter *PurchaseFilter,
+) ([]int64, error) {
+	conditions := purchaseConditions(accountID, filter)
+	query := `
+SELECT id
+FROM purchases
+WHERE ` + conditions.String() + `
+ORDER BY id
+FOR UPDATE`
+	rows, err := tx.QueryContext(ctx, query, conditions.params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
@@ -0,0 +1,171 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+// changesChannel is the notification channel the audit log publishes changes
+// to.
+const changesChannel = "data_changes"
+
+// ActionResync tells a subscriber that changes may have been missed and its
+// data should be reloaded.
+const ActionResync = "resync"
+
+// changeBufferSize is the number of events a subscriber can lag behind before
+// it is dropped.
+const changeBufferSize = 64
+
+// ChangeEvent tells that a purchase, product or tag of an account has
+// changed.
+type ChangeEvent struct {
+	AccountID int64  `json:"accountId"`
+	Entity    string `json:"entity,omitempty"`
+	EntityID  int64  `json:"entityId,omitempty"`
+	Action    string `json:"action"`
+}
+
+// ChangeFeed distributes the changes recorded in the audit log to
+// subscribers. Changes are received with PostgreSQL LISTEN/NOTIFY, so changes
+// made through any server instance sharing the database are seen.
+type ChangeFeed struct {
+	// Log is used for errors of the connection to the database. Nil is the
+	// standard logger of logrus.
+	Log *logrus.Logger
+
+	listener *pq.Listener
+
+	mu          sync.Mutex
+	subscribers map[int64]map[chan *ChangeEvent]struct{}
+}
+
+// NewChangeFeed creates a feed listening to the database identified by
+// connStr. Run must be called to start distributing changes.
+func NewChangeFeed(connStr string) *ChangeFeed {
+	f := &ChangeFeed{subscribers: map[int64]map[chan *ChangeEvent]struct{}{}}
+	f.listener = pq.NewListener(connStr, time.Second, time.Minute,
+		func(event pq.ListenerEventType, err error) {
+			if err != nil {
+				f.logError(err)
+			}
+		})
+	return f
+}
+
+func (f *ChangeFeed) logError(err error) {
+	logger := f.Log
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+	logger.WithError(err).Error("change feed error")
+}
+
+// Run distributes changes until ctx is done. The feed is closed when Run
+// returns.
+func (f *ChangeFeed) Run(ctx context.Context) error {
+	defer f.close()
+	if err := f.listener.Listen(changesChannel); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case n := <-f.listener.Notify:
+			if n == nil {
+				// The connection was lost and notifications sent in the
+				// meantime are gone.
+				f.broadcast(&ChangeEvent{Action: ActionResync})
+				continue
+			}
+			event := &ChangeEvent{}
+			if err := json.Unmarshal([]byte(n.Extra), event); err != nil {
+				f.logError(err)
+				continue
+			}
+			f.publish(event)
+		}
+	}
+}
+
+// Subscribe returns a channel receiving the changes of an account. The
+// channel is closed when cancel is called, when the feed is closed or when
+// the subscriber falls too far behind.
+func (f *ChangeFeed) Subscribe(accountID int64) (events <-chan *ChangeEvent, cancel func()) {
+	ch := make(chan *ChangeEvent, changeBufferSize)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.subscribers == nil {
+		close(ch)
+		return ch, func() {}
+	}
+	if f.subscribers[accountID] == nil {
+		f.subscribers[accountID] = map[chan *ChangeEvent]struct{}{}
+	}
+	f.subscribers[accountID][ch] = struct{}{}
+	return ch, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.unsubscribe(accountID, ch)
+	}
+}
+
+// unsubscribe removes and closes a subscriber channel. f.mu must be held.
+func (f *ChangeFeed) unsubscribe(accountID int64, ch chan *ChangeEvent) {
+	if _, ok := f.subscribers[accountID][ch]; !ok {
+		return
+	}
+	delete(f.subscribers[accountID], ch)
+	if len(f.subscribers[accountID]) == 0 {
+		delete(f.subscribers, accountID)
+	}
+	close(ch)
+}
+
+func (f *ChangeFeed) publish(event *ChangeEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for ch := range f.subscribers[event.AccountID] {
+		f.send(event.AccountID, ch, event)
+	}
+}
+
+func (f *ChangeFeed) broadcast(event *ChangeEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for accountID, chans := range f.subscribers {
+		for ch := range chans {
+			f.send(accountID, ch, event)
+		}
+	}
+}
+
+// send delivers an event without blocking. A subscriber whose buffer is full
+// is dropped. f.mu must be held.
+func (f *ChangeFeed) send(accountID int64, ch chan *ChangeEvent, event *ChangeEvent) {
+	select {
+	case ch <- event:
+	default:
+		f.unsubscribe(accountID, ch)
+	}
+}
+
+func (f *ChangeFeed) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for accountID, chans := range f.subscribers {
+		for ch := range chans {
+			f.unsubscribe(accountID, ch)
+		}
+	}
+	f.subscribers = nil
+	if err := f.listener.Close(); err != nil {
+		f.logError(err)
+	}
+}
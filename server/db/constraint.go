@@ -0,0 +1,110 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/lib/pq"
+)
+
+// Kinds of values rejected by the database.
+const (
+	DataInvalid          = "invalid"
+	DataMissing          = "missing"
+	DataUnknownReference = "unknownReference"
+	DataDuplicate        = "duplicate"
+)
+
+// DataError reports an invalid value of a request, such as a reference to a
+// product that doesn't exist or a price that isn't positive. The value may have
+// been rejected by validation or by a constraint of the database.
+type DataError struct {
+	// Kind is one of the Data* constants.
+	Kind string
+	// Field is the path of the rejected value in the request, such as price
+	// or tags/1, or empty if unknown.
+	Field   string
+	Message string
+	err     *pq.Error
+}
+
+func (e *DataError) Error() string {
+	if e.Field == "" {
+		return e.Message
+	}
+	return e.Field + ": " + e.Message
+}
+
+func (e *DataError) Unwrap() error {
+	if e.err == nil {
+		return nil
+	}
+	return e.err
+}
+
+type constraintField struct {
+	field, message string
+}
+
+// constraintFields maps the constraints of the database to the fields of
+// requests they check.
+var constraintFields = map[string]constraintField{
+	"purchases_product_id_fkey": {"product", "product does not exist"},
+	"purchases_quantity_check":  {"quantity", "must be positive"},
+	"purchases_price_check":     {"price", "must be positive"},
+	"purchase_tag_tag_id_fkey":  {"tags", "tag does not exist"},
+	"accounts_email_check":      {"email", ErrInvalidEmail.Error()},
+	"accounts_email_key":        {"email", ErrEmailTaken.Error()},
+}
+
+// columnFields maps columns whose name differs from the field of requests.
+var columnFields = map[string]string{
+	"product_id": "product",
+	"tag_id":     "tags",
+}
+
+// AsDataError returns the error describing the values rejected by the database
+// if err was caused by one, or nil otherwise.
+func AsDataError(err error) *DataError {
+	var dataErr *DataError
+	if errors.As(err, &dataErr) {
+		return dataErr
+	}
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return nil
+	}
+	dataErr = &DataError{err: pqErr}
+	switch pqErr.Code.Name() {
+	case "foreign_key_violation":
+		dataErr.Kind = DataUnknownReference
+		dataErr.Message = "refers to a missing entity"
+	case "not_null_violation":
+		dataErr.Kind = DataMissing
+		dataErr.Message = "is required"
+		dataErr.Field = pqErr.Column
+		if field, ok := columnFields[pqErr.Column]; ok {
+			dataErr.Field = field
+		}
+	case "unique_violation":
+		dataErr.Kind = DataDuplicate
+		dataErr.Message = "already exists"
+	default:
+		switch pqErr.Code.Class() {
+		case "22":
+			// Data exceptions, such as malformed numbers, describe the
+			// rejected value in the message.
+			dataErr.Kind = DataInvalid
+			dataErr.Message = pqErr.Message
+		case "23":
+			dataErr.Kind = DataInvalid
+			dataErr.Message = "invalid value"
+		default:
+			return nil
+		}
+	}
+	if c, ok := constraintFields[pqErr.Constraint]; ok {
+		dataErr.Field = c.field
+		dataErr.Message = c.message
+	}
+	return dataErr
+}
@@ -1,9 +1,14 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"sync"
 	"time"
+
+	"github.com/lassilaiho/expenditure-accounting/server/logging"
+	"github.com/sirupsen/logrus"
 )
 
 var (
@@ -15,4 +20,42 @@ type API struct {
 	BcryptCost     int
 	SessionTimeout time.Duration
 	RefreshTime    time.Duration
+	// MaxLoginFailures is the number of consecutive failed logins after which
+	// an account is locked. Zero disables locking accounts.
+	MaxLoginFailures int
+	// LockoutDuration is the time an account is locked for after
+	// MaxLoginFailures failed logins. The duration doubles with every further
+	// failure up to MaxLockoutDuration.
+	LockoutDuration time.Duration
+	// Currency rounds the total prices of purchases. Nil is DefaultCurrency.
+	Currency *Currency
+	// ObserveQuery, if not nil, is called with the name and duration of each
+	// call to an exported method.
+	ObserveQuery func(method string, duration time.Duration)
+	// AllowPrivateWebhooks accepts webhook URLs pointing to localhost and
+	// private addresses.
+	AllowPrivateWebhooks bool
+	// Log is used for errors that aren't returned to the caller when the
+	// context doesn't carry a logger. Nil is the standard logger of logrus.
+	Log *logrus.Logger
+
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+}
+
+// logger returns the logger carried by ctx or Log.
+func (api *API) logger(ctx context.Context) *logrus.Entry {
+	return logging.Logger(ctx, api.Log)
+}
+
+// observe returns a function reporting the time elapsed since the call to
+// observe to ObserveQuery. Methods use it as defer api.observe("Method")().
+func (api *API) observe(method string) func() {
+	if api.ObserveQuery == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		api.ObserveQuery(method, time.Since(start))
+	}
 }
@@ -0,0 +1,344 @@
+package db
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// maxDecimalExponent limits the exponents accepted by ParseDecimal so that
+// parsing can't be used to allocate huge numbers.
+const maxDecimalExponent = 100
+
+var ErrInvalidDecimal = errors.New("invalid decimal number")
+
+// Decimal is an exact decimal number such as a quantity or a price. The zero
+// value is zero. Decimals are immutable; the arithmetic methods return new
+// values.
+type Decimal struct {
+	// The value is unscaled * 10^-scale. A nil unscaled is zero.
+	unscaled *big.Int
+	scale    int
+}
+
+// NewDecimal returns unscaled * 10^-scale.
+func NewDecimal(unscaled int64, scale int) Decimal {
+	if scale < 0 {
+		return Decimal{new(big.Int).Mul(big.NewInt(unscaled), pow10(-scale)), 0}
+	}
+	return Decimal{big.NewInt(unscaled), scale}
+}
+
+// ParseDecimal parses a decimal number such as "12", "-0.25" or "1.5e3". The
+// scale of the result is the number of decimal places in s.
+func ParseDecimal(s string) (Decimal, error) {
+	mantissa, exp := s, 0
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		var err error
+		if exp, err = strconv.Atoi(s[i+1:]); err != nil {
+			return Decimal{}, ErrInvalidDecimal
+		}
+		if exp > maxDecimalExponent || exp < -maxDecimalExponent {
+			return Decimal{}, ErrInvalidDecimal
+		}
+		mantissa = s[:i]
+	}
+	intPart, fracPart := mantissa, ""
+	if i := strings.IndexByte(mantissa, '.'); i >= 0 {
+		intPart, fracPart = mantissa[:i], mantissa[i+1:]
+		if fracPart == "" {
+			return Decimal{}, ErrInvalidDecimal
+		}
+	}
+	sign := ""
+	if strings.HasPrefix(intPart, "-") || strings.HasPrefix(intPart, "+") {
+		sign, intPart = intPart[:1], intPart[1:]
+	}
+	if intPart == "" || !isDigits(intPart) || !isDigits(fracPart) {
+		return Decimal{}, ErrInvalidDecimal
+	}
+	unscaled, ok := new(big.Int).SetString(sign+intPart+fracPart, 10)
+	if !ok {
+		return Decimal{}, ErrInvalidDecimal
+	}
+	scale := len(fracPart) - exp
+	if scale < 0 {
+		unscaled.Mul(unscaled, pow10(-scale))
+		scale = 0
+	}
+	return Decimal{unscaled, scale}, nil
+}
+
+// MustParseDecimal is like ParseDecimal but panics if s is invalid.
+func MustParseDecimal(s string) Decimal {
+	d, err := ParseDecimal(s)
+	if err != nil {
+		panic(fmt.Sprintf("invalid decimal %q", s))
+	}
+	return d
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+func (d Decimal) int() *big.Int {
+	if d.unscaled == nil {
+		return new(big.Int)
+	}
+	return d.unscaled
+}
+
+// rescale returns the unscaled value of d with scale, which must not be less
+// than the scale of d.
+func (d Decimal) rescale(scale int) *big.Int {
+	return new(big.Int).Mul(d.int(), pow10(scale-d.scale))
+}
+
+// Scale returns the number of decimal places of d.
+func (d Decimal) Scale() int {
+	return d.scale
+}
+
+// Sign returns -1, 0 or 1 depending on whether d is negative, zero or positive.
+func (d Decimal) Sign() int {
+	return d.int().Sign()
+}
+
+// IntegerDigits returns the number of digits before the decimal point of d
+// without leading zeros.
+func (d Decimal) IntegerDigits() int {
+	i := new(big.Int).Quo(new(big.Int).Abs(d.int()), pow10(d.scale))
+	if i.Sign() == 0 {
+		return 0
+	}
+	return len(i.String())
+}
+
+// Normalize returns d without trailing zeros after the decimal point.
+func (d Decimal) Normalize() Decimal {
+	unscaled, scale := new(big.Int).Set(d.int()), d.scale
+	ten, rem := big.NewInt(10), new(big.Int)
+	for scale > 0 {
+		q, r := new(big.Int).QuoRem(unscaled, ten, rem)
+		if r.Sign() != 0 {
+			break
+		}
+		unscaled, scale = q, scale-1
+	}
+	return Decimal{unscaled, scale}
+}
+
+// Cmp returns -1, 0 or 1 depending on whether d is less than, equal to or
+// greater than other.
+func (d Decimal) Cmp(other Decimal) int {
+	scale := d.scale
+	if other.scale > scale {
+		scale = other.scale
+	}
+	return d.rescale(scale).Cmp(other.rescale(scale))
+}
+
+// Add returns d + other.
+func (d Decimal) Add(other Decimal) Decimal {
+	scale := d.scale
+	if other.scale > scale {
+		scale = other.scale
+	}
+	return Decimal{new(big.Int).Add(d.rescale(scale), other.rescale(scale)), scale}
+}
+
+// Mul returns d * other. The scale of the result is the sum of the scales.
+func (d Decimal) Mul(other Decimal) Decimal {
+	return Decimal{new(big.Int).Mul(d.int(), other.int()), d.scale + other.scale}
+}
+
+// Round returns d rounded to scale decimal places with mode. The result always
+// has exactly scale decimal places.
+func (d Decimal) Round(scale int, mode RoundingMode) Decimal {
+	if d.scale <= scale {
+		return Decimal{d.rescale(scale), scale}
+	}
+	divisor := pow10(d.scale - scale)
+	q, r := new(big.Int).QuoRem(new(big.Int).Abs(d.int()), divisor, new(big.Int))
+	if r.Sign() != 0 {
+		half := new(big.Int).Lsh(r, 1).Cmp(divisor)
+		var increment bool
+		switch mode {
+		case RoundUp:
+			increment = true
+		case RoundDown:
+			increment = false
+		case RoundHalfEven:
+			increment = half > 0 || half == 0 && q.Bit(0) == 1
+		default:
+			increment = half >= 0
+		}
+		if increment {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	if d.Sign() < 0 {
+		q.Neg(q)
+	}
+	return Decimal{q, scale}
+}
+
+func (d Decimal) String() string {
+	digits := new(big.Int).Abs(d.int()).String()
+	if d.scale > 0 {
+		if len(digits) <= d.scale {
+			digits = strings.Repeat("0", d.scale-len(digits)+1) + digits
+		}
+		point := len(digits) - d.scale
+		digits = digits[:point] + "." + digits[point:]
+	}
+	if d.Sign() < 0 {
+		return "-" + digits
+	}
+	return digits
+}
+
+// MarshalJSON encodes d as a string to preserve its precision in clients.
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON decodes a decimal from a string or a number.
+func (d *Decimal) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		return nil
+	}
+	if strings.HasPrefix(s, `"`) {
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+	}
+	parsed, err := ParseDecimal(s)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+// Scan implements sql.Scanner for numeric columns.
+func (d *Decimal) Scan(src interface{}) error {
+	var err error
+	switch src := src.(type) {
+	case []byte:
+		*d, err = ParseDecimal(string(src))
+	case string:
+		*d, err = ParseDecimal(src)
+	case int64:
+		*d = NewDecimal(src, 0)
+	case float64:
+		*d, err = ParseDecimal(strconv.FormatFloat(src, 'f', -1, 64))
+	default:
+		return fmt.Errorf("cannot scan %T into Decimal", src)
+	}
+	return err
+}
+
+// Value implements driver.Valuer.
+func (d Decimal) Value() (driver.Value, error) {
+	return d.String(), nil
+}
+
+// RoundingMode determines how Decimal.Round rounds values halfway between two
+// results and values not representable with the scale.
+type RoundingMode int
+
+const (
+	// RoundHalfUp rounds halfway values away from zero.
+	RoundHalfUp RoundingMode = iota
+	// RoundHalfEven rounds halfway values to the nearest even result.
+	RoundHalfEven
+	// RoundDown rounds towards zero.
+	RoundDown
+	// RoundUp rounds away from zero.
+	RoundUp
+)
+
+var roundingModeNames = map[RoundingMode]string{
+	RoundHalfUp:   "halfUp",
+	RoundHalfEven: "halfEven",
+	RoundDown:     "down",
+	RoundUp:       "up",
+}
+
+func (m RoundingMode) String() string {
+	return roundingModeNames[m]
+}
+
+// UnmarshalText parses the name of a rounding mode, such as halfEven.
+func (m *RoundingMode) UnmarshalText(text []byte) error {
+	for mode, name := range roundingModeNames {
+		if name == string(text) {
+			*m = mode
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid rounding mode %q", text)
+}
+
+// Currency determines the scale and rounding of amounts of money.
+type Currency struct {
+	// Code is the ISO 4217 code of the currency.
+	Code string
+	// Scale is the number of decimal places of rounded amounts.
+	Scale    int
+	Rounding RoundingMode
+}
+
+// DefaultCurrency is used if no currency is configured.
+var DefaultCurrency = NewCurrency("EUR")
+
+// currencyScales lists the currencies whose amounts don't have two decimal
+// places.
+var currencyScales = map[string]int{
+	"BHD": 3,
+	"CLP": 0,
+	"ISK": 0,
+	"JOD": 3,
+	"JPY": 0,
+	"KRW": 0,
+	"KWD": 3,
+	"OMR": 3,
+	"TND": 3,
+	"VND": 0,
+}
+
+// NewCurrency returns the currency with an ISO 4217 code. Amounts are rounded
+// half up to the usual number of decimal places of the currency.
+func NewCurrency(code string) *Currency {
+	code = strings.ToUpper(code)
+	scale, ok := currencyScales[code]
+	if !ok {
+		scale = 2
+	}
+	return &Currency{Code: code, Scale: scale, Rounding: RoundHalfUp}
+}
+
+// Round rounds an amount of money in the currency.
+func (c *Currency) Round(amount Decimal) Decimal {
+	return amount.Round(c.Scale, c.Rounding)
+}
+
+func (api *API) currency() *Currency {
+	if api.Currency == nil {
+		return DefaultCurrency
+	}
+	return api.Currency
+}
+
+// setTotalPrice computes the total price of a purchase rounded in the currency
+// of the API.
+func (api *API) setTotalPrice(p *Purchase) {
+	p.TotalPrice = api.currency().Round(p.Quantity.Mul(p.Price))
+}
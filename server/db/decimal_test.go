@@ -0,0 +1,106 @@
+package db
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDecimal(t *testing.T) {
+	valid := map[string]string{
+		"0":       "0",
+		"12":      "12",
+		"+12":     "12",
+		"-0.25":   "-0.25",
+		"0.050":   "0.050",
+		"1.5e3":   "1500",
+		"1.25E-1": "0.125",
+		"25e-4":   "0.0025",
+	}
+	for s, expected := range valid {
+		d, err := ParseDecimal(s)
+		require.Nil(t, err, s)
+		require.Equal(t, expected, d.String(), s)
+	}
+	for _, s := range []string{"", "-", ".5", "1.", "1,5", "abc", "1e", "1e1000", "0x10", "Inf"} {
+		_, err := ParseDecimal(s)
+		require.Equal(t, ErrInvalidDecimal, err, s)
+	}
+	require.Equal(t, "0", Decimal{}.String())
+	require.Equal(t, "1.00", NewDecimal(100, 2).String())
+	require.Equal(t, "-0.05", NewDecimal(-5, 2).String())
+	require.Equal(t, "3000", NewDecimal(3, -3).String())
+}
+
+func TestDecimalArithmetic(t *testing.T) {
+	a, b := MustParseDecimal("2.53"), MustParseDecimal("2.09")
+	require.Equal(t, "5.2877", a.Mul(b).String())
+	require.Equal(t, "4.62", a.Add(b).String())
+	require.Equal(t, "2.6", MustParseDecimal("0.1").Add(MustParseDecimal("2.5")).String())
+	require.Equal(t, 1, a.Cmp(b))
+	require.Equal(t, 0, MustParseDecimal("2.5").Cmp(MustParseDecimal("2.500")))
+	require.Equal(t, "2.5", MustParseDecimal("2.500").Normalize().String())
+	require.Equal(t, "100", MustParseDecimal("100").Normalize().String())
+	require.Equal(t, 3, MustParseDecimal("-123.45").IntegerDigits())
+	require.Equal(t, 0, MustParseDecimal("0.45").IntegerDigits())
+}
+
+func TestDecimalRound(t *testing.T) {
+	cases := []struct {
+		value                      string
+		halfUp, halfEven, down, up string
+	}{
+		{"1.005", "1.01", "1.00", "1.00", "1.01"},
+		{"1.015", "1.02", "1.02", "1.01", "1.02"},
+		{"1.0151", "1.02", "1.02", "1.01", "1.02"},
+		{"-1.005", "-1.01", "-1.00", "-1.00", "-1.01"},
+		{"2.5", "2.50", "2.50", "2.50", "2.50"},
+		{"0.001", "0.00", "0.00", "0.00", "0.01"},
+	}
+	for _, c := range cases {
+		d := MustParseDecimal(c.value)
+		require.Equal(t, c.halfUp, d.Round(2, RoundHalfUp).String(), c.value)
+		require.Equal(t, c.halfEven, d.Round(2, RoundHalfEven).String(), c.value)
+		require.Equal(t, c.down, d.Round(2, RoundDown).String(), c.value)
+		require.Equal(t, c.up, d.Round(2, RoundUp).String(), c.value)
+	}
+	require.Equal(t, "1236", MustParseDecimal("1235.5").Round(0, RoundHalfEven).String())
+	require.Equal(t, "5", NewCurrency("jpy").Round(MustParseDecimal("4.5")).String())
+	require.Equal(t, "0.125", NewCurrency("KWD").Round(MustParseDecimal("0.1245")).String())
+}
+
+func TestDecimalJSON(t *testing.T) {
+	var values struct {
+		String Decimal  `json:"string"`
+		Number Decimal  `json:"number"`
+		Null   *Decimal `json:"null"`
+	}
+	err := json.Unmarshal([]byte(`{"string": "1.50", "number": 2.25, "null": null}`), &values)
+	require.Nil(t, err)
+	require.Equal(t, "1.50", values.String.String())
+	require.Equal(t, "2.25", values.Number.String())
+	require.Nil(t, values.Null)
+	data, err := json.Marshal(&values)
+	require.Nil(t, err)
+	require.JSONEq(t, `{"string": "1.50", "number": "2.25", "null": null}`, string(data))
+	require.NotNil(t, json.Unmarshal([]byte(`{"string": "1.5x"}`), &values))
+	require.NotNil(t, json.Unmarshal([]byte(`{"string": true}`), &values))
+
+	var mode RoundingMode
+	require.Nil(t, json.Unmarshal([]byte(`"halfEven"`), &mode))
+	require.Equal(t, RoundHalfEven, mode)
+	require.NotNil(t, json.Unmarshal([]byte(`"sideways"`), &mode))
+}
+
+func TestDecimalSQL(t *testing.T) {
+	var d Decimal
+	require.Nil(t, d.Scan([]byte("12.340")))
+	require.Equal(t, "12.340", d.String())
+	require.Nil(t, d.Scan(int64(7)))
+	require.Equal(t, "7", d.String())
+	require.NotNil(t, d.Scan(nil))
+	value, err := MustParseDecimal("-0.5").Value()
+	require.Nil(t, err)
+	require.Equal(t, "-0.5", value)
+}
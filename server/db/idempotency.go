@@ -0,0 +1,143 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const MaxIdempotencyKeyLength = 255
+
+var (
+	ErrInvalidIdempotencyKey    = errors.New("invalid idempotency key")
+	ErrIdempotencyKeyReused     = errors.New("idempotency key has been used with a different request")
+	ErrIdempotencyKeyInProgress = errors.New("request with the idempotency key is still in progress")
+)
+
+// StoredResponse is the response to a request made with an idempotency key.
+type StoredResponse struct {
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// BeginIdempotentRequest reserves an idempotency key of an account for a
+// request identified by requestHash. Keys older than window are forgotten. If
+// the key has already been used for the same request, the stored response is
+// returned. Otherwise the response is nil and the request must be completed
+// with CompleteIdempotentRequest or AbortIdempotentRequest.
+func (api *API) BeginIdempotentRequest(
+	ctx context.Context, accountID int64, key, requestHash string, window time.Duration,
+) (*StoredResponse, error) {
+	defer api.observe("BeginIdempotentRequest")()
+	if key == "" || len(key) > MaxIdempotencyKeyLength {
+		return nil, ErrInvalidIdempotencyKey
+	}
+	tx, err := api.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	query := "DELETE FROM idempotency_keys WHERE account_id = $1 AND creation_time < $2"
+	if _, err = tx.ExecContext(ctx, query, accountID, now.Add(-window)); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	query = `
+INSERT INTO idempotency_keys (account_id, key, request_hash, creation_time)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (account_id, key) DO NOTHING`
+	result, err := tx.ExecContext(ctx, query, accountID, key, requestHash, now)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if inserted > 0 {
+		if err = tx.Commit(); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		return nil, nil
+	}
+	var (
+		storedHash string
+		completed  bool
+		response   StoredResponse
+	)
+	query = `
+SELECT request_hash, completed, status, content_type, body
+FROM idempotency_keys
+WHERE account_id = $1 AND key = $2`
+	err = tx.QueryRowContext(ctx, query, accountID, key).Scan(
+		&storedHash,
+		&completed,
+		&response.Status,
+		&response.ContentType,
+		&response.Body,
+	)
+	tx.Rollback()
+	if err == sql.ErrNoRows {
+		// The key was released by a concurrent request.
+		return nil, ErrIdempotencyKeyInProgress
+	}
+	if err != nil {
+		return nil, err
+	}
+	if storedHash != requestHash {
+		return nil, ErrIdempotencyKeyReused
+	}
+	if !completed {
+		return nil, ErrIdempotencyKeyInProgress
+	}
+	return &response, nil
+}
+
+// CompleteIdempotentRequest stores the response to a request begun with
+// BeginIdempotentRequest.
+func (api *API) CompleteIdempotentRequest(
+	ctx context.Context, accountID int64, key string, response *StoredResponse,
+) error {
+	defer api.observe("CompleteIdempotentRequest")()
+	query := `
+UPDATE idempotency_keys
+SET completed = TRUE, status = $1, content_type = $2, body = $3
+WHERE account_id = $4 AND key = $5`
+	_, err := api.DB.ExecContext(
+		ctx,
+		query,
+		response.Status,
+		response.ContentType,
+		response.Body,
+		accountID,
+		key)
+	return err
+}
+
+// AbortIdempotentRequest releases an idempotency key so that the request can
+// be retried.
+func (api *API) AbortIdempotentRequest(ctx context.Context, accountID int64, key string) error {
+	defer api.observe("AbortIdempotentRequest")()
+	query := "DELETE FROM idempotency_keys WHERE account_id = $1 AND key = $2 AND NOT completed"
+	_, err := api.DB.ExecContext(ctx, query, accountID, key)
+	return err
+}
+
+// PurgeIdempotencyKeys deletes the idempotency keys of all accounts created
+// before the given time. The number of deleted keys is returned.
+func (api *API) PurgeIdempotencyKeys(ctx context.Context, before time.Time) (int64, error) {
+	defer api.observe("PurgeIdempotencyKeys")()
+	result, err := api.DB.ExecContext(
+		ctx,
+		"DELETE FROM idempotency_keys WHERE creation_time < $1",
+		before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
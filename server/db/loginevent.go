@@ -0,0 +1,140 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MaxLockoutDuration limits how long an account can be locked after repeated
+// failed logins.
+const MaxLockoutDuration = time.Hour
+
+// Results of login attempts recorded in login events.
+const (
+	LoginSucceeded        = "success"
+	LoginChallengeIssued  = "challenge_issued"
+	LoginInvalidPassword  = "invalid_password"
+	LoginUnknownEmail     = "unknown_email"
+	LoginLocked           = "locked"
+	LoginDisabled         = "disabled"
+	LoginTwoFactorFailed  = "invalid_two_factor_code"
+	LoginPasswordDisabled = "password_login_disabled"
+	LoginOIDC             = "oidc"
+)
+
+const maxLoginEventsFetched = 100
+
+type LoginEvent struct {
+	ID        int64     `json:"id"`
+	Time      time.Time `json:"time"`
+	Email     string    `json:"email"`
+	IPAddress string    `json:"ipAddress"`
+	UserAgent string    `json:"userAgent"`
+	Result    string    `json:"result"`
+}
+
+// compareDummyPassword spends the same time as checking a password against an
+// existing password hash.
+func (api *API) compareDummyPassword(password string) {
+	api.dummyHashOnce.Do(func() {
+		hash, err := api.hashPassword("dummy password")
+		if err != nil {
+			api.logger(context.Background()).WithError(err).
+				Error("error generating dummy password hash")
+		}
+		api.dummyHash = hash
+	})
+	bcrypt.CompareHashAndPassword(api.dummyHash, []byte(password))
+}
+
+// lockoutDuration returns how long an account is locked after failureCount
+// consecutive failed logins.
+func (api *API) lockoutDuration(failureCount int) time.Duration {
+	if api.MaxLoginFailures <= 0 || failureCount < api.MaxLoginFailures {
+		return 0
+	}
+	d := api.LockoutDuration
+	for i := api.MaxLoginFailures; i < failureCount && d < MaxLockoutDuration; i++ {
+		d *= 2
+	}
+	if d > MaxLockoutDuration {
+		d = MaxLockoutDuration
+	}
+	return d
+}
+
+func (api *API) recordFailedLogin(
+	ctx context.Context, tx *sql.Tx, accountID int64, failureCount int, now time.Time,
+) error {
+	lockedUntil := sql.NullTime{}
+	if d := api.lockoutDuration(failureCount); d > 0 {
+		lockedUntil = sql.NullTime{Time: now.Add(d), Valid: true}
+	}
+	query := `
+UPDATE accounts
+SET failed_login_count = $1, locked_until = $2
+WHERE id = $3`
+	_, err := tx.ExecContext(ctx, query, failureCount, lockedUntil, accountID)
+	return err
+}
+
+// recordLoginEvent stores the result of a login attempt. Errors are logged
+// instead of being returned so that they don't affect the login itself.
+func (api *API) recordLoginEvent(
+	ctx context.Context, accountID *int64, email string, client *ClientInfo, result string,
+) {
+	if client == nil {
+		client = &ClientInfo{}
+	}
+	query := `
+INSERT INTO login_events (time, account_id, email, ip_address, user_agent, result)
+VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err := api.DB.ExecContext(
+		ctx,
+		query,
+		time.Now().UTC(),
+		accountID,
+		email,
+		client.IPAddress,
+		truncateUserAgent(client.UserAgent),
+		result)
+	if err != nil {
+		api.logger(ctx).WithError(err).Error("error recording login event")
+	}
+}
+
+// GetLoginEventsForAccount returns the most recent login attempts to an
+// account, newest first.
+func (api *API) GetLoginEventsForAccount(ctx context.Context, accountID int64) ([]*LoginEvent, error) {
+	defer api.observe("GetLoginEventsForAccount")()
+	rows, err := api.DB.QueryContext(
+		ctx,
+		`
+SELECT id, time, email, ip_address, user_agent, result
+FROM login_events
+WHERE account_id = $1
+ORDER BY time DESC, id DESC
+LIMIT $2`,
+		accountID,
+		maxLoginEventsFetched)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := []*LoginEvent{}
+	for rows.Next() {
+		e := &LoginEvent{}
+		err = rows.Scan(&e.ID, &e.Time, &e.Email, &e.IPAddress, &e.UserAgent, &e.Result)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
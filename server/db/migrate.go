@@ -6,37 +6,107 @@ import (
 	"strconv"
 )
 
-const SchemaVersion = 2
+const SchemaVersion = 16
 
 var schemaVersionStr = strconv.Itoa(SchemaVersion)
 
 var initDBScript = `
 CREATE TABLE IF NOT EXISTS accounts (
     id SERIAL PRIMARY KEY,
-    email text NOT NULL,
+    email text NOT NULL UNIQUE CHECK (email = lower(btrim(email))),
     password_hash text NOT NULL,
-    role varchar(5) NOT NULL
+    role varchar(5) NOT NULL,
+    disabled boolean NOT NULL DEFAULT FALSE,
+    totp_secret text NOT NULL DEFAULT '',
+    totp_enabled boolean NOT NULL DEFAULT FALSE,
+    totp_last_step bigint NOT NULL DEFAULT 0,
+    failed_login_count integer NOT NULL DEFAULT 0,
+    locked_until timestamp,
+    password_login boolean NOT NULL DEFAULT TRUE,
+    oidc_issuer text,
+    oidc_subject text,
+    UNIQUE (oidc_issuer, oidc_subject)
+);
+
+CREATE TABLE IF NOT EXISTS oidc_login_states (
+    id SERIAL PRIMARY KEY,
+    state_hash varchar(64) NOT NULL UNIQUE,
+    nonce text NOT NULL,
+    code_verifier text NOT NULL,
+    expiry_time timestamp NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS login_events (
+    id SERIAL PRIMARY KEY,
+    time timestamp NOT NULL,
+    account_id integer REFERENCES accounts ON DELETE CASCADE,
+    email text NOT NULL,
+    ip_address text NOT NULL,
+    user_agent text NOT NULL,
+    result text NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS login_events_account_id_time_idx
+ON login_events (account_id, time);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id SERIAL PRIMARY KEY,
+    account_id integer NOT NULL REFERENCES accounts ON DELETE CASCADE,
+    code_hash varchar(64) NOT NULL,
+    used boolean NOT NULL DEFAULT FALSE
+);
+
+CREATE TABLE IF NOT EXISTS login_challenges (
+    id SERIAL PRIMARY KEY,
+    token_hash varchar(64) NOT NULL UNIQUE,
+    account_id integer NOT NULL REFERENCES accounts ON DELETE CASCADE,
+    expiry_time timestamp NOT NULL,
+    attempts integer NOT NULL DEFAULT 0
 );
 
 CREATE TABLE IF NOT EXISTS sessions (
     id SERIAL PRIMARY KEY,
-    token varchar(64) NOT NULL UNIQUE,
+    token_hash varchar(64) NOT NULL UNIQUE,
     expiry_time timestamp NOT NULL,
-    account_id integer NOT NULL REFERENCES accounts ON DELETE CASCADE
+    account_id integer NOT NULL REFERENCES accounts ON DELETE CASCADE,
+    creation_time timestamp NOT NULL DEFAULT (now() AT TIME ZONE 'utc'),
+    last_used_time timestamp NOT NULL DEFAULT (now() AT TIME ZONE 'utc'),
+    user_agent text NOT NULL DEFAULT '',
+    ip_address text NOT NULL DEFAULT '',
+    name text NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS api_tokens (
+    id SERIAL PRIMARY KEY,
+    account_id integer NOT NULL REFERENCES accounts ON DELETE CASCADE,
+    token_hash varchar(64) NOT NULL UNIQUE,
+    name text NOT NULL,
+    scopes text[] NOT NULL,
+    creation_time timestamp NOT NULL,
+    expiry_time timestamp,
+    last_used_time timestamp
 );
 
 CREATE TABLE IF NOT EXISTS products (
     id SERIAL PRIMARY KEY,
     name text NOT NULL,
     account_id integer NOT NULL REFERENCES accounts ON DELETE CASCADE,
-    deleted boolean NOT NULL DEFAULT FALSE
+    deleted boolean NOT NULL DEFAULT FALSE,
+    deleted_time timestamp,
+    client_id text,
+    change_version bigint NOT NULL DEFAULT txid_current(),
+    UNIQUE (account_id, client_id)
 );
 
 CREATE TABLE IF NOT EXISTS tags (
     id SERIAL PRIMARY KEY,
     name text NOT NULL,
     account_id integer NOT NULL REFERENCES accounts ON DELETE CASCADE,
-    deleted boolean NOT NULL DEFAULT FALSE
+    deleted boolean NOT NULL DEFAULT FALSE,
+    deleted_time timestamp,
+    client_id text,
+    change_version bigint NOT NULL DEFAULT txid_current(),
+    UNIQUE (account_id, client_id)
 );
 
 CREATE TABLE IF NOT EXISTS purchases (
@@ -47,16 +117,213 @@ CREATE TABLE IF NOT EXISTS purchases (
     price numeric NOT NULL CHECK (price > 0),
     total_price numeric GENERATED ALWAYS AS (quantity * price) STORED,
     account_id integer NOT NULL REFERENCES accounts ON DELETE CASCADE,
-    deleted boolean NOT NULL DEFAULT FALSE
+    deleted boolean NOT NULL DEFAULT FALSE,
+    deleted_time timestamp,
+    client_id text,
+    change_version bigint NOT NULL DEFAULT txid_current(),
+    UNIQUE (account_id, client_id)
 );
 
 CREATE TABLE IF NOT EXISTS purchase_tag (
     id SERIAL PRIMARY KEY,
     purchase_id integer NOT NULL REFERENCES purchases ON DELETE CASCADE,
     tag_id integer NOT NULL REFERENCES tags ON DELETE CASCADE,
-    deleted boolean NOT NULL DEFAULT FALSE
+    deleted boolean NOT NULL DEFAULT FALSE,
+    change_version bigint NOT NULL DEFAULT txid_current()
+);
+
+CREATE INDEX IF NOT EXISTS products_account_id_change_version_idx
+ON products (account_id, change_version);
+
+CREATE INDEX IF NOT EXISTS tags_account_id_change_version_idx
+ON tags (account_id, change_version);
+
+CREATE INDEX IF NOT EXISTS purchases_account_id_change_version_idx
+ON purchases (account_id, change_version);
+
+CREATE OR REPLACE FUNCTION set_change_version() RETURNS trigger AS $$
+BEGIN
+    NEW.change_version := txid_current();
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION purchase_tag_touch_purchase() RETURNS trigger AS $$
+BEGIN
+    UPDATE purchases
+    SET change_version = txid_current()
+    WHERE id = COALESCE(NEW.purchase_id, OLD.purchase_id)
+        AND change_version <> txid_current();
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS products_set_change_version ON products;
+CREATE TRIGGER products_set_change_version
+BEFORE INSERT OR UPDATE ON products
+FOR EACH ROW EXECUTE FUNCTION set_change_version();
+
+DROP TRIGGER IF EXISTS tags_set_change_version ON tags;
+CREATE TRIGGER tags_set_change_version
+BEFORE INSERT OR UPDATE ON tags
+FOR EACH ROW EXECUTE FUNCTION set_change_version();
+
+DROP TRIGGER IF EXISTS purchases_set_change_version ON purchases;
+CREATE TRIGGER purchases_set_change_version
+BEFORE INSERT OR UPDATE ON purchases
+FOR EACH ROW EXECUTE FUNCTION set_change_version();
+
+DROP TRIGGER IF EXISTS purchase_tag_set_change_version ON purchase_tag;
+CREATE TRIGGER purchase_tag_set_change_version
+BEFORE INSERT OR UPDATE ON purchase_tag
+FOR EACH ROW EXECUTE FUNCTION set_change_version();
+
+DROP TRIGGER IF EXISTS purchase_tag_touch_purchase ON purchase_tag;
+CREATE TRIGGER purchase_tag_touch_purchase
+AFTER INSERT OR UPDATE OR DELETE ON purchase_tag
+FOR EACH ROW EXECUTE FUNCTION purchase_tag_touch_purchase();
+
+CREATE TABLE IF NOT EXISTS audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    time timestamp NOT NULL,
+    account_id integer NOT NULL REFERENCES accounts ON DELETE CASCADE,
+    actor_account_id integer,
+    session_id integer,
+    api_token_id integer,
+    entity text NOT NULL,
+    entity_id integer NOT NULL,
+    action text NOT NULL,
+    before jsonb,
+    after jsonb NOT NULL,
+    operation_id bigint NOT NULL DEFAULT txid_current()
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_account_id_time_idx
+ON audit_log (account_id, time);
+
+CREATE INDEX IF NOT EXISTS audit_log_account_id_entity_entity_id_idx
+ON audit_log (account_id, entity, entity_id);
+
+CREATE INDEX IF NOT EXISTS audit_log_account_id_operation_id_idx
+ON audit_log (account_id, operation_id);
+
+CREATE OR REPLACE FUNCTION audit_log_prevent_update() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit log entries cannot be modified';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_log_prevent_update ON audit_log;
+CREATE TRIGGER audit_log_prevent_update
+BEFORE UPDATE ON audit_log
+FOR EACH ROW EXECUTE FUNCTION audit_log_prevent_update();
+
+CREATE OR REPLACE FUNCTION audit_log_notify() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('data_changes', json_build_object(
+        'accountId', NEW.account_id,
+        'entity', NEW.entity,
+        'entityId', NEW.entity_id,
+        'action', NEW.action
+    )::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_log_notify ON audit_log;
+CREATE TRIGGER audit_log_notify
+AFTER INSERT ON audit_log
+FOR EACH ROW EXECUTE FUNCTION audit_log_notify();
+
+CREATE TABLE IF NOT EXISTS session_operations (
+    id SERIAL PRIMARY KEY,
+    session_id integer NOT NULL REFERENCES sessions ON DELETE CASCADE,
+    operation_id bigint NOT NULL,
+    undone boolean NOT NULL DEFAULT FALSE,
+    UNIQUE (session_id, operation_id)
+);
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    id SERIAL PRIMARY KEY,
+    account_id integer NOT NULL REFERENCES accounts ON DELETE CASCADE,
+    key text NOT NULL,
+    request_hash varchar(64) NOT NULL,
+    creation_time timestamp NOT NULL,
+    completed boolean NOT NULL DEFAULT FALSE,
+    status integer NOT NULL DEFAULT 0,
+    content_type text NOT NULL DEFAULT '',
+    body bytea NOT NULL DEFAULT '',
+    UNIQUE (account_id, key)
+);
+
+CREATE TABLE IF NOT EXISTS webhooks (
+    id SERIAL PRIMARY KEY,
+    account_id integer NOT NULL REFERENCES accounts ON DELETE CASCADE,
+    url text NOT NULL,
+    events text[] NOT NULL,
+    secret text NOT NULL,
+    active boolean NOT NULL DEFAULT TRUE,
+    creation_time timestamp NOT NULL
 );
 
+CREATE INDEX IF NOT EXISTS webhooks_account_id_idx ON webhooks (account_id);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id BIGSERIAL PRIMARY KEY,
+    webhook_id integer NOT NULL REFERENCES webhooks ON DELETE CASCADE,
+    event text NOT NULL,
+    payload text NOT NULL,
+    creation_time timestamp NOT NULL,
+    status text NOT NULL DEFAULT 'pending',
+    attempts integer NOT NULL DEFAULT 0,
+    next_attempt_time timestamp NOT NULL,
+    last_attempt_time timestamp,
+    response_status integer,
+    error text NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_status_next_attempt_time_idx
+ON webhook_deliveries (status, next_attempt_time);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_id_creation_time_idx
+ON webhook_deliveries (webhook_id, creation_time);
+
+CREATE OR REPLACE FUNCTION audit_log_enqueue_webhooks() RETURNS trigger AS $$
+DECLARE
+    event_type text := NEW.entity || '.' || NEW.action;
+BEGIN
+    INSERT INTO webhook_deliveries (
+        webhook_id,
+        event,
+        payload,
+        creation_time,
+        next_attempt_time
+    )
+    SELECT
+        id,
+        event_type,
+        json_build_object(
+            'event', event_type,
+            'time', to_char(NEW.time, 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"'),
+            'entity', NEW.entity,
+            'entityId', NEW.entity_id,
+            'action', NEW.action,
+            'before', NEW.before,
+            'after', NEW.after
+        )::text,
+        NEW.time,
+        NEW.time
+    FROM webhooks
+    WHERE account_id = NEW.account_id AND active AND event_type = ANY(events);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_log_enqueue_webhooks ON audit_log;
+CREATE TRIGGER audit_log_enqueue_webhooks
+AFTER INSERT ON audit_log
+FOR EACH ROW EXECUTE FUNCTION audit_log_enqueue_webhooks();
+
 CREATE TABLE IF NOT EXISTS metadata (
     id SERIAL PRIMARY KEY,
     version integer NOT NULL,
@@ -86,10 +353,367 @@ ADD COLUMN deleted boolean NOT NULL DEFAULT FALSE;
 
 UPDATE metadata SET is_current = FALSE;
 INSERT INTO metadata (version, is_current)
-VALUES (` + schemaVersionStr + `, TRUE);`,
+VALUES (2, TRUE);`,
+	{From: 2, To: 3}: `
+UPDATE accounts SET email = lower(btrim(email));
+
+ALTER TABLE accounts
+ADD CONSTRAINT accounts_email_key UNIQUE (email),
+ADD CONSTRAINT accounts_email_check CHECK (email = lower(btrim(email)));
+
+UPDATE metadata SET is_current = FALSE;
+INSERT INTO metadata (version, is_current)
+VALUES (3, TRUE);`,
+	{From: 3, To: 4}: `
+ALTER TABLE accounts
+ADD COLUMN disabled boolean NOT NULL DEFAULT FALSE;
+
+UPDATE metadata SET is_current = FALSE;
+INSERT INTO metadata (version, is_current)
+VALUES (4, TRUE);`,
+	{From: 4, To: 5}: `
+ALTER TABLE sessions
+ADD COLUMN creation_time timestamp NOT NULL DEFAULT (now() AT TIME ZONE 'utc'),
+ADD COLUMN last_used_time timestamp NOT NULL DEFAULT (now() AT TIME ZONE 'utc'),
+ADD COLUMN user_agent text NOT NULL DEFAULT '',
+ADD COLUMN ip_address text NOT NULL DEFAULT '',
+ADD COLUMN name text NOT NULL DEFAULT '';
+
+UPDATE metadata SET is_current = FALSE;
+INSERT INTO metadata (version, is_current)
+VALUES (5, TRUE);`,
+	{From: 5, To: 6}: `
+DELETE FROM sessions;
+
+ALTER TABLE sessions
+RENAME COLUMN token TO token_hash;
+
+UPDATE metadata SET is_current = FALSE;
+INSERT INTO metadata (version, is_current)
+VALUES (6, TRUE);`,
+	{From: 6, To: 7}: `
+ALTER TABLE accounts
+ADD COLUMN totp_secret text NOT NULL DEFAULT '',
+ADD COLUMN totp_enabled boolean NOT NULL DEFAULT FALSE,
+ADD COLUMN totp_last_step bigint NOT NULL DEFAULT 0;
+
+CREATE TABLE recovery_codes (
+    id SERIAL PRIMARY KEY,
+    account_id integer NOT NULL REFERENCES accounts ON DELETE CASCADE,
+    code_hash varchar(64) NOT NULL,
+    used boolean NOT NULL DEFAULT FALSE
+);
+
+CREATE TABLE login_challenges (
+    id SERIAL PRIMARY KEY,
+    token_hash varchar(64) NOT NULL UNIQUE,
+    account_id integer NOT NULL REFERENCES accounts ON DELETE CASCADE,
+    expiry_time timestamp NOT NULL,
+    attempts integer NOT NULL DEFAULT 0
+);
+
+UPDATE metadata SET is_current = FALSE;
+INSERT INTO metadata (version, is_current)
+VALUES (7, TRUE);`,
+	{From: 7, To: 8}: `
+ALTER TABLE accounts
+ADD COLUMN failed_login_count integer NOT NULL DEFAULT 0,
+ADD COLUMN locked_until timestamp;
+
+CREATE TABLE login_events (
+    id SERIAL PRIMARY KEY,
+    time timestamp NOT NULL,
+    account_id integer REFERENCES accounts ON DELETE CASCADE,
+    email text NOT NULL,
+    ip_address text NOT NULL,
+    user_agent text NOT NULL,
+    result text NOT NULL
+);
+
+CREATE INDEX login_events_account_id_time_idx
+ON login_events (account_id, time);
+
+UPDATE metadata SET is_current = FALSE;
+INSERT INTO metadata (version, is_current)
+VALUES (8, TRUE);`,
+	{From: 8, To: 9}: `
+CREATE TABLE api_tokens (
+    id SERIAL PRIMARY KEY,
+    account_id integer NOT NULL REFERENCES accounts ON DELETE CASCADE,
+    token_hash varchar(64) NOT NULL UNIQUE,
+    name text NOT NULL,
+    scopes text[] NOT NULL,
+    creation_time timestamp NOT NULL,
+    expiry_time timestamp,
+    last_used_time timestamp
+);
+
+UPDATE metadata SET is_current = FALSE;
+INSERT INTO metadata (version, is_current)
+VALUES (9, TRUE);`,
+	{From: 9, To: 10}: `
+ALTER TABLE accounts
+ADD COLUMN password_login boolean NOT NULL DEFAULT TRUE,
+ADD COLUMN oidc_issuer text,
+ADD COLUMN oidc_subject text,
+ADD CONSTRAINT accounts_oidc_issuer_oidc_subject_key UNIQUE (oidc_issuer, oidc_subject);
+
+CREATE TABLE oidc_login_states (
+    id SERIAL PRIMARY KEY,
+    state_hash varchar(64) NOT NULL UNIQUE,
+    nonce text NOT NULL,
+    code_verifier text NOT NULL,
+    expiry_time timestamp NOT NULL
+);
+
+UPDATE metadata SET is_current = FALSE;
+INSERT INTO metadata (version, is_current)
+VALUES (10, TRUE);`,
+	{From: 10, To: 11}: `
+CREATE TABLE audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    time timestamp NOT NULL,
+    account_id integer NOT NULL REFERENCES accounts ON DELETE CASCADE,
+    actor_account_id integer,
+    session_id integer,
+    api_token_id integer,
+    entity text NOT NULL,
+    entity_id integer NOT NULL,
+    action text NOT NULL,
+    before jsonb,
+    after jsonb NOT NULL
+);
+
+CREATE INDEX audit_log_account_id_time_idx
+ON audit_log (account_id, time);
+
+CREATE INDEX audit_log_account_id_entity_entity_id_idx
+ON audit_log (account_id, entity, entity_id);
+
+CREATE FUNCTION audit_log_prevent_update() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit log entries cannot be modified';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_prevent_update
+BEFORE UPDATE ON audit_log
+FOR EACH ROW EXECUTE FUNCTION audit_log_prevent_update();
+
+UPDATE metadata SET is_current = FALSE;
+INSERT INTO metadata (version, is_current)
+VALUES (11, TRUE);`,
+	{From: 11, To: 12}: `
+ALTER TABLE products
+ADD COLUMN deleted_time timestamp;
+
+ALTER TABLE tags
+ADD COLUMN deleted_time timestamp;
+
+ALTER TABLE purchases
+ADD COLUMN deleted_time timestamp;
+
+UPDATE products SET deleted_time = now() AT TIME ZONE 'utc' WHERE deleted;
+UPDATE tags SET deleted_time = now() AT TIME ZONE 'utc' WHERE deleted;
+UPDATE purchases SET deleted_time = now() AT TIME ZONE 'utc' WHERE deleted;
+
+ALTER TABLE audit_log
+ADD COLUMN operation_id bigint NOT NULL DEFAULT txid_current();
+
+CREATE INDEX audit_log_account_id_operation_id_idx
+ON audit_log (account_id, operation_id);
+
+CREATE TABLE session_operations (
+    id SERIAL PRIMARY KEY,
+    session_id integer NOT NULL REFERENCES sessions ON DELETE CASCADE,
+    operation_id bigint NOT NULL,
+    undone boolean NOT NULL DEFAULT FALSE,
+    UNIQUE (session_id, operation_id)
+);
+
+UPDATE metadata SET is_current = FALSE;
+INSERT INTO metadata (version, is_current)
+VALUES (12, TRUE);`,
+	{From: 12, To: 13}: `
+ALTER TABLE products
+ADD COLUMN client_id text,
+ADD COLUMN change_version bigint NOT NULL DEFAULT txid_current(),
+ADD CONSTRAINT products_account_id_client_id_key UNIQUE (account_id, client_id);
+
+ALTER TABLE tags
+ADD COLUMN client_id text,
+ADD COLUMN change_version bigint NOT NULL DEFAULT txid_current(),
+ADD CONSTRAINT tags_account_id_client_id_key UNIQUE (account_id, client_id);
+
+ALTER TABLE purchases
+ADD COLUMN client_id text,
+ADD COLUMN change_version bigint NOT NULL DEFAULT txid_current(),
+ADD CONSTRAINT purchases_account_id_client_id_key UNIQUE (account_id, client_id);
+
+ALTER TABLE purchase_tag
+ADD COLUMN change_version bigint NOT NULL DEFAULT txid_current();
+
+CREATE INDEX products_account_id_change_version_idx
+ON products (account_id, change_version);
+
+CREATE INDEX tags_account_id_change_version_idx
+ON tags (account_id, change_version);
+
+CREATE INDEX purchases_account_id_change_version_idx
+ON purchases (account_id, change_version);
+
+CREATE FUNCTION set_change_version() RETURNS trigger AS $$
+BEGIN
+    NEW.change_version := txid_current();
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION purchase_tag_touch_purchase() RETURNS trigger AS $$
+BEGIN
+    UPDATE purchases
+    SET change_version = txid_current()
+    WHERE id = COALESCE(NEW.purchase_id, OLD.purchase_id)
+        AND change_version <> txid_current();
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER products_set_change_version
+BEFORE INSERT OR UPDATE ON products
+FOR EACH ROW EXECUTE FUNCTION set_change_version();
+
+CREATE TRIGGER tags_set_change_version
+BEFORE INSERT OR UPDATE ON tags
+FOR EACH ROW EXECUTE FUNCTION set_change_version();
+
+CREATE TRIGGER purchases_set_change_version
+BEFORE INSERT OR UPDATE ON purchases
+FOR EACH ROW EXECUTE FUNCTION set_change_version();
+
+CREATE TRIGGER purchase_tag_set_change_version
+BEFORE INSERT OR UPDATE ON purchase_tag
+FOR EACH ROW EXECUTE FUNCTION set_change_version();
+
+CREATE TRIGGER purchase_tag_touch_purchase
+AFTER INSERT OR UPDATE OR DELETE ON purchase_tag
+FOR EACH ROW EXECUTE FUNCTION purchase_tag_touch_purchase();
+
+UPDATE metadata SET is_current = FALSE;
+INSERT INTO metadata (version, is_current)
+VALUES (13, TRUE);`,
+	{From: 13, To: 14}: `
+CREATE TABLE idempotency_keys (
+    id SERIAL PRIMARY KEY,
+    account_id integer NOT NULL REFERENCES accounts ON DELETE CASCADE,
+    key text NOT NULL,
+    request_hash varchar(64) NOT NULL,
+    creation_time timestamp NOT NULL,
+    completed boolean NOT NULL DEFAULT FALSE,
+    status integer NOT NULL DEFAULT 0,
+    content_type text NOT NULL DEFAULT '',
+    body bytea NOT NULL DEFAULT '',
+    UNIQUE (account_id, key)
+);
+
+UPDATE metadata SET is_current = FALSE;
+INSERT INTO metadata (version, is_current)
+VALUES (14, TRUE);`,
+	{From: 14, To: 15}: `
+CREATE FUNCTION audit_log_notify() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('data_changes', json_build_object(
+        'accountId', NEW.account_id,
+        'entity', NEW.entity,
+        'entityId', NEW.entity_id,
+        'action', NEW.action
+    )::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_notify
+AFTER INSERT ON audit_log
+FOR EACH ROW EXECUTE FUNCTION audit_log_notify();
+
+UPDATE metadata SET is_current = FALSE;
+INSERT INTO metadata (version, is_current)
+VALUES (15, TRUE);`,
+	{From: 15, To: 16}: `
+CREATE TABLE webhooks (
+    id SERIAL PRIMARY KEY,
+    account_id integer NOT NULL REFERENCES accounts ON DELETE CASCADE,
+    url text NOT NULL,
+    events text[] NOT NULL,
+    secret text NOT NULL,
+    active boolean NOT NULL DEFAULT TRUE,
+    creation_time timestamp NOT NULL
+);
+
+CREATE INDEX webhooks_account_id_idx ON webhooks (account_id);
+
+CREATE TABLE webhook_deliveries (
+    id BIGSERIAL PRIMARY KEY,
+    webhook_id integer NOT NULL REFERENCES webhooks ON DELETE CASCADE,
+    event text NOT NULL,
+    payload text NOT NULL,
+    creation_time timestamp NOT NULL,
+    status text NOT NULL DEFAULT 'pending',
+    attempts integer NOT NULL DEFAULT 0,
+    next_attempt_time timestamp NOT NULL,
+    last_attempt_time timestamp,
+    response_status integer,
+    error text NOT NULL DEFAULT ''
+);
+
+CREATE INDEX webhook_deliveries_status_next_attempt_time_idx
+ON webhook_deliveries (status, next_attempt_time);
+
+CREATE INDEX webhook_deliveries_webhook_id_creation_time_idx
+ON webhook_deliveries (webhook_id, creation_time);
+
+CREATE FUNCTION audit_log_enqueue_webhooks() RETURNS trigger AS $$
+DECLARE
+    event_type text := NEW.entity || '.' || NEW.action;
+BEGIN
+    INSERT INTO webhook_deliveries (
+        webhook_id,
+        event,
+        payload,
+        creation_time,
+        next_attempt_time
+    )
+    SELECT
+        id,
+        event_type,
+        json_build_object(
+            'event', event_type,
+            'time', to_char(NEW.time, 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"'),
+            'entity', NEW.entity,
+            'entityId', NEW.entity_id,
+            'action', NEW.action,
+            'before', NEW.before,
+            'after', NEW.after
+        )::text,
+        NEW.time,
+        NEW.time
+    FROM webhooks
+    WHERE account_id = NEW.account_id AND active AND event_type = ANY(events);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_enqueue_webhooks
+AFTER INSERT ON audit_log
+FOR EACH ROW EXECUTE FUNCTION audit_log_enqueue_webhooks();
+
+UPDATE metadata SET is_current = FALSE;
+INSERT INTO metadata (version, is_current)
+VALUES (16, TRUE);`,
 }
 
 func (api *API) GetSchemaVersion(ctx context.Context) (version int, err error) {
+	defer api.observe("GetSchemaVersion")()
 	query := "SELECT version FROM metadata WHERE is_current = TRUE"
 	err = api.DB.QueryRowContext(ctx, query).Scan(&version)
 	return
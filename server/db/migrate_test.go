@@ -19,7 +19,7 @@ var dbAPI = API{
 var bgctx = context.Background()
 
 func TestMain(m *testing.M) {
-	migrationScripts[migration{From: 2, To: 3}] =
+	migrationScripts[migration{From: SchemaVersion, To: SchemaVersion + 1}] =
 		"ALTER TABLE metadata ADD COLUMN test_col TEXT DEFAULT 'test'"
 
 	var cleanup func()
@@ -35,7 +35,7 @@ func TestAutoMigrate(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, SchemaVersion, version)
 
-	require.Nil(t, dbAPI.AutoMigrate(bgctx, 3))
+	require.Nil(t, dbAPI.AutoMigrate(bgctx, SchemaVersion+1))
 	var testData string
 	require.Nil(t, dbAPI.DB.QueryRow(
 		"select test_col from metadata").Scan(&testData))
@@ -0,0 +1,308 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"time"
+)
+
+const oidcLoginTimeout = 10 * time.Minute
+
+var (
+	ErrInvalidOIDCState      = errors.New("invalid or expired OpenID Connect login state")
+	ErrOIDCAccountNotFound   = errors.New("no account is linked to the identity")
+	ErrOIDCIdentityMismatch  = errors.New("account is linked to another identity")
+	ErrPasswordLoginDisabled = errors.New("password login is disabled for the account")
+	ErrNoOIDCIdentity        = errors.New("account has no linked identity")
+	ErrOIDCLinkRequired      = errors.New("account must be linked to the identity while logged in")
+	ErrOIDCIdentityTaken     = errors.New("identity is linked to another account")
+)
+
+// OIDCLoginState holds the values generated for an OpenID Connect
+// authorization request that are needed again when the user returns from the
+// identity provider.
+type OIDCLoginState struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+}
+
+// CodeChallenge returns the S256 PKCE code challenge derived from the code
+// verifier.
+func (s *OIDCLoginState) CodeChallenge() string {
+	hash := sha256.Sum256([]byte(s.CodeVerifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// BeginOIDCLogin generates and stores the state of a new OpenID Connect
+// login.
+func (api *API) BeginOIDCLogin(ctx context.Context) (*OIDCLoginState, error) {
+	defer api.observe("BeginOIDCLogin")()
+	state := &OIDCLoginState{}
+	for _, s := range []*string{&state.State, &state.Nonce, &state.CodeVerifier} {
+		token, err := generateToken(sessionTokenBytes)
+		if err != nil {
+			return nil, err
+		}
+		*s = token
+	}
+	tx, err := api.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	query := `
+INSERT INTO oidc_login_states (state_hash, nonce, code_verifier, expiry_time)
+VALUES ($1, $2, $3, $4)`
+	_, err = tx.ExecContext(
+		ctx,
+		query,
+		hashToken(state.State),
+		state.Nonce,
+		state.CodeVerifier,
+		now.Add(oidcLoginTimeout))
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	query = "DELETE FROM oidc_login_states WHERE expiry_time < $1"
+	if _, err = tx.ExecContext(ctx, query, now); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return state, nil
+}
+
+// TakeOIDCLoginState returns and deletes the stored state of an OpenID Connect
+// login. Each state can be used only once.
+func (api *API) TakeOIDCLoginState(ctx context.Context, state string) (*OIDCLoginState, error) {
+	defer api.observe("TakeOIDCLoginState")()
+	result := &OIDCLoginState{State: state}
+	var expiryTime time.Time
+	query := `
+DELETE FROM oidc_login_states
+WHERE state_hash = $1
+RETURNING nonce, code_verifier, expiry_time`
+	err := api.DB.QueryRowContext(ctx, query, hashToken(state)).
+		Scan(&result.Nonce, &result.CodeVerifier, &expiryTime)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidOIDCState
+	}
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().UTC().After(expiryTime) {
+		return nil, ErrInvalidOIDCState
+	}
+	return result, nil
+}
+
+// OIDCIdentity is a user authenticated by an OpenID Connect provider. Email
+// must have been verified by the provider.
+type OIDCIdentity struct {
+	Issuer  string
+	Subject string
+	Email   string
+}
+
+// OIDCLogin starts a new session for the account linked to an identity or, if
+// the account uses two-factor authentication, a login challenge. An account
+// without a linked identity is linked to it if the email addresses match and
+// the account has neither a password nor two-factor authentication. Other
+// accounts must be linked with LinkOIDCIdentity. If no account matches and
+// autoProvision is true, a new account without password login is created.
+// client may be nil.
+func (api *API) OIDCLogin(
+	ctx context.Context, identity *OIDCIdentity, autoProvision bool, client *ClientInfo,
+) (*LoginResult, error) {
+	defer api.observe("OIDCLogin")()
+	email := normalizeEmail(identity.Email)
+	if err := checkEmail(email); err != nil {
+		return nil, err
+	}
+	tx, err := api.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		accountID    int64
+		role         string
+		disabled     bool
+		passwordHash string
+		totpEnabled  bool
+		lockedUntil  sql.NullTime
+		issuer       sql.NullString
+		subject      sql.NullString
+	)
+	query := `
+SELECT
+	id,
+	role,
+	disabled,
+	password_hash,
+	totp_enabled,
+	locked_until,
+	oidc_issuer,
+	oidc_subject
+FROM accounts
+WHERE (oidc_issuer = $1 AND oidc_subject = $2) OR email = $3
+ORDER BY COALESCE(oidc_issuer = $1 AND oidc_subject = $2, FALSE) DESC
+LIMIT 1
+FOR UPDATE`
+	err = tx.QueryRowContext(ctx, query, identity.Issuer, identity.Subject, email).
+		Scan(
+			&accountID,
+			&role,
+			&disabled,
+			&passwordHash,
+			&totpEnabled,
+			&lockedUntil,
+			&issuer,
+			&subject)
+	switch {
+	case err == sql.ErrNoRows && autoProvision:
+		role = RoleUser
+		query = `
+INSERT INTO accounts (email, password_hash, role, password_login, oidc_issuer, oidc_subject)
+VALUES ($1, '', $2, FALSE, $3, $4)
+RETURNING id`
+		err = tx.QueryRowContext(ctx, query, email, role, identity.Issuer, identity.Subject).
+			Scan(&accountID)
+		if err != nil {
+			tx.Rollback()
+			if isUniqueViolation(err) {
+				return nil, ErrEmailTaken
+			}
+			return nil, err
+		}
+	case err == sql.ErrNoRows:
+		tx.Rollback()
+		return nil, ErrOIDCAccountNotFound
+	case err != nil:
+		tx.Rollback()
+		return nil, err
+	case !subject.Valid:
+		// Linking an account that can be logged in to otherwise would let
+		// anyone controlling the email address at the provider take it over.
+		if passwordHash != "" || totpEnabled {
+			tx.Rollback()
+			return nil, ErrOIDCLinkRequired
+		}
+		query = "UPDATE accounts SET oidc_issuer = $1, oidc_subject = $2 WHERE id = $3"
+		_, err = tx.ExecContext(ctx, query, identity.Issuer, identity.Subject, accountID)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	case issuer.String != identity.Issuer || subject.String != identity.Subject:
+		tx.Rollback()
+		return nil, ErrOIDCIdentityMismatch
+	}
+	if lockedUntil.Valid && time.Now().UTC().Before(lockedUntil.Time) {
+		tx.Rollback()
+		api.recordLoginEvent(ctx, &accountID, email, client, LoginLocked)
+		return nil, ErrAccountLocked
+	}
+	if disabled {
+		tx.Rollback()
+		api.recordLoginEvent(ctx, &accountID, email, client, LoginDisabled)
+		return nil, ErrAccountDisabled
+	}
+	result := &LoginResult{}
+	if totpEnabled {
+		result.Challenge, err = insertLoginChallenge(ctx, tx, accountID)
+	} else {
+		result.Session, err = api.insertSession(ctx, tx, accountID, role, client)
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if result.Challenge != nil {
+		api.recordLoginEvent(ctx, &accountID, email, client, LoginChallengeIssued)
+	} else {
+		api.recordLoginEvent(ctx, &accountID, email, client, LoginOIDC)
+	}
+	return result, nil
+}
+
+// VerifyOIDCIdentity returns ErrOIDCIdentityMismatch if identity isn't linked
+// to the account.
+func (api *API) VerifyOIDCIdentity(ctx context.Context, accountID int64, identity *OIDCIdentity) error {
+	defer api.observe("VerifyOIDCIdentity")()
+	query := `
+SELECT EXISTS (
+	SELECT 1 FROM accounts WHERE id = $1 AND oidc_issuer = $2 AND oidc_subject = $3
+)`
+	var linked bool
+	err := api.DB.QueryRowContext(ctx, query, accountID, identity.Issuer, identity.Subject).
+		Scan(&linked)
+	if err != nil {
+		return err
+	}
+	if !linked {
+		return ErrOIDCIdentityMismatch
+	}
+	return nil
+}
+
+// LinkOIDCIdentity links an identity to an account that isn't linked to one
+// yet. ErrOIDCIdentityMismatch is returned if the account is linked to
+// another identity and ErrOIDCIdentityTaken if the identity is linked to
+// another account.
+func (api *API) LinkOIDCIdentity(ctx context.Context, accountID int64, identity *OIDCIdentity) error {
+	defer api.observe("LinkOIDCIdentity")()
+	query := `
+UPDATE accounts
+SET oidc_issuer = $1, oidc_subject = $2
+WHERE id = $3 AND (oidc_subject IS NULL OR (oidc_issuer = $1 AND oidc_subject = $2))`
+	result, err := api.DB.ExecContext(ctx, query, identity.Issuer, identity.Subject, accountID)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return ErrOIDCIdentityTaken
+		}
+		return err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrOIDCIdentityMismatch
+	}
+	return nil
+}
+
+// SetPasswordLogin enables or disables logging in to an account with a
+// password. Password login can only be disabled for accounts linked to an
+// OpenID Connect identity.
+func (api *API) SetPasswordLogin(ctx context.Context, accountID int64, enabled bool) error {
+	defer api.observe("SetPasswordLogin")()
+	query := `
+UPDATE accounts
+SET password_login = $1
+WHERE id = $2 AND ($1 OR oidc_subject IS NOT NULL)`
+	result, err := api.DB.ExecContext(ctx, query, enabled, accountID)
+	if err != nil {
+		return err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNoOIDCIdentity
+	}
+	return nil
+}
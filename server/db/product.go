@@ -8,14 +8,38 @@ type Product struct {
 }
 
 func (api *API) InsertProduct(ctx context.Context, accountID int64, name string) (*Product, error) {
+	defer api.observe("InsertProduct")()
+	v := &validator{}
+	v.checkName("name", name)
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	tx, err := api.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
 	query := `
 INSERT INTO products (name, account_id)
 VALUES ($1, $2)
 RETURNING id`
 	product := &Product{Name: name}
-	err := api.DB.QueryRowContext(ctx, query, name, accountID).
+	err = tx.QueryRowContext(ctx, query, name, accountID).
 		Scan(&product.ID)
 	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	err = recordChange(ctx, tx, accountID, &change{
+		Entity:   EntityProduct,
+		EntityID: product.ID,
+		Action:   ActionCreate,
+	})
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
 		return nil, err
 	}
 	return product, nil
@@ -11,12 +11,17 @@ type Purchase struct {
 	ID       int64     `json:"id"`
 	Product  Product   `json:"product"`
 	Date     time.Time `json:"date"`
-	Quantity string    `json:"quantity"`
-	Price    string    `json:"price"`
-	Tags     []*Tag    `json:"tags"`
+	Quantity Decimal   `json:"quantity"`
+	Price    Decimal   `json:"price"`
+	// TotalPrice is the quantity times the price rounded in the currency.
+	TotalPrice Decimal `json:"totalPrice"`
+	Tags       []*Tag  `json:"tags"`
+	// Version changes whenever the purchase or its tags change.
+	Version int64 `json:"version"`
 }
 
 func (api *API) GetPurchasesByAccount(ctx context.Context, accountID int64) ([]*Purchase, error) {
+	defer api.observe("GetPurchasesByAccount")()
 	rows, err := api.DB.QueryContext(
 		ctx,
 		`
@@ -25,6 +30,7 @@ SELECT
 	purchases.date,
 	purchases.quantity,
 	purchases.price,
+	purchases.change_version,
 	products.id,
 	products.name
 FROM purchases, products
@@ -48,12 +54,14 @@ ORDER BY purchases.date DESC, products.name ASC`,
 			&p.Date,
 			&p.Quantity,
 			&p.Price,
+			&p.Version,
 			&p.Product.ID,
 			&p.Product.Name,
 		)
 		if err != nil {
 			return nil, err
 		}
+		api.setTotalPrice(p)
 		result = append(result, p)
 	}
 	if err = rows.Err(); err != nil {
@@ -62,8 +70,102 @@ ORDER BY purchases.date DESC, products.name ASC`,
 	return result, nil
 }
 
-func (api *API) UpdatePurchaseById(ctx context.Context, purchaseID, accountID int64, update *PurchaseUpdate) error {
+// GetPurchaseById returns a purchase of an account that hasn't been deleted.
+func (api *API) GetPurchaseById(ctx context.Context, purchaseID, accountID int64) (*Purchase, error) {
+	defer api.observe("GetPurchaseById")()
+	query := `
+SELECT
+	purchases.date,
+	purchases.quantity,
+	purchases.price,
+	purchases.change_version,
+	products.id,
+	products.name
+FROM purchases, products
+WHERE
+	purchases.id = $1
+	AND purchases.account_id = $2
+	AND purchases.product_id = products.id
+	AND NOT purchases.deleted`
+	p := &Purchase{ID: purchaseID, Tags: []*Tag{}}
+	err := api.DB.QueryRowContext(ctx, query, purchaseID, accountID).Scan(
+		&p.Date,
+		&p.Quantity,
+		&p.Price,
+		&p.Version,
+		&p.Product.ID,
+		&p.Product.Name,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoRowsAffected
+	}
+	if err != nil {
+		return nil, err
+	}
+	api.setTotalPrice(p)
+	query = `
+SELECT tags.id, tags.name
+FROM tags, purchase_tag
+WHERE
+	purchase_tag.purchase_id = $1
+	AND tags.id = purchase_tag.tag_id
+	AND NOT purchase_tag.deleted
+ORDER BY tags.name`
+	rows, err := api.DB.QueryContext(ctx, query, purchaseID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		t := &Tag{}
+		if err = rows.Scan(&t.ID, &t.Name); err != nil {
+			return nil, err
+		}
+		p.Tags = append(p.Tags, t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// UpdatePurchaseById updates a purchase and returns its new version. If
+// ifVersion isn't zero, ErrVersionMismatch is returned unless it is the
+// current version of the purchase.
+func (api *API) UpdatePurchaseById(
+	ctx context.Context, purchaseID, accountID, ifVersion int64, update *PurchaseUpdate,
+) (int64, error) {
+	defer api.observe("UpdatePurchaseById")()
 	tx, err := api.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	if err = checkVersion(ctx, tx, EntityPurchase, purchaseID, accountID, ifVersion); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err = validatePurchase(ctx, tx, accountID, update, false); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err = updatePurchase(ctx, tx, purchaseID, accountID, update); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	version, err := getVersion(ctx, tx, EntityPurchase, purchaseID)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return version, nil
+}
+
+func updatePurchase(ctx context.Context, tx *sql.Tx, purchaseID, accountID int64, update *PurchaseUpdate) error {
+	before, err := snapshot(ctx, tx, EntityPurchase, purchaseID, accountID)
 	if err != nil {
 		return err
 	}
@@ -87,16 +189,13 @@ func (api *API) UpdatePurchaseById(ctx context.Context, purchaseID, accountID in
 			Build()
 		result, err := tx.ExecContext(ctx, query, params...)
 		if err != nil {
-			tx.Rollback()
 			return err
 		}
 		count, err := result.RowsAffected()
 		if err != nil {
-			tx.Rollback()
 			return err
 		}
 		if count == 0 {
-			tx.Rollback()
 			return ErrNoRowsAffected
 		}
 	}
@@ -109,7 +208,6 @@ AND purchases.account_id = $2
 AND purchases.id = purchase_tag.purchase_id`
 		_, err := tx.ExecContext(ctx, query, purchaseID, accountID)
 		if err != nil {
-			tx.Rollback()
 			return err
 		}
 		builder := insertQuery("purchase_tag", "purchase_id", "tag_id")
@@ -119,22 +217,44 @@ AND purchases.id = purchase_tag.purchase_id`
 		query, params := builder.Build()
 		_, err = tx.ExecContext(ctx, query, params...)
 		if err != nil {
-			tx.Rollback()
 			return err
 		}
 	}
-	if err = tx.Commit(); err != nil {
-		tx.Rollback()
+	err = recordChange(ctx, tx, accountID, &change{
+		Entity:   EntityPurchase,
+		EntityID: purchaseID,
+		Action:   ActionUpdate,
+		Before:   before,
+	})
+	if err != nil {
 		return err
 	}
 	return nil
 }
 
 func (api *API) InsertPurchase(ctx context.Context, accountID int64, value *PurchaseUpdate) (int64, error) {
+	defer api.observe("InsertPurchase")()
 	tx, err := api.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return -1, err
 	}
+	if err = validatePurchase(ctx, tx, accountID, value, true); err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+	purchaseID, err := insertPurchase(ctx, tx, accountID, value)
+	if err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+	return purchaseID, nil
+}
+
+func insertPurchase(ctx context.Context, tx *sql.Tx, accountID int64, value *PurchaseUpdate) (int64, error) {
 	query := `
 INSERT INTO purchases (product_id, date, quantity, price, account_id)
 VALUES ($1, $2, $3, $4, $5)
@@ -149,7 +269,6 @@ RETURNING id`
 		accountID)
 	var purchaseID int64
 	if err := row.Scan(&purchaseID); err != nil {
-		tx.Rollback()
 		return -1, err
 	}
 	if len(value.Tags) > 0 {
@@ -159,12 +278,15 @@ RETURNING id`
 		}
 		query, params := builder.Build()
 		if _, err := tx.ExecContext(ctx, query, params...); err != nil {
-			tx.Rollback()
 			return -1, err
 		}
 	}
-	if err = tx.Commit(); err != nil {
-		tx.Rollback()
+	err := recordChange(ctx, tx, accountID, &change{
+		Entity:   EntityPurchase,
+		EntityID: purchaseID,
+		Action:   ActionCreate,
+	})
+	if err != nil {
 		return -1, err
 	}
 	return purchaseID, nil
@@ -175,7 +297,7 @@ type PurchaseRelatedIDs struct {
 	TagIDs    []int64
 }
 
-func (api *API) GetProductAndTagsForPurchase(
+func getProductAndTagsForPurchase(
 	ctx context.Context, tx *sql.Tx, purchaseID, accountID int64,
 ) (*PurchaseRelatedIDs, error) {
 	query := `
@@ -223,37 +345,70 @@ WHERE
 	return result, nil
 }
 
-func (api *API) DeletePurchaseById(ctx context.Context, purchaseID, accountID int64) error {
+// DeletePurchaseById moves a purchase to the trash. ifVersion is checked like
+// in UpdatePurchaseById.
+func (api *API) DeletePurchaseById(ctx context.Context, purchaseID, accountID, ifVersion int64) error {
+	defer api.observe("DeletePurchaseById")()
 	tx, err := api.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	ids, err := api.GetProductAndTagsForPurchase(ctx, tx, purchaseID, accountID)
-	if err != nil {
+	if err = checkVersion(ctx, tx, EntityPurchase, purchaseID, accountID, ifVersion); err != nil {
 		tx.Rollback()
 		return err
 	}
-	query := "UPDATE purchases SET deleted = TRUE WHERE id = $1 AND account_id = $2"
+	if err = deletePurchase(ctx, tx, purchaseID, accountID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return nil
+}
+
+func deletePurchase(ctx context.Context, tx *sql.Tx, purchaseID, accountID int64) error {
+	ids, err := getProductAndTagsForPurchase(ctx, tx, purchaseID, accountID)
+	if err != nil {
+		return err
+	}
+	changes, err := beginPurchaseChanges(ctx, tx, accountID, purchaseID, ActionDelete)
+	if err != nil {
+		return err
+	}
+	if ids.ProductID != -1 {
+		if err = changes.add(ctx, tx, EntityProduct, ids.ProductID); err != nil {
+			return err
+		}
+	}
+	for _, tagID := range ids.TagIDs {
+		if err = changes.add(ctx, tx, EntityTag, tagID); err != nil {
+			return err
+		}
+	}
+	query := `
+UPDATE purchases
+SET deleted = TRUE, deleted_time = now() AT TIME ZONE 'utc'
+WHERE id = $1 AND account_id = $2`
 	result, err := tx.ExecContext(ctx, query, purchaseID, accountID)
 	if err != nil {
-		tx.Rollback()
 		return err
 	}
 	deleteCount, err := result.RowsAffected()
 	if err != nil {
-		tx.Rollback()
 		return err
 	}
 	if deleteCount == 0 {
-		tx.Rollback()
 		return ErrNoRowsAffected
 	}
 	query = `
 UPDATE products
-SET deleted = TRUE
+SET deleted = TRUE, deleted_time = now() AT TIME ZONE 'utc'
 FROM purchases
 WHERE
 	products.account_id = $1
+	AND NOT products.deleted
 	AND purchases.account_id = $1
 	AND purchases.product_id = products.id
 	AND purchases.id = $2
@@ -266,15 +421,15 @@ WHERE
 	) = 0`
 	_, err = tx.ExecContext(ctx, query, accountID, purchaseID, ids.ProductID)
 	if err != nil {
-		tx.Rollback()
 		return err
 	}
 	query = `
 UPDATE tags
-SET deleted = true
+SET deleted = true, deleted_time = now() AT TIME ZONE 'utc'
 FROM purchase_tag
 WHERE
 	tags.account_id = $1
+	AND NOT tags.deleted
 	AND tags.id = $2
 	AND (
 		SELECT count(*) FROM tags, purchase_tag
@@ -286,7 +441,6 @@ WHERE
 	for _, tagID := range ids.TagIDs {
 		_, err = tx.ExecContext(ctx, query, accountID, tagID)
 		if err != nil {
-			tx.Rollback()
 			return err
 		}
 	}
@@ -300,45 +454,73 @@ WHERE
 	AND purchases.id = $2`
 	_, err = tx.ExecContext(ctx, query, accountID, purchaseID)
 	if err != nil {
-		tx.Rollback()
 		return err
 	}
-	if err = tx.Commit(); err != nil {
-		tx.Rollback()
+	if err = changes.record(ctx, tx); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (api *API) RestorePurchaseById(ctx context.Context, purchaseID, accountID int64) (*Purchase, error) {
+// RestorePurchaseById restores a purchase from the trash. ifVersion is
+// checked like in UpdatePurchaseById.
+func (api *API) RestorePurchaseById(
+	ctx context.Context, purchaseID, accountID, ifVersion int64,
+) (*Purchase, error) {
+	defer api.observe("RestorePurchaseById")()
 	tx, err := api.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
+	if err = checkVersion(ctx, tx, EntityPurchase, purchaseID, accountID, ifVersion); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	purchase, err := restorePurchase(ctx, tx, purchaseID, accountID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	api.setTotalPrice(purchase)
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return purchase, nil
+}
+
+// restorePurchase restores a deleted purchase together with its product and
+// tags.
+func restorePurchase(ctx context.Context, tx *sql.Tx, purchaseID, accountID int64) (*Purchase, error) {
+	changes, err := beginPurchaseChanges(ctx, tx, accountID, purchaseID, ActionRestore)
+	if err != nil {
+		return nil, err
+	}
 	purchase := &Purchase{ID: purchaseID}
 	query := `
 UPDATE purchases
-SET deleted = FALSE
+SET deleted = FALSE, deleted_time = NULL
 WHERE id = $1 AND account_id = $2
 RETURNING date, product_id, quantity, price`
 	err = tx.QueryRowContext(ctx, query, purchaseID, accountID).
 		Scan(&purchase.Date, &purchase.Product.ID, &purchase.Quantity, &purchase.Price)
 	if err != nil {
-		tx.Rollback()
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, ErrNoRowsAffected
 		}
 		return nil, err
 	}
+	if err = changes.add(ctx, tx, EntityProduct, purchase.Product.ID); err != nil {
+		return nil, err
+	}
 	query = `
 UPDATE products
-SET deleted = FALSE
+SET deleted = FALSE, deleted_time = NULL
 WHERE account_id = $1 AND id = $2
 RETURNING name`
 	err = tx.QueryRowContext(ctx, query, accountID, purchase.Product.ID).
 		Scan(&purchase.Product.Name)
 	if err != nil {
-		tx.Rollback()
 		return nil, err
 	}
 	query = `
@@ -352,7 +534,6 @@ WHERE
 RETURNING purchase_tag.tag_id`
 	rows, err := tx.QueryContext(ctx, query, accountID, purchaseID)
 	if err != nil {
-		tx.Rollback()
 		return nil, err
 	}
 	defer rows.Close()
@@ -360,19 +541,23 @@ RETURNING purchase_tag.tag_id`
 	for rows.Next() {
 		var tagID int64
 		if err = rows.Scan(&tagID); err != nil {
-			tx.Rollback()
 			return nil, err
 		}
 		tagIDs = append(tagIDs, tagID)
 	}
 	if err := rows.Err(); err != nil {
-		tx.Rollback()
 		return nil, err
 	}
+	for _, tagID := range tagIDs {
+		if err = changes.add(ctx, tx, EntityTag, tagID.(int64)); err != nil {
+			return nil, err
+		}
+	}
 	purchase.Tags = make([]*Tag, len(tagIDs))
 	if len(tagIDs) > 0 {
 		query, args := updateQuery("tags").
 			Set("deleted", false).
+			Set("deleted_time", nil).
 			Where().
 			Column("account_id", accountID).
 			And().In("id", tagIDs).
@@ -380,34 +565,76 @@ RETURNING purchase_tag.tag_id`
 			Build()
 		rows, err := tx.QueryContext(ctx, query, args...)
 		if err != nil {
-			tx.Rollback()
 			return nil, err
 		}
 		defer rows.Close()
 		for i := 0; rows.Next(); i++ {
 			tag := &Tag{ID: tagIDs[i].(int64)}
 			if err = rows.Scan(&tag.Name); err != nil {
-				tx.Rollback()
 				return nil, err
 			}
 			purchase.Tags[i] = tag
 		}
 		if err = rows.Err(); err != nil {
-			tx.Rollback()
 			return nil, err
 		}
 	}
-	if err = tx.Commit(); err != nil {
-		tx.Rollback()
+	if err = changes.record(ctx, tx); err != nil {
+		return nil, err
+	}
+	if purchase.Version, err = getVersion(ctx, tx, EntityPurchase, purchaseID); err != nil {
 		return nil, err
 	}
 	return purchase, nil
 }
 
+// purchaseChanges collects the entities affected by deleting or restoring a
+// purchase so that their changes can be recorded in the audit log.
+type purchaseChanges struct {
+	accountID int64
+	action    string
+	changes   []*change
+}
+
+// beginPurchaseChanges records the state of a purchase before it is deleted
+// or restored.
+func beginPurchaseChanges(
+	ctx context.Context, tx *sql.Tx, accountID, purchaseID int64, action string,
+) (*purchaseChanges, error) {
+	c := &purchaseChanges{accountID: accountID, action: action}
+	if err := c.add(ctx, tx, EntityPurchase, purchaseID); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *purchaseChanges) add(ctx context.Context, tx *sql.Tx, entity string, entityID int64) error {
+	before, err := snapshot(ctx, tx, entity, entityID, c.accountID)
+	if err != nil {
+		return err
+	}
+	c.changes = append(c.changes, &change{
+		Entity:   entity,
+		EntityID: entityID,
+		Action:   c.action,
+		Before:   before,
+	})
+	return nil
+}
+
+func (c *purchaseChanges) record(ctx context.Context, tx *sql.Tx) error {
+	for _, change := range c.changes {
+		if err := recordChange(ctx, tx, c.accountID, change); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type PurchaseUpdate struct {
 	Product  *int64     `json:"product"`
 	Date     *time.Time `json:"date"`
-	Quantity *string    `json:"quantity"`
-	Price    *string    `json:"price"`
+	Quantity *Decimal   `json:"quantity"`
+	Price    *Decimal   `json:"price"`
 	Tags     []int64    `json:"tags"`
 }
@@ -0,0 +1,337 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Groupings of purchase statistics.
+const (
+	GroupByProduct = "product"
+	GroupByTag     = "tag"
+	GroupByMonth   = "month"
+)
+
+var ErrInvalidGrouping = errors.New("invalid grouping")
+
+// conditions collects the conditions of a WHERE clause joined with AND.
+type conditions struct {
+	list   []string
+	params []interface{}
+}
+
+// add adds a condition with one parameter for each ? in it.
+func (c *conditions) add(condition string, params ...interface{}) {
+	for _, param := range params {
+		c.params = append(c.params, param)
+		condition = strings.Replace(condition, "?", "$"+strconv.Itoa(len(c.params)), 1)
+	}
+	c.list = append(c.list, condition)
+}
+
+func (c *conditions) String() string {
+	return strings.Join(c.list, " AND ")
+}
+
+// purchaseConditions selects the purchases of an account matching filter.
+// Deleted purchases are never selected.
+func purchaseConditions(accountID int64, filter *PurchaseFilter) *conditions {
+	c := &conditions{}
+	c.add("purchases.account_id = ?", accountID)
+	c.add("NOT purchases.deleted")
+	if filter == nil {
+		return c
+	}
+	if filter.IDs != nil {
+		c.add("purchases.id = ANY(?)", pq.Array(filter.IDs))
+	}
+	if filter.From != nil {
+		c.add("purchases.date >= ?", *filter.From)
+	}
+	if filter.To != nil {
+		c.add("purchases.date <= ?", *filter.To)
+	}
+	if filter.Product != nil {
+		c.add("purchases.product_id = ?", *filter.Product)
+	}
+	if filter.Tag != nil {
+		c.add(`EXISTS (
+		SELECT 1 FROM purchase_tag
+		WHERE
+			purchase_tag.purchase_id = purchases.id
+			AND purchase_tag.tag_id = ?
+			AND NOT purchase_tag.deleted
+	)`, *filter.Tag)
+	}
+	return c
+}
+
+// PurchaseCursor is the position of a purchase in the order QueryPurchases
+// returns purchases in.
+type PurchaseCursor struct {
+	Date time.Time
+	ID   int64
+}
+
+// QueryPurchases returns at most limit purchases of an account matching
+// filter, newest first. If after is not nil, only the purchases after it are
+// returned. The tags of the purchases are not loaded.
+func (api *API) QueryPurchases(
+	ctx context.Context, accountID int64, filter *PurchaseFilter, after *PurchaseCursor, limit int,
+) ([]*Purchase, error) {
+	defer api.observe("QueryPurchases")()
+	c := purchaseConditions(accountID, filter)
+	if after != nil {
+		c.add("(purchases.date, purchases.id) < (?, ?)", after.Date, after.ID)
+	}
+	c.params = append(c.params, limit)
+	query := `
+SELECT
+	purchases.id,
+	purchases.date,
+	purchases.quantity,
+	purchases.price,
+	purchases.change_version,
+	products.id,
+	products.name
+FROM purchases, products
+WHERE
+	purchases.product_id = products.id
+	AND ` + c.String() + `
+ORDER BY purchases.date DESC, purchases.id DESC
+LIMIT $` + strconv.Itoa(len(c.params))
+	rows, err := api.DB.QueryContext(ctx, query, c.params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := []*Purchase{}
+	for rows.Next() {
+		p := &Purchase{}
+		err = rows.Scan(
+			&p.ID,
+			&p.Date,
+			&p.Quantity,
+			&p.Price,
+			&p.Version,
+			&p.Product.ID,
+			&p.Product.Name,
+		)
+		if err != nil {
+			return nil, err
+		}
+		api.setTotalPrice(p)
+		result = append(result, p)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// CountPurchases returns the number of purchases of an account matching
+// filter.
+func (api *API) CountPurchases(ctx context.Context, accountID int64, filter *PurchaseFilter) (int64, error) {
+	defer api.observe("CountPurchases")()
+	c := purchaseConditions(accountID, filter)
+	var count int64
+	err := api.DB.QueryRowContext(
+		ctx,
+		"SELECT count(*) FROM purchases WHERE "+c.String(),
+		c.params...).Scan(&count)
+	return count, err
+}
+
+// GetTagsForPurchases returns the tags of the given purchases of an account
+// keyed by purchase ID, ordered by name.
+func (api *API) GetTagsForPurchases(
+	ctx context.Context, accountID int64, purchaseIDs []int64,
+) (map[int64][]*Tag, error) {
+	defer api.observe("GetTagsForPurchases")()
+	query := `
+SELECT purchase_tag.purchase_id, tags.id, tags.name
+FROM tags, purchase_tag
+WHERE
+	tags.id = purchase_tag.tag_id
+	AND tags.account_id = $1
+	AND purchase_tag.purchase_id = ANY($2)
+	AND NOT purchase_tag.deleted
+ORDER BY tags.name, tags.id`
+	rows, err := api.DB.QueryContext(ctx, query, accountID, pq.Array(purchaseIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := map[int64][]*Tag{}
+	for rows.Next() {
+		var purchaseID int64
+		t := &Tag{}
+		if err = rows.Scan(&purchaseID, &t.ID, &t.Name); err != nil {
+			return nil, err
+		}
+		result[purchaseID] = append(result[purchaseID], t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// GetProducts returns the products of an account that haven't been deleted,
+// ordered by name. If ids is not nil, only the products with the given IDs
+// are returned.
+func (api *API) GetProducts(ctx context.Context, accountID int64, ids []int64) ([]*Product, error) {
+	defer api.observe("GetProducts")()
+	products := []*Product{}
+	err := api.getNamedEntities(ctx, "products", accountID, ids, func(id int64, name string) {
+		products = append(products, &Product{ID: id, Name: name})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return products, nil
+}
+
+// GetTags is like GetProducts for tags.
+func (api *API) GetTags(ctx context.Context, accountID int64, ids []int64) ([]*Tag, error) {
+	defer api.observe("GetTags")()
+	tags := []*Tag{}
+	err := api.getNamedEntities(ctx, "tags", accountID, ids, func(id int64, name string) {
+		tags = append(tags, &Tag{ID: id, Name: name})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// getNamedEntities calls add for each product or tag selected like in
+// GetProducts.
+func (api *API) getNamedEntities(
+	ctx context.Context, table string, accountID int64, ids []int64, add func(id int64, name string),
+) error {
+	c := &conditions{}
+	c.add("account_id = ?", accountID)
+	c.add("NOT deleted")
+	if ids != nil {
+		c.add("id = ANY(?)", pq.Array(ids))
+	}
+	query := "SELECT id, name FROM " + table + " WHERE " + c.String() + " ORDER BY name, id"
+	rows, err := api.DB.QueryContext(ctx, query, c.params...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id   int64
+			name string
+		)
+		if err = rows.Scan(&id, &name); err != nil {
+			return err
+		}
+		add(id, name)
+	}
+	return rows.Err()
+}
+
+// PurchaseStats aggregates purchases. Total is the sum of the total prices of
+// the purchases rounded in the currency.
+type PurchaseStats struct {
+	Count int64
+	Total Decimal
+}
+
+// PurchaseGroupStats aggregates a group of purchases. ID identifies the
+// product or tag of the group, and Month the first day of the month.
+type PurchaseGroupStats struct {
+	PurchaseStats
+	ID    int64
+	Month time.Time
+}
+
+// GetPurchaseStats aggregates the purchases of an account matching filter.
+func (api *API) GetPurchaseStats(
+	ctx context.Context, accountID int64, filter *PurchaseFilter,
+) (*PurchaseStats, error) {
+	defer api.observe("GetPurchaseStats")()
+	c := purchaseConditions(accountID, filter)
+	query := `
+SELECT count(*), coalesce(sum(purchases.total_price), 0)
+FROM purchases
+WHERE ` + c.String()
+	stats := &PurchaseStats{}
+	err := api.DB.QueryRowContext(ctx, query, c.params...).Scan(&stats.Count, &stats.Total)
+	if err != nil {
+		return nil, err
+	}
+	stats.Total = api.currency().Round(stats.Total)
+	return stats, nil
+}
+
+// GetPurchaseStatsByGroup aggregates the purchases of an account matching
+// filter grouped by product, tag or month. Purchases with several tags are
+// counted in the group of each tag. Groups are ordered by ID or month.
+func (api *API) GetPurchaseStatsByGroup(
+	ctx context.Context, accountID int64, filter *PurchaseFilter, groupBy string,
+) ([]*PurchaseGroupStats, error) {
+	defer api.observe("GetPurchaseStatsByGroup")()
+	c := purchaseConditions(accountID, filter)
+	var query string
+	switch groupBy {
+	case GroupByProduct:
+		query = `
+SELECT purchases.product_id, count(*), sum(purchases.total_price)
+FROM purchases
+WHERE ` + c.String() + `
+GROUP BY purchases.product_id
+ORDER BY purchases.product_id`
+	case GroupByTag:
+		query = `
+SELECT purchase_tag.tag_id, count(*), sum(purchases.total_price)
+FROM purchases, purchase_tag
+WHERE
+	purchase_tag.purchase_id = purchases.id
+	AND NOT purchase_tag.deleted
+	AND ` + c.String() + `
+GROUP BY purchase_tag.tag_id
+ORDER BY purchase_tag.tag_id`
+	case GroupByMonth:
+		query = `
+SELECT date_trunc('month', purchases.date), count(*), sum(purchases.total_price)
+FROM purchases
+WHERE ` + c.String() + `
+GROUP BY 1
+ORDER BY 1`
+	default:
+		return nil, ErrInvalidGrouping
+	}
+	rows, err := api.DB.QueryContext(ctx, query, c.params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := []*PurchaseGroupStats{}
+	for rows.Next() {
+		g := &PurchaseGroupStats{}
+		if groupBy == GroupByMonth {
+			err = rows.Scan(&g.Month, &g.Count, &g.Total)
+		} else {
+			err = rows.Scan(&g.ID, &g.Count, &g.Total)
+		}
+		if err != nil {
+			return nil, err
+		}
+		g.Total = api.currency().Round(g.Total)
+		result = append(result, g)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,477 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// lastUsedResolution is the precision of Session.LastUsedTime. It limits how
+// often a session is written to when it is used.
+const lastUsedResolution = time.Minute
+
+const maxUserAgentLength = 512
+
+func truncateUserAgent(userAgent string) string {
+	if len(userAgent) <= maxUserAgentLength {
+		return userAgent
+	}
+	return strings.ToValidUTF8(userAgent[:maxUserAgentLength], "")
+}
+
+// sessionTokenBytes is the number of random bytes in a session token.
+const sessionTokenBytes = 32
+
+// generateToken returns a random URL-safe token suitable for use as a bearer
+// credential.
+func generateToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the hash of a token stored in the database in place of
+// the token itself.
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// ClientInfo describes the client a session is created for.
+type ClientInfo struct {
+	UserAgent string
+	IPAddress string
+}
+
+type Session struct {
+	ID           int64     `json:"id"`
+	Token        string    `json:"token,omitempty"`
+	ExpiryTime   time.Time `json:"expiryTime"`
+	AccountID    int64     `json:"accountId"`
+	Role         string    `json:"-"`
+	CreationTime time.Time `json:"creationTime"`
+	LastUsedTime time.Time `json:"lastUsedTime"`
+	UserAgent    string    `json:"userAgent"`
+	IPAddress    string    `json:"ipAddress"`
+	Name         string    `json:"name"`
+	// APITokenID is the ID of the API token used to authenticate, or 0 for
+	// a login session.
+	APITokenID int64    `json:"-"`
+	Scopes     []string `json:"-"`
+}
+
+// IsAdmin reports whether the session belongs to an administrator.
+func (s *Session) IsAdmin() bool {
+	return s.Role == RoleAdmin
+}
+
+// HasScope reports whether the session grants any of the given scopes. Login
+// sessions grant every scope.
+func (s *Session) HasScope(scopes ...string) bool {
+	if s.APITokenID == 0 {
+		return true
+	}
+	for _, granted := range s.Scopes {
+		for _, scope := range scopes {
+			if granted == scope {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// LoginResult is the result of a successful password login. If the account
+// uses two-factor authentication, Challenge is set and the login must be
+// completed with CompleteLogin. Otherwise Session is set.
+type LoginResult struct {
+	Session   *Session
+	Challenge *LoginChallenge
+}
+
+// Login checks the credentials of an account and starts a new session for it
+// or, if the account uses two-factor authentication, a login challenge.
+// client may be nil.
+func (api *API) Login(
+	ctx context.Context, email, password string, client *ClientInfo,
+) (*LoginResult, error) {
+	defer api.observe("Login")()
+	tx, err := api.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	email = normalizeEmail(email)
+	var (
+		accountID        int64
+		passwordHash     string
+		role             string
+		disabled         bool
+		totpEnabled      bool
+		passwordLogin    bool
+		failedLoginCount int
+		lockedUntil      sql.NullTime
+	)
+	err = tx.QueryRowContext(
+		ctx,
+		`
+SELECT
+	id,
+	password_hash,
+	role,
+	disabled,
+	totp_enabled,
+	password_login,
+	failed_login_count,
+	locked_until
+FROM accounts
+WHERE email = $1
+FOR UPDATE`,
+		email).
+		Scan(
+			&accountID,
+			&passwordHash,
+			&role,
+			&disabled,
+			&totpEnabled,
+			&passwordLogin,
+			&failedLoginCount,
+			&lockedUntil)
+	if err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			// Spend the same time as with an existing account so that the
+			// response time doesn't reveal whether the account exists.
+			api.compareDummyPassword(password)
+			api.recordLoginEvent(ctx, nil, email, client, LoginUnknownEmail)
+			return nil, ErrInvalidEmailOrPassword
+		}
+		return nil, err
+	}
+	now := time.Now().UTC()
+	if lockedUntil.Valid && now.Before(lockedUntil.Time) {
+		// The lockout is only recorded in the login events so that the
+		// response doesn't reveal that the account exists.
+		tx.Rollback()
+		api.compareDummyPassword(password)
+		api.recordLoginEvent(ctx, &accountID, email, client, LoginLocked)
+		return nil, ErrInvalidEmailOrPassword
+	}
+	if err = comparePassword(password, passwordHash); err != nil {
+		err = api.recordFailedLogin(ctx, tx, accountID, failedLoginCount+1, now)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if err = tx.Commit(); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		api.recordLoginEvent(ctx, &accountID, email, client, LoginInvalidPassword)
+		return nil, ErrInvalidEmailOrPassword
+	}
+	if disabled {
+		tx.Rollback()
+		api.recordLoginEvent(ctx, &accountID, email, client, LoginDisabled)
+		return nil, ErrAccountDisabled
+	}
+	if !passwordLogin {
+		tx.Rollback()
+		api.recordLoginEvent(ctx, &accountID, email, client, LoginPasswordDisabled)
+		return nil, ErrPasswordLoginDisabled
+	}
+	if failedLoginCount > 0 || lockedUntil.Valid {
+		query := `
+UPDATE accounts
+SET failed_login_count = 0, locked_until = NULL
+WHERE id = $1`
+		if _, err = tx.ExecContext(ctx, query, accountID); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	result := &LoginResult{}
+	if totpEnabled {
+		result.Challenge, err = insertLoginChallenge(ctx, tx, accountID)
+	} else {
+		result.Session, err = api.insertSession(ctx, tx, accountID, role, client)
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if result.Challenge != nil {
+		api.recordLoginEvent(ctx, &accountID, email, client, LoginChallengeIssued)
+	} else {
+		api.recordLoginEvent(ctx, &accountID, email, client, LoginSucceeded)
+	}
+	return result, nil
+}
+
+// CreateSession creates a new session for the account with the given
+// credentials. ErrTwoFactorRequired is returned if the account uses two-factor
+// authentication. client may be nil.
+func (api *API) CreateSession(
+	ctx context.Context, email, password string, client *ClientInfo,
+) (*Session, error) {
+	defer api.observe("CreateSession")()
+	result, err := api.Login(ctx, email, password, client)
+	if err != nil {
+		return nil, err
+	}
+	if result.Session == nil {
+		return nil, ErrTwoFactorRequired
+	}
+	return result.Session, nil
+}
+
+// insertSession creates a new session for an account and deletes the expired
+// sessions of the account.
+func (api *API) insertSession(
+	ctx context.Context, tx *sql.Tx, accountID int64, role string, client *ClientInfo,
+) (*Session, error) {
+	token, err := generateToken(sessionTokenBytes)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	session := &Session{
+		AccountID:    accountID,
+		Role:         role,
+		Token:        token,
+		ExpiryTime:   now.Add(api.SessionTimeout),
+		CreationTime: now,
+		LastUsedTime: now,
+	}
+	if client != nil {
+		session.UserAgent = truncateUserAgent(client.UserAgent)
+		session.IPAddress = client.IPAddress
+	}
+	query := `
+INSERT INTO sessions (
+	token_hash,
+	expiry_time,
+	account_id,
+	creation_time,
+	last_used_time,
+	user_agent,
+	ip_address
+)
+VALUES ($1, $2, $3, $4, $5, $6, $7)
+RETURNING id`
+	err = tx.QueryRowContext(
+		ctx,
+		query,
+		hashToken(session.Token),
+		session.ExpiryTime,
+		accountID,
+		session.CreationTime,
+		session.LastUsedTime,
+		session.UserAgent,
+		session.IPAddress).Scan(&session.ID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		"DELETE FROM sessions WHERE account_id = $1 AND expiry_time < $2",
+		accountID,
+		now)
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (api *API) DeleteSession(ctx context.Context, id int64) error {
+	defer api.observe("DeleteSession")()
+	_, err := api.DB.ExecContext(
+		ctx,
+		"DELETE FROM sessions WHERE id = $1",
+		id)
+	return err
+}
+
+// ValidateSession returns the session identified by token. Personal API
+// tokens are accepted as well.
+func (api *API) ValidateSession(ctx context.Context, token string) (*Session, error) {
+	defer api.observe("ValidateSession")()
+	if strings.HasPrefix(token, APITokenPrefix) {
+		return api.validateAPIToken(ctx, token)
+	}
+	session := &Session{Token: token}
+	tokenHash := hashToken(token)
+	var disabled bool
+	err := api.DB.
+		QueryRowContext(
+			ctx,
+			`
+SELECT
+	sessions.id,
+	sessions.account_id,
+	sessions.expiry_time,
+	sessions.last_used_time,
+	accounts.role,
+	accounts.disabled
+FROM sessions, accounts
+WHERE sessions.token_hash = $1 AND accounts.id = sessions.account_id`,
+			tokenHash).
+		Scan(
+			&session.ID,
+			&session.AccountID,
+			&session.ExpiryTime,
+			&session.LastUsedTime,
+			&session.Role,
+			&disabled)
+	if err != nil {
+		return nil, err
+	}
+	if disabled {
+		return nil, ErrAccountDisabled
+	}
+	now := time.Now().UTC()
+	if now.After(session.ExpiryTime) {
+		return nil, ErrSessionExpired
+	}
+	refresh := now.Add(api.RefreshTime).After(session.ExpiryTime)
+	if refresh || now.Sub(session.LastUsedTime) >= lastUsedResolution {
+		expiryTime := session.ExpiryTime
+		if refresh {
+			expiryTime = now.Add(api.SessionTimeout)
+		}
+		logger := api.logger(ctx)
+		go func() {
+			_, err := api.DB.Exec(
+				"UPDATE sessions SET expiry_time = $1, last_used_time = $2 WHERE id = $3",
+				expiryTime, now, session.ID)
+			if err != nil {
+				logger.WithError(err).Error("error refreshing session")
+			}
+		}()
+	}
+	return session, nil
+}
+
+// CountActiveSessions returns the number of unexpired sessions of all
+// accounts.
+func (api *API) CountActiveSessions(ctx context.Context) (int64, error) {
+	defer api.observe("CountActiveSessions")()
+	var count int64
+	err := api.DB.
+		QueryRowContext(
+			ctx,
+			"SELECT count(*) FROM sessions WHERE expiry_time > $1",
+			time.Now().UTC()).
+		Scan(&count)
+	return count, err
+}
+
+// GetSessionsForAccount returns the unexpired sessions of an account, most
+// recently used first. Tokens of the sessions are not returned.
+func (api *API) GetSessionsForAccount(ctx context.Context, accountID int64) ([]*Session, error) {
+	defer api.observe("GetSessionsForAccount")()
+	rows, err := api.DB.QueryContext(
+		ctx,
+		`
+SELECT
+	id,
+	expiry_time,
+	creation_time,
+	last_used_time,
+	user_agent,
+	ip_address,
+	name
+FROM sessions
+WHERE account_id = $1 AND expiry_time > $2
+ORDER BY last_used_time DESC, id DESC`,
+		accountID,
+		time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := []*Session{}
+	for rows.Next() {
+		s := &Session{AccountID: accountID}
+		err = rows.Scan(
+			&s.ID,
+			&s.ExpiryTime,
+			&s.CreationTime,
+			&s.LastUsedTime,
+			&s.UserAgent,
+			&s.IPAddress,
+			&s.Name,
+		)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (api *API) DeleteSessionForAccount(ctx context.Context, sessionID, accountID int64) error {
+	defer api.observe("DeleteSessionForAccount")()
+	result, err := api.DB.ExecContext(
+		ctx,
+		"DELETE FROM sessions WHERE id = $1 AND account_id = $2",
+		sessionID,
+		accountID)
+	if err != nil {
+		return err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNoRowsAffected
+	}
+	return nil
+}
+
+// DeleteOtherSessions deletes all sessions of an account except the one with
+// ID keepSessionID.
+func (api *API) DeleteOtherSessions(ctx context.Context, accountID, keepSessionID int64) error {
+	defer api.observe("DeleteOtherSessions")()
+	_, err := api.DB.ExecContext(
+		ctx,
+		"DELETE FROM sessions WHERE account_id = $1 AND id <> $2",
+		accountID,
+		keepSessionID)
+	return err
+}
+
+func (api *API) RenameSession(ctx context.Context, sessionID, accountID int64, name string) error {
+	defer api.observe("RenameSession")()
+	result, err := api.DB.ExecContext(
+		ctx,
+		"UPDATE sessions SET name = $1 WHERE id = $2 AND account_id = $3",
+		name,
+		sessionID,
+		accountID)
+	if err != nil {
+		return err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNoRowsAffected
+	}
+	return nil
+}
@@ -0,0 +1,655 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var ErrUnknownReference = errors.New("referenced product or tag doesn't exist")
+
+// errIDMismatch is returned by locate if a server ID and a client ID identify
+// different entities.
+var errIDMismatch = errors.New("server and client IDs identify different entities")
+
+// Every insert and update of purchases, products, tags and purchase_tag sets
+// the change_version of the row to the ID of the transaction making it. A
+// sync cursor is the oldest transaction that may not have been visible to the
+// client when it last synchronized, so all rows with a version at or above the
+// cursor are sent again. Entities purged permanently are found from the audit
+// log, whose operation_id follows the same scheme.
+
+type SyncProduct struct {
+	ID       int64   `json:"id"`
+	ClientID *string `json:"clientId"`
+	Name     string  `json:"name"`
+	Deleted  bool    `json:"deleted"`
+	Version  int64   `json:"version"`
+}
+
+type SyncTag = SyncProduct
+
+type SyncPurchase struct {
+	ID       int64     `json:"id"`
+	ClientID *string   `json:"clientId"`
+	Product  int64     `json:"product"`
+	Date     time.Time `json:"date"`
+	Quantity Decimal   `json:"quantity"`
+	Price    Decimal   `json:"price"`
+	Tags     []int64   `json:"tags"`
+	Deleted  bool      `json:"deleted"`
+	Version  int64     `json:"version"`
+}
+
+// SyncChanges lists the entities changed since a sync cursor. Purged lists
+// the IDs of permanently deleted entities by entity type.
+type SyncChanges struct {
+	Cursor    int64              `json:"cursor"`
+	Products  []*SyncProduct     `json:"products"`
+	Tags      []*SyncTag         `json:"tags"`
+	Purchases []*SyncPurchase    `json:"purchases"`
+	Purged    map[string][]int64 `json:"purged"`
+}
+
+// GetChangesSince returns the entities of an account changed since cursor.
+// A zero cursor returns all entities that haven't been deleted.
+func (api *API) GetChangesSince(ctx context.Context, accountID, cursor int64) (*SyncChanges, error) {
+	defer api.observe("GetChangesSince")()
+	// All queries must see the same snapshot the new cursor is taken from.
+	tx, err := api.DB.BeginTx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelRepeatableRead,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	changes := &SyncChanges{
+		Products:  []*SyncProduct{},
+		Tags:      []*SyncTag{},
+		Purchases: []*SyncPurchase{},
+		Purged: map[string][]int64{
+			EntityPurchase: {},
+			EntityProduct:  {},
+			EntityTag:      {},
+		},
+	}
+	query := "SELECT txid_snapshot_xmin(txid_current_snapshot())"
+	if err = tx.QueryRowContext(ctx, query).Scan(&changes.Cursor); err != nil {
+		return nil, err
+	}
+	for _, entity := range []string{EntityProduct, EntityTag} {
+		query = `
+SELECT id, client_id, name, deleted, change_version
+FROM ` + entityTables[entity] + `
+WHERE account_id = $1 AND change_version >= $2 AND ($2 > 0 OR NOT deleted)
+ORDER BY id`
+		rows, err := tx.QueryContext(ctx, query, accountID, cursor)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			p := &SyncProduct{}
+			var clientID sql.NullString
+			err = rows.Scan(&p.ID, &clientID, &p.Name, &p.Deleted, &p.Version)
+			if err != nil {
+				return nil, err
+			}
+			p.ClientID = stringPtr(clientID)
+			if entity == EntityProduct {
+				changes.Products = append(changes.Products, p)
+			} else {
+				changes.Tags = append(changes.Tags, p)
+			}
+		}
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	query = `
+SELECT
+	id,
+	client_id,
+	product_id,
+	date,
+	quantity,
+	price,
+	deleted,
+	change_version,
+	ARRAY(SELECT tag_id FROM purchase_tag WHERE purchase_id = purchases.id ORDER BY tag_id)
+FROM purchases
+WHERE account_id = $1 AND change_version >= $2 AND ($2 > 0 OR NOT deleted)
+ORDER BY id`
+	rows, err := tx.QueryContext(ctx, query, accountID, cursor)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		p := &SyncPurchase{}
+		var clientID sql.NullString
+		var tags pq.Int64Array
+		err = rows.Scan(
+			&p.ID,
+			&clientID,
+			&p.Product,
+			&p.Date,
+			&p.Quantity,
+			&p.Price,
+			&p.Deleted,
+			&p.Version,
+			&tags,
+		)
+		if err != nil {
+			return nil, err
+		}
+		p.ClientID = stringPtr(clientID)
+		p.Tags = []int64(tags)
+		changes.Purchases = append(changes.Purchases, p)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if cursor > 0 {
+		query = `
+SELECT entity, entity_id
+FROM audit_log
+WHERE account_id = $1 AND action = $2 AND operation_id >= $3
+ORDER BY id`
+		rows, err := tx.QueryContext(ctx, query, accountID, ActionPurge, cursor)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var entity string
+			var id int64
+			if err = rows.Scan(&entity, &id); err != nil {
+				return nil, err
+			}
+			changes.Purged[entity] = append(changes.Purged[entity], id)
+		}
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return changes, nil
+}
+
+func stringPtr(s sql.NullString) *string {
+	if !s.Valid {
+		return nil
+	}
+	return &s.String
+}
+
+// PushProduct is a product or tag created or changed by a client, possibly
+// while offline. Entities created by the client are identified by ClientID
+// until they have a server ID. BaseVersion is the version of the entity the
+// client's change is based on.
+type PushProduct struct {
+	ID          int64  `json:"id"`
+	ClientID    string `json:"clientId"`
+	BaseVersion int64  `json:"baseVersion"`
+	Name        string `json:"name"`
+	Deleted     bool   `json:"deleted"`
+}
+
+type PushTag = PushProduct
+
+// PushPurchase is a purchase created or changed by a client. The product and
+// tags are referenced either by server ID or by client ID.
+type PushPurchase struct {
+	ID              int64     `json:"id"`
+	ClientID        string    `json:"clientId"`
+	BaseVersion     int64     `json:"baseVersion"`
+	Product         int64     `json:"product"`
+	ProductClientID string    `json:"productClientId"`
+	Date            time.Time `json:"date"`
+	Quantity        Decimal   `json:"quantity"`
+	Price           Decimal   `json:"price"`
+	Tags            []int64   `json:"tags"`
+	TagClientIDs    []string  `json:"tagClientIds"`
+	Deleted         bool      `json:"deleted"`
+}
+
+type PushRequest struct {
+	Products  []*PushProduct  `json:"products"`
+	Tags      []*PushTag      `json:"tags"`
+	Purchases []*PushPurchase `json:"purchases"`
+}
+
+// PushedEntity is an entity whose pushed state is now stored on the server.
+type PushedEntity struct {
+	Entity   string `json:"entity"`
+	ID       int64  `json:"id"`
+	ClientID string `json:"clientId,omitempty"`
+	Version  int64  `json:"version"`
+}
+
+// PushConflict is an entity changed on the server after the version the
+// pushed change was based on. Current is the state of the entity on the
+// server, or null if it no longer exists.
+type PushConflict struct {
+	Entity   string          `json:"entity"`
+	ID       int64           `json:"id"`
+	ClientID string          `json:"clientId,omitempty"`
+	Current  json.RawMessage `json:"current"`
+}
+
+type PushResult struct {
+	Applied   []*PushedEntity `json:"applied"`
+	Conflicts []*PushConflict `json:"conflicts"`
+}
+
+// pushState tracks the entities of a push request.
+type pushState struct {
+	accountID int64
+	version   int64
+	clientIDs map[string]map[string]int64
+	result    *PushResult
+}
+
+// PushChanges applies changes made by a client. Changes to entities modified
+// on the server after their base version are not applied but reported as
+// conflicts, unless the entity already is in the pushed state. Pushing the
+// same changes again is therefore safe. Other errors abort the whole push.
+func (api *API) PushChanges(ctx context.Context, accountID int64, req *PushRequest) (*PushResult, error) {
+	defer api.observe("PushChanges")()
+	tx, err := api.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	s := &pushState{
+		accountID: accountID,
+		clientIDs: map[string]map[string]int64{
+			EntityProduct: {},
+			EntityTag:     {},
+		},
+		result: &PushResult{
+			Applied:   []*PushedEntity{},
+			Conflicts: []*PushConflict{},
+		},
+	}
+	if err = tx.QueryRowContext(ctx, "SELECT txid_current()").Scan(&s.version); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	for i, p := range req.Products {
+		if err = s.pushNamed(ctx, tx, EntityProduct, p); err != nil {
+			tx.Rollback()
+			return nil, inField(fmt.Sprintf("products/%d", i), err)
+		}
+	}
+	for i, t := range req.Tags {
+		if err = s.pushNamed(ctx, tx, EntityTag, t); err != nil {
+			tx.Rollback()
+			return nil, inField(fmt.Sprintf("tags/%d", i), err)
+		}
+	}
+	for i, p := range req.Purchases {
+		if err = s.pushPurchase(ctx, tx, p); err != nil {
+			tx.Rollback()
+			return nil, inField(fmt.Sprintf("purchases/%d", i), err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return s.result, nil
+}
+
+// locate finds and locks an entity by server or client ID. found is false if
+// the entity doesn't exist. If both IDs are given, they must identify the same
+// entity or errIDMismatch is returned; found then tells whether the entity
+// with the server ID exists. An entity without a client ID matches any client
+// ID.
+func (s *pushState) locate(
+	ctx context.Context, tx *sql.Tx, entity string, id int64, clientID string,
+) (found bool, foundID, version int64, err error) {
+	query := `
+SELECT id, client_id, change_version
+FROM ` + entityTables[entity] + `
+WHERE account_id = $1 AND (id = $2 OR client_id = $3)
+ORDER BY id
+FOR UPDATE`
+	rows, err := tx.QueryContext(ctx, query, s.accountID, id, nullString(clientID))
+	if err != nil {
+		return false, 0, 0, err
+	}
+	defer rows.Close()
+	mismatch := false
+	for rows.Next() {
+		var (
+			rowID      int64
+			rowClient  sql.NullString
+			rowVersion int64
+		)
+		if err = rows.Scan(&rowID, &rowClient, &rowVersion); err != nil {
+			return false, 0, 0, err
+		}
+		if id != 0 && clientID != "" {
+			if rowID != id || (rowClient.Valid && rowClient.String != clientID) {
+				mismatch = true
+			}
+			if rowID != id {
+				continue
+			}
+		}
+		if !found || rowID == id {
+			found, foundID, version = true, rowID, rowVersion
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return false, 0, 0, err
+	}
+	if mismatch {
+		return found, foundID, version, errIDMismatch
+	}
+	return found, foundID, version, nil
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func (s *pushState) applied(entity string, id int64, clientID string) {
+	if clientID != "" && s.clientIDs[entity] != nil {
+		s.clientIDs[entity][clientID] = id
+	}
+	s.result.Applied = append(s.result.Applied, &PushedEntity{
+		Entity:   entity,
+		ID:       id,
+		ClientID: clientID,
+		Version:  s.version,
+	})
+}
+
+func (s *pushState) conflict(
+	ctx context.Context, tx *sql.Tx, entity string, id int64, clientID string, found bool,
+) error {
+	c := &PushConflict{
+		Entity:   entity,
+		ID:       id,
+		ClientID: clientID,
+		Current:  json.RawMessage("null"),
+	}
+	if found {
+		current, err := snapshot(ctx, tx, entity, id, s.accountID)
+		if err != nil {
+			return err
+		}
+		c.Current = current
+	}
+	s.result.Conflicts = append(s.result.Conflicts, c)
+	return nil
+}
+
+func deletedTime(deleted bool) interface{} {
+	if deleted {
+		return time.Now().UTC()
+	}
+	return nil
+}
+
+func (s *pushState) pushNamed(ctx context.Context, tx *sql.Tx, entity string, p *PushProduct) error {
+	v := &validator{}
+	v.checkName("name", p.Name)
+	if err := v.err(); err != nil {
+		return err
+	}
+	table := entityTables[entity]
+	found, id, version, err := s.locate(ctx, tx, entity, p.ID, p.ClientID)
+	if err == errIDMismatch {
+		return s.conflict(ctx, tx, entity, p.ID, p.ClientID, found)
+	}
+	if err != nil {
+		return err
+	}
+	if !found {
+		if p.ID != 0 {
+			return s.conflict(ctx, tx, entity, p.ID, p.ClientID, false)
+		}
+		query := "INSERT INTO " + table + ` (name, account_id, client_id, deleted, deleted_time)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING id`
+		err = tx.QueryRowContext(
+			ctx,
+			query,
+			p.Name,
+			s.accountID,
+			nullString(p.ClientID),
+			p.Deleted,
+			deletedTime(p.Deleted)).Scan(&id)
+		if err != nil {
+			return err
+		}
+		err = recordChange(ctx, tx, s.accountID, &change{
+			Entity:   entity,
+			EntityID: id,
+			Action:   ActionCreate,
+		})
+		if err != nil {
+			return err
+		}
+		s.applied(entity, id, p.ClientID)
+		return nil
+	}
+	var unchanged bool
+	query := "SELECT name = $2 AND deleted = $3 FROM " + table + " WHERE id = $1"
+	err = tx.QueryRowContext(ctx, query, id, p.Name, p.Deleted).Scan(&unchanged)
+	if err != nil {
+		return err
+	}
+	if unchanged {
+		s.applied(entity, id, p.ClientID)
+		return nil
+	}
+	if version != p.BaseVersion {
+		return s.conflict(ctx, tx, entity, id, p.ClientID, true)
+	}
+	before, err := snapshot(ctx, tx, entity, id, s.accountID)
+	if err != nil {
+		return err
+	}
+	query = "UPDATE " + table + `
+SET
+	name = $1,
+	deleted = $2,
+	deleted_time = CASE WHEN $2 THEN coalesce(deleted_time, $3) END
+WHERE id = $4`
+	_, err = tx.ExecContext(ctx, query, p.Name, p.Deleted, time.Now().UTC(), id)
+	if err != nil {
+		return err
+	}
+	err = recordChange(ctx, tx, s.accountID, &change{
+		Entity:   entity,
+		EntityID: id,
+		Action:   ActionUpdate,
+		Before:   before,
+	})
+	if err != nil {
+		return err
+	}
+	s.applied(entity, id, p.ClientID)
+	return nil
+}
+
+// resolve returns the server ID of an entity referenced by a pushed purchase.
+func (s *pushState) resolve(
+	ctx context.Context, tx *sql.Tx, entity string, id int64, clientID string,
+) (int64, error) {
+	if clientID != "" {
+		if id, ok := s.clientIDs[entity][clientID]; ok {
+			return id, nil
+		}
+	}
+	found, id, _, err := s.locate(ctx, tx, entity, id, clientID)
+	if err == errIDMismatch {
+		return 0, ErrUnknownReference
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, ErrUnknownReference
+	}
+	return id, nil
+}
+
+func (s *pushState) pushPurchase(ctx context.Context, tx *sql.Tx, p *PushPurchase) error {
+	productID, err := s.resolve(ctx, tx, EntityProduct, p.Product, p.ProductClientID)
+	if err != nil {
+		return err
+	}
+	tagSet := map[int64]bool{}
+	for _, tagID := range p.Tags {
+		if tagID, err = s.resolve(ctx, tx, EntityTag, tagID, ""); err != nil {
+			return err
+		}
+		tagSet[tagID] = true
+	}
+	for _, clientID := range p.TagClientIDs {
+		tagID, err := s.resolve(ctx, tx, EntityTag, 0, clientID)
+		if err != nil {
+			return err
+		}
+		tagSet[tagID] = true
+	}
+	tags := make([]int64, 0, len(tagSet))
+	for tagID := range tagSet {
+		tags = append(tags, tagID)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+
+	values := &PurchaseUpdate{
+		Product:  &productID,
+		Date:     &p.Date,
+		Quantity: &p.Quantity,
+		Price:    &p.Price,
+		Tags:     tags,
+	}
+	found, id, version, err := s.locate(ctx, tx, EntityPurchase, p.ID, p.ClientID)
+	if err == errIDMismatch {
+		return s.conflict(ctx, tx, EntityPurchase, p.ID, p.ClientID, found)
+	}
+	if err != nil {
+		return err
+	}
+	if !found {
+		if p.ID != 0 {
+			return s.conflict(ctx, tx, EntityPurchase, p.ID, p.ClientID, false)
+		}
+		// The product and tags have already been resolved.
+		if err = checkPurchaseValues(values, true); err != nil {
+			return err
+		}
+		id, err = insertPurchase(ctx, tx, s.accountID, values)
+		if err != nil {
+			return err
+		}
+		query := "UPDATE purchases SET client_id = $1 WHERE id = $2"
+		if _, err = tx.ExecContext(ctx, query, nullString(p.ClientID), id); err != nil {
+			return err
+		}
+		if p.Deleted {
+			if err = deletePurchase(ctx, tx, id, s.accountID); err != nil {
+				return err
+			}
+		}
+		s.applied(EntityPurchase, id, p.ClientID)
+		return nil
+	}
+	var unchanged, deleted bool
+	query := `
+SELECT
+	product_id = $2
+		AND date = $3
+		AND quantity = $4::numeric
+		AND price = $5::numeric
+		AND deleted = $6
+		AND ARRAY(
+			SELECT tag_id::bigint FROM purchase_tag
+			WHERE purchase_id = $1
+			ORDER BY tag_id
+		) = $7::bigint[],
+	deleted
+FROM purchases
+WHERE id = $1`
+	err = tx.QueryRowContext(
+		ctx,
+		query,
+		id,
+		productID,
+		p.Date,
+		p.Quantity,
+		p.Price,
+		p.Deleted,
+		pq.Array(tags)).Scan(&unchanged, &deleted)
+	if err != nil {
+		return err
+	}
+	if unchanged {
+		s.applied(EntityPurchase, id, p.ClientID)
+		return nil
+	}
+	if version != p.BaseVersion {
+		return s.conflict(ctx, tx, EntityPurchase, id, p.ClientID, true)
+	}
+	if err = checkPurchaseValues(values, false); err != nil {
+		return err
+	}
+	if deleted && !p.Deleted {
+		if _, err = restorePurchase(ctx, tx, id, s.accountID); err != nil {
+			return err
+		}
+	}
+	before, err := snapshot(ctx, tx, EntityPurchase, id, s.accountID)
+	if err != nil {
+		return err
+	}
+	query = `
+UPDATE purchases
+SET product_id = $1, date = $2, quantity = $3, price = $4
+WHERE id = $5`
+	_, err = tx.ExecContext(ctx, query, productID, p.Date, p.Quantity, p.Price, id)
+	if err != nil {
+		return err
+	}
+	query = "DELETE FROM purchase_tag WHERE purchase_id = $1"
+	if _, err = tx.ExecContext(ctx, query, id); err != nil {
+		return err
+	}
+	query = `
+INSERT INTO purchase_tag (purchase_id, tag_id, deleted)
+SELECT id, unnest($2::integer[]), deleted
+FROM purchases
+WHERE id = $1`
+	if _, err = tx.ExecContext(ctx, query, id, pq.Array(tags)); err != nil {
+		return err
+	}
+	err = recordChange(ctx, tx, s.accountID, &change{
+		Entity:   EntityPurchase,
+		EntityID: id,
+		Action:   ActionUpdate,
+		Before:   before,
+	})
+	if err != nil {
+		return err
+	}
+	if !deleted && p.Deleted {
+		if err = deletePurchase(ctx, tx, id, s.accountID); err != nil {
+			return err
+		}
+	}
+	s.applied(EntityPurchase, id, p.ClientID)
+	return nil
+}
@@ -8,6 +8,7 @@ type Tag struct {
 }
 
 func (api *API) GetTagsByPurchaseForAccount(ctx context.Context, accountID int64) (map[int64][]*Tag, error) {
+	defer api.observe("GetTagsByPurchaseForAccount")()
 	rows, err := api.DB.QueryContext(
 		ctx,
 		`
@@ -58,13 +59,22 @@ WHERE
 }
 
 func (api *API) InsertTags(ctx context.Context, accountID int64, newTags []string) ([]*Tag, error) {
+	defer api.observe("InsertTags")()
+	if err := validateNames("tags", newTags); err != nil {
+		return nil, err
+	}
+	tx, err := api.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
 	builder := insertQuery("tags", "name", "account_id")
 	for _, tag := range newTags {
 		builder.Values(tag, accountID)
 	}
 	query, params := builder.Returning("id").Build()
-	rows, err := api.DB.QueryContext(ctx, query, params...)
+	rows, err := tx.QueryContext(ctx, query, params...)
 	if err != nil {
+		tx.Rollback()
 		return nil, err
 	}
 	defer rows.Close()
@@ -72,11 +82,28 @@ func (api *API) InsertTags(ctx context.Context, accountID int64, newTags []strin
 	for i := 0; rows.Next(); i++ {
 		tag := &Tag{Name: newTags[i]}
 		if err = rows.Scan(&tag.ID); err != nil {
+			tx.Rollback()
 			return nil, err
 		}
 		tags = append(tags, tag)
 	}
 	if err = rows.Err(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	for _, tag := range tags {
+		err = recordChange(ctx, tx, accountID, &change{
+			Entity:   EntityTag,
+			EntityID: tag.ID,
+			Action:   ActionCreate,
+		})
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
 		return nil, err
 	}
 	return tags, nil
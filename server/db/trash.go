@@ -0,0 +1,348 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type TrashedPurchase struct {
+	Purchase
+	DeletedTime time.Time `json:"deletedTime"`
+}
+
+type TrashedProduct struct {
+	Product
+	DeletedTime time.Time `json:"deletedTime"`
+}
+
+type TrashedTag struct {
+	Tag
+	DeletedTime time.Time `json:"deletedTime"`
+}
+
+// Trash lists the deleted entities of an account.
+type Trash struct {
+	Purchases []*TrashedPurchase `json:"purchases"`
+	Products  []*TrashedProduct  `json:"products"`
+	Tags      []*TrashedTag      `json:"tags"`
+}
+
+// TrashItems identifies deleted entities to restore or purge.
+type TrashItems struct {
+	Purchases []int64 `json:"purchases"`
+	Products  []int64 `json:"products"`
+	Tags      []int64 `json:"tags"`
+}
+
+// GetTrash returns the deleted purchases, products and tags of an account,
+// most recently deleted first.
+func (api *API) GetTrash(ctx context.Context, accountID int64) (*Trash, error) {
+	defer api.observe("GetTrash")()
+	trash := &Trash{
+		Purchases: []*TrashedPurchase{},
+		Products:  []*TrashedProduct{},
+		Tags:      []*TrashedTag{},
+	}
+	query := `
+SELECT
+	purchases.id,
+	purchases.date,
+	purchases.quantity,
+	purchases.price,
+	purchases.deleted_time,
+	purchases.change_version,
+	products.id,
+	products.name
+FROM purchases, products
+WHERE
+	purchases.account_id = $1
+	AND purchases.product_id = products.id
+	AND purchases.deleted
+ORDER BY purchases.deleted_time DESC, purchases.id DESC`
+	rows, err := api.DB.QueryContext(ctx, query, accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	purchases := map[int64]*TrashedPurchase{}
+	for rows.Next() {
+		p := &TrashedPurchase{}
+		err = rows.Scan(
+			&p.ID,
+			&p.Date,
+			&p.Quantity,
+			&p.Price,
+			&p.DeletedTime,
+			&p.Version,
+			&p.Product.ID,
+			&p.Product.Name,
+		)
+		if err != nil {
+			return nil, err
+		}
+		api.setTotalPrice(&p.Purchase)
+		p.Tags = []*Tag{}
+		purchases[p.ID] = p
+		trash.Purchases = append(trash.Purchases, p)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	query = `
+SELECT tags.id, tags.name, purchases.id
+FROM tags, purchases, purchase_tag
+WHERE
+	tags.id = purchase_tag.tag_id
+	AND purchases.id = purchase_tag.purchase_id
+	AND purchases.account_id = $1
+	AND purchases.deleted
+ORDER BY tags.name`
+	rows, err = api.DB.QueryContext(ctx, query, accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		tag := &Tag{}
+		var purchaseID int64
+		if err = rows.Scan(&tag.ID, &tag.Name, &purchaseID); err != nil {
+			return nil, err
+		}
+		if p := purchases[purchaseID]; p != nil {
+			p.Tags = append(p.Tags, tag)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	query = `
+SELECT id, name, deleted_time
+FROM products
+WHERE account_id = $1 AND deleted
+ORDER BY deleted_time DESC, id DESC`
+	rows, err = api.DB.QueryContext(ctx, query, accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		p := &TrashedProduct{}
+		if err = rows.Scan(&p.ID, &p.Name, &p.DeletedTime); err != nil {
+			return nil, err
+		}
+		trash.Products = append(trash.Products, p)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	query = `
+SELECT id, name, deleted_time
+FROM tags
+WHERE account_id = $1 AND deleted
+ORDER BY deleted_time DESC, id DESC`
+	rows, err = api.DB.QueryContext(ctx, query, accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		t := &TrashedTag{}
+		if err = rows.Scan(&t.ID, &t.Name, &t.DeletedTime); err != nil {
+			return nil, err
+		}
+		trash.Tags = append(trash.Tags, t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return trash, nil
+}
+
+// RestoreFromTrash restores deleted entities of an account. Restoring a
+// purchase also restores its product and tags. ErrNoRowsAffected is returned
+// if any of the entities doesn't exist.
+func (api *API) RestoreFromTrash(ctx context.Context, accountID int64, items *TrashItems) error {
+	defer api.observe("RestoreFromTrash")()
+	tx, err := api.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, purchaseID := range items.Purchases {
+		if _, err = restorePurchase(ctx, tx, purchaseID, accountID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for _, productID := range items.Products {
+		if err = restoreEntity(ctx, tx, EntityProduct, productID, accountID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for _, tagID := range items.Tags {
+		if err = restoreEntity(ctx, tx, EntityTag, tagID, accountID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return nil
+}
+
+func restoreEntity(ctx context.Context, tx *sql.Tx, entity string, entityID, accountID int64) error {
+	before, err := snapshot(ctx, tx, entity, entityID, accountID)
+	if err != nil {
+		return err
+	}
+	query := "UPDATE " + entityTables[entity] + `
+SET deleted = FALSE, deleted_time = NULL
+WHERE id = $1 AND account_id = $2`
+	if _, err = tx.ExecContext(ctx, query, entityID, accountID); err != nil {
+		return err
+	}
+	return recordChange(ctx, tx, accountID, &change{
+		Entity:   entity,
+		EntityID: entityID,
+		Action:   ActionRestore,
+		Before:   before,
+	})
+}
+
+// purge permanently deletes the deleted entities matching condition and
+// records their last state in the audit log. The entity row is aliased as e
+// in condition. The number of purged entities is returned.
+func purge(
+	ctx context.Context, tx *sql.Tx, entity, condition string, params ...interface{},
+) (int64, error) {
+	actor := actorFromContext(ctx)
+	n := len(params)
+	query := fmt.Sprintf(`
+WITH purged AS (
+	DELETE FROM %s e
+	WHERE e.deleted AND %s
+	RETURNING e.id, e.account_id, %s AS snapshot
+)
+INSERT INTO audit_log (
+	time,
+	account_id,
+	actor_account_id,
+	session_id,
+	api_token_id,
+	entity,
+	entity_id,
+	action,
+	before,
+	after
+)
+SELECT $%d, account_id, $%d, $%d, $%d, $%d, id, $%d, snapshot, 'null'
+FROM purged`,
+		entityTables[entity], condition, snapshotExprs[entity],
+		n+1, n+2, n+3, n+4, n+5, n+6)
+	params = append(
+		params,
+		time.Now().UTC(),
+		nullID(actor.AccountID),
+		nullID(actor.SessionID),
+		nullID(actor.APITokenID),
+		entity,
+		ActionPurge)
+	result, err := tx.ExecContext(ctx, query, params...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Conditions selecting the products and tags that can be purged without
+// affecting purchases that haven't been purged. Purchases in the trash keep
+// their tags, so that restoring them restores the tags too.
+const (
+	productUnusedCondition = `
+	NOT EXISTS (SELECT 1 FROM purchases WHERE purchases.product_id = e.id)`
+	tagUnusedCondition = `
+	NOT EXISTS (SELECT 1 FROM purchase_tag WHERE purchase_tag.tag_id = e.id)`
+)
+
+// PurgeFromTrash permanently deletes deleted entities of an account. Purging
+// a product also purges the deleted purchases of the product. Products and
+// tags still used by purchases, including purchases in the trash, are
+// skipped. The number of purged entities is returned.
+func (api *API) PurgeFromTrash(ctx context.Context, accountID int64, items *TrashItems) (int64, error) {
+	defer api.observe("PurgeFromTrash")()
+	tx, err := api.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	purchaseCount, err := purge(
+		ctx, tx, EntityPurchase,
+		"e.account_id = $1 AND (e.id = ANY($2) OR e.product_id = ANY($3))",
+		accountID, pq.Array(items.Purchases), pq.Array(items.Products))
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	total += purchaseCount
+	productCount, err := purge(
+		ctx, tx, EntityProduct,
+		"e.account_id = $1 AND e.id = ANY($2) AND"+productUnusedCondition,
+		accountID, pq.Array(items.Products))
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	total += productCount
+	tagCount, err := purge(
+		ctx, tx, EntityTag,
+		"e.account_id = $1 AND e.id = ANY($2) AND"+tagUnusedCondition,
+		accountID, pq.Array(items.Tags))
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	total += tagCount
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return total, nil
+}
+
+// PurgeExpiredTrash permanently deletes entities of all accounts deleted
+// before the given time. The number of purged entities is returned.
+func (api *API) PurgeExpiredTrash(ctx context.Context, before time.Time) (int64, error) {
+	defer api.observe("PurgeExpiredTrash")()
+	tx, err := api.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	conditions := []struct {
+		entity    string
+		condition string
+	}{
+		{EntityPurchase, "e.deleted_time < $1"},
+		{EntityProduct, "e.deleted_time < $1 AND" + productUnusedCondition},
+		{EntityTag, "e.deleted_time < $1 AND" + tagUnusedCondition},
+	}
+	for _, c := range conditions {
+		count, err := purge(ctx, tx, c.entity, c.condition, before.UTC())
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		total += count
+	}
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return total, nil
+}
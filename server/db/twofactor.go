@@ -0,0 +1,385 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lassilaiho/expenditure-accounting/server/totp"
+)
+
+const (
+	loginChallengeTimeout = 5 * time.Minute
+	// maxChallengeAttempts is the number of invalid codes accepted for a login
+	// challenge before the challenge is invalidated.
+	maxChallengeAttempts = 5
+	recoveryCodeCount    = 10
+	recoveryCodeBytes    = 10
+)
+
+var (
+	ErrInvalidTwoFactorCode = errors.New("invalid two-factor authentication code")
+	ErrInvalidChallenge     = errors.New("invalid or expired login challenge")
+	ErrTwoFactorEnabled     = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorNotEnabled  = errors.New("two-factor authentication is not enabled")
+)
+
+// LoginChallenge is issued after a successful password login when the account
+// uses two-factor authentication. The token is exchanged for a session using
+// CompleteLogin.
+type LoginChallenge struct {
+	Token      string    `json:"challenge"`
+	ExpiryTime time.Time `json:"expiryTime"`
+}
+
+type TwoFactorStatus struct {
+	Enabled               bool `json:"enabled"`
+	RecoveryCodesLeft     int  `json:"recoveryCodesLeft"`
+	PendingTOTPEnrollment bool `json:"pendingTotpEnrollment"`
+}
+
+func insertLoginChallenge(ctx context.Context, tx *sql.Tx, accountID int64) (*LoginChallenge, error) {
+	token, err := generateToken(sessionTokenBytes)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	challenge := &LoginChallenge{
+		Token:      token,
+		ExpiryTime: now.Add(loginChallengeTimeout),
+	}
+	query := `
+INSERT INTO login_challenges (token_hash, account_id, expiry_time)
+VALUES ($1, $2, $3)`
+	_, err = tx.ExecContext(ctx, query, hashToken(token), accountID, challenge.ExpiryTime)
+	if err != nil {
+		return nil, err
+	}
+	query = "DELETE FROM login_challenges WHERE account_id = $1 AND expiry_time < $2"
+	if _, err = tx.ExecContext(ctx, query, accountID, now); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// CompleteLogin exchanges a login challenge for a session. Either a TOTP code
+// or an unused recovery code must be given. client may be nil.
+func (api *API) CompleteLogin(
+	ctx context.Context, challengeToken, code, recoveryCode string, client *ClientInfo,
+) (*Session, error) {
+	defer api.observe("CompleteLogin")()
+	tx, err := api.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		challengeID int64
+		accountID   int64
+		expiryTime  time.Time
+		attempts    int
+		email       string
+		role        string
+		disabled    bool
+		totpSecret  string
+		lastStep    int64
+	)
+	query := `
+SELECT
+	login_challenges.id,
+	login_challenges.account_id,
+	login_challenges.expiry_time,
+	login_challenges.attempts,
+	accounts.email,
+	accounts.role,
+	accounts.disabled,
+	accounts.totp_secret,
+	accounts.totp_last_step
+FROM login_challenges, accounts
+WHERE
+	login_challenges.token_hash = $1
+	AND accounts.id = login_challenges.account_id
+FOR UPDATE`
+	err = tx.QueryRowContext(ctx, query, hashToken(challengeToken)).Scan(
+		&challengeID,
+		&accountID,
+		&expiryTime,
+		&attempts,
+		&email,
+		&role,
+		&disabled,
+		&totpSecret,
+		&lastStep)
+	if err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return nil, ErrInvalidChallenge
+		}
+		return nil, err
+	}
+	now := time.Now().UTC()
+	if now.After(expiryTime) || attempts >= maxChallengeAttempts {
+		tx.Rollback()
+		return nil, ErrInvalidChallenge
+	}
+	if disabled {
+		tx.Rollback()
+		return nil, ErrAccountDisabled
+	}
+	valid := false
+	if code != "" {
+		var step int64
+		if step, valid = totp.Validate(totpSecret, code, now, lastStep); valid {
+			query = "UPDATE accounts SET totp_last_step = $1 WHERE id = $2"
+			if _, err = tx.ExecContext(ctx, query, step, accountID); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		}
+	} else if recoveryCode != "" {
+		valid, err = useRecoveryCode(ctx, tx, accountID, recoveryCode)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if !valid {
+		query = "UPDATE login_challenges SET attempts = attempts + 1 WHERE id = $1"
+		if _, err = tx.ExecContext(ctx, query, challengeID); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if err = tx.Commit(); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		api.recordLoginEvent(ctx, &accountID, email, client, LoginTwoFactorFailed)
+		return nil, ErrInvalidTwoFactorCode
+	}
+	query = "DELETE FROM login_challenges WHERE id = $1"
+	if _, err = tx.ExecContext(ctx, query, challengeID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	session, err := api.insertSession(ctx, tx, accountID, role, client)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	api.recordLoginEvent(ctx, &accountID, email, client, LoginSucceeded)
+	return session, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+func generateRecoveryCode() (string, error) {
+	b := make([]byte, recoveryCodeBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+	return code[:len(code)/2] + "-" + code[len(code)/2:], nil
+}
+
+func useRecoveryCode(ctx context.Context, tx *sql.Tx, accountID int64, code string) (bool, error) {
+	query := `
+UPDATE recovery_codes
+SET used = TRUE
+WHERE account_id = $1 AND code_hash = $2 AND NOT used`
+	result, err := tx.ExecContext(
+		ctx, query, accountID, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// replaceRecoveryCodes generates a new set of recovery codes for an account
+// and invalidates the old ones.
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, accountID int64) ([]string, error) {
+	query := "DELETE FROM recovery_codes WHERE account_id = $1"
+	if _, err := tx.ExecContext(ctx, query, accountID); err != nil {
+		return nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	builder := insertQuery("recovery_codes", "account_id", "code_hash")
+	for i := range codes {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+		builder.Values(accountID, hashToken(normalizeRecoveryCode(code)))
+	}
+	query, params := builder.Build()
+	if _, err := tx.ExecContext(ctx, query, params...); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (api *API) GetTwoFactorStatus(ctx context.Context, accountID int64) (*TwoFactorStatus, error) {
+	defer api.observe("GetTwoFactorStatus")()
+	status := &TwoFactorStatus{}
+	query := `
+SELECT
+	totp_enabled,
+	NOT totp_enabled AND totp_secret <> '',
+	(SELECT count(*) FROM recovery_codes
+		WHERE recovery_codes.account_id = accounts.id AND NOT recovery_codes.used)
+FROM accounts
+WHERE id = $1`
+	err := api.DB.QueryRowContext(ctx, query, accountID).Scan(
+		&status.Enabled,
+		&status.PendingTOTPEnrollment,
+		&status.RecoveryCodesLeft)
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// BeginTOTPEnrollment generates a new TOTP secret for an account. The secret
+// isn't used for logging in until the enrollment is confirmed with
+// ConfirmTOTPEnrollment. The email address of the account is returned along
+// with the secret.
+func (api *API) BeginTOTPEnrollment(ctx context.Context, accountID int64) (secret, email string, err error) {
+	defer api.observe("BeginTOTPEnrollment")()
+	secret, err = totp.GenerateSecret()
+	if err != nil {
+		return "", "", err
+	}
+	query := `
+UPDATE accounts
+SET totp_secret = $1, totp_last_step = 0
+WHERE id = $2 AND NOT totp_enabled
+RETURNING email`
+	err = api.DB.QueryRowContext(ctx, query, secret, accountID).Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", "", ErrTwoFactorEnabled
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return secret, email, nil
+}
+
+// ConfirmTOTPEnrollment enables two-factor authentication for an account if
+// code is valid for the pending TOTP secret. A new set of recovery codes is
+// returned.
+func (api *API) ConfirmTOTPEnrollment(ctx context.Context, accountID int64, code string) ([]string, error) {
+	defer api.observe("ConfirmTOTPEnrollment")()
+	tx, err := api.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		secret  string
+		enabled bool
+	)
+	query := "SELECT totp_secret, totp_enabled FROM accounts WHERE id = $1 FOR UPDATE"
+	if err = tx.QueryRowContext(ctx, query, accountID).Scan(&secret, &enabled); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if enabled {
+		tx.Rollback()
+		return nil, ErrTwoFactorEnabled
+	}
+	if secret == "" {
+		tx.Rollback()
+		return nil, ErrTwoFactorNotEnabled
+	}
+	step, ok := totp.Validate(secret, code, time.Now(), 0)
+	if !ok {
+		tx.Rollback()
+		return nil, ErrInvalidTwoFactorCode
+	}
+	query = "UPDATE accounts SET totp_enabled = TRUE, totp_last_step = $1 WHERE id = $2"
+	if _, err = tx.ExecContext(ctx, query, step, accountID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	codes, err := replaceRecoveryCodes(ctx, tx, accountID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (api *API) DisableTwoFactor(ctx context.Context, accountID int64) error {
+	defer api.observe("DisableTwoFactor")()
+	tx, err := api.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	query := `
+UPDATE accounts
+SET totp_enabled = FALSE, totp_secret = '', totp_last_step = 0
+WHERE id = $1`
+	if _, err = tx.ExecContext(ctx, query, accountID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	query = "DELETE FROM recovery_codes WHERE account_id = $1"
+	if _, err = tx.ExecContext(ctx, query, accountID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	query = "DELETE FROM login_challenges WHERE account_id = $1"
+	if _, err = tx.ExecContext(ctx, query, accountID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return nil
+}
+
+func (api *API) RegenerateRecoveryCodes(ctx context.Context, accountID int64) ([]string, error) {
+	defer api.observe("RegenerateRecoveryCodes")()
+	tx, err := api.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	var enabled bool
+	query := "SELECT totp_enabled FROM accounts WHERE id = $1 FOR UPDATE"
+	if err = tx.QueryRowContext(ctx, query, accountID).Scan(&enabled); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if !enabled {
+		tx.Rollback()
+		return nil, ErrTwoFactorNotEnabled
+	}
+	codes, err := replaceRecoveryCodes(ctx, tx, accountID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return codes, nil
+}
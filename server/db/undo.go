@@ -0,0 +1,302 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// maxUndoOperations is the number of operations kept in the undo stack of a
+// session.
+const maxUndoOperations = 100
+
+var ErrUndoConflict = errors.New("data has been changed after the operation")
+
+// isUndoable reports whether changes with the given action are added to the
+// undo stack of the session making them.
+func isUndoable(action string) bool {
+	switch action {
+	case ActionUndo, ActionRedo, ActionPurge:
+		return false
+	default:
+		return true
+	}
+}
+
+// pushOperation adds the operation of the current transaction to the undo
+// stack of a session. Operations undone earlier can't be redone after a new
+// operation.
+func pushOperation(ctx context.Context, tx *sql.Tx, sessionID int64) error {
+	query := "DELETE FROM session_operations WHERE session_id = $1 AND undone"
+	if _, err := tx.ExecContext(ctx, query, sessionID); err != nil {
+		return err
+	}
+	query = `
+INSERT INTO session_operations (session_id, operation_id)
+VALUES ($1, txid_current())
+ON CONFLICT (session_id, operation_id) DO NOTHING`
+	if _, err := tx.ExecContext(ctx, query, sessionID); err != nil {
+		return err
+	}
+	query = `
+DELETE FROM session_operations
+WHERE session_id = $1 AND id <= (
+	SELECT id FROM session_operations
+	WHERE session_id = $1
+	ORDER BY id DESC
+	OFFSET $2 LIMIT 1
+)`
+	_, err := tx.ExecContext(ctx, query, sessionID, maxUndoOperations)
+	return err
+}
+
+// applySnapshotQueries set the state of an entity to the snapshot given as
+// $3.
+var applySnapshotQueries = map[string][]string{
+	EntityPurchase: {
+		`
+UPDATE purchases
+SET
+	product_id = (s->>'product_id')::integer,
+	date = (s->>'date')::date,
+	quantity = (s->>'quantity')::numeric,
+	price = (s->>'price')::numeric,
+	deleted = (s->>'deleted')::boolean,
+	deleted_time = (s->>'deleted_time')::timestamp
+FROM (SELECT $3::jsonb AS s) AS snapshot
+WHERE id = $1 AND account_id = $2`,
+		`
+DELETE FROM purchase_tag
+USING purchases
+WHERE
+	purchase_tag.purchase_id = $1
+	AND purchases.id = purchase_tag.purchase_id
+	AND purchases.account_id = $2`,
+		`
+INSERT INTO purchase_tag (purchase_id, tag_id, deleted)
+SELECT purchases.id, tag_id::integer, (s->>'deleted')::boolean
+FROM
+	purchases,
+	(SELECT $3::jsonb AS s) AS snapshot,
+	jsonb_array_elements_text(s->'tags') AS tag_id
+WHERE purchases.id = $1 AND purchases.account_id = $2`,
+	},
+	EntityProduct: {`
+UPDATE products
+SET
+	name = s->>'name',
+	deleted = (s->>'deleted')::boolean,
+	deleted_time = (s->>'deleted_time')::timestamp
+FROM (SELECT $3::jsonb AS s) AS snapshot
+WHERE id = $1 AND account_id = $2`,
+	},
+	EntityTag: {`
+UPDATE tags
+SET
+	name = s->>'name',
+	deleted = (s->>'deleted')::boolean,
+	deleted_time = (s->>'deleted_time')::timestamp
+FROM (SELECT $3::jsonb AS s) AS snapshot
+WHERE id = $1 AND account_id = $2`,
+	},
+}
+
+func applySnapshot(
+	ctx context.Context, tx *sql.Tx, entity string, entityID, accountID int64, data json.RawMessage,
+) error {
+	for _, query := range applySnapshotQueries[entity] {
+		_, err := tx.ExecContext(ctx, query, entityID, accountID, string(data))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markDeleted returns a copy of a snapshot with the entity marked as deleted.
+func markDeleted(data json.RawMessage, now time.Time) (json.RawMessage, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	fields["deleted"] = true
+	fields["deleted_time"] = now.Format("2006-01-02T15:04:05.999999")
+	return json.Marshal(fields)
+}
+
+type operationEntry struct {
+	entity   string
+	entityID int64
+	before   json.RawMessage
+	after    json.RawMessage
+}
+
+func getOperationEntries(
+	ctx context.Context, tx *sql.Tx, accountID, operationID int64, newestFirst bool,
+) ([]*operationEntry, error) {
+	query := `
+SELECT entity, entity_id, before, after
+FROM audit_log
+WHERE account_id = $1 AND operation_id = $2
+ORDER BY id`
+	if newestFirst {
+		query += " DESC"
+	}
+	rows, err := tx.QueryContext(ctx, query, accountID, operationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []*operationEntry{}
+	for rows.Next() {
+		e := &operationEntry{}
+		var before, after []byte
+		if err = rows.Scan(&e.entity, &e.entityID, &before, &after); err != nil {
+			return nil, err
+		}
+		if before != nil {
+			e.before = before
+		}
+		e.after = after
+		entries = append(entries, e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+type stackedOperation struct {
+	id          int64
+	operationID int64
+}
+
+func getStackedOperations(
+	ctx context.Context, tx *sql.Tx, sessionID int64, undone bool, count int,
+) ([]stackedOperation, error) {
+	// Undo pops the most recent operations, redo the most recently undone
+	// ones, which are the oldest undone operations.
+	query := `
+SELECT id, operation_id
+FROM session_operations
+WHERE session_id = $1 AND undone = $2
+ORDER BY id DESC
+LIMIT $3
+FOR UPDATE`
+	if undone {
+		query = `
+SELECT id, operation_id
+FROM session_operations
+WHERE session_id = $1 AND undone = $2
+ORDER BY id ASC
+LIMIT $3
+FOR UPDATE`
+	}
+	rows, err := tx.QueryContext(ctx, query, sessionID, undone, count)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	operations := []stackedOperation{}
+	for rows.Next() {
+		var op stackedOperation
+		if err = rows.Scan(&op.id, &op.operationID); err != nil {
+			return nil, err
+		}
+		operations = append(operations, op)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return operations, nil
+}
+
+// Undo reverts the last count operations made in a session. The number of
+// operations undone is returned. ErrUndoConflict is returned if an entity
+// changed by one of the operations has been changed again afterwards.
+func (api *API) Undo(ctx context.Context, accountID, sessionID int64, count int) (int, error) {
+	defer api.observe("Undo")()
+	return api.undoOrRedo(ctx, accountID, sessionID, count, false)
+}
+
+// Redo applies again the last count operations undone in a session.
+func (api *API) Redo(ctx context.Context, accountID, sessionID int64, count int) (int, error) {
+	defer api.observe("Redo")()
+	return api.undoOrRedo(ctx, accountID, sessionID, count, true)
+}
+
+func (api *API) undoOrRedo(
+	ctx context.Context, accountID, sessionID int64, count int, redo bool,
+) (int, error) {
+	tx, err := api.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	operations, err := getStackedOperations(ctx, tx, sessionID, redo, count)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	now := time.Now().UTC()
+	for _, op := range operations {
+		entries, err := getOperationEntries(ctx, tx, accountID, op.operationID, !redo)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		for _, e := range entries {
+			if err = revertEntry(ctx, tx, accountID, e, redo, now); err != nil {
+				tx.Rollback()
+				return 0, err
+			}
+		}
+		query := "UPDATE session_operations SET undone = $1 WHERE id = $2"
+		if _, err = tx.ExecContext(ctx, query, !redo, op.id); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return len(operations), nil
+}
+
+// revertEntry undoes or redoes the change recorded in an audit log entry.
+func revertEntry(
+	ctx context.Context, tx *sql.Tx, accountID int64, e *operationEntry, redo bool, now time.Time,
+) error {
+	current, err := snapshot(ctx, tx, e.entity, e.entityID, accountID)
+	if err == ErrNoRowsAffected {
+		return ErrUndoConflict
+	}
+	if err != nil {
+		return err
+	}
+	expected, target, action := e.after, e.before, ActionUndo
+	if redo {
+		expected, target, action = e.before, e.after, ActionRedo
+	}
+	if expected != nil && !bytes.Equal(current, expected) {
+		return ErrUndoConflict
+	}
+	if target == nil {
+		// Undoing the creation of an entity moves it to the trash.
+		if target, err = markDeleted(e.after, now); err != nil {
+			return err
+		}
+	}
+	if err = applySnapshot(ctx, tx, e.entity, e.entityID, accountID, target); err != nil {
+		return err
+	}
+	return recordChange(ctx, tx, accountID, &change{
+		Entity:   e.entity,
+		EntityID: e.entityID,
+		Action:   action,
+		Before:   current,
+	})
+}
@@ -0,0 +1,232 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+// Limits of the values of purchases, products and tags.
+const (
+	MaxNameLength = 200
+	// MaxQuantityScale and MaxPriceScale are the maximum numbers of decimal
+	// places of quantities and prices.
+	MaxQuantityScale = 3
+	MaxPriceScale    = 4
+	// MaxIntegerDigits is the maximum number of digits before the decimal
+	// point of quantities and prices.
+	MaxIntegerDigits = 12
+)
+
+// MinPurchaseDate is the earliest date of a purchase. Purchases can be dated
+// at most a year ahead.
+var MinPurchaseDate = time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func maxPurchaseDate() time.Time {
+	return time.Now().AddDate(1, 0, 0)
+}
+
+// ValidationErrors lists every invalid value of a request.
+type ValidationErrors []*DataError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// inField returns err with the fields of invalid values prefixed with the path
+// of the part of the request they are in. Other errors are returned as is.
+func inField(prefix string, err error) error {
+	var validationErrs ValidationErrors
+	if errors.As(err, &validationErrs) {
+		prefixed := make(ValidationErrors, len(validationErrs))
+		for i, e := range validationErrs {
+			prefixed[i] = e.inField(prefix)
+		}
+		return prefixed
+	}
+	if dataErr := AsDataError(err); dataErr != nil {
+		return dataErr.inField(prefix)
+	}
+	return err
+}
+
+func (e *DataError) inField(prefix string) *DataError {
+	prefixed := *e
+	prefixed.Field = prefix
+	if e.Field != "" {
+		prefixed.Field += "/" + e.Field
+	}
+	return &prefixed
+}
+
+// validator collects the invalid values of a request.
+type validator struct {
+	errs ValidationErrors
+}
+
+func (v *validator) add(kind, field, message string) {
+	v.errs = append(v.errs, &DataError{Kind: kind, Field: field, Message: message})
+}
+
+// err returns the collected errors as ValidationErrors or nil if there are
+// none.
+func (v *validator) err() error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return v.errs
+}
+
+func (v *validator) checkName(field, name string) {
+	if strings.TrimSpace(name) == "" {
+		v.add(DataMissing, field, "must not be empty")
+	} else if utf8.RuneCountInString(name) > MaxNameLength {
+		v.add(DataInvalid, field, fmt.Sprintf("must be at most %d characters", MaxNameLength))
+	}
+}
+
+// checkDecimal checks that value is positive and has at most scale decimal
+// places ignoring trailing zeros.
+func (v *validator) checkDecimal(field string, value Decimal, scale int) {
+	if value.Sign() <= 0 {
+		v.add(DataInvalid, field, "must be positive")
+	} else if value.IntegerDigits() > MaxIntegerDigits {
+		v.add(DataInvalid, field, "is too large")
+	} else if value.Normalize().Scale() > scale {
+		v.add(DataInvalid, field, fmt.Sprintf("must have at most %d decimal places", scale))
+	}
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// checkPurchase checks the values of a new purchase or an update to a
+// purchase except for the references to the product and tags. A new purchase
+// must have all fields except tags.
+func (v *validator) checkPurchase(value *PurchaseUpdate, create bool) {
+	if value.Product == nil && create {
+		v.add(DataMissing, "product", "is required")
+	}
+	if value.Date != nil {
+		if value.Date.Before(MinPurchaseDate) || value.Date.After(maxPurchaseDate()) {
+			v.add(DataInvalid, "date", "is out of range")
+		}
+	} else if create {
+		v.add(DataMissing, "date", "is required")
+	}
+	if value.Quantity != nil {
+		v.checkDecimal("quantity", *value.Quantity, MaxQuantityScale)
+	} else if create {
+		v.add(DataMissing, "quantity", "is required")
+	}
+	if value.Price != nil {
+		v.checkDecimal("price", *value.Price, MaxPriceScale)
+	} else if create {
+		v.add(DataMissing, "price", "is required")
+	}
+}
+
+// checkPurchaseValues is checkPurchase for purchases whose product and tags
+// have already been checked.
+func checkPurchaseValues(value *PurchaseUpdate, create bool) error {
+	v := &validator{}
+	v.checkPurchase(value, create)
+	return v.err()
+}
+
+// validatePurchase checks the values of a new purchase or an update to a
+// purchase of an account like checkPurchase. In addition, the product and tags
+// must belong to the account and not be deleted.
+func validatePurchase(
+	ctx context.Context, tx *sql.Tx, accountID int64, value *PurchaseUpdate, create bool,
+) error {
+	v := &validator{}
+	if value.Product != nil {
+		exists, err := entityExists(ctx, tx, "products", accountID, *value.Product)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			v.add(DataUnknownReference, "product", "product does not exist")
+		}
+	}
+	v.checkPurchase(value, create)
+	if len(value.Tags) > 0 {
+		owned, err := ownedTags(ctx, tx, accountID, value.Tags)
+		if err != nil {
+			return err
+		}
+		seen := make(map[int64]bool, len(value.Tags))
+		for i, tagID := range value.Tags {
+			field := fmt.Sprintf("tags/%d", i)
+			if seen[tagID] {
+				v.add(DataDuplicate, field, "tag is listed more than once")
+			} else if !owned[tagID] {
+				v.add(DataUnknownReference, field, "tag does not exist")
+			}
+			seen[tagID] = true
+		}
+	}
+	return v.err()
+}
+
+// entityExists reports whether a product or tag belongs to an account and
+// isn't deleted.
+func entityExists(ctx context.Context, tx *sql.Tx, table string, accountID, id int64) (bool, error) {
+	var exists bool
+	err := tx.QueryRowContext(
+		ctx,
+		"SELECT EXISTS (SELECT 1 FROM "+table+" WHERE id = $1 AND account_id = $2 AND NOT deleted)",
+		id,
+		accountID).Scan(&exists)
+	return exists, err
+}
+
+// ownedTags returns the set of tagIDs belonging to an account that aren't
+// deleted.
+func ownedTags(ctx context.Context, tx *sql.Tx, accountID int64, tagIDs []int64) (map[int64]bool, error) {
+	query := "SELECT id FROM tags WHERE account_id = $1 AND id = ANY($2) AND NOT deleted"
+	rows, err := tx.QueryContext(ctx, query, accountID, pq.Array(tagIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	owned := map[int64]bool{}
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		owned[id] = true
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return owned, nil
+}
+
+// validateNames checks the names of new tags. Field is the prefix of the
+// path of each name.
+func validateNames(field string, names []string) error {
+	v := &validator{}
+	for i, name := range names {
+		v.checkName(fmt.Sprintf("%s/%d", field, i), name)
+	}
+	return v.err()
+}
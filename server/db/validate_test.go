@@ -0,0 +1,53 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckDecimal(t *testing.T) {
+	cases := []struct {
+		value, message string
+	}{
+		{"1", ""},
+		{"0.25", ""},
+		{"007.5000", ""},
+		{"123456789012.12", ""},
+		{"0", "must be positive"},
+		{"0.00", "must be positive"},
+		{"-1", "must be positive"},
+		{"1234567890123", "is too large"},
+		{"1.125", "must have at most 2 decimal places"},
+	}
+	for _, c := range cases {
+		v := &validator{}
+		v.checkDecimal("price", MustParseDecimal(c.value), 2)
+		if c.message == "" {
+			require.Nil(t, v.err(), c.value)
+		} else {
+			require.Equal(t, ValidationErrors{{
+				Kind:    DataInvalid,
+				Field:   "price",
+				Message: c.message,
+			}}, v.err(), c.value)
+		}
+	}
+}
+
+func TestValidateNames(t *testing.T) {
+	long := make([]rune, MaxNameLength+1)
+	for i := range long {
+		long[i] = 'ä'
+	}
+	require.Nil(t, validateNames("tags", []string{"Food", string(long[1:])}))
+	err := validateNames("tags", []string{"Food", " ", string(long)})
+	require.Equal(t, ValidationErrors{
+		{Kind: DataMissing, Field: "tags/1", Message: "must not be empty"},
+		{Kind: DataInvalid, Field: "tags/2", Message: "must be at most 200 characters"},
+	}, err)
+	require.Equal(
+		t,
+		"purchases/3/tags/1: must not be empty; purchases/3/tags/2: must be at most 200 characters",
+		inField("purchases/3", err).Error())
+}
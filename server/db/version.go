@@ -0,0 +1,45 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// The change_version column used for synchronization doubles as the version
+// of an entity for optimistic concurrency control.
+
+var ErrVersionMismatch = errors.New("entity has been changed by someone else")
+
+// checkVersion locks an entity and checks that its version is expected. A zero
+// expected version matches any version. ErrNoRowsAffected is returned if the
+// entity doesn't exist.
+func checkVersion(
+	ctx context.Context, tx *sql.Tx, entity string, entityID, accountID, expected int64,
+) error {
+	if expected == 0 {
+		return nil
+	}
+	query := "SELECT change_version FROM " + entityTables[entity] + `
+WHERE id = $1 AND account_id = $2
+FOR UPDATE`
+	var version int64
+	err := tx.QueryRowContext(ctx, query, entityID, accountID).Scan(&version)
+	if err == sql.ErrNoRows {
+		return ErrNoRowsAffected
+	}
+	if err != nil {
+		return err
+	}
+	if version != expected {
+		return ErrVersionMismatch
+	}
+	return nil
+}
+
+func getVersion(ctx context.Context, tx *sql.Tx, entity string, entityID int64) (int64, error) {
+	query := "SELECT change_version FROM " + entityTables[entity] + " WHERE id = $1"
+	var version int64
+	err := tx.QueryRowContext(ctx, query, entityID).Scan(&version)
+	return version, err
+}
@@ -0,0 +1,594 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Statuses of webhook deliveries.
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// EventPing is the event sent when a webhook is tested.
+const EventPing = "ping"
+
+const (
+	maxWebhookURLLength = 2000
+	webhookSecretBytes  = 32
+)
+
+var (
+	ErrInvalidWebhookURL   = errors.New("invalid webhook URL")
+	ErrInvalidWebhookEvent = errors.New("invalid webhook event type")
+)
+
+// WebhookEvents lists the event types webhooks can subscribe to. An event
+// type is the changed entity and the action separated by a dot, such as
+// purchase.create.
+var WebhookEvents = func() []string {
+	events := []string{}
+	for _, entity := range []string{EntityPurchase, EntityProduct, EntityTag} {
+		for _, action := range []string{
+			ActionCreate,
+			ActionUpdate,
+			ActionDelete,
+			ActionRestore,
+			ActionPurge,
+			ActionUndo,
+			ActionRedo,
+		} {
+			events = append(events, entity+"."+action)
+		}
+	}
+	return events
+}()
+
+// privateNetworks are the address ranges webhooks aren't delivered to unless
+// private addresses are allowed: loopback, private, shared, link-local,
+// multicast and otherwise reserved addresses.
+var privateNetworks = func() []*net.IPNet {
+	cidrs := []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.0.0.0/24",
+		"192.168.0.0/16",
+		"198.18.0.0/15",
+		"224.0.0.0/4",
+		"240.0.0.0/4",
+		"::/128",
+		"::1/128",
+		"64:ff9b::/96",
+		"fc00::/7",
+		"fe80::/10",
+		"ff00::/8",
+	}
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}()
+
+// PublicWebhookAddress reports whether ip is a public address webhooks may
+// be delivered to. Deliveries to other addresses could reach services inside
+// the network of the server, such as cloud metadata endpoints.
+func PublicWebhookAddress(ip net.IP) bool {
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkWebhookURL checks that rawURL is an HTTP URL. Unless allowPrivate is
+// true, the host must not be localhost or a private address. Host names
+// resolving to private addresses are rejected when the delivery is sent.
+func checkWebhookURL(rawURL string, allowPrivate bool) error {
+	if len(rawURL) > maxWebhookURLLength {
+		return ErrInvalidWebhookURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrInvalidWebhookURL
+	}
+	if allowPrivate {
+		return nil
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return ErrInvalidWebhookURL
+	}
+	if ip := net.ParseIP(host); ip != nil && !PublicWebhookAddress(ip) {
+		return ErrInvalidWebhookURL
+	}
+	return nil
+}
+
+func checkWebhookEvents(events []string) error {
+	if len(events) == 0 {
+		return ErrInvalidWebhookEvent
+	}
+outer:
+	for _, event := range events {
+		for _, valid := range WebhookEvents {
+			if event == valid {
+				continue outer
+			}
+		}
+		return ErrInvalidWebhookEvent
+	}
+	return nil
+}
+
+// Webhook sends the changes of an account to a URL. Deliveries for the
+// subscribed events are queued in the same transaction as the change.
+type Webhook struct {
+	ID     int64    `json:"id"`
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	// Secret is used to sign the deliveries. It is only returned when the
+	// webhook is created.
+	Secret       string    `json:"secret,omitempty"`
+	Active       bool      `json:"active"`
+	CreationTime time.Time `json:"creationTime"`
+}
+
+type WebhookUpdate struct {
+	URL    *string  `json:"url"`
+	Events []string `json:"events"`
+	Secret *string  `json:"secret"`
+	Active *bool    `json:"active"`
+}
+
+// WebhookDelivery is a queued or attempted delivery of an event to a webhook.
+type WebhookDelivery struct {
+	ID              int64           `json:"id"`
+	WebhookID       int64           `json:"webhookId"`
+	Event           string          `json:"event"`
+	Payload         json.RawMessage `json:"payload"`
+	CreationTime    time.Time       `json:"creationTime"`
+	Status          string          `json:"status"`
+	Attempts        int             `json:"attempts"`
+	NextAttemptTime *time.Time      `json:"nextAttemptTime"`
+	LastAttemptTime *time.Time      `json:"lastAttemptTime"`
+	ResponseStatus  *int            `json:"responseStatus"`
+	Error           string          `json:"error"`
+}
+
+// DueWebhookDelivery is a delivery claimed for sending.
+type DueWebhookDelivery struct {
+	ID      int64
+	URL     string
+	Secret  string
+	Event   string
+	Payload []byte
+	// Attempts is the number of earlier attempts.
+	Attempts int
+}
+
+// WebhookAttempt is the outcome of an attempt to send a delivery.
+type WebhookAttempt struct {
+	Time time.Time
+	// Status is the status of the delivery after the attempt.
+	Status         string
+	ResponseStatus int
+	Error          string
+	// NextAttemptTime is the time of the next attempt of a pending delivery.
+	NextAttemptTime time.Time
+}
+
+// InsertWebhook creates a webhook for an account. A random secret is
+// generated if secret is empty.
+func (api *API) InsertWebhook(
+	ctx context.Context, accountID int64, webhookURL string, events []string, secret string,
+) (*Webhook, error) {
+	defer api.observe("InsertWebhook")()
+	if err := checkWebhookURL(webhookURL, api.AllowPrivateWebhooks); err != nil {
+		return nil, err
+	}
+	if err := checkWebhookEvents(events); err != nil {
+		return nil, err
+	}
+	if secret == "" {
+		var err error
+		if secret, err = generateToken(webhookSecretBytes); err != nil {
+			return nil, err
+		}
+	}
+	webhook := &Webhook{
+		URL:          webhookURL,
+		Events:       events,
+		Secret:       secret,
+		Active:       true,
+		CreationTime: time.Now().UTC(),
+	}
+	query := `
+INSERT INTO webhooks (account_id, url, events, secret, creation_time)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING id`
+	err := api.DB.QueryRowContext(
+		ctx,
+		query,
+		accountID,
+		webhook.URL,
+		pq.Array(webhook.Events),
+		webhook.Secret,
+		webhook.CreationTime).Scan(&webhook.ID)
+	if err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+// GetWebhooks returns the webhooks of an account without their secrets.
+func (api *API) GetWebhooks(ctx context.Context, accountID int64) ([]*Webhook, error) {
+	defer api.observe("GetWebhooks")()
+	query := `
+SELECT id, url, events, active, creation_time
+FROM webhooks
+WHERE account_id = $1
+ORDER BY id`
+	rows, err := api.DB.QueryContext(ctx, query, accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	webhooks := []*Webhook{}
+	for rows.Next() {
+		w := &Webhook{}
+		err = rows.Scan(&w.ID, &w.URL, pq.Array(&w.Events), &w.Active, &w.CreationTime)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, w)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+// UpdateWebhook changes the non-nil fields of a webhook and returns the
+// updated webhook without its secret.
+func (api *API) UpdateWebhook(
+	ctx context.Context, webhookID, accountID int64, update *WebhookUpdate,
+) (*Webhook, error) {
+	defer api.observe("UpdateWebhook")()
+	builder := updateQuery("webhooks")
+	if update.URL != nil {
+		if err := checkWebhookURL(*update.URL, api.AllowPrivateWebhooks); err != nil {
+			return nil, err
+		}
+		builder.Set("url", *update.URL)
+	}
+	if update.Events != nil {
+		if err := checkWebhookEvents(update.Events); err != nil {
+			return nil, err
+		}
+		builder.Set("events", pq.Array(update.Events))
+	}
+	if update.Secret != nil && *update.Secret != "" {
+		builder.Set("secret", *update.Secret)
+	}
+	if update.Active != nil {
+		builder.Set("active", *update.Active)
+	}
+	if !builder.HasParams() {
+		// Set the ID to itself so that the query returns the webhook.
+		builder.Set("id", webhookID)
+	}
+	query, params := builder.Where().
+		Column("id", webhookID).
+		And().Column("account_id", accountID).
+		Returning("id", "url", "events", "active", "creation_time").
+		Build()
+	w := &Webhook{}
+	err := api.DB.QueryRowContext(ctx, query, params...).
+		Scan(&w.ID, &w.URL, pq.Array(&w.Events), &w.Active, &w.CreationTime)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoRowsAffected
+	}
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// DeleteWebhook deletes a webhook together with its deliveries.
+func (api *API) DeleteWebhook(ctx context.Context, webhookID, accountID int64) error {
+	defer api.observe("DeleteWebhook")()
+	result, err := api.DB.ExecContext(
+		ctx,
+		"DELETE FROM webhooks WHERE id = $1 AND account_id = $2",
+		webhookID,
+		accountID)
+	if err != nil {
+		return err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNoRowsAffected
+	}
+	return nil
+}
+
+const webhookDeliveryColumns = `
+	id,
+	webhook_id,
+	event,
+	payload,
+	creation_time,
+	status,
+	attempts,
+	next_attempt_time,
+	last_attempt_time,
+	response_status,
+	error`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanWebhookDelivery(row rowScanner) (*WebhookDelivery, error) {
+	d := &WebhookDelivery{}
+	var (
+		payload         string
+		nextAttemptTime time.Time
+		lastAttemptTime sql.NullTime
+		responseStatus  sql.NullInt64
+	)
+	err := row.Scan(
+		&d.ID,
+		&d.WebhookID,
+		&d.Event,
+		&payload,
+		&d.CreationTime,
+		&d.Status,
+		&d.Attempts,
+		&nextAttemptTime,
+		&lastAttemptTime,
+		&responseStatus,
+		&d.Error,
+	)
+	if err != nil {
+		return nil, err
+	}
+	d.Payload = json.RawMessage(payload)
+	if d.Status == DeliveryPending {
+		d.NextAttemptTime = &nextAttemptTime
+	}
+	if lastAttemptTime.Valid {
+		d.LastAttemptTime = &lastAttemptTime.Time
+	}
+	if responseStatus.Valid {
+		status := int(responseStatus.Int64)
+		d.ResponseStatus = &status
+	}
+	return d, nil
+}
+
+// GetWebhookDeliveries returns at most limit most recent deliveries of a
+// webhook, newest first. ErrNoRowsAffected is returned if the webhook
+// doesn't exist.
+func (api *API) GetWebhookDeliveries(
+	ctx context.Context, webhookID, accountID int64, limit int,
+) ([]*WebhookDelivery, error) {
+	defer api.observe("GetWebhookDeliveries")()
+	var exists bool
+	err := api.DB.QueryRowContext(
+		ctx,
+		"SELECT EXISTS (SELECT 1 FROM webhooks WHERE id = $1 AND account_id = $2)",
+		webhookID,
+		accountID).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrNoRowsAffected
+	}
+	query := `
+SELECT` + webhookDeliveryColumns + `
+FROM webhook_deliveries
+WHERE webhook_id = $1
+ORDER BY creation_time DESC, id DESC
+LIMIT $2`
+	rows, err := api.DB.QueryContext(ctx, query, webhookID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deliveries := []*WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// InsertWebhookPing queues a ping delivery to a webhook and claims it for
+// lease so that it can be sent right away. ErrNoRowsAffected is returned if
+// the webhook doesn't exist.
+func (api *API) InsertWebhookPing(
+	ctx context.Context, webhookID, accountID int64, lease time.Duration,
+) (*DueWebhookDelivery, error) {
+	defer api.observe("InsertWebhookPing")()
+	now := time.Now().UTC()
+	payload, err := json.Marshal(struct {
+		Event     string `json:"event"`
+		Time      string `json:"time"`
+		WebhookID int64  `json:"webhookId"`
+	}{EventPing, now.Format(time.RFC3339Nano), webhookID})
+	if err != nil {
+		return nil, err
+	}
+	query := `
+WITH webhook AS (
+	SELECT id, url, secret FROM webhooks WHERE id = $1 AND account_id = $2
+), inserted AS (
+	INSERT INTO webhook_deliveries (
+		webhook_id,
+		event,
+		payload,
+		creation_time,
+		next_attempt_time
+	)
+	SELECT id, $3, $4, $5, $6
+	FROM webhook
+	RETURNING id
+)
+SELECT inserted.id, webhook.url, webhook.secret
+FROM inserted, webhook`
+	d := &DueWebhookDelivery{Event: EventPing, Payload: payload}
+	err = api.DB.QueryRowContext(
+		ctx,
+		query,
+		webhookID,
+		accountID,
+		EventPing,
+		string(payload),
+		now,
+		now.Add(lease)).Scan(&d.ID, &d.URL, &d.Secret)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoRowsAffected
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// ClaimWebhookDeliveries returns at most limit pending deliveries of active
+// webhooks that are due and postpones their next attempt by lease so that no one else sends
+// them in the meantime.
+func (api *API) ClaimWebhookDeliveries(
+	ctx context.Context, limit int, lease time.Duration,
+) ([]*DueWebhookDelivery, error) {
+	defer api.observe("ClaimWebhookDeliveries")()
+	now := time.Now().UTC()
+	query := `
+UPDATE webhook_deliveries
+SET next_attempt_time = $1
+FROM webhooks
+WHERE
+	webhooks.id = webhook_deliveries.webhook_id
+	AND webhook_deliveries.id IN (
+		SELECT webhook_deliveries.id
+		FROM webhook_deliveries
+		JOIN webhooks ON webhooks.id = webhook_deliveries.webhook_id
+		WHERE
+			webhooks.active
+			AND webhook_deliveries.status = $2
+			AND webhook_deliveries.next_attempt_time <= $3
+		ORDER BY webhook_deliveries.next_attempt_time
+		LIMIT $4
+		FOR UPDATE OF webhook_deliveries SKIP LOCKED
+	)
+RETURNING
+	webhook_deliveries.id,
+	webhooks.url,
+	webhooks.secret,
+	webhook_deliveries.event,
+	webhook_deliveries.payload,
+	webhook_deliveries.attempts`
+	rows, err := api.DB.QueryContext(ctx, query, now.Add(lease), DeliveryPending, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deliveries := []*DueWebhookDelivery{}
+	for rows.Next() {
+		d := &DueWebhookDelivery{}
+		var payload string
+		err = rows.Scan(&d.ID, &d.URL, &d.Secret, &d.Event, &payload, &d.Attempts)
+		if err != nil {
+			return nil, err
+		}
+		d.Payload = []byte(payload)
+		deliveries = append(deliveries, d)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// RecordWebhookAttempt stores the outcome of an attempt to send a delivery
+// and returns the updated delivery.
+func (api *API) RecordWebhookAttempt(
+	ctx context.Context, deliveryID int64, attempt *WebhookAttempt,
+) (*WebhookDelivery, error) {
+	defer api.observe("RecordWebhookAttempt")()
+	var responseStatus sql.NullInt64
+	if attempt.ResponseStatus != 0 {
+		responseStatus = sql.NullInt64{Int64: int64(attempt.ResponseStatus), Valid: true}
+	}
+	nextAttemptTime := attempt.NextAttemptTime
+	if attempt.Status != DeliveryPending {
+		nextAttemptTime = attempt.Time
+	}
+	query := `
+UPDATE webhook_deliveries
+SET
+	status = $1,
+	attempts = attempts + 1,
+	next_attempt_time = $2,
+	last_attempt_time = $3,
+	response_status = $4,
+	error = $5
+WHERE id = $6
+RETURNING` + webhookDeliveryColumns
+	return scanWebhookDelivery(api.DB.QueryRowContext(
+		ctx,
+		query,
+		attempt.Status,
+		nextAttemptTime.UTC(),
+		attempt.Time.UTC(),
+		responseStatus,
+		attempt.Error,
+		deliveryID))
+}
+
+// PurgeWebhookDeliveries deletes the finished deliveries of all accounts
+// created before the given time. The number of deleted deliveries is
+// returned.
+func (api *API) PurgeWebhookDeliveries(ctx context.Context, before time.Time) (int64, error) {
+	defer api.observe("PurgeWebhookDeliveries")()
+	result, err := api.DB.ExecContext(
+		ctx,
+		"DELETE FROM webhook_deliveries WHERE status <> $1 AND creation_time < $2",
+		DeliveryPending,
+		before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
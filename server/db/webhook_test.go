@@ -0,0 +1,39 @@
+package db
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckWebhookURL(t *testing.T) {
+	cases := []struct {
+		url     string
+		private bool
+	}{
+		{"https://example.com/hook", false},
+		{"http://93.184.216.34:8080/hook", false},
+		{"http://localhost/hook", true},
+		{"http://api.LOCALHOST./hook", true},
+		{"http://127.0.0.1:8080/hook", true},
+		{"http://10.1.2.3/hook", true},
+		{"http://172.20.0.1/hook", true},
+		{"http://192.168.1.1/hook", true},
+		{"http://169.254.169.254/latest/meta-data", true},
+		{"http://[::1]/hook", true},
+		{"http://[fd00::1]/hook", true},
+		{"http://[::ffff:127.0.0.1]/hook", true},
+	}
+	for _, c := range cases {
+		require.Nil(t, checkWebhookURL(c.url, true), c.url)
+		if c.private {
+			require.Equal(t, ErrInvalidWebhookURL, checkWebhookURL(c.url, false), c.url)
+		} else {
+			require.Nil(t, checkWebhookURL(c.url, false), c.url)
+		}
+	}
+	require.Equal(t, ErrInvalidWebhookURL, checkWebhookURL("ftp://example.com", true))
+	require.True(t, PublicWebhookAddress(net.ParseIP("2606:2800:220:1::1")))
+	require.False(t, PublicWebhookAddress(net.ParseIP("fe80::1")))
+}
@@ -3,11 +3,17 @@ module github.com/lassilaiho/expenditure-accounting/server
 go 1.15
 
 require (
-	github.com/google/uuid v1.1.2
+	github.com/coreos/go-oidc v2.2.1+incompatible
 	github.com/gorilla/mux v1.8.0
+	github.com/graph-gophers/graphql-go v1.1.0
 	github.com/lib/pq v1.9.0
 	github.com/ory/dockertest/v3 v3.6.2
+	github.com/pquerna/cachecontrol v0.0.0-20200819021114-67c6ae64274f // indirect
+	github.com/prometheus/client_golang v1.9.0
 	github.com/rs/cors v1.7.0
+	github.com/sirupsen/logrus v1.6.0
 	github.com/stretchr/testify v1.6.1
 	golang.org/x/crypto v0.0.0-20201208171446-5f87f3452ae9
+	golang.org/x/oauth2 v0.0.0-20201208152858-08078c50e5b5
+	gopkg.in/square/go-jose.v2 v2.5.1 // indirect
 )
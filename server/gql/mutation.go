@@ -0,0 +1,206 @@
+package gql
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/lassilaiho/expenditure-accounting/server/db"
+)
+
+var ErrInvalidVersion = errors.New("invalid version")
+
+type purchaseInput struct {
+	Product  *graphql.ID
+	Date     *graphql.Time
+	Quantity *string
+	Price    *string
+	Tags     *[]graphql.ID
+}
+
+func (input *purchaseInput) toUpdate() (*db.PurchaseUpdate, error) {
+	update := &db.PurchaseUpdate{}
+	var err error
+	if update.Quantity, err = parseDecimal(input.Quantity); err != nil {
+		return nil, err
+	}
+	if update.Price, err = parseDecimal(input.Price); err != nil {
+		return nil, err
+	}
+	if input.Product != nil {
+		id, err := parseID(*input.Product)
+		if err != nil {
+			return nil, err
+		}
+		update.Product = &id
+	}
+	if input.Date != nil {
+		update.Date = &input.Date.Time
+	}
+	if update.Tags, err = parseIDs(input.Tags); err != nil {
+		return nil, err
+	}
+	return update, nil
+}
+
+func parseDecimal(s *string) (*db.Decimal, error) {
+	if s == nil {
+		return nil, nil
+	}
+	d, err := db.ParseDecimal(*s)
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func parseVersion(version *string) (int64, error) {
+	if version == nil {
+		return 0, nil
+	}
+	v, err := strconv.ParseInt(*version, 10, 64)
+	if err != nil || v <= 0 {
+		return 0, ErrInvalidVersion
+	}
+	return v, nil
+}
+
+// writer returns the account of a mutation, checking that the viewer may
+// change data.
+func writer(ctx context.Context) (int64, error) {
+	viewer := getViewer(ctx)
+	if !viewer.CanWrite {
+		return 0, ErrForbidden
+	}
+	return viewer.AccountID, nil
+}
+
+// mutationError converts errors of the db package to errors shown to
+// clients.
+func mutationError(err error) error {
+	if err == db.ErrNoRowsAffected {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (r *Resolver) AddProduct(ctx context.Context, args struct{ Name string }) (*productResolver, error) {
+	accountID, err := writer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	product, err := r.db.InsertProduct(ctx, accountID, args.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &productResolver{product}, nil
+}
+
+func (r *Resolver) AddTags(ctx context.Context, args struct{ Names []string }) ([]*tagResolver, error) {
+	accountID, err := writer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := r.db.InsertTags(ctx, accountID, args.Names)
+	if err != nil {
+		return nil, err
+	}
+	return tagResolvers(tags), nil
+}
+
+func (r *Resolver) AddPurchase(ctx context.Context, args struct{ Input purchaseInput }) (*purchaseResolver, error) {
+	accountID, err := writer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	values, err := args.Input.toUpdate()
+	if err != nil {
+		return nil, err
+	}
+	purchaseID, err := r.db.InsertPurchase(ctx, accountID, values)
+	if err != nil {
+		return nil, err
+	}
+	return r.getPurchase(ctx, purchaseID, accountID)
+}
+
+func (r *Resolver) UpdatePurchase(ctx context.Context, args struct {
+	ID        graphql.ID
+	Input     purchaseInput
+	IfVersion *string
+}) (*purchaseResolver, error) {
+	accountID, err := writer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	purchaseID, err := parseID(args.ID)
+	if err != nil {
+		return nil, err
+	}
+	ifVersion, err := parseVersion(args.IfVersion)
+	if err != nil {
+		return nil, err
+	}
+	update, err := args.Input.toUpdate()
+	if err != nil {
+		return nil, err
+	}
+	_, err = r.db.UpdatePurchaseById(ctx, purchaseID, accountID, ifVersion, update)
+	if err != nil {
+		return nil, mutationError(err)
+	}
+	return r.getPurchase(ctx, purchaseID, accountID)
+}
+
+func (r *Resolver) DeletePurchase(ctx context.Context, args struct {
+	ID        graphql.ID
+	IfVersion *string
+}) (bool, error) {
+	accountID, err := writer(ctx)
+	if err != nil {
+		return false, err
+	}
+	purchaseID, err := parseID(args.ID)
+	if err != nil {
+		return false, err
+	}
+	ifVersion, err := parseVersion(args.IfVersion)
+	if err != nil {
+		return false, err
+	}
+	if err = r.db.DeletePurchaseById(ctx, purchaseID, accountID, ifVersion); err != nil {
+		return false, mutationError(err)
+	}
+	return true, nil
+}
+
+func (r *Resolver) RestorePurchase(ctx context.Context, args struct {
+	ID        graphql.ID
+	IfVersion *string
+}) (*purchaseResolver, error) {
+	accountID, err := writer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	purchaseID, err := parseID(args.ID)
+	if err != nil {
+		return nil, err
+	}
+	ifVersion, err := parseVersion(args.IfVersion)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = r.db.RestorePurchaseById(ctx, purchaseID, accountID, ifVersion); err != nil {
+		return nil, mutationError(err)
+	}
+	return r.getPurchase(ctx, purchaseID, accountID)
+}
+
+func (r *Resolver) getPurchase(ctx context.Context, purchaseID, accountID int64) (*purchaseResolver, error) {
+	purchase, err := r.db.GetPurchaseById(ctx, purchaseID, accountID)
+	if err != nil {
+		return nil, mutationError(err)
+	}
+	return &purchaseResolver{purchase: purchase}, nil
+}
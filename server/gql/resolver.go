@@ -0,0 +1,499 @@
+package gql
+
+import (
+	"context"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/lassilaiho/expenditure-accounting/server/db"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+	cursorDate      = "2006-01-02"
+)
+
+// Resolver is the root resolver of queries and mutations.
+type Resolver struct {
+	db *db.API
+}
+
+func parseID(id graphql.ID) (int64, error) {
+	n, err := strconv.ParseInt(string(id), 10, 64)
+	if err != nil {
+		return 0, ErrInvalidID
+	}
+	return n, nil
+}
+
+func parseIDs(ids *[]graphql.ID) ([]int64, error) {
+	if ids == nil {
+		return nil, nil
+	}
+	result := make([]int64, len(*ids))
+	for i, id := range *ids {
+		var err error
+		if result[i], err = parseID(id); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func formatID(id int64) graphql.ID {
+	return graphql.ID(strconv.FormatInt(id, 10))
+}
+
+func encodeCursor(p *db.Purchase) string {
+	s := p.Date.Format(cursorDate) + ":" + strconv.FormatInt(p.ID, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func decodeCursor(cursor string) (*db.PurchaseCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	parts := strings.SplitN(string(b), ":", 2)
+	if len(parts) != 2 {
+		return nil, ErrInvalidCursor
+	}
+	date, err := time.Parse(cursorDate, parts[0])
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &db.PurchaseCursor{Date: date, ID: id}, nil
+}
+
+type purchaseFilterInput struct {
+	IDs     *[]graphql.ID
+	From    *graphql.Time
+	To      *graphql.Time
+	Product *graphql.ID
+	Tag     *graphql.ID
+}
+
+func (input *purchaseFilterInput) toFilter() (*db.PurchaseFilter, error) {
+	filter := &db.PurchaseFilter{}
+	if input == nil {
+		return filter, nil
+	}
+	var err error
+	if filter.IDs, err = parseIDs(input.IDs); err != nil {
+		return nil, err
+	}
+	if input.From != nil {
+		filter.From = &input.From.Time
+	}
+	if input.To != nil {
+		filter.To = &input.To.Time
+	}
+	if input.Product != nil {
+		id, err := parseID(*input.Product)
+		if err != nil {
+			return nil, err
+		}
+		filter.Product = &id
+	}
+	if input.Tag != nil {
+		id, err := parseID(*input.Tag)
+		if err != nil {
+			return nil, err
+		}
+		filter.Tag = &id
+	}
+	return filter, nil
+}
+
+func (r *Resolver) Purchases(ctx context.Context, args struct {
+	Filter *purchaseFilterInput
+	First  *int32
+	After  *string
+}) (*purchaseConnectionResolver, error) {
+	viewer := getViewer(ctx)
+	if !viewer.CanRead {
+		return nil, ErrForbidden
+	}
+	filter, err := args.Filter.toFilter()
+	if err != nil {
+		return nil, err
+	}
+	first := defaultPageSize
+	if args.First != nil {
+		first = int(*args.First)
+	}
+	if first < 0 || first > maxPageSize {
+		first = maxPageSize
+	}
+	var after *db.PurchaseCursor
+	if args.After != nil {
+		if after, err = decodeCursor(*args.After); err != nil {
+			return nil, err
+		}
+	}
+	// One extra purchase is fetched to find out if there are more.
+	purchases, err := r.db.QueryPurchases(ctx, viewer.AccountID, filter, after, first+1)
+	if err != nil {
+		return nil, err
+	}
+	hasNextPage := len(purchases) > first
+	if hasNextPage {
+		purchases = purchases[:first]
+	}
+	return &purchaseConnectionResolver{
+		db:          r.db,
+		accountID:   viewer.AccountID,
+		filter:      filter,
+		batch:       newPurchaseBatch(r.db, viewer.AccountID, purchases),
+		hasNextPage: hasNextPage,
+	}, nil
+}
+
+func (r *Resolver) Purchase(ctx context.Context, args struct{ ID graphql.ID }) (*purchaseResolver, error) {
+	viewer := getViewer(ctx)
+	if !viewer.CanRead {
+		return nil, ErrForbidden
+	}
+	id, err := parseID(args.ID)
+	if err != nil {
+		return nil, err
+	}
+	purchase, err := r.db.GetPurchaseById(ctx, id, viewer.AccountID)
+	if err == db.ErrNoRowsAffected {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &purchaseResolver{purchase: purchase}, nil
+}
+
+func (r *Resolver) Products(ctx context.Context, args struct{ IDs *[]graphql.ID }) ([]*productResolver, error) {
+	viewer := getViewer(ctx)
+	if !viewer.CanRead {
+		return nil, ErrForbidden
+	}
+	ids, err := parseIDs(args.IDs)
+	if err != nil {
+		return nil, err
+	}
+	products, err := r.db.GetProducts(ctx, viewer.AccountID, ids)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*productResolver, len(products))
+	for i, p := range products {
+		result[i] = &productResolver{p}
+	}
+	return result, nil
+}
+
+func (r *Resolver) Tags(ctx context.Context, args struct{ IDs *[]graphql.ID }) ([]*tagResolver, error) {
+	viewer := getViewer(ctx)
+	if !viewer.CanRead {
+		return nil, ErrForbidden
+	}
+	ids, err := parseIDs(args.IDs)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := r.db.GetTags(ctx, viewer.AccountID, ids)
+	if err != nil {
+		return nil, err
+	}
+	return tagResolvers(tags), nil
+}
+
+func (r *Resolver) Stats(ctx context.Context, args struct{ Filter *purchaseFilterInput }) (*statsResolver, error) {
+	viewer := getViewer(ctx)
+	if !viewer.CanRead {
+		return nil, ErrForbidden
+	}
+	filter, err := args.Filter.toFilter()
+	if err != nil {
+		return nil, err
+	}
+	stats, err := r.db.GetPurchaseStats(ctx, viewer.AccountID, filter)
+	if err != nil {
+		return nil, err
+	}
+	return &statsResolver{
+		db:        r.db,
+		accountID: viewer.AccountID,
+		filter:    filter,
+		stats:     stats,
+	}, nil
+}
+
+// purchaseBatch loads the tags of a list of purchases with a single query
+// the first time the tags of any of them are needed.
+type purchaseBatch struct {
+	db        *db.API
+	accountID int64
+	purchases []*db.Purchase
+
+	once sync.Once
+	tags map[int64][]*db.Tag
+	err  error
+}
+
+func newPurchaseBatch(dbAPI *db.API, accountID int64, purchases []*db.Purchase) *purchaseBatch {
+	return &purchaseBatch{db: dbAPI, accountID: accountID, purchases: purchases}
+}
+
+func (b *purchaseBatch) tagsOf(ctx context.Context, purchaseID int64) ([]*db.Tag, error) {
+	b.once.Do(func() {
+		ids := make([]int64, len(b.purchases))
+		for i, p := range b.purchases {
+			ids[i] = p.ID
+		}
+		b.tags, b.err = b.db.GetTagsForPurchases(ctx, b.accountID, ids)
+	})
+	return b.tags[purchaseID], b.err
+}
+
+func (b *purchaseBatch) resolvers() []*purchaseResolver {
+	result := make([]*purchaseResolver, len(b.purchases))
+	for i, p := range b.purchases {
+		result[i] = &purchaseResolver{purchase: p, batch: b}
+	}
+	return result
+}
+
+type purchaseConnectionResolver struct {
+	db          *db.API
+	accountID   int64
+	filter      *db.PurchaseFilter
+	batch       *purchaseBatch
+	hasNextPage bool
+}
+
+func (r *purchaseConnectionResolver) Edges() []*purchaseEdgeResolver {
+	purchases := r.batch.resolvers()
+	edges := make([]*purchaseEdgeResolver, len(purchases))
+	for i, p := range purchases {
+		edges[i] = &purchaseEdgeResolver{p}
+	}
+	return edges
+}
+
+func (r *purchaseConnectionResolver) PageInfo() *pageInfoResolver {
+	info := &pageInfoResolver{hasNextPage: r.hasNextPage}
+	if n := len(r.batch.purchases); n > 0 {
+		cursor := encodeCursor(r.batch.purchases[n-1])
+		info.endCursor = &cursor
+	}
+	return info
+}
+
+func (r *purchaseConnectionResolver) TotalCount(ctx context.Context) (int32, error) {
+	count, err := r.db.CountPurchases(ctx, r.accountID, r.filter)
+	return int32(count), err
+}
+
+type purchaseEdgeResolver struct {
+	node *purchaseResolver
+}
+
+func (r *purchaseEdgeResolver) Cursor() string {
+	return encodeCursor(r.node.purchase)
+}
+
+func (r *purchaseEdgeResolver) Node() *purchaseResolver {
+	return r.node
+}
+
+type pageInfoResolver struct {
+	hasNextPage bool
+	endCursor   *string
+}
+
+func (r *pageInfoResolver) HasNextPage() bool {
+	return r.hasNextPage
+}
+
+func (r *pageInfoResolver) EndCursor() *string {
+	return r.endCursor
+}
+
+// purchaseResolver resolves a purchase. The tags are taken from the purchase
+// if they have been loaded, and otherwise from the batch.
+type purchaseResolver struct {
+	purchase *db.Purchase
+	batch    *purchaseBatch
+}
+
+func (r *purchaseResolver) ID() graphql.ID {
+	return formatID(r.purchase.ID)
+}
+
+func (r *purchaseResolver) Date() graphql.Time {
+	return graphql.Time{Time: r.purchase.Date}
+}
+
+func (r *purchaseResolver) Quantity() string {
+	return r.purchase.Quantity.String()
+}
+
+func (r *purchaseResolver) Price() string {
+	return r.purchase.Price.String()
+}
+
+func (r *purchaseResolver) TotalPrice() string {
+	return r.purchase.TotalPrice.String()
+}
+
+func (r *purchaseResolver) Version() string {
+	return strconv.FormatInt(r.purchase.Version, 10)
+}
+
+func (r *purchaseResolver) Product() *productResolver {
+	return &productResolver{&r.purchase.Product}
+}
+
+func (r *purchaseResolver) Tags(ctx context.Context) ([]*tagResolver, error) {
+	if r.purchase.Tags != nil || r.batch == nil {
+		return tagResolvers(r.purchase.Tags), nil
+	}
+	tags, err := r.batch.tagsOf(ctx, r.purchase.ID)
+	if err != nil {
+		return nil, err
+	}
+	return tagResolvers(tags), nil
+}
+
+type productResolver struct {
+	product *db.Product
+}
+
+func (r *productResolver) ID() graphql.ID {
+	return formatID(r.product.ID)
+}
+
+func (r *productResolver) Name() string {
+	return r.product.Name
+}
+
+type tagResolver struct {
+	tag *db.Tag
+}
+
+func tagResolvers(tags []*db.Tag) []*tagResolver {
+	result := make([]*tagResolver, len(tags))
+	for i, t := range tags {
+		result[i] = &tagResolver{t}
+	}
+	return result
+}
+
+func (r *tagResolver) ID() graphql.ID {
+	return formatID(r.tag.ID)
+}
+
+func (r *tagResolver) Name() string {
+	return r.tag.Name
+}
+
+type statsResolver struct {
+	db        *db.API
+	accountID int64
+	filter    *db.PurchaseFilter
+	stats     *db.PurchaseStats
+}
+
+func (r *statsResolver) Count() int32 {
+	return int32(r.stats.Count)
+}
+
+func (r *statsResolver) Total() string {
+	return r.stats.Total.String()
+}
+
+func (r *statsResolver) ByProduct(ctx context.Context) ([]*groupStatsResolver, error) {
+	return r.byGroup(ctx, db.GroupByProduct)
+}
+
+func (r *statsResolver) ByTag(ctx context.Context) ([]*groupStatsResolver, error) {
+	return r.byGroup(ctx, db.GroupByTag)
+}
+
+func (r *statsResolver) ByMonth(ctx context.Context) ([]*groupStatsResolver, error) {
+	return r.byGroup(ctx, db.GroupByMonth)
+}
+
+// byGroup aggregates the purchases by group. The products and tags of the
+// groups are loaded with a single query. Groups of deleted products and tags
+// are left out.
+func (r *statsResolver) byGroup(ctx context.Context, groupBy string) ([]*groupStatsResolver, error) {
+	groups, err := r.db.GetPurchaseStatsByGroup(ctx, r.accountID, r.filter, groupBy)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int64, len(groups))
+	for i, g := range groups {
+		ids[i] = g.ID
+	}
+	names := map[int64]string{}
+	switch groupBy {
+	case db.GroupByProduct:
+		products, err := r.db.GetProducts(ctx, r.accountID, ids)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range products {
+			names[p.ID] = p.Name
+		}
+	case db.GroupByTag:
+		tags, err := r.db.GetTags(ctx, r.accountID, ids)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range tags {
+			names[t.ID] = t.Name
+		}
+	}
+	result := []*groupStatsResolver{}
+	for _, g := range groups {
+		name, ok := names[g.ID]
+		if groupBy != db.GroupByMonth && !ok {
+			continue
+		}
+		result = append(result, &groupStatsResolver{g, name})
+	}
+	return result, nil
+}
+
+// groupStatsResolver resolves ProductStats, TagStats and MonthStats.
+type groupStatsResolver struct {
+	stats *db.PurchaseGroupStats
+	name  string
+}
+
+func (r *groupStatsResolver) Product() *productResolver {
+	return &productResolver{&db.Product{ID: r.stats.ID, Name: r.name}}
+}
+
+func (r *groupStatsResolver) Tag() *tagResolver {
+	return &tagResolver{&db.Tag{ID: r.stats.ID, Name: r.name}}
+}
+
+func (r *groupStatsResolver) Month() graphql.Time {
+	return graphql.Time{Time: r.stats.Month}
+}
+
+func (r *groupStatsResolver) Count() int32 {
+	return int32(r.stats.Count)
+}
+
+func (r *groupStatsResolver) Total() string {
+	return r.stats.Total.String()
+}
@@ -0,0 +1,154 @@
+// Package gql implements a GraphQL API over the purchases, products and tags
+// of an account.
+package gql
+
+import (
+	"context"
+	"errors"
+
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/lassilaiho/expenditure-accounting/server/db"
+)
+
+const schema = `
+schema {
+	query: Query
+	mutation: Mutation
+}
+
+scalar Time
+
+type Query {
+	# Purchases newest first. At most 500 purchases are returned at a time.
+	purchases(filter: PurchaseFilter, first: Int, after: String): PurchaseConnection!
+	purchase(id: ID!): Purchase
+	products(ids: [ID!]): [Product!]!
+	tags(ids: [ID!]): [Tag!]!
+	stats(filter: PurchaseFilter): PurchaseStats!
+}
+
+type Mutation {
+	addProduct(name: String!): Product!
+	addTags(names: [String!]!): [Tag!]!
+	addPurchase(input: PurchaseInput!): Purchase!
+	updatePurchase(id: ID!, input: PurchaseInput!, ifVersion: String): Purchase!
+	deletePurchase(id: ID!, ifVersion: String): Boolean!
+	restorePurchase(id: ID!, ifVersion: String): Purchase!
+}
+
+input PurchaseFilter {
+	ids: [ID!]
+	from: Time
+	to: Time
+	product: ID
+	tag: ID
+}
+
+input PurchaseInput {
+	product: ID
+	date: Time
+	quantity: String
+	price: String
+	tags: [ID!]
+}
+
+type Purchase {
+	id: ID!
+	date: Time!
+	quantity: String!
+	price: String!
+	totalPrice: String!
+	version: String!
+	product: Product!
+	tags: [Tag!]!
+}
+
+type Product {
+	id: ID!
+	name: String!
+}
+
+type Tag {
+	id: ID!
+	name: String!
+}
+
+type PurchaseConnection {
+	edges: [PurchaseEdge!]!
+	pageInfo: PageInfo!
+	totalCount: Int!
+}
+
+type PurchaseEdge {
+	cursor: String!
+	node: Purchase!
+}
+
+type PageInfo {
+	hasNextPage: Boolean!
+	endCursor: String
+}
+
+type PurchaseStats {
+	count: Int!
+	total: String!
+	byProduct: [ProductStats!]!
+	byTag: [TagStats!]!
+	byMonth: [MonthStats!]!
+}
+
+type ProductStats {
+	product: Product!
+	count: Int!
+	total: String!
+}
+
+type TagStats {
+	tag: Tag!
+	count: Int!
+	total: String!
+}
+
+type MonthStats {
+	month: Time!
+	count: Int!
+	total: String!
+}
+`
+
+// maxDepth limits the nesting of queries.
+const maxDepth = 10
+
+var (
+	ErrForbidden     = errors.New("API token lacks the required scope")
+	ErrNotFound      = errors.New("not found")
+	ErrInvalidID     = errors.New("invalid ID")
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+// Viewer is the account a query is executed for.
+type Viewer struct {
+	AccountID int64
+	CanRead   bool
+	CanWrite  bool
+}
+
+type viewerContextKey struct{}
+
+// WithViewer returns a context executing queries for viewer.
+func WithViewer(ctx context.Context, viewer *Viewer) context.Context {
+	return context.WithValue(ctx, viewerContextKey{}, viewer)
+}
+
+func getViewer(ctx context.Context) *Viewer {
+	if v, ok := ctx.Value(viewerContextKey{}).(*Viewer); ok {
+		return v
+	}
+	return &Viewer{}
+}
+
+// NewSchema returns the GraphQL schema resolved from the database. Queries
+// must be executed with a context created with WithViewer.
+func NewSchema(dbAPI *db.API) *graphql.Schema {
+	return graphql.MustParseSchema(schema, &Resolver{db: dbAPI}, graphql.MaxDepth(maxDepth))
+}
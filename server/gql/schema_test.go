@@ -0,0 +1,38 @@
+package gql
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lassilaiho/expenditure-accounting/server/db"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchemaMatchesResolvers(t *testing.T) {
+	require.NotPanics(t, func() { NewSchema(&db.API{}) })
+}
+
+func TestCursor(t *testing.T) {
+	p := &db.Purchase{ID: 42, Date: time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)}
+	cursor, err := decodeCursor(encodeCursor(p))
+	require.Nil(t, err)
+	require.Equal(t, &db.PurchaseCursor{Date: p.Date, ID: 42}, cursor)
+
+	for _, invalid := range []string{"", "!!", "MjAyMS0wMy0wMQ", "eDo0Mg"} {
+		_, err = decodeCursor(invalid)
+		require.Equal(t, ErrInvalidCursor, err, invalid)
+	}
+}
+
+func TestRequiresScopes(t *testing.T) {
+	schema := NewSchema(&db.API{})
+	ctx := WithViewer(context.Background(), &Viewer{AccountID: 1})
+	resp := schema.Exec(ctx, `{ tags { id } }`, "", nil)
+	require.Len(t, resp.Errors, 1)
+	require.Equal(t, ErrForbidden.Error(), resp.Errors[0].Message)
+
+	resp = schema.Exec(ctx, `mutation { addProduct(name: "Milk") { id } }`, "", nil)
+	require.Len(t, resp.Errors, 1)
+	require.Equal(t, ErrForbidden.Error(), resp.Errors[0].Message)
+}
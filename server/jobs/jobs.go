@@ -0,0 +1,34 @@
+// Package jobs runs periodic background tasks.
+package jobs
+
+import (
+	"context"
+	"time"
+
+	"github.com/lassilaiho/expenditure-accounting/server/logging"
+	"github.com/lassilaiho/expenditure-accounting/server/metrics"
+)
+
+// Every runs fn once per interval until ctx is canceled. Errors returned by
+// fn are logged with name to the logger carried by ctx and don't stop the
+// job. The status of each run is recorded in the metrics of the job.
+func Every(ctx context.Context, interval time.Duration, name string, fn func(context.Context) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if ctx.Err() != nil {
+				return
+			}
+			start := time.Now()
+			err := fn(ctx)
+			metrics.ObserveJob(name, start, err)
+			if err != nil {
+				logging.Logger(ctx, nil).WithField("job", name).WithError(err).Error("job failed")
+			}
+		}
+	}
+}
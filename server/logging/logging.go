@@ -0,0 +1,158 @@
+// Package logging configures structured logging and carries request-scoped
+// loggers in contexts.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Formats of log output.
+const (
+	FormatJSON   = "json"
+	FormatLogfmt = "logfmt"
+)
+
+// Redacted replaces the values of sensitive fields.
+const Redacted = "[REDACTED]"
+
+// sensitiveKeys are substrings of the names of fields and query parameters
+// whose values must not be logged.
+var sensitiveKeys = []string{"password", "token", "secret", "authorization", "cookie", "code"}
+
+// IsSensitive reports whether the value of a field or query parameter named
+// key must be redacted.
+func IsSensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range sensitiveKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// New returns a logger writing entries at level and above to out in format,
+// which is FormatJSON or FormatLogfmt. Sensitive fields are redacted.
+func New(out io.Writer, format, level string) (*logrus.Logger, error) {
+	logger := logrus.New()
+	logger.SetOutput(out)
+	switch format {
+	case FormatJSON:
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	case FormatLogfmt:
+		logger.SetFormatter(&logrus.TextFormatter{DisableColors: true, FullTimestamp: true})
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+	parsedLevel, err := logrus.ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	logger.SetLevel(parsedLevel)
+	logger.AddHook(redactHook{})
+	return logger, nil
+}
+
+// redactHook replaces the values of sensitive fields with Redacted.
+type redactHook struct{}
+
+func (redactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (redactHook) Fire(entry *logrus.Entry) error {
+	entry.Data = Redact(entry.Data)
+	return nil
+}
+
+// Redact returns fields with the values of sensitive fields replaced with
+// Redacted. Fields is returned as is if it has no sensitive fields.
+func Redact(fields logrus.Fields) logrus.Fields {
+	var redacted logrus.Fields
+	for key := range fields {
+		if key == logrus.ErrorKey || !IsSensitive(key) {
+			continue
+		}
+		if redacted == nil {
+			redacted = make(logrus.Fields, len(fields))
+			for k, v := range fields {
+				redacted[k] = v
+			}
+		}
+		redacted[key] = Redacted
+	}
+	if redacted == nil {
+		return fields
+	}
+	return redacted
+}
+
+// RedactQuery returns an encoded query string with the values of sensitive
+// parameters replaced with Redacted.
+func RedactQuery(query url.Values) string {
+	redacted := make(url.Values, len(query))
+	for key, values := range query {
+		if IsSensitive(key) {
+			values = []string{Redacted}
+		}
+		redacted[key] = values
+	}
+	return redacted.Encode()
+}
+
+type contextKey struct{}
+
+// requestLogger holds the logger of a request. Fields known only after the
+// request has been routed, such as the account making it, are added to it
+// with AddFields.
+type requestLogger struct {
+	mu    sync.Mutex
+	entry *logrus.Entry
+}
+
+// NewContext returns a copy of ctx carrying entry.
+func NewContext(ctx context.Context, entry *logrus.Entry) context.Context {
+	return context.WithValue(ctx, contextKey{}, &requestLogger{entry: entry})
+}
+
+// FromContext returns the logger carried by ctx or nil if there is none.
+func FromContext(ctx context.Context) *logrus.Entry {
+	rl, ok := ctx.Value(contextKey{}).(*requestLogger)
+	if !ok {
+		return nil
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.entry
+}
+
+// AddFields adds fields to the logger carried by ctx. It's visible to every
+// holder of a context derived from the one passed to NewContext.
+func AddFields(ctx context.Context, fields logrus.Fields) {
+	rl, ok := ctx.Value(contextKey{}).(*requestLogger)
+	if !ok {
+		return
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.entry = rl.entry.WithFields(fields)
+}
+
+// Logger returns the logger carried by ctx or an entry of fallback if there
+// is none. A nil fallback is the standard logger of logrus.
+func Logger(ctx context.Context, fallback *logrus.Logger) *logrus.Entry {
+	if entry := FromContext(ctx); entry != nil {
+		return entry
+	}
+	if fallback == nil {
+		fallback = logrus.StandardLogger()
+	}
+	return logrus.NewEntry(fallback)
+}
@@ -0,0 +1,75 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, FormatJSON, "warn")
+	require.Nil(t, err)
+	logger.Info("hidden")
+	logger.WithField("user", "a").Warn("shown")
+	var entry map[string]interface{}
+	require.Nil(t, json.Unmarshal(buf.Bytes(), &entry))
+	require.Equal(t, "shown", entry["msg"])
+	require.Equal(t, "warning", entry["level"])
+	require.Equal(t, "a", entry["user"])
+
+	buf.Reset()
+	logger, err = New(&buf, FormatLogfmt, "debug")
+	require.Nil(t, err)
+	logger.WithField("user", "a").Debug("shown")
+	require.Contains(t, buf.String(), "level=debug msg=shown user=a")
+
+	_, err = New(&buf, "xml", "info")
+	require.NotNil(t, err)
+	_, err = New(&buf, FormatJSON, "loud")
+	require.NotNil(t, err)
+}
+
+func TestRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, FormatLogfmt, "info")
+	require.Nil(t, err)
+	fields := logrus.Fields{
+		"password":     "hunter2",
+		"sessionToken": "abc",
+		"clientSecret": "xyz",
+		"email":        "user@example.com",
+	}
+	logger.WithFields(fields).Info("login")
+	out := buf.String()
+	for _, secret := range []string{"hunter2", "abc", "xyz"} {
+		require.NotContains(t, out, secret)
+	}
+	require.Contains(t, out, "user@example.com")
+	require.Equal(t, "hunter2", fields["password"], "fields of the caller must not change")
+
+	query := RedactQuery(url.Values{"limit": {"10"}, "access_token": {"abc"}})
+	require.Equal(t, "access_token=%5BREDACTED%5D&limit=10", query)
+}
+
+func TestContext(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, FormatLogfmt, "info")
+	require.Nil(t, err)
+	require.Nil(t, FromContext(context.Background()))
+
+	ctx := NewContext(context.Background(), logger.WithField("requestId", "r1"))
+	derived, cancel := context.WithCancel(ctx)
+	defer cancel()
+	AddFields(derived, logrus.Fields{"accountId": 7})
+	Logger(ctx, nil).Info("done")
+	out := strings.TrimSpace(buf.String())
+	require.Contains(t, out, "accountId=7")
+	require.Contains(t, out, "requestId=r1")
+}
@@ -5,7 +5,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"flag"
-	"log"
+	"fmt"
 	"net/http"
 	"os"
 	"strconv"
@@ -14,18 +14,121 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/lassilaiho/expenditure-accounting/server/api"
 	"github.com/lassilaiho/expenditure-accounting/server/db"
+	"github.com/lassilaiho/expenditure-accounting/server/jobs"
+	"github.com/lassilaiho/expenditure-accounting/server/logging"
+	"github.com/lassilaiho/expenditure-accounting/server/metrics"
+	"github.com/lassilaiho/expenditure-accounting/server/webhooks"
 	_ "github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/cors"
+	"github.com/sirupsen/logrus"
+)
+
+// version and commit identify the build. They are set when building with
+//
+//	go build -ldflags "-X main.version=<VERSION> -X main.commit=<COMMIT>"
+var (
+	version = "dev"
+	commit  = "unknown"
 )
 
 type configuration struct {
-	Port               int           `json:"port"`
-	BcryptCost         int           `json:"bcryptCost"`
-	SessionTimeout     time.Duration `json:"sessionTimeout"`
-	RefreshTime        time.Duration `json:"refreshTime"`
-	RootURL            string        `json:"rootUrl"`
-	AllowedOrigins     []string      `json:"allowedOrigins"`
-	DBConnectionString string        `json:"dbConnectionString"`
+	Port                 int            `json:"port"`
+	MetricsPort          int            `json:"metricsPort"`
+	BcryptCost           int            `json:"bcryptCost"`
+	SessionTimeout       time.Duration  `json:"sessionTimeout"`
+	RefreshTime          time.Duration  `json:"refreshTime"`
+	RootURL              string         `json:"rootUrl"`
+	AllowedOrigins       []string       `json:"allowedOrigins"`
+	DBConnectionString   string         `json:"dbConnectionString"`
+	AllowRegistration    bool           `json:"allowRegistration"`
+	InviteCodes          []string       `json:"inviteCodes"`
+	TrustProxyHeaders    bool           `json:"trustProxyHeaders"`
+	CookieSessions       bool           `json:"cookieSessions"`
+	CookieName           string         `json:"cookieName"`
+	CookieDomain         string         `json:"cookieDomain"`
+	CookieSameSite       string         `json:"cookieSameSite"`
+	InsecureCookies      bool           `json:"insecureCookies"`
+	TOTPIssuer           string         `json:"totpIssuer"`
+	MaxLoginFailures     int            `json:"maxLoginFailures"`
+	LockoutDuration      time.Duration  `json:"lockoutDuration"`
+	MaxIPLoginFailures   int            `json:"maxLoginFailuresPerIP"`
+	LoginBackoff         time.Duration  `json:"loginBackoff"`
+	OIDC                 *oidcConfig    `json:"oidc"`
+	TrashRetention       time.Duration  `json:"trashRetention"`
+	IdempotencyWindow    time.Duration  `json:"idempotencyWindow"`
+	AllowPrivateWebhooks bool           `json:"allowPrivateWebhooks"`
+	Currency             currencyConfig `json:"currency"`
+	LogFormat            string         `json:"logFormat"`
+	LogLevel             string         `json:"logLevel"`
+}
+
+// currencyConfig overrides the scale and rounding of a currency if set.
+type currencyConfig struct {
+	Code     string           `json:"code"`
+	Scale    *int             `json:"scale"`
+	Rounding *db.RoundingMode `json:"rounding"`
+}
+
+func (config *currencyConfig) currency() *db.Currency {
+	currency := *db.DefaultCurrency
+	if config.Code != "" {
+		currency = *db.NewCurrency(config.Code)
+	}
+	if config.Scale != nil {
+		currency.Scale = *config.Scale
+	}
+	if config.Rounding != nil {
+		currency.Rounding = *config.Rounding
+	}
+	return &currency
+}
+
+type oidcConfig struct {
+	Issuer        string   `json:"issuer"`
+	ClientID      string   `json:"clientId"`
+	ClientSecret  string   `json:"clientSecret"`
+	RedirectURL   string   `json:"redirectUrl"`
+	Scopes        []string `json:"scopes"`
+	AutoProvision bool     `json:"autoProvision"`
+}
+
+// trashPurgeInterval is how often entities deleted longer than trashRetention
+// ago are purged.
+const trashPurgeInterval = time.Hour
+
+// idempotencyPurgeInterval is how often idempotency keys older than the
+// idempotency window are deleted.
+const idempotencyPurgeInterval = time.Hour
+
+const (
+	// webhookDeliveryInterval is how often queued webhook deliveries are
+	// sent.
+	webhookDeliveryInterval = 5 * time.Second
+	// webhookPurgeInterval is how often finished webhook deliveries older
+	// than webhookDeliveryRetention are deleted.
+	webhookPurgeInterval     = time.Hour
+	webhookDeliveryRetention = 30 * 24 * time.Hour
+)
+
+var sameSiteModes = map[string]http.SameSite{
+	"strict": http.SameSiteStrictMode,
+	"lax":    http.SameSiteLaxMode,
+	"none":   http.SameSiteNoneMode,
+}
+
+func (config *configuration) cookieConfig() *api.CookieConfig {
+	if !config.CookieSessions {
+		return nil
+	}
+	return &api.CookieConfig{
+		Name:     config.CookieName,
+		Domain:   config.CookieDomain,
+		Path:     config.RootURL,
+		SameSite: sameSiteModes[config.CookieSameSite],
+		Secure:   !config.InsecureCookies,
+	}
 }
 
 func loadConfig(file string) (*configuration, error) {
@@ -56,11 +159,171 @@ func loadConfig(file string) (*configuration, error) {
 	if config.AllowedOrigins == nil {
 		config.AllowedOrigins = []string{}
 	}
+	if config.TOTPIssuer == "" {
+		config.TOTPIssuer = "Expenditure Accounting"
+	}
+	if config.MaxLoginFailures == 0 {
+		config.MaxLoginFailures = 5
+	}
+	if config.LockoutDuration == 0 {
+		config.LockoutDuration = time.Minute
+	}
+	if config.MaxIPLoginFailures == 0 {
+		config.MaxIPLoginFailures = 20
+	}
+	if config.LoginBackoff == 0 {
+		config.LoginBackoff = time.Second
+	}
+	if config.TrashRetention == 0 {
+		config.TrashRetention = 30 * 24 * time.Hour
+	}
+	if config.IdempotencyWindow == 0 {
+		config.IdempotencyWindow = 24 * time.Hour
+	}
+	if config.CookieName == "" {
+		config.CookieName = "session"
+	}
+	if config.CookieSameSite == "" {
+		config.CookieSameSite = "strict"
+	}
+	if config.LogFormat == "" {
+		config.LogFormat = logging.FormatLogfmt
+	}
+	if config.LogLevel == "" {
+		config.LogLevel = "info"
+	}
+	if config.OIDC != nil && config.OIDC.Scopes == nil {
+		config.OIDC.Scopes = []string{"email"}
+	}
+	if _, ok := sameSiteModes[config.CookieSameSite]; !ok {
+		return nil, fmt.Errorf("invalid cookieSameSite value %q", config.CookieSameSite)
+	}
+	if config.MetricsPort != 0 && config.MetricsPort == config.Port {
+		return nil, fmt.Errorf("metricsPort must differ from port %d", config.Port)
+	}
+	if config.Currency.Scale != nil && *config.Currency.Scale < 0 {
+		return nil, fmt.Errorf("invalid currency scale %d", *config.Currency.Scale)
+	}
 	return &config, nil
 }
 
+func serve(config *configuration, dbapi *db.API, logger *logrus.Logger) error {
+	var oidcProvider *api.OIDCProvider
+	if config.OIDC != nil {
+		var err error
+		oidcProvider, err = api.NewOIDCProvider(context.Background(), &api.OIDCConfig{
+			Issuer:        config.OIDC.Issuer,
+			ClientID:      config.OIDC.ClientID,
+			ClientSecret:  config.OIDC.ClientSecret,
+			RedirectURL:   config.OIDC.RedirectURL,
+			Scopes:        config.OIDC.Scopes,
+			AutoProvision: config.OIDC.AutoProvision,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	changes := db.NewChangeFeed(config.DBConnectionString)
+	changes.Log = logger
+	deliverer := &webhooks.Deliverer{
+		DB:                    dbapi,
+		AllowPrivateAddresses: config.AllowPrivateWebhooks,
+	}
+	apiHandler := api.NewHandler(&api.API{
+		DB:                dbapi,
+		AllowRegistration: config.AllowRegistration,
+		InviteCodes:       config.InviteCodes,
+		TrustProxyHeaders: config.TrustProxyHeaders,
+		Cookies:           config.cookieConfig(),
+		TOTPIssuer:        config.TOTPIssuer,
+		LoginLimiter: &api.LoginLimiter{
+			MaxFailures: config.MaxIPLoginFailures,
+			BaseDelay:   config.LoginBackoff,
+			MaxDelay:    db.MaxLockoutDuration,
+		},
+		OIDC:              oidcProvider,
+		IdempotencyWindow: config.IdempotencyWindow,
+		Changes:           changes,
+		Webhooks:          deliverer,
+		Log:               logger,
+		Build:             api.BuildInfo{Version: version, Commit: commit},
+	})
+
+	go func() {
+		if err := changes.Run(context.Background()); err != nil {
+			logger.WithError(err).Error("change feed stopped")
+		}
+	}()
+
+	jobCtx := logging.NewContext(context.Background(), logrus.NewEntry(logger))
+	go jobs.Every(jobCtx, webhookDeliveryInterval, "deliver webhooks",
+		deliverer.DeliverPending)
+	go jobs.Every(jobCtx, webhookPurgeInterval, "purge webhook deliveries",
+		func(ctx context.Context) error {
+			_, err := dbapi.PurgeWebhookDeliveries(ctx, time.Now().Add(-webhookDeliveryRetention))
+			return err
+		})
+
+	go jobs.Every(jobCtx, idempotencyPurgeInterval, "purge idempotency keys",
+		func(ctx context.Context) error {
+			_, err := dbapi.PurgeIdempotencyKeys(ctx, time.Now().Add(-config.IdempotencyWindow))
+			return err
+		})
+
+	if config.TrashRetention > 0 {
+		go jobs.Every(jobCtx, trashPurgeInterval, "purge trash",
+			func(ctx context.Context) error {
+				_, err := dbapi.PurgeExpiredTrash(ctx, time.Now().Add(-config.TrashRetention))
+				return err
+			})
+	}
+
+	r := mux.NewRouter()
+	r.PathPrefix(config.RootURL).Handler(
+		http.StripPrefix(config.RootURL, apiHandler))
+
+	if config.MetricsPort != 0 {
+		go serveMetrics(config.MetricsPort, dbapi, logger)
+	}
+
+	logger.Info("listening to port ", config.Port)
+	return http.ListenAndServe(
+		":"+strconv.Itoa(config.Port),
+		newCORS(config.AllowedOrigins).Handler(r))
+}
+
+// newCORS allows browser clients on the allowed origins to use the API.
+func newCORS(allowedOrigins []string) *cors.Cors {
+	return cors.New(cors.Options{
+		AllowedOrigins:   allowedOrigins,
+		AllowCredentials: true,
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS", "HEAD"},
+		AllowedHeaders: []string{
+			"Authorization",
+			"Content-Type",
+			api.CSRFHeader,
+			api.IdempotencyKeyHeader,
+			"If-Match",
+			api.RequestIDHeader,
+		},
+		ExposedHeaders: []string{"ETag", "Idempotent-Replayed", api.RequestIDHeader},
+	})
+}
+
+// serveMetrics serves the Prometheus metrics of the server at /metrics.
+func serveMetrics(port int, dbapi *db.API, logger *logrus.Logger) {
+	prometheus.MustRegister(&metrics.DBCollector{API: dbapi})
+	metricsMux := http.NewServeMux()
+	metricsMux.Handle("/metrics", promhttp.Handler())
+	logger.Info("serving metrics on port ", port)
+	if err := http.ListenAndServe(":"+strconv.Itoa(port), metricsMux); err != nil {
+		logger.WithError(err).Error("metrics server stopped")
+	}
+}
+
 func run() error {
 	configPath := flag.String("config", "", "path to configuration file")
+	flag.Usage = usage
 	flag.Parse()
 
 	config, err := loadConfig(*configPath)
@@ -68,6 +331,11 @@ func run() error {
 		return err
 	}
 
+	logger, err := logging.New(os.Stderr, config.LogFormat, config.LogLevel)
+	if err != nil {
+		return err
+	}
+
 	sqldb, err := sql.Open("postgres", config.DBConnectionString)
 	if err != nil {
 		return err
@@ -75,37 +343,30 @@ func run() error {
 	defer sqldb.Close()
 
 	dbapi := &db.API{
-		DB:             sqldb,
-		BcryptCost:     config.BcryptCost,
-		SessionTimeout: config.SessionTimeout,
-		RefreshTime:    config.RefreshTime,
+		DB:                   sqldb,
+		BcryptCost:           config.BcryptCost,
+		SessionTimeout:       config.SessionTimeout,
+		RefreshTime:          config.RefreshTime,
+		MaxLoginFailures:     config.MaxLoginFailures,
+		LockoutDuration:      config.LockoutDuration,
+		Currency:             config.Currency.currency(),
+		ObserveQuery:         metrics.ObserveQuery,
+		Log:                  logger,
+		AllowPrivateWebhooks: config.AllowPrivateWebhooks,
 	}
 	err = dbapi.AutoMigrate(context.Background(), db.SchemaVersion)
 	if err != nil {
 		return err
 	}
 
-	apiHandler := api.NewHandler(&api.API{DB: dbapi})
-
-	r := mux.NewRouter()
-	r.PathPrefix(config.RootURL).Handler(
-		http.StripPrefix(config.RootURL, apiHandler))
-
-	c := cors.New(cors.Options{
-		AllowedOrigins:   config.AllowedOrigins,
-		AllowCredentials: true,
-		AllowedMethods:   []string{"GET", "POST", "DELETE", "OPTIONS", "HEAD", "PATCH"},
-		AllowedHeaders:   []string{"Authorization", "Content-Type"},
-	})
-
-	log.Print("Listening to port ", config.Port)
-	return http.ListenAndServe(
-		":"+strconv.Itoa(config.Port),
-		c.Handler(r))
+	if flag.NArg() == 0 {
+		return serve(config, dbapi, logger)
+	}
+	return runCommand(context.Background(), dbapi, flag.Arg(0), flag.Args()[1:])
 }
 
 func main() {
 	if err := run(); err != nil {
-		log.Fatal(err)
+		logrus.Fatal(err)
 	}
 }
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCORSPreflight(t *testing.T) {
+	h := newCORS([]string{"https://app.example.com"}).Handler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Error("preflight request must not reach the API")
+		}))
+	for _, method := range []string{"GET", "POST", "PUT", "PATCH", "DELETE"} {
+		req := httptest.NewRequest("OPTIONS", "/account/password-login", nil)
+		req.Header.Set("Origin", "https://app.example.com")
+		req.Header.Set("Access-Control-Request-Method", method)
+		req.Header.Set("Access-Control-Request-Headers", "Authorization, Content-Type")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		require.Equal(t, method, w.Header().Get("Access-Control-Allow-Methods"), method)
+		require.Equal(
+			t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"), method)
+	}
+}
@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/lassilaiho/expenditure-accounting/server/db"
+	"github.com/lassilaiho/expenditure-accounting/server/logging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sessionCountTimeout limits the time spent counting sessions per scrape.
+const sessionCountTimeout = 5 * time.Second
+
+func dbDesc(name, help string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(namespace, "db", name), help, nil, nil)
+}
+
+var (
+	activeSessionsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "active_sessions"),
+		"Number of unexpired login sessions.",
+		nil, nil)
+	maxOpenConnectionsDesc = dbDesc(
+		"max_open_connections", "Maximum number of open connections to the database.")
+	openConnectionsDesc = dbDesc(
+		"open_connections", "Number of open connections to the database.")
+	inUseConnectionsDesc = dbDesc(
+		"in_use_connections", "Number of connections currently in use.")
+	idleConnectionsDesc = dbDesc(
+		"idle_connections", "Number of idle connections.")
+	waitCountDesc = dbDesc(
+		"wait_count_total", "Number of times a connection was waited for.")
+	waitDurationDesc = dbDesc(
+		"wait_duration_seconds_total", "Time spent waiting for connections.")
+	maxIdleClosedDesc = dbDesc(
+		"max_idle_closed_total", "Number of connections closed because of the idle connection limit.")
+	maxIdleTimeClosedDesc = dbDesc(
+		"max_idle_time_closed_total", "Number of connections closed because of the idle time limit.")
+	maxLifetimeClosedDesc = dbDesc(
+		"max_lifetime_closed_total", "Number of connections closed because of the lifetime limit.")
+)
+
+// DBCollector collects the connection pool statistics of a database and the
+// number of active sessions stored in it.
+type DBCollector struct {
+	API *db.API
+}
+
+func (c *DBCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- activeSessionsDesc
+	ch <- maxOpenConnectionsDesc
+	ch <- openConnectionsDesc
+	ch <- inUseConnectionsDesc
+	ch <- idleConnectionsDesc
+	ch <- waitCountDesc
+	ch <- waitDurationDesc
+	ch <- maxIdleClosedDesc
+	ch <- maxIdleTimeClosedDesc
+	ch <- maxLifetimeClosedDesc
+}
+
+func (c *DBCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.API.DB.Stats()
+	gauge := func(desc *prometheus.Desc, value float64) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value)
+	}
+	counter := func(desc *prometheus.Desc, value float64) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, value)
+	}
+	gauge(maxOpenConnectionsDesc, float64(stats.MaxOpenConnections))
+	gauge(openConnectionsDesc, float64(stats.OpenConnections))
+	gauge(inUseConnectionsDesc, float64(stats.InUse))
+	gauge(idleConnectionsDesc, float64(stats.Idle))
+	counter(waitCountDesc, float64(stats.WaitCount))
+	counter(waitDurationDesc, stats.WaitDuration.Seconds())
+	counter(maxIdleClosedDesc, float64(stats.MaxIdleClosed))
+	counter(maxIdleTimeClosedDesc, float64(stats.MaxIdleTimeClosed))
+	counter(maxLifetimeClosedDesc, float64(stats.MaxLifetimeClosed))
+
+	ctx, cancel := context.WithTimeout(context.Background(), sessionCountTimeout)
+	defer cancel()
+	count, err := c.API.CountActiveSessions(ctx)
+	if err != nil {
+		logging.Logger(ctx, c.API.Log).WithError(err).Error("error counting sessions")
+		ch <- prometheus.NewInvalidMetric(activeSessionsDesc, err)
+		return
+	}
+	gauge(activeSessionsDesc, float64(count))
+}
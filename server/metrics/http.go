@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lassilaiho/expenditure-accounting/server/recorder"
+)
+
+// unmatchedRoute labels requests that didn't match any route.
+const unmatchedRoute = "unmatched"
+
+type routeContextKey struct{}
+
+// routeLabel holds the route of a request. It's set by RecordRoute after the
+// request has been passed to Instrument.
+type routeLabel struct {
+	template string
+}
+
+// Instrument counts the requests handled by h and records their latencies.
+// Requests are labeled with the path template of the route they matched,
+// which the routers of h must record with the RecordRoute middleware.
+func Instrument(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		label := &routeLabel{template: unmatchedRoute}
+		rec := recorder.Wrap(w)
+		start := time.Now()
+		h.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), routeContextKey{}, label)))
+		httpRequests.WithLabelValues(label.template, r.Method, strconv.Itoa(rec.Status())).Inc()
+		httpRequestDuration.WithLabelValues(label.template, r.Method).
+			Observe(time.Since(start).Seconds())
+	})
+}
+
+// RecordRoute is a mux middleware recording the route matched by a request for
+// Instrument. Routes delegating to a nested router are skipped so that the
+// nested router can record the route it matches.
+func RecordRoute(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		label, _ := r.Context().Value(routeContextKey{}).(*routeLabel)
+		route := mux.CurrentRoute(r)
+		if label != nil && route != nil {
+			if _, nested := route.GetHandler().(*mux.Router); !nested {
+				if template, err := route.GetPathTemplate(); err == nil {
+					label.template = template
+				}
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
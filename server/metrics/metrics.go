@@ -0,0 +1,92 @@
+// Package metrics collects Prometheus metrics of the server.
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// namespace prefixes the names of all metrics.
+const namespace = "expenditure"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	logins = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "logins_total",
+		Help:      "Number of login attempts by result.",
+	}, []string{"result"})
+
+	queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "Latency of database operations by method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+
+	jobRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "job_runs_total",
+		Help:      "Number of runs of background jobs by result.",
+	}, []string{"job", "result"})
+	jobDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "job_duration_seconds",
+		Help:      "Duration of runs of background jobs.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"job"})
+	jobLastRun = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "job_last_run_timestamp_seconds",
+		Help:      "Unix time of the last run of background jobs.",
+	}, []string{"job"})
+	jobLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "job_last_success_timestamp_seconds",
+		Help:      "Unix time of the last successful run of background jobs.",
+	}, []string{"job"})
+)
+
+// LoginSucceeded counts a login creating a new session.
+func LoginSucceeded() {
+	logins.WithLabelValues("success").Inc()
+}
+
+// LoginFailed counts a login rejected because of invalid credentials.
+func LoginFailed() {
+	logins.WithLabelValues("failure").Inc()
+}
+
+// ObserveQuery records the duration of a call to a method of db.API. It's
+// meant to be used as db.API.ObserveQuery.
+func ObserveQuery(method string, duration time.Duration) {
+	queryDuration.WithLabelValues(method).Observe(duration.Seconds())
+}
+
+// ObserveJob records a run of a background job started at start. Err is the
+// error returned by the job, if any.
+func ObserveJob(job string, start time.Time, err error) {
+	now := time.Now()
+	result := "success"
+	if err != nil {
+		result = "failure"
+	} else {
+		jobLastSuccess.WithLabelValues(job).Set(float64(now.Unix()))
+	}
+	jobRuns.WithLabelValues(job, result).Inc()
+	jobDuration.WithLabelValues(job).Observe(now.Sub(start).Seconds())
+	jobLastRun.WithLabelValues(job).Set(float64(now.Unix()))
+}
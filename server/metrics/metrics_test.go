@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstrument(t *testing.T) {
+	nested := mux.NewRouter()
+	nested.Use(RecordRoute)
+	nested.Path("/items/{id}").Methods("GET").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		})
+	root := mux.NewRouter()
+	root.Use(RecordRoute)
+	root.Path("/login").Methods("POST").HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	root.PathPrefix("/").Handler(nested)
+	h := Instrument(root)
+
+	count := func(route, method, code string) float64 {
+		return testutil.ToFloat64(httpRequests.WithLabelValues(route, method, code))
+	}
+	before := []float64{
+		count("/items/{id}", "GET", "418"),
+		count("/login", "POST", "200"),
+		count(unmatchedRoute, "GET", "404"),
+	}
+	for _, target := range []string{"/items/1", "/items/2"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", target, nil))
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/login", nil))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/missing", nil))
+
+	require.Equal(t, before[0]+2, count("/items/{id}", "GET", "418"))
+	require.Equal(t, before[1]+1, count("/login", "POST", "200"))
+	require.Equal(t, before[2]+1, count(unmatchedRoute, "GET", "404"))
+}
+
+func TestObserveJob(t *testing.T) {
+	ObserveJob("test job", time.Now(), nil)
+	ObserveJob("test job", time.Now(), errors.New("failed"))
+	ObserveJob("test job", time.Now(), errors.New("failed"))
+	require.Equal(t, 1.0, testutil.ToFloat64(jobRuns.WithLabelValues("test job", "success")))
+	require.Equal(t, 2.0, testutil.ToFloat64(jobRuns.WithLabelValues("test job", "failure")))
+	require.NotZero(t, testutil.ToFloat64(jobLastSuccess.WithLabelValues("test job")))
+}
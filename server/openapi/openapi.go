@@ -0,0 +1,238 @@
+// Package openapi reads OpenAPI 3 documents and validates JSON values against
+// the schemas in them. Only the parts of the specification needed for
+// validating request bodies are supported.
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Methods lists the HTTP methods that can have an operation in a path item.
+var Methods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+type Document struct {
+	OpenAPI string `json:"openapi"`
+	// Paths maps path templates to operations by lowercase HTTP method.
+	Paths      map[string]map[string]*Operation `json:"-"`
+	Components struct {
+		Schemas    map[string]*Schema    `json:"schemas"`
+		Parameters map[string]*Parameter `json:"parameters"`
+		Responses  map[string]*Response  `json:"responses"`
+	} `json:"components"`
+}
+
+type Operation struct {
+	OperationID string               `json:"operationId"`
+	Parameters  []*Parameter         `json:"parameters"`
+	RequestBody *RequestBody         `json:"requestBody"`
+	Responses   map[string]*Response `json:"responses"`
+}
+
+type Parameter struct {
+	Ref      string  `json:"$ref"`
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required"`
+	Schema   *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                  `json:"required"`
+	Content  map[string]*MediaType `json:"content"`
+}
+
+type Response struct {
+	Ref         string                `json:"$ref"`
+	Description string                `json:"description"`
+	Content     map[string]*MediaType `json:"content"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type Schema struct {
+	Ref        string             `json:"$ref"`
+	Type       string             `json:"type"`
+	Format     string             `json:"format"`
+	Nullable   bool               `json:"nullable"`
+	Enum       []interface{}      `json:"enum"`
+	Properties map[string]*Schema `json:"properties"`
+	Required   []string           `json:"required"`
+	// AdditionalProperties, if not nil, is the schema of the values of
+	// objects with arbitrary keys.
+	AdditionalProperties *Schema   `json:"additionalProperties"`
+	Items                *Schema   `json:"items"`
+	OneOf                []*Schema `json:"oneOf"`
+	Minimum              *float64  `json:"minimum"`
+	Maximum              *float64  `json:"maximum"`
+	MinLength            *int      `json:"minLength"`
+	MaxLength            *int      `json:"maxLength"`
+	MinItems             *int      `json:"minItems"`
+	MaxItems             *int      `json:"maxItems"`
+}
+
+// Parse reads an OpenAPI document in JSON format.
+func Parse(data []byte) (*Document, error) {
+	var raw struct {
+		Document
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	doc := raw.Document
+	doc.Paths = map[string]map[string]*Operation{}
+	for path, item := range raw.Paths {
+		doc.Paths[path] = map[string]*Operation{}
+		for _, method := range Methods {
+			if op, ok := item[method]; ok {
+				operation := &Operation{}
+				if err := json.Unmarshal(op, operation); err != nil {
+					return nil, fmt.Errorf("%s %s: %w", strings.ToUpper(method), path, err)
+				}
+				doc.Paths[path][method] = operation
+			}
+		}
+	}
+	if err := doc.checkRefs(); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// MustParse is like Parse but panics if the document is invalid.
+func MustParse(data string) *Document {
+	doc, err := Parse([]byte(data))
+	if err != nil {
+		panic("openapi: " + err.Error())
+	}
+	return doc
+}
+
+// Operation returns the operation of a path template and HTTP method or nil if
+// the document doesn't define one.
+func (d *Document) Operation(method, path string) *Operation {
+	return d.Paths[path][strings.ToLower(method)]
+}
+
+// JSONSchema returns the schema of a JSON request body of op or nil if op
+// doesn't accept one.
+func (op *Operation) JSONSchema() *Schema {
+	if op.RequestBody == nil {
+		return nil
+	}
+	if media, ok := op.RequestBody.Content["application/json"]; ok {
+		return media.Schema
+	}
+	return nil
+}
+
+// resolve follows the reference of s, if any.
+func (d *Document) resolve(s *Schema) (*Schema, error) {
+	if s.Ref == "" {
+		return s, nil
+	}
+	const prefix = "#/components/schemas/"
+	if !strings.HasPrefix(s.Ref, prefix) {
+		return nil, fmt.Errorf("unsupported reference %q", s.Ref)
+	}
+	target, ok := d.Components.Schemas[strings.TrimPrefix(s.Ref, prefix)]
+	if !ok {
+		return nil, fmt.Errorf("undefined schema %q", s.Ref)
+	}
+	return target, nil
+}
+
+// checkRefs checks that every schema reference in the document can be
+// resolved.
+func (d *Document) checkRefs() error {
+	var check func(s *Schema) error
+	check = func(s *Schema) error {
+		if s == nil {
+			return nil
+		}
+		if _, err := d.resolve(s); err != nil {
+			return err
+		}
+		children := append([]*Schema{s.AdditionalProperties, s.Items}, s.OneOf...)
+		for _, prop := range s.Properties {
+			children = append(children, prop)
+		}
+		for _, child := range children {
+			if err := check(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, s := range d.Components.Schemas {
+		if err := check(s); err != nil {
+			return err
+		}
+	}
+	for _, param := range d.Components.Parameters {
+		if err := check(param.Schema); err != nil {
+			return err
+		}
+	}
+	for _, resp := range d.Components.Responses {
+		for _, media := range resp.Content {
+			if err := check(media.Schema); err != nil {
+				return err
+			}
+		}
+	}
+	for path, item := range d.Paths {
+		for method, op := range item {
+			schemas := []*Schema{}
+			for _, param := range op.Parameters {
+				if param.Ref != "" {
+					if _, ok := d.Components.Parameters[strings.TrimPrefix(param.Ref, "#/components/parameters/")]; !ok {
+						return fmt.Errorf("%s %s: undefined parameter %q", strings.ToUpper(method), path, param.Ref)
+					}
+				}
+				schemas = append(schemas, param.Schema)
+			}
+			if op.RequestBody != nil {
+				for _, media := range op.RequestBody.Content {
+					schemas = append(schemas, media.Schema)
+				}
+			}
+			for _, resp := range op.Responses {
+				if resp.Ref != "" {
+					if _, ok := d.Components.Responses[strings.TrimPrefix(resp.Ref, "#/components/responses/")]; !ok {
+						return fmt.Errorf("%s %s: undefined response %q", strings.ToUpper(method), path, resp.Ref)
+					}
+				}
+				for _, media := range resp.Content {
+					schemas = append(schemas, media.Schema)
+				}
+			}
+			for _, s := range schemas {
+				if err := check(s); err != nil {
+					return fmt.Errorf("%s %s: %w", strings.ToUpper(method), path, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// DecodeJSON decodes a JSON value for validation. Numbers are decoded as
+// json.Number to keep integers and decimals apart.
+func DecodeJSON(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("unexpected data after JSON value")
+	}
+	return value, nil
+}
@@ -0,0 +1,234 @@
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ValidationError describes a part of a value not matching its schema. Path is
+// a JSON pointer to the invalid part.
+type ValidationError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (e *ValidationError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// Validate checks value against schema. The value must have been decoded with
+// DecodeJSON. All errors found are returned.
+func (d *Document) Validate(schema *Schema, value interface{}) []*ValidationError {
+	v := &validator{doc: d}
+	v.validate(schema, value, "")
+	return v.errors
+}
+
+type validator struct {
+	doc    *Document
+	errors []*ValidationError
+}
+
+func (v *validator) fail(path, format string, args ...interface{}) {
+	v.errors = append(v.errors, &ValidationError{
+		Path:    path,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *validator) validate(schema *Schema, value interface{}, path string) {
+	schema, err := v.doc.resolve(schema)
+	if err != nil {
+		v.fail(path, "%v", err)
+		return
+	}
+	if value == nil {
+		if !schema.Nullable && schema.Type != "" {
+			v.fail(path, "must not be null")
+		}
+		return
+	}
+	if len(schema.OneOf) > 0 {
+		v.validateOneOf(schema, value, path)
+	}
+	if len(schema.Enum) > 0 && !inEnum(schema.Enum, value) {
+		v.fail(path, "must be one of %s", formatEnum(schema.Enum))
+		return
+	}
+	switch schema.Type {
+	case "":
+	case "object":
+		v.validateObject(schema, value, path)
+	case "array":
+		v.validateArray(schema, value, path)
+	case "string":
+		v.validateString(schema, value, path)
+	case "integer", "number":
+		v.validateNumber(schema, value, path)
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			v.fail(path, "must be a boolean")
+		}
+	default:
+		v.fail(path, "unsupported schema type %q", schema.Type)
+	}
+}
+
+// validateOneOf checks that value matches exactly one of the schemas. If it
+// matches none, the errors of the schema it is closest to matching are
+// reported, preferring earlier schemas.
+func (v *validator) validateOneOf(schema *Schema, value interface{}, path string) {
+	matches := 0
+	var closest []*ValidationError
+	for _, s := range schema.OneOf {
+		errs := v.doc.Validate(s, value)
+		if len(errs) == 0 {
+			matches++
+		} else if closest == nil || len(errs) < len(closest) {
+			closest = errs
+		}
+	}
+	switch {
+	case matches == 0:
+		for _, err := range closest {
+			v.fail(path+err.Path, "%s", err.Message)
+		}
+	case matches > 1:
+		v.fail(path, "must match exactly one of %d schemas", len(schema.OneOf))
+	}
+}
+
+func (v *validator) validateObject(schema *Schema, value interface{}, path string) {
+	obj, ok := value.(map[string]interface{})
+	if !ok {
+		v.fail(path, "must be an object")
+		return
+	}
+	for _, name := range schema.Required {
+		if _, ok := obj[name]; !ok {
+			v.fail(path+"/"+escapePointer(name), "is required")
+		}
+	}
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		prop, ok := schema.Properties[key]
+		if !ok {
+			prop = schema.AdditionalProperties
+		}
+		if prop != nil {
+			v.validate(prop, obj[key], path+"/"+escapePointer(key))
+		}
+	}
+}
+
+func (v *validator) validateArray(schema *Schema, value interface{}, path string) {
+	arr, ok := value.([]interface{})
+	if !ok {
+		v.fail(path, "must be an array")
+		return
+	}
+	if schema.MinItems != nil && len(arr) < *schema.MinItems {
+		v.fail(path, "must have at least %d items", *schema.MinItems)
+	}
+	if schema.MaxItems != nil && len(arr) > *schema.MaxItems {
+		v.fail(path, "must have at most %d items", *schema.MaxItems)
+	}
+	if schema.Items != nil {
+		for i, item := range arr {
+			v.validate(schema.Items, item, path+"/"+strconv.Itoa(i))
+		}
+	}
+}
+
+func (v *validator) validateString(schema *Schema, value interface{}, path string) {
+	s, ok := value.(string)
+	if !ok {
+		v.fail(path, "must be a string")
+		return
+	}
+	length := len([]rune(s))
+	if schema.MinLength != nil && length < *schema.MinLength {
+		v.fail(path, "must be at least %d characters long", *schema.MinLength)
+	}
+	if schema.MaxLength != nil && length > *schema.MaxLength {
+		v.fail(path, "must be at most %d characters long", *schema.MaxLength)
+	}
+	switch schema.Format {
+	case "date-time":
+		if _, err := time.Parse(time.RFC3339, s); err != nil {
+			v.fail(path, "must be an RFC 3339 date-time")
+		}
+	case "decimal":
+		if !decimalPattern.MatchString(s) {
+			v.fail(path, "must be a decimal number")
+		}
+	}
+}
+
+// decimalPattern matches decimal numbers in the syntax of JSON numbers except
+// that a leading plus sign and leading zeros are allowed.
+var decimalPattern = regexp.MustCompile(`^[-+]?[0-9]+(\.[0-9]+)?([eE][-+]?[0-9]+)?$`)
+
+func (v *validator) validateNumber(schema *Schema, value interface{}, path string) {
+	message := "must be a number"
+	if schema.Type == "integer" {
+		message = "must be an integer"
+	}
+	n, ok := value.(json.Number)
+	if !ok {
+		v.fail(path, "%s", message)
+		return
+	}
+	f, ok := new(big.Float).SetString(string(n))
+	if !ok || schema.Type == "integer" && !f.IsInt() {
+		v.fail(path, "%s", message)
+		return
+	}
+	if schema.Type == "integer" {
+		if i, _ := f.Int(nil); !i.IsInt64() {
+			v.fail(path, "is out of range")
+			return
+		}
+	}
+	if schema.Minimum != nil && f.Cmp(big.NewFloat(*schema.Minimum)) < 0 {
+		v.fail(path, "must be at least %v", *schema.Minimum)
+	}
+	if schema.Maximum != nil && f.Cmp(big.NewFloat(*schema.Maximum)) > 0 {
+		v.fail(path, "must be at most %v", *schema.Maximum)
+	}
+}
+
+func inEnum(enum []interface{}, value interface{}) bool {
+	for _, e := range enum {
+		if fmt.Sprint(e) == fmt.Sprint(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func formatEnum(enum []interface{}) string {
+	values := make([]string, len(enum))
+	for i, e := range enum {
+		values[i] = strconv.Quote(fmt.Sprint(e))
+	}
+	return strings.Join(values, ", ")
+}
+
+// escapePointer escapes a key for use in a JSON pointer.
+func escapePointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
@@ -0,0 +1,112 @@
+package openapi
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testDocument = `{
+  "openapi": "3.0.3",
+  "paths": {
+    "/items/{id}": {
+      "parameters": [{"name": "id", "in": "path", "required": true}],
+      "put": {
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Item"}}}},
+        "responses": {"200": {"description": "OK"}}
+      }
+    }
+  },
+  "components": {
+    "schemas": {
+      "Item": {
+        "type": "object",
+        "required": ["name"],
+        "properties": {
+          "name": {"type": "string", "minLength": 1},
+          "count": {"type": "integer", "minimum": 0},
+          "kind": {"type": "string", "enum": ["a", "b"]},
+          "time": {"type": "string", "format": "date-time", "nullable": true},
+          "tags": {"type": "array", "items": {"type": "string"}, "maxItems": 2},
+          "extra": {"type": "object", "additionalProperties": {"type": "boolean"}},
+          "price": {"oneOf": [{"type": "string", "format": "decimal"}, {"type": "number"}]}
+        }
+      }
+    }
+  }
+}`
+
+func validate(t *testing.T, doc *Document, body string) []*ValidationError {
+	t.Helper()
+	value, err := DecodeJSON([]byte(body))
+	require.Nil(t, err)
+	return doc.Validate(doc.Operation("PUT", "/items/{id}").JSONSchema(), value)
+}
+
+func TestValidate(t *testing.T) {
+	doc := MustParse(testDocument)
+	require.Empty(t, validate(t, doc, `{
+		"name": "x",
+		"count": 2,
+		"kind": "a",
+		"time": null,
+		"tags": ["y"],
+		"extra": {"z": true},
+		"unknown": 1
+	}`))
+	require.Empty(t, validate(t, doc, `{"name": "x", "time": "2021-01-02T03:04:05Z"}`))
+	require.Equal(t, []*ValidationError{
+		{Path: "/name", Message: "is required"},
+		{Path: "/count", Message: "must be at least 0"},
+		{Path: "/extra/z", Message: "must be a boolean"},
+		{Path: "/kind", Message: `must be one of "a", "b"`},
+		{Path: "/tags", Message: "must have at most 2 items"},
+		{Path: "/tags/1", Message: "must be a string"},
+		{Path: "/time", Message: "must be an RFC 3339 date-time"},
+	}, validate(t, doc, `{
+		"count": -1,
+		"kind": "c",
+		"time": "2021-01-02",
+		"tags": ["y", 1, "z"],
+		"extra": {"z": 1}
+	}`))
+	require.Equal(t, []*ValidationError{
+		{Path: "/count", Message: "must be an integer"},
+		{Path: "/name", Message: "must not be null"},
+	}, validate(t, doc, `{"name": null, "count": 1.5}`))
+	require.Equal(t, []*ValidationError{
+		{Path: "/count", Message: "is out of range"},
+	}, validate(t, doc, `{"name": "x", "count": 9223372036854775808}`))
+	require.Equal(t, []*ValidationError{
+		{Message: "must be an object"},
+	}, validate(t, doc, `[]`))
+}
+
+func TestParseChecksReferences(t *testing.T) {
+	_, err := Parse([]byte(`{"components": {"schemas": {"A": {"$ref": "#/components/schemas/B"}}}}`))
+	require.NotNil(t, err)
+	_, err = Parse([]byte(`{"paths": {"/": {"get": {"responses": {"200": {"$ref": "#/components/responses/OK"}}}}}}`))
+	require.NotNil(t, err)
+	_, err = Parse([]byte(testDocument))
+	require.Nil(t, err)
+}
+
+func TestDecodeJSON(t *testing.T) {
+	_, err := DecodeJSON([]byte(`{} {}`))
+	require.NotNil(t, err)
+	_, err = DecodeJSON([]byte(`{"a": `))
+	require.NotNil(t, err)
+}
+
+func TestValidateOneOf(t *testing.T) {
+	doc := MustParse(testDocument)
+	for _, price := range []string{`"2.50"`, `"-1e3"`, `"007"`, `2.5`} {
+		require.Empty(t, validate(t, doc, `{"name": "x", "price": `+price+`}`), price)
+	}
+	require.Equal(t, []*ValidationError{
+		{Path: "/price", Message: "must be a decimal number"},
+	}, validate(t, doc, `{"name": "x", "price": "2,50"}`))
+	require.Equal(t, []*ValidationError{
+		{Path: "/price", Message: "must be a string"},
+	}, validate(t, doc, `{"name": "x", "price": true}`))
+}
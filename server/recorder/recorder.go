@@ -0,0 +1,69 @@
+// Package recorder provides a response writer remembering what was written
+// through it, shared by the middlewares that need to inspect responses.
+package recorder
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// Recorder passes a response through while remembering its status code and
+// size. If Body is not nil, the written body is also copied to it.
+type Recorder struct {
+	http.ResponseWriter
+	Body   *bytes.Buffer
+	status int
+	size   int
+}
+
+// Wrap returns a Recorder for w. If w already is a Recorder, it's returned as
+// is so that nested middlewares don't wrap the same response several times.
+func Wrap(w http.ResponseWriter) *Recorder {
+	if rec, ok := w.(*Recorder); ok {
+		return rec
+	}
+	return &Recorder{ResponseWriter: w}
+}
+
+// Status returns the status code of the response. A handler that didn't
+// write anything responded with 200 OK.
+func (rec *Recorder) Status() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
+
+// Size returns the number of body bytes written.
+func (rec *Recorder) Size() int {
+	return rec.size
+}
+
+func (rec *Recorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *Recorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.size += n
+	if rec.Body != nil {
+		rec.Body.Write(b[:n])
+	}
+	return n, err
+}
+
+// Flush supports streaming responses if the wrapped writer does.
+func (rec *Recorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		f.Flush()
+	}
+}
@@ -0,0 +1,34 @@
+package recorder
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecorder(t *testing.T) {
+	rec := Wrap(httptest.NewRecorder())
+	require.Equal(t, http.StatusOK, rec.Status())
+	rec.WriteHeader(http.StatusCreated)
+	rec.WriteHeader(http.StatusInternalServerError)
+	rec.Write([]byte("hello"))
+	require.Equal(t, http.StatusCreated, rec.Status())
+	require.Equal(t, 5, rec.Size())
+
+	w := httptest.NewRecorder()
+	rec = &Recorder{ResponseWriter: w, Body: &bytes.Buffer{}}
+	rec.Write([]byte("copied"))
+	rec.Flush()
+	require.Equal(t, http.StatusOK, rec.Status())
+	require.Equal(t, "copied", rec.Body.String())
+	require.Equal(t, "copied", w.Body.String())
+	require.True(t, w.Flushed)
+}
+
+func TestWrapReusesRecorder(t *testing.T) {
+	rec := Wrap(httptest.NewRecorder())
+	require.True(t, rec == Wrap(rec))
+}
@@ -11,7 +11,7 @@ import (
 	"github.com/ory/dockertest/v3"
 )
 
-func connectDockertestDB() (db *sql.DB, close func()) {
+func connectDockertestDB() (db *sql.DB, connStr string, close func()) {
 	pool, err := dockertest.NewPool("")
 	if err != nil {
 		log.Fatalf("Could not connect to docker: %s", err)
@@ -21,12 +21,11 @@ func connectDockertestDB() (db *sql.DB, close func()) {
 	if err != nil {
 		log.Fatalf("Could not start resource: %s", err)
 	}
+	connStr = fmt.Sprintf(
+		"user=postgres password=password port=%s sslmode=disable",
+		resource.GetPort("5432/tcp"))
 	if err := pool.Retry(func() error {
-		db, err = sql.Open(
-			"postgres",
-			fmt.Sprintf(
-				"user=postgres password=password port=%s sslmode=disable",
-				resource.GetPort("5432/tcp")))
+		db, err = sql.Open("postgres", connStr)
 		if err != nil {
 			return err
 		}
@@ -34,24 +33,23 @@ func connectDockertestDB() (db *sql.DB, close func()) {
 	}); err != nil {
 		log.Fatalf("Could not connect to docker: %s", err)
 	}
-	return db, func() {
+	return db, connStr, func() {
 		if err := pool.Purge(resource); err != nil {
 			log.Fatalf("Could not purge resource: %s", err)
 		}
 	}
 }
 
-func connectExistingDB() (*sql.DB, func()) {
-	db, err := sql.Open(
-		"postgres",
-		fmt.Sprintf(
-			"host=%s user=postgres password=postgres port=%s sslmode=disable",
-			os.Getenv("POSTGRES_HOST"),
-			os.Getenv(("POSTGRES_PORT"))))
+func connectExistingDB() (*sql.DB, string, func()) {
+	connStr := fmt.Sprintf(
+		"host=%s user=postgres password=postgres port=%s sslmode=disable",
+		os.Getenv("POSTGRES_HOST"),
+		os.Getenv(("POSTGRES_PORT")))
+	db, err := sql.Open("postgres", connStr)
 	if err != nil {
 		log.Fatal(err)
 	}
-	return db, func() { db.Close() }
+	return db, connStr, func() { db.Close() }
 }
 
 func isCI() bool {
@@ -64,6 +62,13 @@ func isCI() bool {
 }
 
 func ConnectDB() (*sql.DB, func()) {
+	db, _, close := ConnectDBWithConnStr()
+	return db, close
+}
+
+// ConnectDBWithConnStr is like ConnectDB but also returns the connection
+// string of the database for opening further connections.
+func ConnectDBWithConnStr() (*sql.DB, string, func()) {
 	if isCI() {
 		return connectExistingDB()
 	}
@@ -0,0 +1,63 @@
+package totp
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHOTPRFC6238(t *testing.T) {
+	key := []byte("12345678901234567890")
+	vectors := []struct {
+		time int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, v := range vectors {
+		step := Step(time.Unix(v.time, 0))
+		require.Equal(t, v.code, hotp(key, uint64(step), 8))
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111111, 0)
+	code, err := Code(secret, now)
+	require.Nil(t, err)
+	require.Equal(t, "050471", code)
+
+	step, ok := Validate(secret, code, now, 0)
+	require.True(t, ok)
+	require.Equal(t, Step(now), step)
+	_, ok = Validate(secret, code, now, step)
+	require.False(t, ok, "code must not be accepted twice")
+	_, ok = Validate(secret, code, now.Add(Period), 0)
+	require.True(t, ok)
+	_, ok = Validate(secret, code, now.Add(3*Period), 0)
+	require.False(t, ok)
+	_, ok = Validate(secret, "000000", now, 0)
+	require.False(t, ok)
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	require.Nil(t, err)
+	key, err := decodeSecret(secret)
+	require.Nil(t, err)
+	require.Len(t, key, secretBytes)
+}
+
+func TestProvisioningURI(t *testing.T) {
+	require.Equal(
+		t,
+		"otpauth://totp/Example:alice@example.com?algorithm=SHA1&digits=6&issuer=Example&period=30&secret=JBSWY3DPEHPK3PXP",
+		ProvisioningURI("JBSWY3DPEHPK3PXP", "Example", "alice@example.com"))
+}
@@ -0,0 +1,223 @@
+// Package webhooks delivers queued webhook events over HTTP.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lassilaiho/expenditure-accounting/server/db"
+)
+
+// Headers sent with every delivery.
+const (
+	EventHeader     = "X-Webhook-Event"
+	DeliveryHeader  = "X-Webhook-Delivery"
+	TimestampHeader = "X-Webhook-Timestamp"
+	SignatureHeader = "X-Webhook-Signature"
+)
+
+const (
+	defaultMaxAttempts = 8
+	defaultBaseBackoff = 30 * time.Second
+	defaultMaxBackoff  = 6 * time.Hour
+	defaultTimeout     = 10 * time.Second
+	batchSize          = 20
+	maxErrorLength     = 500
+)
+
+var errPrivateAddress = errors.New("webhook host resolves to a private address")
+
+// Sign returns the signature of a delivery sent at timestamp, given in Unix
+// seconds. The signature is the hex encoded HMAC-SHA256 of the timestamp and
+// the body separated by a dot, keyed with the secret of the webhook and
+// prefixed with "sha256=".
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Deliverer sends queued deliveries and retries failed ones with exponential
+// backoff.
+type Deliverer struct {
+	DB *db.API
+	// Client sends the deliveries. If nil, a client with a 10 second timeout
+	// is used. It refuses to connect to private addresses and doesn't follow
+	// redirects.
+	Client *http.Client
+	// AllowPrivateAddresses lets the default client connect to loopback and
+	// private addresses, such as a receiver running on the same host.
+	AllowPrivateAddresses bool
+	// MaxAttempts is the number of attempts after which a delivery is marked
+	// failed. Defaults to 8.
+	MaxAttempts int
+	// BaseBackoff is the wait before the first retry, doubled for each
+	// further attempt up to MaxBackoff. They default to 30 seconds and 6
+	// hours.
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+
+	defaultClientOnce sync.Once
+	defaultClient     *http.Client
+}
+
+func (d *Deliverer) client() *http.Client {
+	if d.Client != nil {
+		return d.Client
+	}
+	d.defaultClientOnce.Do(func() {
+		dialer := &net.Dialer{Timeout: defaultTimeout}
+		if !d.AllowPrivateAddresses {
+			dialer.Control = checkAddress
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		// A proxy would connect to the receiver on behalf of the dialer.
+		transport.Proxy = nil
+		transport.DialContext = dialer.DialContext
+		d.defaultClient = &http.Client{
+			Transport: transport,
+			Timeout:   defaultTimeout,
+			// Redirects aren't followed, so a redirect fails the delivery.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	})
+	return d.defaultClient
+}
+
+// checkAddress refuses connections to private addresses. It's called with
+// the resolved address right before connecting, so host names can't resolve
+// to a private address after the URL has been checked.
+func checkAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !db.PublicWebhookAddress(ip) {
+		return fmt.Errorf("%w: %s", errPrivateAddress, host)
+	}
+	return nil
+}
+
+// Lease is how long a claimed delivery is reserved for sending.
+func (d *Deliverer) Lease() time.Duration {
+	timeout := d.client().Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	return 2 * timeout
+}
+
+// backoff returns the wait before the next attempt after the given number of
+// attempts.
+func (d *Deliverer) backoff(attempts int) time.Duration {
+	wait, max := d.BaseBackoff, d.MaxBackoff
+	if wait <= 0 {
+		wait = defaultBaseBackoff
+	}
+	if max <= 0 {
+		max = defaultMaxBackoff
+	}
+	for i := 1; i < attempts && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		wait = max
+	}
+	return wait
+}
+
+// DeliverPending sends all deliveries that are due.
+func (d *Deliverer) DeliverPending(ctx context.Context) error {
+	for {
+		deliveries, err := d.DB.ClaimWebhookDeliveries(ctx, batchSize, d.Lease())
+		if err != nil {
+			return err
+		}
+		for _, delivery := range deliveries {
+			if _, err = d.Deliver(ctx, delivery); err != nil {
+				return err
+			}
+		}
+		if len(deliveries) < batchSize {
+			return nil
+		}
+	}
+}
+
+// Deliver sends a claimed delivery and records the outcome. An error is only
+// returned if the outcome couldn't be recorded.
+func (d *Deliverer) Deliver(
+	ctx context.Context, delivery *db.DueWebhookDelivery,
+) (*db.WebhookDelivery, error) {
+	attempt := &db.WebhookAttempt{Time: time.Now()}
+	status, err := d.send(ctx, delivery, attempt.Time)
+	attempt.ResponseStatus = status
+	attempts := delivery.Attempts + 1
+	maxAttempts := d.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxAttempts
+	}
+	switch {
+	case err == nil:
+		attempt.Status = db.DeliverySucceeded
+	case attempts >= maxAttempts || delivery.Event == db.EventPing:
+		attempt.Status = db.DeliveryFailed
+	default:
+		attempt.Status = db.DeliveryPending
+		attempt.NextAttemptTime = attempt.Time.Add(d.backoff(attempts))
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+		if len(attempt.Error) > maxErrorLength {
+			attempt.Error = attempt.Error[:maxErrorLength]
+		}
+	}
+	return d.DB.RecordWebhookAttempt(ctx, delivery.ID, attempt)
+}
+
+// send posts a delivery and returns the response status. Responses other
+// than 2xx are errors.
+func (d *Deliverer) send(
+	ctx context.Context, delivery *db.DueWebhookDelivery, now time.Time,
+) (int, error) {
+	req, err := http.NewRequestWithContext(
+		ctx, "POST", delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := now.Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "expenditure-accounting-webhooks")
+	req.Header.Set(EventHeader, delivery.Event)
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, Sign(delivery.Secret, timestamp, delivery.Payload))
+	resp, err := d.client().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected response status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
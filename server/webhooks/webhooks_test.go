@@ -0,0 +1,59 @@
+package webhooks
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"event":"ping"}`)
+	signature := Sign("secret", 1600000000, body)
+	require.Equal(
+		t,
+		"sha256=f1629e66e53028c0a0ed0f843c4f60e3379f3b998c821cf99eae2fd6dcaa0969",
+		signature)
+	require.NotEqual(t, signature, Sign("other", 1600000000, body))
+	require.NotEqual(t, signature, Sign("secret", 1600000001, body))
+	require.NotEqual(t, signature, Sign("secret", 1600000000, []byte(`{}`)))
+}
+
+func TestBackoff(t *testing.T) {
+	d := &Deliverer{BaseBackoff: time.Second, MaxBackoff: 10 * time.Second}
+	require.Equal(t, time.Second, d.backoff(1))
+	require.Equal(t, 2*time.Second, d.backoff(2))
+	require.Equal(t, 8*time.Second, d.backoff(4))
+	require.Equal(t, 10*time.Second, d.backoff(5))
+	require.Equal(t, 10*time.Second, d.backoff(100))
+
+	d = &Deliverer{}
+	require.Equal(t, defaultBaseBackoff, d.backoff(1))
+	require.Equal(t, defaultMaxBackoff, d.backoff(100))
+}
+
+func TestPrivateAddresses(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/", http.StatusFound)
+		}
+	}))
+	defer receiver.Close()
+
+	d := &Deliverer{}
+	_, err := d.client().Get(receiver.URL)
+	require.True(t, errors.Is(err, errPrivateAddress), "got %v", err)
+
+	d = &Deliverer{AllowPrivateAddresses: true}
+	resp, err := d.client().Get(receiver.URL)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, err = d.client().Get(receiver.URL + "/redirect")
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusFound, resp.StatusCode, "redirects must not be followed")
+}